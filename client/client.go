@@ -0,0 +1,282 @@
+// Package client queries echoprint servers, retrying failed queries with exponential backoff
+// and optionally hedging slow ones against replicas
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	mrand "math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AudioAddict/go-echoprint/echoprint"
+)
+
+const (
+	defaultRetries    = 2
+	defaultBackoff    = 100 * time.Millisecond
+	defaultMaxBackoff = 5 * time.Second
+)
+
+// ErrNoEndpoints is returned by clients created without a server to query
+var ErrNoEndpoints = errors.New("No endpoints to query")
+
+// Result is the result of a fingerprint of a query, in the order of the batch
+type Result struct {
+	Matches      []*echoprint.MatchResult `json:"matches"`
+	Status       string                   `json:"status"`
+	MatchCount   int                      `json:"match_count"`
+	Ambiguous    bool                     `json:"ambiguous"`
+	TiedTrackIDs []uint32                 `json:"tied_track_ids,omitempty"`
+	NearMatches  []*echoprint.MatchResult `json:"near_matches,omitempty"`
+
+	Partial            bool `json:"partial,omitempty"`
+	UnscoredCandidates int  `json:"unscored_candidates,omitempty"`
+
+	Stats    *echoprint.MatchStats `json:"stats,omitempty"`
+	Evidence *echoprint.Evidence   `json:"evidence,omitempty"`
+}
+
+// APIError is an error reported by the server
+type APIError struct {
+	StatusCode int             `json:"-"`
+	Code       string          `json:"code"`
+	Message    string          `json:"message"`
+	Details    json.RawMessage `json:"details,omitempty"`
+	RequestID  string          `json:"request_id,omitempty"`
+
+	retryAfter time.Duration
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("echoprint: %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// Temporary reports whether the query may succeed when retried: the server was overloaded or
+// throttled it, its backend was unavailable or it failed unexpectedly
+func (e *APIError) Temporary() bool {
+	return e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// Client queries a set of replicas of an echoprint server. Queries don't change the index so
+// they are safely retried and hedged, which trades duplicate work for latency
+type Client struct {
+	// Endpoints are the base urls of the replicas (e.g. http://echoprint-1:8080), failed
+	// attempts move on to the next one
+	Endpoints []string
+	// HTTPClient sends the requests, http.DefaultClient when nil
+	HTTPClient *http.Client
+	// APIKey is sent as X-API-Key when set
+	APIKey string
+
+	// Retries is the number of times a failed query is retried, negative disables retries
+	// (0 for 2)
+	Retries int
+	// Backoff is the delay before the first retry, doubled with jitter for each following one
+	// up to MaxBackoff (0 for 100ms and 5s). A Retry-After sent by the server is honored
+	Backoff, MaxBackoff time.Duration
+
+	// HedgeDelay sends the query to the next endpoint as well when no response arrived after
+	// this long, the first response wins and the others are cancelled (0 disables hedging)
+	HedgeDelay time.Duration
+	// MaxHedges limits the number of requests in flight for an attempt (0 for every endpoint)
+	MaxHedges int
+}
+
+// New returns a client querying the endpoints
+func New(endpoints ...string) *Client {
+	return &Client{Endpoints: endpoints}
+}
+
+// Query matches the codegen json, params are the matching options of the query string (e.g.
+// catalog or time_scaling). Every attempt shares an X-Request-ID so the server's logs and audit
+// records tie them together
+func (c *Client) Query(ctx context.Context, codegenJSON []byte, params url.Values) ([]Result, error) {
+	if len(c.Endpoints) == 0 {
+		return nil, ErrNoEndpoints
+	}
+
+	requestID := newRequestID()
+	retries := c.Retries
+	if retries == 0 {
+		retries = defaultRetries
+	}
+
+	var err error
+	var results []Result
+	// attempts start at a random endpoint so clients spread their load over the replicas
+	endpoint := mrand.Intn(len(c.Endpoints))
+	for attempt := 0; ; attempt++ {
+		results, err = c.hedge(ctx, endpoint, codegenJSON, params, requestID)
+		if err == nil || attempt >= retries || !retryable(err) {
+			return results, err
+		}
+
+		select {
+		case <-time.After(c.backoff(attempt, err)):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		endpoint++
+	}
+}
+
+type response struct {
+	results []Result
+	err     error
+}
+
+// hedge sends the query to the endpoint, and to the following ones every HedgeDelay until one
+// of them responds successfully. Once every request failed the last error is returned
+func (c *Client) hedge(ctx context.Context, endpoint int, codegenJSON []byte, params url.Values, requestID string) ([]Result, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	hedges := 1
+	if c.HedgeDelay > 0 {
+		hedges = len(c.Endpoints)
+		if c.MaxHedges > 0 && c.MaxHedges < hedges {
+			hedges = c.MaxHedges
+		}
+	}
+
+	responses := make(chan response, hedges)
+	send := func(i int) {
+		base := c.Endpoints[(endpoint+i)%len(c.Endpoints)]
+		results, err := c.send(ctx, base, codegenJSON, params, requestID)
+		responses <- response{results, err}
+	}
+
+	go send(0)
+	sent, failed := 1, 0
+	var timer <-chan time.Time
+	if sent < hedges {
+		timer = time.After(c.HedgeDelay)
+	}
+
+	var err error
+	for {
+		select {
+		case resp := <-responses:
+			if resp.err == nil {
+				return resp.results, nil
+			}
+			err = resp.err
+			failed++
+			if failed == sent && (sent == hedges || !retryable(err)) {
+				return nil, err
+			}
+			// a failed request is hedged straight away rather than after the delay
+			if failed == sent {
+				go send(sent)
+				sent++
+			}
+		case <-timer:
+			go send(sent)
+			sent++
+		}
+
+		timer = nil
+		if sent < hedges {
+			timer = time.After(c.HedgeDelay)
+		}
+	}
+}
+
+// send posts the query to a single endpoint
+func (c *Client) send(ctx context.Context, base string, codegenJSON []byte, params url.Values, requestID string) ([]Result, error) {
+	target := strings.TrimRight(base, "/") + "/query"
+	if len(params) > 0 {
+		target += "?" + params.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", target, bytes.NewReader(codegenJSON))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Request-ID", requestID)
+	if c.APIKey != "" {
+		req.Header.Set("X-API-Key", c.APIKey)
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		apiErr := &APIError{StatusCode: resp.StatusCode}
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		if json.Unmarshal(body, apiErr) != nil {
+			apiErr.Message = strings.TrimSpace(string(body))
+		}
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			apiErr.retryAfter = time.Duration(seconds) * time.Second
+		}
+		return nil, apiErr
+	}
+
+	var results []Result
+	if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// backoff returns the delay before retrying the attempt
+func (c *Client) backoff(attempt int, err error) time.Duration {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.retryAfter > 0 {
+		return apiErr.retryAfter
+	}
+
+	backoff, maxBackoff := c.Backoff, c.MaxBackoff
+	if backoff == 0 {
+		backoff = defaultBackoff
+	}
+	if maxBackoff == 0 {
+		maxBackoff = defaultMaxBackoff
+	}
+
+	d := time.Duration(float64(backoff) * math.Pow(2, float64(attempt)))
+	if d <= 0 || d > maxBackoff {
+		d = maxBackoff
+	}
+	// full jitter keeps clients that failed together from retrying together
+	return time.Duration(mrand.Int63n(int64(d)) + 1)
+}
+
+// retryable reports whether a query failing with err may succeed when sent again, the server
+// rejects invalid queries the same way every time
+func retryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Temporary()
+	}
+	return true
+}
+
+func newRequestID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,131 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const matchedJSON = `[{"status":"matched","match_count":1}]`
+
+// newTestServer serves queries with respond, which is passed the number of the request. The
+// query is read first like the server does, which lets it notice cancelled requests
+func newTestServer(t *testing.T, respond func(n int64, w http.ResponseWriter, r *http.Request)) (*httptest.Server, *int64) {
+	var requests int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		respond(atomic.AddInt64(&requests, 1), w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &requests
+}
+
+// TestHedgeDelay never answers the first request, the query must be hedged to the other
+// endpoint after HedgeDelay and the first request cancelled once the hedge answered
+func TestHedgeDelay(t *testing.T) {
+	cancelled := make(chan struct{})
+	srv, requests := newTestServer(t, func(n int64, w http.ResponseWriter, r *http.Request) {
+		if n == 1 {
+			<-r.Context().Done()
+			close(cancelled)
+			return
+		}
+		w.Write([]byte(matchedJSON))
+	})
+
+	c := &Client{Endpoints: []string{srv.URL, srv.URL}, Retries: -1, HedgeDelay: 50 * time.Millisecond}
+	start := time.Now()
+	results, err := c.Query(context.Background(), []byte("[]"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < c.HedgeDelay {
+		t.Errorf("hedged after %s, want the hedge delay of %s", elapsed, c.HedgeDelay)
+	}
+	if len(results) != 1 || results[0].Status != "matched" {
+		t.Errorf("results %+v, want the hedge's match", results)
+	}
+	if n := atomic.LoadInt64(requests); n != 2 {
+		t.Errorf("sent %d requests, want 2", n)
+	}
+
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("slow request not cancelled once the hedge answered")
+	}
+}
+
+// TestHedgeOnFailure fails the first request, it must be hedged straight away rather than
+// after HedgeDelay
+func TestHedgeOnFailure(t *testing.T) {
+	srv, requests := newTestServer(t, func(n int64, w http.ResponseWriter, r *http.Request) {
+		if n == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(matchedJSON))
+	})
+
+	c := &Client{Endpoints: []string{srv.URL, srv.URL}, Retries: -1, HedgeDelay: time.Hour}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	results, err := c.Query(ctx, []byte("[]"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 {
+		t.Errorf("results %+v, want the hedge's match", results)
+	}
+	if n := atomic.LoadInt64(requests); n != 2 {
+		t.Errorf("sent %d requests, want 2", n)
+	}
+}
+
+// TestNoRetryClientError rejects the query as invalid, it must fail without retries
+func TestNoRetryClientError(t *testing.T) {
+	srv, requests := newTestServer(t, func(n int64, w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"code":"invalid_fingerprint","message":"Invalid fingerprint"}`))
+	})
+
+	c := &Client{Endpoints: []string{srv.URL, srv.URL}, Retries: 3, Backoff: time.Millisecond, HedgeDelay: time.Hour}
+	_, err := c.Query(context.Background(), []byte("[]"), nil)
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest || apiErr.Code != "invalid_fingerprint" {
+		t.Fatalf("query failed with %v, want the invalid_fingerprint error", err)
+	}
+	if n := atomic.LoadInt64(requests); n != 1 {
+		t.Errorf("sent %d requests, want 1", n)
+	}
+}
+
+// TestRetryAfter answers the first request with Retry-After, the retry must wait for it rather
+// than the much shorter backoff
+func TestRetryAfter(t *testing.T) {
+	srv, requests := newTestServer(t, func(n int64, w http.ResponseWriter, r *http.Request) {
+		if n == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(matchedJSON))
+	})
+
+	c := &Client{Endpoints: []string{srv.URL}, Retries: 1, Backoff: time.Millisecond, MaxBackoff: time.Millisecond}
+	start := time.Now()
+	if _, err := c.Query(context.Background(), []byte("[]"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("retried after %s, want the Retry-After of 1s", elapsed)
+	}
+	if n := atomic.LoadInt64(requests); n != 2 {
+		t.Errorf("sent %d requests, want 2", n)
+	}
+}
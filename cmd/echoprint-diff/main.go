@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/AudioAddict/go-echoprint/echoprint"
+)
+
+func dieOrNah(err error) {
+	if err != nil {
+		fatal(err)
+	}
+}
+
+func fatal(err error) {
+	fmt.Println(err)
+	os.Exit(1)
+}
+
+var (
+	boltA     = flag.String("a-bolt", "", "bolt database of catalog A, the reference catalog")
+	solrHostA = flag.String("a-solr-host", "localhost", "solr host of catalog A")
+	solrPortA = flag.Int("a-solr-port", 8983, "solr port of catalog A")
+	solrCoreA = flag.String("a-solr-core", "echoprint", "solr core of catalog A")
+
+	boltB     = flag.String("b-bolt", "", "bolt database of catalog B, the catalog being validated")
+	solrHostB = flag.String("b-solr-host", "localhost", "solr host of catalog B")
+	solrPortB = flag.Int("b-solr-port", 8983, "solr port of catalog B")
+	solrCoreB = flag.String("b-solr-core", "echoprint", "solr core of catalog B")
+
+	samples = flag.Int("samples", 100, "number of shared tracks cross queried against both catalogs")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s -a-bolt path -b-bolt path [options]\n", os.Args[0])
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+
+	flag.Parse()
+	if *boltA == "" || *boltB == "" {
+		flag.Usage()
+	}
+
+	storeA, err := echoprint.NewDBStore(*boltA, *solrHostA, *solrPortA, *solrCoreA)
+	dieOrNah(err)
+	defer storeA.Close()
+
+	storeB, err := echoprint.NewDBStore(*boltB, *solrHostB, *solrPortB, *solrCoreB)
+	dieOrNah(err)
+	defer storeB.Close()
+
+	report, err := echoprint.DiffCatalogs(
+		echoprint.New(echoprint.WithStore(storeA)),
+		echoprint.New(echoprint.WithStore(storeB)),
+		echoprint.DiffOptions{Samples: *samples},
+	)
+	dieOrNah(err)
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	dieOrNah(encoder.Encode(report))
+
+	if len(report.MissingFromA) > 0 || len(report.MissingFromB) > 0 || len(report.Disagreements) > 0 {
+		os.Exit(1)
+	}
+}
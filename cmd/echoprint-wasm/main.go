@@ -0,0 +1,54 @@
+//go:build js && wasm
+// +build js,wasm
+
+// echoprint-wasm runs the matcher entirely in the browser against an in-memory index, build
+// with GOOS=js GOARCH=wasm. It registers echoprintIngest and echoprintQuery functions that
+// take codegen json and return the results as json
+package main
+
+import (
+	"encoding/json"
+	"syscall/js"
+
+	"github.com/AudioAddict/go-echoprint/echoprint"
+)
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func main() {
+	echoprint.UseMemoryStore()
+
+	js.Global().Set("echoprintIngest", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		return handle(args, func(codegenList []*echoprint.CodegenFp) interface{} {
+			return echoprint.IngestAll(codegenList, echoprint.IngestOptions{AllocateTrackIDs: true})
+		})
+	}))
+
+	js.Global().Set("echoprintQuery", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		return handle(args, func(codegenList []*echoprint.CodegenFp) interface{} {
+			return echoprint.MatchAll(codegenList, echoprint.MatchOptions{})
+		})
+	}))
+
+	// keep the exported functions alive
+	select {}
+}
+
+func handle(args []js.Value, fn func([]*echoprint.CodegenFp) interface{}) interface{} {
+	var result interface{}
+	if len(args) != 1 {
+		result = errorResponse{"Expected a single codegen json argument"}
+	} else if codegenList, err := echoprint.ParseCodegen([]byte(args[0].String())); err != nil {
+		result = errorResponse{err.Error()}
+	} else {
+		result = fn(codegenList)
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		data, _ = json.Marshal(errorResponse{err.Error()})
+	}
+	return string(data)
+}
@@ -21,6 +21,8 @@ func fatal(err error) {
 }
 
 var codegenPath = flag.String("path", "", "path to codegen file to match")
+var timeScaling = flag.Bool("time-scaling", false, "also match against sped up/slowed down versions of the query")
+var samples = flag.Bool("samples", false, "the fingerprints of the file are clips of the same asset, combine them into a single result")
 
 func main() {
 	flag.Usage = func() {
@@ -41,11 +43,12 @@ func main() {
 	dieOrNah(err)
 	defer echoprint.DBDisconnect()
 
-	allMatches := echoprint.MatchAll(codegenList)
+	opts := echoprint.MatchOptions{TimeScaling: *timeScaling, Samples: *samples}
+	allMatches := echoprint.MatchAll(codegenList, opts)
 
-	for group, matches := range allMatches {
+	for group, matchGroup := range allMatches {
 		log.Println("Matches for group ", group)
-		for _, match := range matches {
+		for _, match := range matchGroup.Matches {
 			log.Printf("\t%+v", match)
 		}
 	}
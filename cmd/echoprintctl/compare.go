@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/AudioAddict/go-echoprint/echoprint"
+)
+
+var errEmptyCodegen = errors.New("Codegen file holds no fingerprint")
+
+// histogramWidth is the length of the bar of the most popular offset
+const histogramWidth = 50
+
+// compareCommand compares the first fingerprint of two codegen files without a server, for
+// quick manual QA of encodes
+func compareCommand(args []string) {
+	flags := flag.NewFlagSet("compare", flag.ExitOnError)
+	top := flags.Int("top", 10, "number of time offsets shown in the histogram")
+	clampMinutes := flags.Int("clamp-minutes", 0, "only compare the first N minutes of a (0 compares all of it)")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s compare [options] <a.json> <b.json>\n", os.Args[0])
+		flags.PrintDefaults()
+		os.Exit(2)
+	}
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+	}
+
+	a, err := loadFingerprint(flags.Arg(0))
+	dieOrNah(err)
+	b, err := loadFingerprint(flags.Arg(1))
+	dieOrNah(err)
+
+	s := echoprint.Compare(a, b, echoprint.CompareOptions{ClampMinutes: *clampMinutes, Histogram: *top})
+
+	verdict := "no match"
+	if s.Match {
+		verdict = "match"
+	}
+	fmt.Printf("confidence    %.1f%% (%s), raw %.1f%%\n", s.Confidence, verdict, s.RawConfidence)
+	fmt.Printf("offset        %s\n", formatOffset(s.Offset))
+	fmt.Printf("overlap       %s\n", s.Overlap.Round(time.Millisecond))
+	fmt.Printf("code overlap  %d of %d codes\n", s.CodeOverlap, len(a.Codes))
+
+	if len(s.Histogram) == 0 {
+		return
+	}
+	fmt.Println("\nhistogram")
+	for _, o := range s.Histogram {
+		bar := o.Count * histogramWidth / s.Histogram[0].Count
+		fmt.Printf("  %12s  %-*s %d\n", formatOffset(o.Offset), histogramWidth, strings.Repeat("#", bar), o.Count)
+	}
+}
+
+func loadFingerprint(path string) (*echoprint.Fingerprint, error) {
+	codegenList, err := echoprint.ParseCodegenFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(codegenList) == 0 {
+		return nil, errEmptyCodegen
+	}
+
+	return echoprint.NewFingerprint(codegenList[0])
+}
+
+// formatOffset formats where a lines up in b, with a sign so earlier and later read apart
+func formatOffset(offset time.Duration) string {
+	offset = offset.Round(time.Millisecond)
+	if offset >= 0 {
+		return "+" + offset.String()
+	}
+	return offset.String()
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AudioAddict/go-echoprint/echoprint"
+)
+
+// degradation is one combination of the degradations applied to a reference fingerprint
+type degradation struct {
+	drop   float64
+	jitter time.Duration
+	length time.Duration
+}
+
+func (d degradation) String() string {
+	var parts []string
+	if d.length > 0 {
+		parts = append(parts, "length="+d.length.String())
+	}
+	if d.drop > 0 {
+		parts = append(parts, fmt.Sprintf("drop=%g", d.drop))
+	}
+	if d.jitter > 0 {
+		parts = append(parts, "jitter="+d.jitter.String())
+	}
+	if len(parts) == 0 {
+		return "reference"
+	}
+	return strings.Join(parts, " ")
+}
+
+// degradeCommand synthesizes degraded variants of the fingerprints of a reference codegen file
+// (truncated excerpts, dropped codes, jittered times) as low quality captures would produce,
+// so robustness can be measured with compare, diff or a batch query without collecting
+// degraded audio. Every combination of the levels given is written, the metadata is kept so
+// the expected track is known and the filename notes the degradation
+func degradeCommand(args []string) {
+	flags := flag.NewFlagSet("degrade", flag.ExitOnError)
+	drops := flags.String("drop", "0,0.25,0.5", "comma separated ratios of the codes dropped at random")
+	jitters := flags.String("jitter", "0,50ms", "comma separated maximum shifts of each code's time, either way")
+	lengths := flags.String("length", "0,30s,10s", "comma separated lengths of the excerpts kept (0 keeps the whole fingerprint)")
+	randomStart := flags.Bool("random-start", false, "start the excerpts at random rather than at the beginning")
+	seed := flags.Int64("seed", 1, "random seed, the same seed synthesizes the same variants")
+	out := flags.String("out", "", "write the codegen json to this file rather than stdout")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s degrade [options] <reference.json>\n", os.Args[0])
+		flags.PrintDefaults()
+		os.Exit(2)
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+	}
+
+	var degradations []degradation
+	for _, length := range parseDurations(*lengths) {
+		for _, drop := range parseRatios(*drops) {
+			for _, jitter := range parseDurations(*jitters) {
+				degradations = append(degradations, degradation{drop: drop, jitter: jitter, length: length})
+			}
+		}
+	}
+
+	codegenList, err := echoprint.ParseCodegenFile(flags.Arg(0))
+	dieOrNah(err)
+	if len(codegenList) == 0 {
+		fatal(errEmptyCodegen)
+	}
+
+	rng := rand.New(rand.NewSource(*seed))
+	var variants []*echoprint.CodegenFp
+	for _, codegenFp := range codegenList {
+		fp, err := echoprint.NewFingerprint(codegenFp)
+		dieOrNah(err)
+		for _, d := range degradations {
+			variant, err := d.apply(fp, rng, *randomStart).Codegen()
+			dieOrNah(err)
+			variant.Meta.Filename = fmt.Sprintf("%s [%s]", variant.Meta.Filename, d)
+			variants = append(variants, variant)
+		}
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		dieOrNah(err)
+		defer f.Close()
+		w = f
+	}
+	dieOrNah(json.NewEncoder(w).Encode(variants))
+	if *out != "" {
+		fmt.Fprintf(os.Stderr, "wrote %d variants of %d fingerprints to %s\n", len(variants), len(codegenList), *out)
+	}
+}
+
+// apply returns a degraded copy of the fingerprint. The excerpt is cut first and its times
+// start over from 0 as a capture's would, then codes are dropped and the times jittered
+func (d degradation) apply(fp *echoprint.Fingerprint, rng *rand.Rand, randomStart bool) *echoprint.Fingerprint {
+	degraded := &echoprint.Fingerprint{Meta: fp.Meta}
+	if len(fp.Times) == 0 {
+		return degraded
+	}
+
+	// times are only sorted within each band
+	first, last := fp.Times[0], fp.Times[0]
+	for _, t := range fp.Times {
+		first, last = min(first, t), max(last, t)
+	}
+	start, end := first, last
+	if d.length > 0 {
+		length := echoprint.DurationToFrames(d.length)
+		if randomStart && last-first > length {
+			start += uint32(rng.Int63n(int64(last - first - length)))
+		}
+		end = start + length
+		degraded.Meta.Duration = d.length.Seconds()
+	}
+	jitter := int(echoprint.DurationToFrames(d.jitter))
+
+	for i, t := range fp.Times {
+		if t < start || t > end || rng.Float64() < d.drop {
+			continue
+		}
+		if d.length > 0 {
+			t -= start
+		}
+		if jitter > 0 {
+			t = uint32(max(int(t)+rng.Intn(2*jitter+1)-jitter, 0))
+		}
+		degraded.Codes = append(degraded.Codes, fp.Codes[i])
+		degraded.Times = append(degraded.Times, t)
+	}
+
+	return degraded
+}
+
+func parseRatios(list string) []float64 {
+	var ratios []float64
+	for _, value := range strings.Split(list, ",") {
+		ratio, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || ratio < 0 || ratio > 1 {
+			fatal(fmt.Errorf("Invalid ratio '%s'", value))
+		}
+		ratios = append(ratios, ratio)
+	}
+	return ratios
+}
+
+func parseDurations(list string) []time.Duration {
+	var durations []time.Duration
+	for _, value := range strings.Split(list, ",") {
+		d, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil || d < 0 {
+			fatal(fmt.Errorf("Invalid duration '%s'", value))
+		}
+		durations = append(durations, d)
+	}
+	return durations
+}
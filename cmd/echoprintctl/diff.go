@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/AudioAddict/go-echoprint/echoprint"
+)
+
+// diffCommand reports where the first fingerprint of b diverges from a's, e.g. to QA a
+// re-delivery against its master
+func diffCommand(args []string) {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	window := flags.Duration("window", 30*time.Second, "length of the windows the fingerprints are aligned in")
+	tolerance := flags.Duration("tolerance", 250*time.Millisecond, "divergences shorter than this are ignored")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s diff [options] <a.json> <b.json>\n", os.Args[0])
+		flags.PrintDefaults()
+		os.Exit(2)
+	}
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+	}
+
+	a, err := loadFingerprint(flags.Arg(0))
+	dieOrNah(err)
+	b, err := loadFingerprint(flags.Arg(1))
+	dieOrNah(err)
+
+	d := echoprint.DiffFingerprints(a, b, echoprint.AlignmentOptions{Window: *window, OffsetTolerance: *tolerance})
+	fmt.Printf("confidence  %.1f%%, %.0f%% of the windows match\n", d.Alignment.Confidence, d.Alignment.Coverage*100)
+	if d.Identical {
+		fmt.Println("no divergence")
+		return
+	}
+	for _, div := range d.Divergences {
+		fmt.Printf("%-9s a %s  b %s\n", div.Kind, formatRange(div.A), formatRange(div.B))
+	}
+}
+
+// formatRange formats a time range, or the point where the missing material would be
+func formatRange(r echoprint.TimeRange) string {
+	start, end := r.Start.Round(time.Millisecond), r.End.Round(time.Millisecond)
+	text := fmt.Sprintf("%s-%s", start, end)
+	if start == end {
+		text = "at " + start.String()
+	}
+	return fmt.Sprintf("%-20s", text)
+}
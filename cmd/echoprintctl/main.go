@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+func dieOrNah(err error) {
+	if err != nil {
+		fatal(err)
+	}
+}
+
+func fatal(err error) {
+	fmt.Println(err)
+	os.Exit(1)
+}
+
+// commands are the echoprintctl subcommands, each parses its own flags
+var commands = map[string]func(args []string){
+	"compare": compareCommand,
+	"degrade": degradeCommand,
+	"diff":    diffCommand,
+	"replay":  replayCommand,
+	"tune":    tuneCommand,
+	"verify":  verifyCommand,
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s <command> [options]\n\ncommands:\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  compare <a> <b>       compare two codegen files and print the offset histogram\n")
+	fmt.Fprintf(os.Stderr, "  degrade <reference>   synthesize degraded variants of a codegen file\n")
+	fmt.Fprintf(os.Stderr, "  diff <a> <b>          report the time ranges where b diverges from a\n")
+	fmt.Fprintf(os.Stderr, "  replay <request-id>  re-execute an audited query and diff the results\n")
+	fmt.Fprintf(os.Stderr, "  tune <feedback-file>  propose thresholds from the feedback labeled by clients\n")
+	fmt.Fprintf(os.Stderr, "  verify <response>     check the signed evidence of a saved query response\n")
+	os.Exit(2)
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() < 1 {
+		usage()
+	}
+
+	command, ok := commands[flag.Arg(0)]
+	if !ok {
+		usage()
+	}
+	command(flag.Args()[1:])
+}
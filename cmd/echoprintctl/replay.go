@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/AudioAddict/go-echoprint/echoprint"
+)
+
+// replayCommand asks the server to re-execute an audited query against its current index and
+// prints the recorded and replayed matches side by side. To replay against a snapshot, point
+// -server at a node bootstrapped from it
+func replayCommand(args []string) {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	server := flags.String("server", "http://localhost:8080", "echoprint server holding the audit log")
+	apiKey := flags.String("api-key", "", "API key sent with the request")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s replay [options] <request-id>\n", os.Args[0])
+		flags.PrintDefaults()
+		os.Exit(2)
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+	}
+
+	req, err := http.NewRequest("POST", strings.TrimRight(*server, "/")+"/admin/queries/"+url.PathEscape(flags.Arg(0))+"/replay", nil)
+	dieOrNah(err)
+	if *apiKey != "" {
+		req.Header.Set("X-API-Key", *apiKey)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	dieOrNah(err)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		fatal(fmt.Errorf("Replay failed with %s: %s", resp.Status, apiErr.Message))
+	}
+
+	var result echoprint.ReplayResult
+	dieOrNah(json.NewDecoder(resp.Body).Decode(&result))
+
+	printReplay(result)
+	if result.Changed > 0 {
+		os.Exit(1)
+	}
+}
+
+func printReplay(result echoprint.ReplayResult) {
+	fmt.Printf("Request %s recorded at %s, %d of %d groups changed\n",
+		result.RequestID, result.RecordedAt.Format("2006-01-02 15:04:05 MST"), result.Changed, len(result.Groups))
+
+	for i, group := range result.Groups {
+		changed := ""
+		if group.BestChanged {
+			changed = "  BEST MATCH CHANGED"
+		}
+		fmt.Printf("\nGroup %d%s\n", i, changed)
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "  #\tRECORDED\tREPLAYED\t")
+		rows := len(group.Recorded)
+		if len(group.Replayed) > rows {
+			rows = len(group.Replayed)
+		}
+		for rank := 0; rank < rows; rank++ {
+			fmt.Fprintf(w, "  %d\t%s\t%s\t\n", rank+1, formatMatch(group.Recorded, rank), formatMatch(group.Replayed, rank))
+		}
+		w.Flush()
+	}
+}
+
+func formatMatch(matches []*echoprint.MatchResult, rank int) string {
+	if rank >= len(matches) {
+		return "-"
+	}
+
+	match := matches[rank]
+	if match.Error != nil {
+		return fmt.Sprintf("error: %v", match.Error)
+	}
+
+	s := fmt.Sprintf("%d (%.1f%%)", match.TrackID, match.Confidence)
+	if match.Best {
+		s += " best"
+	}
+	return s
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/AudioAddict/go-echoprint/echoprint"
+)
+
+// tuneCommand proposes thresholds from the feedback collected by the server, comparing the
+// precision and recall of the current and proposed thresholds
+func tuneCommand(args []string) {
+	flags := flag.NewFlagSet("tune", flag.ExitOnError)
+	minPrecision := flags.Float64("min-precision", 0.99, "precision the proposed thresholds must keep")
+	minExamples := flags.Int("min-examples", 20, "labeled results a profile and quality tier needs for a proposal")
+	profilesFile := flags.String("profiles", "", "json array of the server's -profiles-file, when it has one")
+	out := flags.String("out", "", "write the tuned profiles to this file, for review and import at /admin/match-profiles")
+	asJSON := flags.Bool("json", false, "print the report as json")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s tune [options] <feedback-file>\n", os.Args[0])
+		flags.PrintDefaults()
+		os.Exit(2)
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+	}
+
+	if *profilesFile != "" {
+		f, err := os.Open(*profilesFile)
+		dieOrNah(err)
+		dieOrNah(echoprint.LoadProfiles(f))
+		f.Close()
+	}
+
+	feedback, err := echoprint.ReadFeedback(flags.Arg(0))
+	dieOrNah(err)
+	proposals := echoprint.TuneThresholds(feedback, echoprint.TuningOptions{MinPrecision: *minPrecision, MinExamples: *minExamples})
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		dieOrNah(encoder.Encode(proposals))
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "profile\tquality\texamples\tcorrect\tthreshold\tprecision\trecall\tproposed\tprecision\trecall\t")
+		for _, p := range proposals {
+			profile := p.Profile
+			if profile == "" {
+				profile = "(default)"
+			}
+			proposed := fmt.Sprintf("%.1f\t%.3f\t%.3f", p.Proposed.Threshold, p.Proposed.Precision, p.Proposed.Recall)
+			if p.InsufficientData {
+				proposed = "-\t-\t-"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%.1f\t%.3f\t%.3f\t%s\t\n", profile, p.Quality, p.Examples, p.Correct, p.Current.Threshold, p.Current.Precision, p.Current.Recall, proposed)
+		}
+		w.Flush()
+	}
+
+	if *out == "" {
+		return
+	}
+	f, err := os.Create(*out)
+	dieOrNah(err)
+	encoder := json.NewEncoder(f)
+	encoder.SetIndent("", "  ")
+	dieOrNah(encoder.Encode(echoprint.TunedProfiles(proposals)))
+	dieOrNah(f.Close())
+}
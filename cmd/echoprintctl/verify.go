@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/AudioAddict/go-echoprint/echoprint"
+)
+
+var errInvalidPublicKey = errors.New("Public key must be a PEM encoded Ed25519 public key")
+
+// verifyCommand checks the signed evidence of a saved /query response, and optionally that it
+// covers the codegen queries it claims to. It exits 1 unless every result verifies
+func verifyCommand(args []string) {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	keyFile := flags.String("key", "", "PEM encoded public key of the server, as published at /signing-key")
+	queryFile := flags.String("query", "", "codegen json the response was matched for")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s verify -key <public-key> [options] <response>\n", os.Args[0])
+		flags.PrintDefaults()
+		os.Exit(2)
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 || *keyFile == "" {
+		flags.Usage()
+	}
+
+	key, err := loadPublicKey(*keyFile)
+	dieOrNah(err)
+
+	data, err := ioutil.ReadFile(flags.Arg(0))
+	dieOrNah(err)
+	var results []struct {
+		Evidence *echoprint.Evidence `json:"evidence"`
+	}
+	dieOrNah(json.Unmarshal(data, &results))
+
+	var queries []*echoprint.CodegenFp
+	if *queryFile != "" {
+		queries, err = echoprint.ParseCodegenFile(*queryFile)
+		dieOrNah(err)
+		if len(queries) != len(results) {
+			fatal(fmt.Errorf("Response has %d results for %d queries", len(results), len(queries)))
+		}
+	}
+
+	failed := false
+	for i, result := range results {
+		e := result.Evidence
+		switch {
+		case e == nil:
+			fmt.Printf("%d: not signed\n", i)
+			failed = true
+		case !e.Verify(key):
+			fmt.Printf("%d: INVALID signature\n", i)
+			failed = true
+		case queries != nil && !e.VerifyQuery(queries[i]):
+			fmt.Printf("%d: signed for a different query\n", i)
+			failed = true
+		default:
+			fmt.Printf("%d: verified, signed by %s at %s with %d matches\n", i, e.KeyID, e.Timestamp.Format("2006-01-02 15:04:05Z07:00"), len(e.Matches))
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func loadPublicKey(path string) (ed25519.PublicKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errInvalidPublicKey
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, errInvalidPublicKey
+	}
+
+	return publicKey, nil
+}
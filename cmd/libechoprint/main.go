@@ -0,0 +1,129 @@
+//go:build cgo
+// +build cgo
+
+// libechoprint exports the fingerprint decoding and comparison of the matcher as a C library,
+// so ingestion scripts in other languages score exactly like the server. Build it with
+//
+//	go build -buildmode=c-shared -o libechoprint.so ./cmd/libechoprint
+//
+// which also writes the libechoprint.h header. Every function takes codegen json (the output
+// of echoprint-codegen) and returns a json string that must be released with echoprint_free.
+// Failures are returned as {"error": "..."}. From Python:
+//
+//	lib = ctypes.CDLL("./libechoprint.so")
+//	lib.echoprint_compare.restype = ctypes.c_void_p
+//	result = lib.echoprint_compare(a_json, b_json)
+//	similarity = json.loads(ctypes.string_at(result))
+//	lib.echoprint_free(result)
+package main
+
+// #include <stdlib.h>
+import "C"
+
+import (
+	"encoding/json"
+	"errors"
+	"unsafe"
+
+	"github.com/AudioAddict/go-echoprint/echoprint"
+)
+
+// apiVersion is incremented whenever an exported function changes incompatibly
+const apiVersion = 1
+
+var errNoFingerprint = errors.New("Codegen json holds no fingerprint")
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// decodedFingerprint is the json representation of a decoded codegen fingerprint
+type decodedFingerprint struct {
+	Codes []uint32 `json:"codes"`
+	// Times are in codegen frames of FrameDuration
+	Times []uint32 `json:"times"`
+}
+
+func main() {}
+
+// echoprint_api_version returns the version of the C API
+//
+//export echoprint_api_version
+func echoprint_api_version() C.int {
+	return apiVersion
+}
+
+// echoprint_decode decodes every fingerprint of the codegen json into its codes and times
+//
+//export echoprint_decode
+func echoprint_decode(codegen *C.char) *C.char {
+	return respond(func() (interface{}, error) {
+		codegenList, err := echoprint.ParseCodegen([]byte(C.GoString(codegen)))
+		if err != nil {
+			return nil, err
+		}
+
+		decoded := make([]decodedFingerprint, len(codegenList))
+		for i, codegenFp := range codegenList {
+			fp, err := echoprint.NewFingerprint(codegenFp)
+			if err != nil {
+				return nil, err
+			}
+			decoded[i] = decodedFingerprint{Codes: fp.Codes, Times: fp.Times}
+		}
+		return decoded, nil
+	})
+}
+
+// echoprint_compare compares the first fingerprint of codegen json a against the first of b,
+// returning the confidence, offset and overlap of echoprint.Compare
+//
+//export echoprint_compare
+func echoprint_compare(a *C.char, b *C.char) *C.char {
+	return respond(func() (interface{}, error) {
+		fpA, err := firstFingerprint(a)
+		if err != nil {
+			return nil, err
+		}
+		fpB, err := firstFingerprint(b)
+		if err != nil {
+			return nil, err
+		}
+
+		similarity := echoprint.Compare(fpA, fpB, echoprint.CompareOptions{})
+		return &similarity, nil
+	})
+}
+
+// echoprint_free releases a string returned by the library
+//
+//export echoprint_free
+func echoprint_free(s *C.char) {
+	C.free(unsafe.Pointer(s))
+}
+
+func firstFingerprint(codegen *C.char) (*echoprint.Fingerprint, error) {
+	codegenList, err := echoprint.ParseCodegen([]byte(C.GoString(codegen)))
+	if err != nil {
+		return nil, err
+	}
+	if len(codegenList) == 0 {
+		return nil, errNoFingerprint
+	}
+
+	return echoprint.NewFingerprint(codegenList[0])
+}
+
+// respond encodes the result of fn, or its error, as a C string owned by the caller
+func respond(fn func() (interface{}, error)) *C.char {
+	result, err := fn()
+	if err != nil {
+		result = errorResponse{err.Error()}
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		data, _ = json.Marshal(errorResponse{err.Error()})
+	}
+	return C.CString(string(data))
+}
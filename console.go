@@ -0,0 +1,167 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/AudioAddict/go-echoprint/echoprint"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// recentLatencies is the number of query latencies kept for the console
+	recentLatencies = 200
+
+	defaultTracksPage = 50
+	maxTracksPage     = 500
+)
+
+// consoleFiles are the static assets of the web console, served from the binary so the console
+// needs no deployment of its own
+//
+//go:embed console
+var consoleFiles embed.FS
+
+// consoleHandler serves the web console under /console/
+func consoleHandler() http.Handler {
+	files, err := fs.Sub(consoleFiles, "console")
+	if err != nil {
+		panic(err)
+	}
+	return http.StripPrefix("/console/", http.FileServer(http.FS(files)))
+}
+
+type latencyRecord struct {
+	Time    time.Time `json:"time"`
+	Path    string    `json:"path"`
+	Catalog string    `json:"catalog"`
+	Seconds float64   `json:"seconds"`
+}
+
+// latencyRing keeps the latencies of the most recent queries
+type latencyRing struct {
+	mu      sync.Mutex
+	records []latencyRecord
+	next    int
+}
+
+var queryLatencies = &latencyRing{records: make([]latencyRecord, 0, recentLatencies)}
+
+func (l *latencyRing) add(record latencyRecord) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.records) < cap(l.records) {
+		l.records = append(l.records, record)
+		return
+	}
+	l.records[l.next] = record
+	l.next = (l.next + 1) % len(l.records)
+}
+
+// snapshot returns the recorded latencies, most recent first
+func (l *latencyRing) snapshot() []latencyRecord {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	list := append([]latencyRecord(nil), l.records...)
+	sort.Slice(list, func(i, j int) bool { return list[i].Time.After(list[j].Time) })
+	return list
+}
+
+func latenciesHandler(w http.ResponseWriter, r *http.Request) {
+	renderResponse(w, queryLatencies.snapshot())
+}
+
+type catalogInfo struct {
+	Catalog string `json:"catalog"`
+	echoprint.TagCount
+}
+
+// catalogsHandler lists the catalogs and their sizes, it scans every stored track
+func catalogsHandler(w http.ResponseWriter, r *http.Request) {
+	counts, err := echoprint.CountTags(catalogTag)
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+
+	catalogs := make([]catalogInfo, 0, len(counts))
+	for catalog, count := range counts {
+		if catalog == "" {
+			catalog = defaultCatalog
+		}
+		catalogs = append(catalogs, catalogInfo{Catalog: catalog, TagCount: count})
+	}
+	sort.Slice(catalogs, func(i, j int) bool { return catalogs[i].Catalog < catalogs[j].Catalog })
+
+	renderResponse(w, catalogs)
+}
+
+type tracksPage struct {
+	Total  int                    `json:"total"`
+	Offset int                    `json:"offset"`
+	Tracks []*echoprint.TrackInfo `json:"tracks"`
+}
+
+// tracksHandler pages through the tracks of a catalog, all of them when no catalog is given
+func tracksHandler(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	offset, _ := strconv.Atoi(params.Get("offset"))
+	limit, err := strconv.Atoi(params.Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = defaultTracksPage
+	} else if limit > maxTracksPage {
+		limit = maxTracksPage
+	}
+
+	var filter *echoprint.MetadataFilter
+	if catalog := params.Get("catalog"); virtualCatalogs[catalog] != nil {
+		filter = virtualCatalogFilter(catalog, nil)
+	} else if catalog != "" {
+		// tracks of the default catalog carry no catalog tag
+		if catalog == defaultCatalog {
+			catalog = ""
+		}
+		filter = &echoprint.MetadataFilter{Tags: map[string]string{catalogTag: catalog}}
+	}
+
+	trackIDs, total, err := echoprint.Tracks(filter, offset, limit)
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+
+	page := tracksPage{Total: total, Offset: offset, Tracks: make([]*echoprint.TrackInfo, 0, len(trackIDs))}
+	for _, trackID := range trackIDs {
+		info, err := echoprint.Track(trackID)
+		if err != nil {
+			apiError(w, err)
+			return
+		}
+		page.Tracks = append(page.Tracks, info)
+	}
+
+	renderResponse(w, page)
+}
+
+func trackHandler(w http.ResponseWriter, r *http.Request) {
+	trackID, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 32)
+	if err != nil {
+		apiError(w, badRequest("Invalid TrackID '%s'", mux.Vars(r)["id"]))
+		return
+	}
+
+	info, err := echoprint.Track(uint32(trackID))
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+
+	renderResponse(w, info)
+}
@@ -0,0 +1,303 @@
+(function () {
+  'use strict';
+
+  var tracksPageSize = 50;
+  var tracksCatalog = null;
+  var tracksOffset = 0;
+
+  function $(selector) {
+    return document.querySelector(selector);
+  }
+
+  function showError(err) {
+    var el = $('#error');
+    el.textContent = err ? String(err) : '';
+    el.hidden = !err;
+  }
+
+  function api(path, options) {
+    showError(null);
+    return fetch(path, options).then(function (resp) {
+      return resp.json().then(function (body) {
+        if (!resp.ok) {
+          throw new Error(body.message || body.error || resp.statusText);
+        }
+        return body;
+      });
+    }).catch(function (err) {
+      showError(err.message);
+      throw err;
+    });
+  }
+
+  function cell(row, text) {
+    var td = document.createElement('td');
+    td.textContent = text === undefined || text === null ? '' : text;
+    row.appendChild(td);
+    return td;
+  }
+
+  function fillTable(table, items, render) {
+    var body = table.querySelector('tbody');
+    body.innerHTML = '';
+    items.forEach(function (item) {
+      var row = document.createElement('tr');
+      render(row, item);
+      body.appendChild(row);
+    });
+  }
+
+  function showTab(name) {
+    document.querySelectorAll('section').forEach(function (section) {
+      section.hidden = section.id !== name;
+    });
+    document.querySelectorAll('nav a').forEach(function (link) {
+      link.classList.toggle('active', link.dataset.tab === name);
+    });
+  }
+
+  function loadCatalogs() {
+    api('/admin/catalogs').then(function (catalogs) {
+      fillTable($('#catalog-list'), catalogs, function (row, catalog) {
+        row.className = 'clickable';
+        row.onclick = function () { loadTracks(catalog.catalog, 0); };
+        cell(row, catalog.catalog);
+        cell(row, catalog.tracks);
+        cell(row, catalog.codes);
+      });
+    });
+  }
+
+  function loadTracks(catalog, offset) {
+    var query = '?catalog=' + encodeURIComponent(catalog) + '&offset=' + offset + '&limit=' + tracksPageSize;
+    api('/admin/tracks' + query).then(function (page) {
+      tracksCatalog = catalog;
+      tracksOffset = page.offset;
+      $('#tracks').hidden = false;
+      $('#tracks-catalog').textContent = catalog;
+      $('#tracks-range').textContent = page.total === 0 ? 'no tracks' :
+        (page.offset + 1) + '-' + (page.offset + page.tracks.length) + ' of ' + page.total;
+      $('#tracks-prev').disabled = page.offset === 0;
+      $('#tracks-next').disabled = page.offset + page.tracks.length >= page.total;
+
+      fillTable($('#track-list'), page.tracks, function (row, track) {
+        row.className = 'clickable';
+        row.onclick = function () { inspectTrack(track.track_id); };
+        cell(row, track.track_id);
+        cell(row, track.filename);
+        cell(row, track.isrc);
+        cell(row, track.upc);
+        cell(row, track.fingerprints.length);
+      });
+    });
+  }
+
+  function inspectTrack(id) {
+    api('/admin/tracks/' + encodeURIComponent(id)).then(function (track) {
+      $('#track-detail').textContent = JSON.stringify(track, null, 2);
+    });
+  }
+
+  function matchTable(matches) {
+    var table = document.createElement('table');
+    table.innerHTML = '<thead><tr><th>TrackID</th><th>Confidence</th><th>Raw confidence</th>' +
+      '<th>Filename</th><th>ISRC</th></tr></thead><tbody></tbody>';
+    fillTable(table, matches, function (row, match) {
+      if (match.best) {
+        row.className = 'best';
+      }
+      cell(row, match.track_id);
+      cell(row, match.confidence.toFixed(1));
+      cell(row, match.raw_confidence.toFixed(1));
+      cell(row, match.filename);
+      cell(row, match.isrc);
+    });
+    return table;
+  }
+
+  function runQuery(form) {
+    var params = [];
+    if (form.catalog.value) {
+      params.push('catalog=' + encodeURIComponent(form.catalog.value));
+    }
+    if (form.score_details.checked) {
+      params.push('score_details=true');
+    }
+    if (form.near_matches.checked) {
+      params.push('near_matches=true');
+    }
+    if (form.trace.checked) {
+      params.push('trace=true');
+    }
+
+    var results = $('#query-results');
+    results.textContent = 'Querying...';
+    api('/query?' + params.join('&'), {
+      method: 'POST',
+      headers: {'Content-Type': 'application/json'},
+      body: form.codegen.value
+    }).then(function (queries) {
+      results.innerHTML = '';
+      queries.forEach(function (query, i) {
+        var heading = document.createElement('h3');
+        heading.textContent = 'Fingerprint ' + (i + 1) + ': ' + query.status;
+        results.appendChild(heading);
+        if (query.matches.length > 0) {
+          results.appendChild(matchTable(query.matches));
+        }
+        if (query.near_matches) {
+          var near = document.createElement('h4');
+          near.textContent = 'Likely alternate versions';
+          results.appendChild(near);
+          results.appendChild(matchTable(query.near_matches));
+        }
+
+        if (query.stats) {
+          var stats = document.createElement('pre');
+          stats.textContent = JSON.stringify(query.stats, null, 2);
+          results.appendChild(stats);
+        }
+      });
+    }).catch(function () {
+      results.textContent = '';
+    });
+  }
+
+  var spanColors = ['#e4572e', '#29335c', '#f3a712', '#669bbc', '#a8c686'];
+
+  // drawTimeline draws the waveform of the upload with the part matching each track shaded
+  // beneath it, the waveform is skipped when the browser can't decode the audio
+  function drawTimeline(canvas, samples, duration, matches) {
+    var ctx = canvas.getContext('2d');
+    var waveHeight = canvas.height - 10 * matches.length - 10;
+    ctx.clearRect(0, 0, canvas.width, canvas.height);
+
+    if (samples) {
+      var perPixel = Math.max(1, Math.floor(samples.length / canvas.width));
+      ctx.fillStyle = '#888';
+      for (var x = 0; x < canvas.width; x++) {
+        var peak = 0;
+        for (var i = x * perPixel; i < (x + 1) * perPixel && i < samples.length; i++) {
+          peak = Math.max(peak, Math.abs(samples[i]));
+        }
+        ctx.fillRect(x, (1 - peak) * waveHeight / 2, 1, Math.max(1, peak * waveHeight));
+      }
+    }
+
+    matches.forEach(function (match, i) {
+      var x = match.upload_start / duration * canvas.width;
+      var width = (match.upload_end - match.upload_start) / duration * canvas.width;
+      ctx.fillStyle = spanColors[i % spanColors.length];
+      ctx.globalAlpha = 0.15;
+      ctx.fillRect(x, 0, width, waveHeight);
+      ctx.globalAlpha = 1;
+      ctx.fillRect(x, waveHeight + 5 + i * 10, Math.max(1, width), 6);
+    });
+  }
+
+  function decodeAudio(file) {
+    var AudioContext = window.AudioContext || window.webkitAudioContext;
+    if (!AudioContext) {
+      return Promise.resolve(null);
+    }
+    return file.arrayBuffer().then(function (data) {
+      return new AudioContext().decodeAudioData(data);
+    }).then(function (buffer) {
+      return buffer.getChannelData(0);
+    }).catch(function () {
+      return null;
+    });
+  }
+
+  function runUpload(form) {
+    var file = form.audio.files[0];
+    var body = new FormData();
+    body.append('audio', file);
+    var query = form.catalog.value ? '?catalog=' + encodeURIComponent(form.catalog.value) : '';
+
+    var results = $('#upload-results');
+    var canvas = $('#upload-timeline');
+    results.textContent = 'Fingerprinting...';
+    canvas.hidden = true;
+    Promise.all([api('/query/upload' + query, {method: 'POST', body: body}), decodeAudio(file)]).then(function (values) {
+      var upload = values[0];
+      var matches = upload.matches.slice(0, spanColors.length);
+      results.innerHTML = '';
+
+      var heading = document.createElement('h3');
+      heading.textContent = upload.status + ', ' + upload.duration.toFixed(1) + 's uploaded';
+      results.appendChild(heading);
+      if (upload.duration > 0) {
+        canvas.hidden = false;
+        drawTimeline(canvas, values[1], upload.duration, matches);
+      }
+      if (matches.length === 0) {
+        return;
+      }
+
+      var table = document.createElement('table');
+      table.innerHTML = '<thead><tr><th>TrackID</th><th>Confidence</th><th>Upload</th><th>Track</th>' +
+        '<th>Filename</th></tr></thead><tbody></tbody>';
+      fillTable(table, matches, function (row, match) {
+        if (match.best) {
+          row.className = 'best';
+        }
+        var swatch = document.createElement('span');
+        swatch.className = 'swatch';
+        swatch.style.background = spanColors[matches.indexOf(match)];
+        cell(row, match.track_id).prepend(swatch);
+        cell(row, match.confidence.toFixed(1));
+        cell(row, match.upload_start.toFixed(1) + 's-' + match.upload_end.toFixed(1) + 's');
+        cell(row, 'from ' + match.track_start.toFixed(1) + 's');
+        cell(row, match.filename);
+      });
+      results.appendChild(table);
+    }).catch(function () {
+      results.textContent = '';
+    });
+  }
+
+  function loadLatencies() {
+    api('/admin/latencies').then(function (latencies) {
+      var seconds = latencies.map(function (l) { return l.seconds; }).sort(function (a, b) { return a - b; });
+      var percentile = function (p) {
+        return seconds[Math.min(seconds.length - 1, Math.floor(seconds.length * p))].toFixed(3) + 's';
+      };
+      $('#latency-summary').textContent = seconds.length === 0 ? 'No queries yet.' :
+        seconds.length + ' queries, median ' + percentile(0.5) + ', p95 ' + percentile(0.95) +
+        ', max ' + seconds[seconds.length - 1].toFixed(3) + 's';
+
+      fillTable($('#latency-list'), latencies, function (row, latency) {
+        cell(row, new Date(latency.time).toLocaleString());
+        cell(row, latency.path);
+        cell(row, latency.catalog);
+        cell(row, latency.seconds.toFixed(3));
+      });
+    });
+  }
+
+  document.querySelectorAll('nav a').forEach(function (link) {
+    link.onclick = function () { showTab(link.dataset.tab); };
+  });
+  $('#load-catalogs').onclick = loadCatalogs;
+  $('#tracks-prev').onclick = function () { loadTracks(tracksCatalog, Math.max(0, tracksOffset - tracksPageSize)); };
+  $('#tracks-next').onclick = function () { loadTracks(tracksCatalog, tracksOffset + tracksPageSize); };
+  $('#track-form').onsubmit = function (e) {
+    e.preventDefault();
+    inspectTrack(e.target.id.value);
+  };
+  $('#query-form').onsubmit = function (e) {
+    e.preventDefault();
+    runQuery(e.target);
+  };
+  $('#upload-form').onsubmit = function (e) {
+    e.preventDefault();
+    runUpload(e.target);
+  };
+  $('#load-latencies').onclick = loadLatencies;
+
+  showTab(location.hash.replace('#', '') || 'catalogs');
+  if (!$('#latencies').hidden) {
+    loadLatencies();
+  }
+})();
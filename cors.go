@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+const (
+	corsAllowMethods = "GET, POST, PUT, DELETE, OPTIONS"
+	corsAllowHeaders = "Content-Type, X-API-Key, X-Request-ID, X-QoS-Class, X-Priority, Last-Event-ID"
+	corsMaxAge       = "600"
+)
+
+// corsHandler allows browsers on the configured origins to call the API directly, answering
+// preflight requests itself
+type corsHandler struct {
+	handler http.Handler
+	origins map[string]bool
+}
+
+// NewCORSHandler wraps handler to allow cross origin requests from origins, "*" allows any
+func NewCORSHandler(handler http.Handler, origins []string) http.Handler {
+	h := &corsHandler{handler: handler, origins: make(map[string]bool)}
+	for _, origin := range origins {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			h.origins[origin] = true
+		}
+	}
+
+	return h
+}
+
+func (h *corsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	origin := r.Header.Get("Origin")
+	if origin == "" || !(h.origins["*"] || h.origins[origin]) {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	w.Header().Add("Vary", "Origin")
+	w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID, Retry-After")
+
+	if r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != "" {
+		w.Header().Set("Access-Control-Allow-Methods", corsAllowMethods)
+		w.Header().Set("Access-Control-Allow-Headers", corsAllowHeaders)
+		w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	h.handler.ServeHTTP(w, r)
+}
+
+// readCodegen returns the codegen json of a request. Besides a raw json body, browsers may
+// send it as the codegen field of a form, or base64 encoded with encoding=base64
+func readCodegen(r *http.Request) ([]byte, error) {
+	var data []byte
+	contentType := r.Header.Get("Content-Type")
+	if strings.HasPrefix(contentType, "application/x-www-form-urlencoded") || strings.HasPrefix(contentType, "multipart/form-data") {
+		data = []byte(r.FormValue("codegen"))
+	} else {
+		var err error
+		if data, err = ioutil.ReadAll(r.Body); err != nil {
+			return nil, err
+		}
+	}
+
+	if r.URL.Query().Get("encoding") == "base64" {
+		decoded := make([]byte, base64.StdEncoding.DecodedLen(len(data)))
+		n, err := base64.StdEncoding.Decode(decoded, []byte(strings.TrimSpace(string(data))))
+		if err != nil {
+			return nil, badRequest("Invalid base64 codegen body")
+		}
+		data = decoded[:n]
+	}
+
+	return data, nil
+}
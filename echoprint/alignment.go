@@ -0,0 +1,257 @@
+package echoprint
+
+import (
+	"encoding/json"
+	"math"
+	"time"
+)
+
+const (
+	defaultAlignmentWindow          = 30 * time.Second
+	defaultAlignmentOffsetTolerance = 250 * time.Millisecond
+	// windows with fewer codes (silence, fades) can't be told apart and are left out
+	minAlignmentWindowCodes = 20
+)
+
+// AlignmentOptions controls how a query is mapped out against a track window by window, zero
+// values use the defaults
+type AlignmentOptions struct {
+	// Window is the length of the windows the query is chunked into, defaults to 30 seconds
+	Window time.Duration
+	// Slop is the time quantization of the window scores, defaults to the matching's
+	Slop uint32
+	// MinConfidence is the confidence a window needs to match, defaults to the match
+	// threshold of the query's quality
+	MinConfidence float32
+	// OffsetTolerance is how far apart the alignments of consecutive matching windows may be
+	// for them to be the same region, defaults to 250ms. Larger shifts are edits
+	OffsetTolerance time.Duration
+}
+
+// AlignmentWindow is a window of the query scored against the whole track
+type AlignmentWindow struct {
+	// Start and End are the window's time range in the query
+	Start time.Duration
+	End   time.Duration
+	// Offset is where the window lines up in the track, the track's time minus the query's
+	Offset     time.Duration
+	Confidence float32
+	Match      bool
+	Codes      int
+}
+
+// AlignmentRegion is a run of consecutive windows that match the track at the same offset,
+// or that don't match it at all
+type AlignmentRegion struct {
+	Start  time.Duration
+	End    time.Duration
+	Match  bool
+	Offset time.Duration
+}
+
+// Alignment maps out which regions of a query match a track and which differ, e.g. the
+// edited or censored parts of another version of a recording
+type Alignment struct {
+	// Confidence is the mean confidence of the windows, weighted by their codes
+	Confidence float32 `json:"confidence"`
+	// Coverage is the ratio of the windows that match
+	Coverage float32           `json:"coverage"`
+	Regions  []AlignmentRegion `json:"regions"`
+	Windows  []AlignmentWindow `json:"windows"`
+}
+
+// MarshalJSON implements json.Marshaler, times are given in seconds
+func (w AlignmentWindow) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Start      float64 `json:"start"`
+		End        float64 `json:"end"`
+		Offset     float64 `json:"offset"`
+		Confidence float32 `json:"confidence"`
+		Match      bool    `json:"match"`
+		Codes      int     `json:"codes"`
+	}{w.Start.Seconds(), w.End.Seconds(), w.Offset.Seconds(), w.Confidence, w.Match, w.Codes})
+}
+
+// UnmarshalJSON implements json.Unmarshaler, times are given in seconds
+func (w *AlignmentWindow) UnmarshalJSON(data []byte) error {
+	var seconds struct {
+		Start      float64 `json:"start"`
+		End        float64 `json:"end"`
+		Offset     float64 `json:"offset"`
+		Confidence float32 `json:"confidence"`
+		Match      bool    `json:"match"`
+		Codes      int     `json:"codes"`
+	}
+	if err := json.Unmarshal(data, &seconds); err != nil {
+		return err
+	}
+
+	*w = AlignmentWindow{
+		Start:      secondsToDuration(seconds.Start),
+		End:        secondsToDuration(seconds.End),
+		Offset:     secondsToDuration(seconds.Offset),
+		Confidence: seconds.Confidence,
+		Match:      seconds.Match,
+		Codes:      seconds.Codes,
+	}
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler, times are given in seconds
+func (r AlignmentRegion) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Start  float64 `json:"start"`
+		End    float64 `json:"end"`
+		Match  bool    `json:"match"`
+		Offset float64 `json:"offset"`
+	}{r.Start.Seconds(), r.End.Seconds(), r.Match, r.Offset.Seconds()})
+}
+
+// UnmarshalJSON implements json.Unmarshaler, times are given in seconds
+func (r *AlignmentRegion) UnmarshalJSON(data []byte) error {
+	var seconds struct {
+		Start  float64 `json:"start"`
+		End    float64 `json:"end"`
+		Match  bool    `json:"match"`
+		Offset float64 `json:"offset"`
+	}
+	if err := json.Unmarshal(data, &seconds); err != nil {
+		return err
+	}
+
+	*r = AlignmentRegion{
+		Start:  secondsToDuration(seconds.Start),
+		End:    secondsToDuration(seconds.End),
+		Match:  seconds.Match,
+		Offset: secondsToDuration(seconds.Offset),
+	}
+	return nil
+}
+
+// Align maps out fingerprint a against fingerprint b without a store. Both are compared in
+// full, neither is clamped
+func Align(a, b *Fingerprint, opts AlignmentOptions) Alignment {
+	minConfidence := opts.MinConfidence
+	if minConfidence == 0 {
+		minConfidence = Thresholds{}.minConfidence(a.Quality())
+	}
+	return opts.align(a, b, minConfidence)
+}
+
+// align chunks the query into windows and scores each against the whole candidate, so every
+// window finds its own alignment. The candidate is indexed once so that the windows only look
+// their codes up in it, which keeps multi-hour comparisons affordable
+func (o AlignmentOptions) align(query, candidate *Fingerprint, minConfidence float32) Alignment {
+	var alignment Alignment
+	if len(query.Codes) == 0 || len(candidate.Codes) == 0 {
+		return alignment
+	}
+
+	if o.MinConfidence != 0 {
+		minConfidence = o.MinConfidence
+	}
+	window := o.Window
+	if window <= 0 {
+		window = defaultAlignmentWindow
+	}
+	tolerance := o.OffsetTolerance
+	if tolerance <= 0 {
+		tolerance = defaultAlignmentOffsetTolerance
+	}
+	scorer := HistogramScorer{Slop: o.Slop, Partial: true}
+	if candidate.codeIndex == nil {
+		candidate = candidate.NewIndexed()
+	}
+
+	// Times are only sorted within each band, the codes are bucketed by window in one pass
+	windowFrames := max(DurationToFrames(window), 1)
+	start, end := query.timeRange()
+	chunks := make([]*Fingerprint, (end-start)/windowFrames+1)
+	for i, time := range query.Times {
+		n := (time - start) / windowFrames
+		if chunks[n] == nil {
+			chunks[n] = &Fingerprint{Meta: query.Meta, clamped: true, trimmed: true, sparsity: query.sparsity}
+		}
+		chunks[n].Codes = append(chunks[n].Codes, query.Codes[i])
+		chunks[n].Times = append(chunks[n].Times, time)
+	}
+
+	var weighted float64
+	var codes, matched int
+	for n, chunk := range chunks {
+		if chunk == nil || len(chunk.Codes) < minAlignmentWindowCodes {
+			continue
+		}
+
+		d := scorer.Score(chunk, candidate)
+		w := AlignmentWindow{
+			Start:      FramesToDuration(int(start + uint32(n)*windowFrames)),
+			End:        FramesToDuration(int(min(start+uint32(n+1)*windowFrames, end))),
+			Offset:     d.Offset,
+			Confidence: float32(math.Min(float64(d.Confidence), maxConfidence)),
+			Codes:      len(chunk.Codes),
+		}
+		w.Match = w.Confidence >= minConfidence
+		alignment.Windows = append(alignment.Windows, w)
+
+		weighted += float64(w.Confidence) * float64(w.Codes)
+		codes += w.Codes
+		if w.Match {
+			matched++
+		}
+	}
+
+	if len(alignment.Windows) == 0 {
+		return alignment
+	}
+	alignment.Confidence = float32(weighted / float64(codes))
+	alignment.Coverage = float32(matched) / float32(len(alignment.Windows))
+	alignment.Regions = alignmentRegions(alignment.Windows, tolerance)
+
+	return alignment
+}
+
+// alignmentRegions merges the consecutive windows that match at offsets within tolerance of
+// the region's first window, or that don't match. Windows left out extend the region before them
+func alignmentRegions(windows []AlignmentWindow, tolerance time.Duration) []AlignmentRegion {
+	var regions []AlignmentRegion
+	for _, w := range windows {
+		if n := len(regions); n > 0 {
+			last := &regions[n-1]
+			offset := w.Offset - last.Offset
+			if w.Match == last.Match && (!w.Match || (offset >= -tolerance && offset <= tolerance)) {
+				last.End = w.End
+				continue
+			}
+			last.End = w.Start
+		}
+
+		region := AlignmentRegion{Start: w.Start, End: w.End, Match: w.Match}
+		if w.Match {
+			region.Offset = w.Offset
+		}
+		regions = append(regions, region)
+	}
+
+	return regions
+}
+
+// alignMatches maps out the query against each of the matches, at the time scale they
+// matched at
+func (o *AlignmentOptions) alignMatches(query *Fingerprint, matches []*MatchResult, minConfidence float32) {
+	if o == nil {
+		return
+	}
+
+	for _, match := range matches {
+		if match.fp == nil {
+			continue
+		}
+		fp := query
+		if match.TimeScale != 0 && match.TimeScale != 1 {
+			fp = query.newTimeScaled(match.TimeScale)
+		}
+		alignment := o.align(fp, match.fp, minConfidence)
+		match.Alignment = &alignment
+	}
+}
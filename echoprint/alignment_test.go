@@ -0,0 +1,36 @@
+package echoprint
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// TestAlignmentJSON decodes the alignment of an encoded result back, times are in seconds
+func TestAlignmentJSON(t *testing.T) {
+	alignment := &Alignment{
+		Confidence: 80,
+		Coverage:   0.5,
+		Regions: []AlignmentRegion{
+			{Start: 0, End: 30 * time.Second, Match: true, Offset: -1500 * time.Millisecond},
+			{Start: 30 * time.Second, End: 61500 * time.Millisecond},
+		},
+		Windows: []AlignmentWindow{
+			{Start: 0, End: 30 * time.Second, Offset: -1500 * time.Millisecond, Confidence: 90, Match: true, Codes: 400},
+			{Start: 30 * time.Second, End: 61500 * time.Millisecond, Confidence: 10, Codes: 350},
+		},
+	}
+
+	data, err := json.Marshal(&MatchResult{TrackID: 1, Alignment: alignment})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded MatchResult
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("decoding %s: %s", data, err)
+	}
+	if !reflect.DeepEqual(decoded.Alignment, alignment) {
+		t.Errorf("alignment %+v decoded as %+v", alignment, decoded.Alignment)
+	}
+}
@@ -0,0 +1,177 @@
+package echoprint
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ErrAuditRecordNotFound is returned when no audit record exists for a request ID
+var ErrAuditRecordNotFound = errors.New("Audit record not found")
+
+// AuditRecord describes a single query so it can be reviewed (or replayed) later when
+// resolving disputes with rights holders. APIKey identifies the client, the server records a
+// hash of the key rather than the credential
+type AuditRecord struct {
+	RequestID string              `json:"request_id"`
+	APIKey    string              `json:"api_key,omitempty"`
+	Time      time.Time           `json:"time"`
+	Options   map[string][]string `json:"options"`
+	Query     []*CodegenFp        `json:"query"`
+	Groups    []MatchGroup        `json:"groups"`
+	Elapsed   time.Duration       `json:"elapsed"`
+}
+
+// AuditSink persists audit records, implementations must be safe for concurrent use
+type AuditSink interface {
+	Write(record *AuditRecord) error
+	Read(requestID string) (*AuditRecord, error)
+	// Purge deletes the records matching the filter, returning how many were deleted
+	Purge(filter PurgeFilter) (int, error)
+}
+
+// PurgeFilter selects the records deleted by a purge, records must match every criterion set.
+// The zero value matches every record
+type PurgeFilter struct {
+	// APIKey only matches the records of queries made with this API key, as recorded
+	APIKey string
+	// From and To only match records within [From, To), a zero From or To is unbounded
+	From time.Time
+	To   time.Time
+}
+
+func (f PurgeFilter) matches(record *AuditRecord) bool {
+	return (f.APIKey == "" || record.APIKey == f.APIKey) && f.contains(record.Time)
+}
+
+func (f PurgeFilter) contains(t time.Time) bool {
+	return (f.From.IsZero() || !t.Before(f.From)) && (f.To.IsZero() || t.Before(f.To))
+}
+
+// fileAuditSink appends audit records to a file as json lines
+type fileAuditSink struct {
+	mu   sync.Mutex
+	path string
+}
+
+// NewFileAuditSink returns an AuditSink that appends records to the file at path
+func NewFileAuditSink(path string) AuditSink {
+	return &fileAuditSink{path: path}
+}
+
+func (s *fileAuditSink) Write(record *AuditRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+// Read scans the file for the record, if a request ID was logged more than once the
+// latest record is returned
+func (s *fileAuditSink) Read(requestID string) (*AuditRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil, ErrAuditRecordNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var found *AuditRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64*1024*1024)
+	for scanner.Scan() {
+		var record AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return nil, err
+		}
+		if record.RequestID == requestID {
+			found = &record
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return nil, ErrAuditRecordNotFound
+	}
+	return found, nil
+}
+
+// Purge rewrites the file without the matching records, the file is replaced atomically so a
+// failed purge leaves it untouched
+func (s *fileAuditSink) Purge(filter PurgeFilter) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".purge")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	var purged int
+	w := bufio.NewWriter(tmp)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64*1024*1024)
+	for scanner.Scan() {
+		var record AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return 0, err
+		}
+		if filter.matches(&record) {
+			purged++
+			continue
+		}
+		w.Write(scanner.Bytes())
+		w.WriteByte('\n')
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+
+	if purged == 0 {
+		return 0, nil
+	}
+	if err := w.Flush(); err != nil {
+		return 0, err
+	}
+	if err := tmp.Chmod(0600); err != nil {
+		return 0, err
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+
+	return purged, os.Rename(tmp.Name(), s.path)
+}
@@ -0,0 +1,92 @@
+//go:build !js
+// +build !js
+
+package echoprint
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var auditBucket = []byte("audit")
+
+// boltAuditSink stores audit records keyed by request ID in a bolt database
+type boltAuditSink struct {
+	db *bolt.DB
+}
+
+// NewBoltAuditSink returns an AuditSink backed by the bolt database at path
+func NewBoltAuditSink(path string) (AuditSink, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(auditBucket)
+		return err
+	})
+
+	return &boltAuditSink{db: db}, err
+}
+
+func (s *boltAuditSink) Write(record *AuditRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(auditBucket).Put([]byte(record.RequestID), data)
+	})
+}
+
+func (s *boltAuditSink) Read(requestID string) (*AuditRecord, error) {
+	var record *AuditRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(auditBucket).Get([]byte(requestID))
+		if data == nil {
+			return ErrAuditRecordNotFound
+		}
+
+		record = &AuditRecord{}
+		return json.Unmarshal(data, record)
+	})
+
+	return record, err
+}
+
+func (s *boltAuditSink) Purge(filter PurgeFilter) (int, error) {
+	var purged int
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(auditBucket)
+
+		// deleting while iterating skips keys, the matching keys are collected first
+		var keys [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			var record AuditRecord
+			if err := json.Unmarshal(v, &record); err != nil {
+				return err
+			}
+			if filter.matches(&record) {
+				keys = append(keys, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		purged = len(keys)
+		return nil
+	})
+
+	return purged, err
+}
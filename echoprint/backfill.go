@@ -0,0 +1,112 @@
+package echoprint
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/golang/glog"
+)
+
+// BackfillProgress reports how much of the catalog a QualityBackfill has checked
+type BackfillProgress struct {
+	Checked int64 `json:"checked"`
+	Updated int64 `json:"updated"`
+	Skipped int64 `json:"skipped"`
+	Failed  int64 `json:"failed"`
+	Total   int64 `json:"total"`
+	Done    bool  `json:"done"`
+}
+
+// QualityBackfill re-derives the quality tier of every stored track from its bitrate and the
+// current quality thresholds, persisting the tiers (and solr index fields) that changed. It
+// brings the catalog in line after a threshold change without re-ingesting the audio
+type QualityBackfill struct {
+	// Workers is the number of shards checked in parallel, defaults to 1
+	Workers int
+	// Matcher is backfilled, nil backfills the database connected by DBConnect
+	Matcher *Matcher
+
+	checked int64
+	updated int64
+	skipped int64
+	failed  int64
+	total   int64
+	done    int32
+}
+
+// Run backfills the catalog and blocks until it is complete, failing tracks are logged and
+// counted. Tracks stored before bitrates were persisted are skipped as their tier can't be derived
+func (b *QualityBackfill) Run() error {
+	db := b.Matcher.orDefault().Store
+	trackIDs, err := db.trackIDs()
+	if err != nil {
+		atomic.StoreInt32(&b.done, 1)
+		return err
+	}
+	atomic.StoreInt64(&b.total, int64(len(trackIDs)))
+
+	workers := b.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	glog.Infof("Backfilling quality tiers of %d tracks with %d workers", len(trackIDs), workers)
+
+	var wg sync.WaitGroup
+	for shard := 0; shard < workers; shard++ {
+		wg.Add(1)
+		go func(shard int) {
+			defer wg.Done()
+			for i := shard; i < len(trackIDs); i += workers {
+				b.backfill(db, trackIDs[i])
+				atomic.AddInt64(&b.checked, 1)
+			}
+		}(shard)
+	}
+	wg.Wait()
+
+	atomic.StoreInt32(&b.done, 1)
+	progress := b.Progress()
+	glog.Infof("Backfilled quality tiers, %d updated, %d skipped, %d failed of %d tracks", progress.Updated, progress.Skipped, progress.Failed, progress.Total)
+
+	return nil
+}
+
+func (b *QualityBackfill) backfill(db Store, trackID uint32) {
+	fp, err := db.load(trackID, 0)
+	if err != nil {
+		glog.Errorf("Backfilling TrackID=%d failed: %s", trackID, err)
+		atomic.AddInt64(&b.failed, 1)
+		return
+	}
+
+	if fp.Meta.Bitrate == 0 && fp.quality == "" {
+		atomic.AddInt64(&b.skipped, 1)
+		return
+	}
+
+	quality := fp.Quality()
+	if quality == fp.quality {
+		return
+	}
+
+	if err := db.setQuality(trackID, quality); err != nil {
+		glog.Errorf("Backfilling TrackID=%d failed: %s", trackID, err)
+		atomic.AddInt64(&b.failed, 1)
+		return
+	}
+	glog.V(2).Infof("TrackID=%d quality tier changed from '%s' to '%s'", trackID, fp.quality, quality)
+	b.Matcher.orDefault().events.publish(CatalogEvent{Type: EventQualityUpdated, TrackID: trackID, ExternalID: fp.Meta.ExternalID, Quality: quality})
+	atomic.AddInt64(&b.updated, 1)
+}
+
+// Progress returns a snapshot of the backfill progress
+func (b *QualityBackfill) Progress() BackfillProgress {
+	return BackfillProgress{
+		Checked: atomic.LoadInt64(&b.checked),
+		Updated: atomic.LoadInt64(&b.updated),
+		Skipped: atomic.LoadInt64(&b.skipped),
+		Failed:  atomic.LoadInt64(&b.failed),
+		Total:   atomic.LoadInt64(&b.total),
+		Done:    atomic.LoadInt32(&b.done) == 1,
+	}
+}
@@ -0,0 +1,115 @@
+package echoprint
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// ErrBatchingUnsupported is returned by NewBatchingStore for stores that can't look up the
+// candidates of several queries at once
+var ErrBatchingUnsupported = errors.New("Store does not support batched candidate lookups")
+
+// candidateQuery is a single query of a batched candidate lookup
+type candidateQuery struct {
+	fp       *Fingerprint
+	minScore float32
+	filter   *MetadataFilter
+}
+
+// batchLookupStore is implemented by stores that can serve several queries with a single
+// backend request (or scan), returning a cursor for each query in order
+type batchLookupStore interface {
+	candidatesBatch(queries []candidateQuery) []candidateCursor
+}
+
+// batchingStore coalesces the candidate lookups of concurrent queries that arrive within the
+// batching window into a single batched lookup
+type batchingStore struct {
+	Store
+	batcher  batchLookupStore
+	window   time.Duration
+	maxBatch int
+
+	mu      sync.Mutex
+	pending []*pendingLookup
+	timer   *time.Timer
+}
+
+type pendingLookup struct {
+	query  candidateQuery
+	cursor candidateCursor
+	done   chan struct{}
+}
+
+// NewBatchingStore wraps a store so the candidate lookups of concurrent queries are batched,
+// a lookup waits at most window for others to join it and batches are flushed early once they
+// hold maxBatch lookups (0 for no limit). This trades a few milliseconds of latency for fewer
+// backend round trips under high QPS
+func NewBatchingStore(s Store, window time.Duration, maxBatch int) (Store, error) {
+	batcher, ok := s.(batchLookupStore)
+	if !ok {
+		return nil, ErrBatchingUnsupported
+	}
+
+	return &batchingStore{Store: s, batcher: batcher, window: window, maxBatch: maxBatch}, nil
+}
+
+func (s *batchingStore) candidates(fp *Fingerprint, minScore float32, filter *MetadataFilter) candidateCursor {
+	lookup := &pendingLookup{
+		query: candidateQuery{fp: fp, minScore: minScore, filter: filter},
+		done:  make(chan struct{}),
+	}
+
+	s.mu.Lock()
+	s.pending = append(s.pending, lookup)
+	if s.maxBatch > 0 && len(s.pending) >= s.maxBatch {
+		s.flushLocked()
+	} else if s.timer == nil {
+		s.timer = time.AfterFunc(s.window, s.flush)
+	}
+	s.mu.Unlock()
+
+	<-lookup.done
+	return lookup.cursor
+}
+
+func (s *batchingStore) backendName() string {
+	return "batched " + storeBackendName(s.Store)
+}
+
+func (s *batchingStore) flush() {
+	s.mu.Lock()
+	s.flushLocked()
+	s.mu.Unlock()
+}
+
+// flushLocked hands the pending lookups to a goroutine performing the batched lookup, the
+// next lookup starts a new batching window
+func (s *batchingStore) flushLocked() {
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	if len(s.pending) == 0 {
+		return
+	}
+
+	batch := s.pending
+	s.pending = nil
+	go func() {
+		queries := make([]candidateQuery, len(batch))
+		for i, lookup := range batch {
+			queries[i] = lookup.query
+		}
+
+		glog.V(2).Infof("Looking up candidates of %d queries in a single batch", len(batch))
+		cursors := s.batcher.candidatesBatch(queries)
+		for i, lookup := range batch {
+			lookup.cursor = cursors[i]
+			close(lookup.done)
+		}
+	}()
+}
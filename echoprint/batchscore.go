@@ -0,0 +1,44 @@
+package echoprint
+
+import (
+	"errors"
+)
+
+// scoreBatchSize is the number of candidates handed to a BatchScorer at once
+const scoreBatchSize = 64
+
+// ErrVectorScoringDisabled is returned by NewVectorScorer in builds without the vectorscore tag
+var ErrVectorScoringDisabled = errors.New("Vector scoring is not supported by this build, rebuild with -tags vectorscore")
+
+// BatchScorer is a Scorer that compares a query with many candidates at once, for backends that
+// vectorize scoring. Matching hands the candidates to a BatchScorer in batches rather than
+// scoring them one at a time
+type BatchScorer interface {
+	Scorer
+	// ScoreBatch returns the score of each of the candidates, in order
+	ScoreBatch(query *Fingerprint, candidates []*Fingerprint) []ScoreDetail
+}
+
+// scoreBatch scores the candidates with the batch scorer, like score does one at a time
+func (m *Matcher) scoreBatch(scorer BatchScorer, fp *Fingerprint, scaledFps []*Fingerprint, candidates []dbResult) ([]ScoreDetail, []float32) {
+	fps := make([]*Fingerprint, len(candidates))
+	for i, candidate := range candidates {
+		fps[i] = candidate.fp
+	}
+
+	details := scorer.ScoreBatch(fp, fps)
+	timeScales := make([]float32, len(details))
+	for i, scaledFp := range scaledFps {
+		for j, scaled := range scorer.ScoreBatch(scaledFp, fps) {
+			if timeScales[j] == 0 {
+				timeScales[j] = 1
+			}
+			if scaled.Confidence > details[j].Confidence {
+				details[j] = scaled
+				timeScales[j] = m.scaleFactors()[i]
+			}
+		}
+	}
+
+	return details, timeScales
+}
@@ -0,0 +1,66 @@
+package echoprint
+
+import (
+	"github.com/golang/glog"
+)
+
+const defaultVerificationSlop = 1
+
+// BestMatchVerification re-scores the best match against the full, unclamped query with a
+// tighter slop before it is marked best, demoting it when it doesn't hold up. Sparse queries
+// occasionally line up with the wrong track by chance within the matching slop, far less so
+// over every code at a finer time quantization. Zero values use the defaults
+type BestMatchVerification struct {
+	// Slop is the time quantization of the verification, defaults to 1
+	Slop uint32
+	// MinConfidence is the confidence the best match must keep, defaults to the match
+	// threshold of the query's quality
+	MinConfidence float32
+}
+
+// verify re-scores the best match of the ranked matches against the query as it was before
+// clamping and trimming, clearing Best and setting Demoted when it falls short of
+// MinConfidence, or of the minConfidence the query was matched with
+func (v *BestMatchVerification) verify(m *Matcher, query *Fingerprint, matches []*MatchResult, scorer Scorer, minConfidence float32) {
+	if v == nil {
+		return
+	}
+
+	var best *MatchResult
+	for _, match := range matches {
+		if match.Best {
+			best = match
+			break
+		}
+	}
+	if best == nil || best.fp == nil {
+		return
+	}
+
+	// the verification keeps the matching's scorer settings but the slop, any other scorer is
+	// verified with the histogram scorer
+	verifier, _ := scorer.(HistogramScorer)
+	verifier.Slop = v.Slop
+	if verifier.Slop == 0 {
+		verifier.Slop = defaultVerificationSlop
+	}
+
+	query = m.hashCodes(query)
+	if best.TimeScale != 0 && best.TimeScale != 1 {
+		query = query.newTimeScaled(best.TimeScale)
+	}
+
+	if v.MinConfidence != 0 {
+		minConfidence = v.MinConfidence
+	}
+
+	d := verifier.Score(query, best.fp)
+	if d.Confidence >= minConfidence {
+		glog.V(2).Infof("Best match verified, TrackID=%d Confidence=%f", best.TrackID, d.Confidence)
+		return
+	}
+
+	glog.V(1).Infof("Best match failed verification, demoting, TrackID=%d Confidence=%f VerifiedConfidence=%f", best.TrackID, best.Confidence, d.Confidence)
+	best.Best = false
+	best.Demoted = true
+}
@@ -0,0 +1,124 @@
+package echoprint
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+)
+
+// coalescer shares the match of a query with the identical queries submitted while it runs,
+// when a clip goes viral many clients submit the same fingerprint at once and only one of them
+// needs matching
+type coalescer struct {
+	mu    sync.Mutex
+	calls map[uint64]*coalescedCall
+
+	hits   int64
+	misses int64
+}
+
+// coalescedCall is a match in flight, its results are set before done is closed
+type coalescedCall struct {
+	done    chan struct{}
+	matches []*MatchResult
+	stats   MatchStats
+	err     error
+}
+
+// WithCoalescing matches identical concurrent queries once, sharing the results
+func WithCoalescing() Option {
+	return func(m *Matcher) { m.coalescer = newCoalescer() }
+}
+
+// EnableCoalescing matches identical concurrent queries of the package level functions once
+func EnableCoalescing() {
+	defaultMatcher.coalescer = newCoalescer()
+}
+
+func newCoalescer() *coalescer {
+	return &coalescer{calls: make(map[uint64]*coalescedCall)}
+}
+
+// CoalescingStats returns the coalescing counters of the package level functions
+func CoalescingStats() CacheStats {
+	return defaultMatcher.CoalescingStats()
+}
+
+// CoalescingStats returns the coalescing counters, Entries being the matches in flight, all
+// zero when coalescing is disabled
+func (m *Matcher) CoalescingStats() CacheStats {
+	c := m.coalescer
+	if c == nil {
+		return CacheStats{}
+	}
+
+	c.mu.Lock()
+	entries := len(c.calls)
+	c.mu.Unlock()
+
+	return CacheStats{Entries: entries, Hits: atomic.LoadInt64(&c.hits), Misses: atomic.LoadInt64(&c.misses)}
+}
+
+// coalesceKey hashes the fingerprint along with every option that changes its results, the
+// optional settings by their values as every request allocates its own
+func coalesceKey(fp *Fingerprint, opts MatchOptions) uint64 {
+	h := fnv.New64a()
+	binary.Write(h, binary.LittleEndian, negativeCacheKey(fp, opts))
+	fmt.Fprintf(h, "|%v|%v|%v|%v|%v|%v|%+v|%+v|%+v|%+v|%+v|%+v",
+		opts.BestMatchPolicy, opts.ClusterRecordings, opts.GroupByISRC, opts.ScoreDetails, opts.Trace, opts.LatencyBudget, opts.CueSheet, opts.EarlyExit, opts.AdaptiveDepth, opts.NearMatches, opts.VerifyBest, opts.Alignment)
+
+	return h.Sum64()
+}
+
+// do runs match unless an identical query is already being matched, in which case its results
+// are waited for. Each caller gets its own copy of the results as they are annotated further
+// up, the stats of shared results are marked Coalesced
+func (c *coalescer) do(key uint64, match func() ([]*MatchResult, MatchStats, error)) ([]*MatchResult, MatchStats, error) {
+	if c == nil {
+		return match()
+	}
+
+	c.mu.Lock()
+	if call, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		atomic.AddInt64(&c.hits, 1)
+
+		<-call.done
+		stats := call.stats
+		stats.Coalesced = true
+		stats.NearMatches = copyMatches(stats.NearMatches)
+		return copyMatches(call.matches), stats, call.err
+	}
+	call := &coalescedCall{done: make(chan struct{})}
+	c.calls[key] = call
+	c.mu.Unlock()
+	atomic.AddInt64(&c.misses, 1)
+
+	// the call is removed before the results are shared, later queries match afresh
+	defer func() {
+		c.mu.Lock()
+		delete(c.calls, key)
+		c.mu.Unlock()
+		close(call.done)
+	}()
+
+	call.matches, call.stats, call.err = match()
+	matches, stats := copyMatches(call.matches), call.stats
+	stats.NearMatches = copyMatches(stats.NearMatches)
+	return matches, stats, call.err
+}
+
+func copyMatches(matches []*MatchResult) []*MatchResult {
+	if matches == nil {
+		return nil
+	}
+
+	copied := make([]*MatchResult, len(matches))
+	for i, match := range matches {
+		m := *match
+		copied[i] = &m
+	}
+	return copied
+}
@@ -0,0 +1,29 @@
+package echoprint
+
+import (
+	"testing"
+)
+
+// TestCoalesceKey keys queries by their options' values, not where they are allocated
+func TestCoalesceKey(t *testing.T) {
+	fp := &Fingerprint{Codes: []uint32{1, 2, 3}, Times: []uint32{10, 20, 30}}
+	opts := func(minConfidence float32) MatchOptions {
+		return MatchOptions{
+			EarlyExit:     &EarlyExit{MinConfidence: minConfidence},
+			AdaptiveDepth: &AdaptiveDepth{PageSize: 50},
+			NearMatches:   &NearMatches{MinConfidence: 20},
+			VerifyBest:    &BestMatchVerification{Slop: 1},
+			Alignment:     &AlignmentOptions{Window: defaultAlignmentWindow},
+		}
+	}
+
+	if coalesceKey(fp, opts(95)) != coalesceKey(fp, opts(95)) {
+		t.Error("identical options allocated apart have different keys")
+	}
+	if coalesceKey(fp, opts(95)) == coalesceKey(fp, opts(90)) {
+		t.Error("different early exit confidences have the same key")
+	}
+	if coalesceKey(fp, MatchOptions{}) == coalesceKey(fp, MatchOptions{EarlyExit: &EarlyExit{}}) {
+		t.Error("nil and zero valued early exit have the same key")
+	}
+}
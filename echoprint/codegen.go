@@ -1,18 +1,37 @@
 package echoprint
 
 import (
+	"context"
 	"encoding/json"
 	"io/ioutil"
+	"os/exec"
+	"time"
 
 	"github.com/golang/glog"
 )
 
+// CodegenBinary is the echoprint-codegen executable used to fingerprint audio files
+var CodegenBinary = "echoprint-codegen"
+
+// CodegenTimeout bounds a run of CodegenBinary, a file it can't decode must not hold its caller
+var CodegenTimeout = 2 * time.Minute
+
 // CodegenFp represents a parsed json fingerprint generated by codegen
 type CodegenFp struct {
 	Meta metadata `json:"metadata"`
 	Code string   `json:"code"`
 }
 
+// CodeCount returns the number of codes in the codegen data, 0 when it can't be decoded
+func (c *CodegenFp) CodeCount() int {
+	inflated, err := inflate(c.Code)
+	if err != nil {
+		return 0
+	}
+	// 5 hex digits for each time and each code
+	return len(inflated) / 10
+}
+
 // ParseCodegenFile is a helper method for testing, parses a json file generated by codegen
 // and returns and array of CodegenFp stucts
 func ParseCodegenFile(path string) ([]*CodegenFp, error) {
@@ -39,3 +58,27 @@ func ParseCodegen(jsonData []byte) ([]*CodegenFp, error) {
 
 	return fpList, err
 }
+
+// RunCodegen fingerprints the audio file at path by running echoprint-codegen, which is
+// killed when ctx is done or after CodegenTimeout
+func RunCodegen(ctx context.Context, path string) ([]*CodegenFp, error) {
+	t := trackTime("RunCodegen")
+	defer t.finish()
+
+	ctx, cancel := context.WithTimeout(ctx, CodegenTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, CodegenBinary, path)
+	// the decoder codegen runs may outlive it and hold its output open
+	cmd.WaitDelay = time.Second
+	jsonData, err := cmd.Output()
+	if ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		glog.Error(err)
+		return nil, err
+	}
+
+	return ParseCodegen(jsonData)
+}
@@ -0,0 +1,46 @@
+package echoprint
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestRunCodegenTimeout kills a codegen that hangs, along with the decoder holding its output
+func TestRunCodegenTimeout(t *testing.T) {
+	defer func(binary string, timeout time.Duration) {
+		CodegenBinary, CodegenTimeout = binary, timeout
+	}(CodegenBinary, CodegenTimeout)
+
+	fixture, err := filepath.Abs("../test-data/fp1.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	script := func(name, body string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte("#!/bin/sh\n"+body+"\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	CodegenTimeout = 200 * time.Millisecond
+	CodegenBinary = script("hang", "sleep 30 &\nsleep 30")
+	start := time.Now()
+	if _, err := RunCodegen(context.Background(), "audio.mp3"); err != context.DeadlineExceeded {
+		t.Errorf("hanging codegen returned %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("hanging codegen returned after %s", elapsed)
+	}
+
+	CodegenTimeout = 10 * time.Second
+	CodegenBinary = script("codegen", "cat "+fixture)
+	list, err := RunCodegen(context.Background(), "audio.mp3")
+	if err != nil || len(list) == 0 {
+		t.Errorf("codegen returned %d fingerprints (%v)", len(list), err)
+	}
+}
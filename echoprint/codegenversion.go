@@ -0,0 +1,62 @@
+package echoprint
+
+import (
+	"math"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// CurrentCodegenVersion is the codegen release whose time offsets the matcher works in,
+// fingerprints of other known releases are converted to it when decoded
+const CurrentCodegenVersion = 4.12
+
+// codegenQuirks are the decoding differences of a codegen release
+type codegenQuirks struct {
+	// timeScale converts the release's time offsets to codegen 4.12 frames of 23.2ms
+	timeScale uint32
+}
+
+// codegenVersions are the known codegen releases keyed by version*100, fingerprints without
+// a version are assumed to come from the current release. Stored fingerprints keep the times
+// they were ingested with, so a release's quirks must come with a fixture of its output and a
+// backfill of the tracks already stored from it
+var codegenVersions = map[int]codegenQuirks{
+	411: {timeScale: 1},
+	412: {timeScale: 1},
+}
+
+// warnedVersions holds the unknown versions already logged, so each is only warned about once
+var warnedVersions sync.Map
+
+// quirksFor returns the decoding differences of a codegen version, unknown versions are
+// decoded as the current release with a warning as their fingerprints may not match
+func quirksFor(version float64) codegenQuirks {
+	if version == 0 {
+		return codegenVersions[versionKey(CurrentCodegenVersion)]
+	}
+
+	quirks, ok := codegenVersions[versionKey(version)]
+	if !ok {
+		if _, warned := warnedVersions.LoadOrStore(versionKey(version), true); !warned {
+			glog.Warningf("Unknown codegen version %g, decoding as %g", version, CurrentCodegenVersion)
+		}
+		return codegenVersions[versionKey(CurrentCodegenVersion)]
+	}
+
+	return quirks
+}
+
+func versionKey(version float64) int {
+	return int(math.Round(version * 100))
+}
+
+// normalizeTimes converts the decoded times of a codegen version to current release frames
+func (q codegenQuirks) normalizeTimes(times []uint32) {
+	if q.timeScale <= 1 {
+		return
+	}
+	for i := range times {
+		times[i] *= q.timeScale
+	}
+}
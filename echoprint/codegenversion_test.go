@@ -0,0 +1,52 @@
+package echoprint
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestCodegenVersions decodes the fixture as each known release and matches it against the
+// track stored from the current one, the releases' times must line up
+func TestCodegenVersions(t *testing.T) {
+	list, err := ParseCodegenFile("../test-data/fp1.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list[0].Meta.Version != CurrentCodegenVersion {
+		t.Fatalf("fixture is codegen %g, want %g", list[0].Meta.Version, CurrentCodegenVersion)
+	}
+	current, err := NewFingerprint(list[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := New(WithStore(NewMemoryStore()))
+	current.Meta.TrackID = 1
+	if err := m.Ingest(current, IngestOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, version := range []float64{0, 4.11, 4.12, 9.99} {
+		codegenFp := *list[0]
+		codegenFp.Meta.Version = version
+		fp, err := NewFingerprint(&codegenFp)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		quirks := quirksFor(version)
+		times := append([]uint32(nil), current.Times...)
+		quirks.normalizeTimes(times)
+		if !reflect.DeepEqual(fp.Times, times) {
+			t.Errorf("codegen %g: times not scaled by %d", version, quirks.timeScale)
+		}
+
+		matches, _, err := m.Match(fp, MatchOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(matches) == 0 || !matches[0].Best || matches[0].TrackID != 1 || matches[0].Confidence != maxConfidence || matches[0].OffsetSeconds != 0 {
+			t.Errorf("codegen %g: want track 1 as the best match at %.0f and offset 0, got %+v", version, maxConfidence, matches)
+		}
+	}
+}
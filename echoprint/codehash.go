@@ -0,0 +1,42 @@
+package echoprint
+
+import (
+	"errors"
+)
+
+// ErrCodeHashingDisabled is returned by NewCodeHasher in builds without the hashedcodes tag
+var ErrCodeHashingDisabled = errors.New("Code hashing is not supported by this build, rebuild with -tags hashedcodes")
+
+// CodeHasher replaces each code with a keyed hash of it before fingerprints are stored or
+// looked up, so a partner's catalog can be hosted without holding their original codes.
+// Times are left as is, matching still lines up the hashed codes in time
+type CodeHasher interface {
+	HashCode(code uint32) uint32
+}
+
+// WithCodeHasher hashes the codes of every fingerprint ingested into and matched against the
+// Matcher's store. The store must only ever hold codes hashed with the same key
+func WithCodeHasher(h CodeHasher) Option {
+	return func(m *Matcher) { m.codeHasher = h }
+}
+
+// EnableCodeHashing hashes the codes of the package level functions
+func EnableCodeHashing(h CodeHasher) {
+	defaultMatcher.codeHasher = h
+}
+
+// hashCodes returns a copy of the fingerprint with hashed codes, or the fingerprint itself
+// when the Matcher doesn't hash codes
+func (m *Matcher) hashCodes(fp *Fingerprint) *Fingerprint {
+	if m.codeHasher == nil {
+		return fp
+	}
+
+	hashed := *fp
+	hashed.codeIndex = nil
+	hashed.Codes = make([]uint32, len(fp.Codes))
+	for i, code := range fp.Codes {
+		hashed.Codes[i] = m.codeHasher.HashCode(code)
+	}
+	return &hashed
+}
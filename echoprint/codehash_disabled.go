@@ -0,0 +1,9 @@
+//go:build !hashedcodes
+// +build !hashedcodes
+
+package echoprint
+
+// NewCodeHasher is only available in builds with the hashedcodes tag
+func NewCodeHasher(key []byte) (CodeHasher, error) {
+	return nil, ErrCodeHashingDisabled
+}
@@ -0,0 +1,50 @@
+//go:build hashedcodes
+// +build hashedcodes
+
+package echoprint
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"sync"
+)
+
+// minCodeKeyLength is the shortest key accepted, shorter keys make the 20 bit codes easy to
+// recover by hashing every possible code
+const minCodeKeyLength = 16
+
+var errCodeKeyTooShort = errors.New("Code hashing key must be at least 16 bytes")
+
+// hmacCodeHasher hashes codes with HMAC-SHA256, truncated to 31 bits as solr indexes codes as
+// signed integers. Collisions between the roughly million distinct codes are negligible
+type hmacCodeHasher struct {
+	pool sync.Pool
+}
+
+// NewCodeHasher returns a CodeHasher keyed with the catalog's key
+func NewCodeHasher(key []byte) (CodeHasher, error) {
+	if len(key) < minCodeKeyLength {
+		return nil, errCodeKeyTooShort
+	}
+
+	key = append([]byte(nil), key...)
+	h := &hmacCodeHasher{}
+	h.pool.New = func() interface{} { return hmac.New(sha256.New, key) }
+	return h, nil
+}
+
+func (h *hmacCodeHasher) HashCode(code uint32) uint32 {
+	mac := h.pool.Get().(hash.Hash)
+	defer h.pool.Put(mac)
+
+	var buf [sha256.Size]byte
+	binary.BigEndian.PutUint32(buf[:4], code)
+	mac.Reset()
+	mac.Write(buf[:4])
+	sum := mac.Sum(buf[:0])
+
+	return binary.BigEndian.Uint32(sum) & 0x7fffffff
+}
@@ -0,0 +1,67 @@
+package echoprint
+
+import (
+	"cmp"
+	"slices"
+)
+
+// codeIndex is the columnar form of a fingerprint candidates are scored in: its unique codes in
+// sorted order, each with the positions and times it occurs at. Stored fingerprints have it
+// built when they are saved so candidates needn't be mapped out on every query, and queries are
+// indexed once so each candidate can be merge joined against them.
+//
+// The positions of codes[i] are positions[starts[i]:starts[i+1]] in ascending order, times is
+// parallel to positions
+type codeIndex struct {
+	codes     []uint32
+	starts    []uint32
+	positions []uint32
+	times     []uint32
+}
+
+// newCodeIndex indexes the codes of the fingerprint
+func newCodeIndex(fp *Fingerprint) *codeIndex {
+	positions := make([]uint32, len(fp.Codes))
+	for i := range positions {
+		positions[i] = uint32(i)
+	}
+	// a stable sort keeps the positions of each code ascending
+	slices.SortStableFunc(positions, func(a, b uint32) int {
+		return cmp.Compare(fp.Codes[a], fp.Codes[b])
+	})
+
+	idx := &codeIndex{positions: positions}
+	for i, pos := range positions {
+		if i == 0 || fp.Codes[pos] != idx.codes[len(idx.codes)-1] {
+			idx.codes = append(idx.codes, fp.Codes[pos])
+			idx.starts = append(idx.starts, uint32(i))
+		}
+	}
+	idx.starts = append(idx.starts, uint32(len(positions)))
+	idx.fillTimes(fp.Times)
+
+	return idx
+}
+
+// fillTimes builds the times column from the fingerprint's times
+func (idx *codeIndex) fillTimes(times []uint32) {
+	idx.times = make([]uint32, len(idx.positions))
+	for i, pos := range idx.positions {
+		idx.times[i] = times[pos]
+	}
+}
+
+// entry returns the positions and times of the ith code
+func (idx *codeIndex) entry(i int) ([]uint32, []uint32) {
+	start, end := idx.starts[i], idx.starts[i+1]
+	return idx.positions[start:end], idx.times[start:end]
+}
+
+// lookup returns the positions and times the code occurs at, nil when it doesn't occur
+func (idx *codeIndex) lookup(code uint32) ([]uint32, []uint32) {
+	i, ok := slices.BinarySearch(idx.codes, code)
+	if !ok {
+		return nil, nil
+	}
+	return idx.entry(i)
+}
@@ -0,0 +1,140 @@
+package echoprint
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+	"time"
+)
+
+// CompareOptions controls Compare, the zero value compares the whole fingerprints
+type CompareOptions struct {
+	// Scorer compares the fingerprints, defaults to the histogram scorer comparing against
+	// the whole of b so that a may be taken from anywhere in it
+	Scorer Scorer
+
+	// ClampMinutes limits the length of a, 0 compares all of it
+	ClampMinutes int
+
+	// Trim drops the silent and low information segments of a before comparing
+	Trim bool
+
+	// Thresholds overrides the minimum confidence for the fingerprints to be considered a match
+	Thresholds Thresholds
+
+	// Histogram reports the most popular time offsets between matching codes, up to this many
+	Histogram int
+}
+
+// Similarity is the result of comparing two fingerprints
+type Similarity struct {
+	// Confidence is the score relative to the codes of a overlapping b at the best alignment,
+	// RawConfidence relative to all of the codes of a
+	Confidence    float32
+	RawConfidence float32
+
+	// Match is set when the confidence reaches the minimum for a match at a's quality
+	Match bool
+
+	// Offset is where a lines up in b, Overlap how long they overlap at that alignment
+	Offset  time.Duration
+	Overlap time.Duration
+
+	// CodeOverlap is the number of codes of a found anywhere in b
+	CodeOverlap int
+
+	// Histogram are the most popular offsets of CompareOptions.Histogram, most popular first
+	Histogram []OffsetCount
+}
+
+// OffsetCount is the number of matching codes of a and b lined up at a time offset
+type OffsetCount struct {
+	Offset time.Duration
+	Count  int
+}
+
+// MarshalJSON implements json.Marshaler, the offset is given in seconds
+func (o OffsetCount) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Offset float64 `json:"offset"`
+		Count  int     `json:"count"`
+	}{o.Offset.Seconds(), o.Count})
+}
+
+// MarshalJSON implements json.Marshaler, times are given in seconds
+func (s *Similarity) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Confidence    float32       `json:"confidence"`
+		RawConfidence float32       `json:"raw_confidence"`
+		Match         bool          `json:"match"`
+		Offset        float64       `json:"offset"`
+		Overlap       float64       `json:"overlap"`
+		CodeOverlap   int           `json:"code_overlap"`
+		Histogram     []OffsetCount `json:"histogram,omitempty"`
+	}{s.Confidence, s.RawConfidence, s.Match, s.Offset.Seconds(), s.Overlap.Seconds(), s.CodeOverlap, s.Histogram})
+}
+
+// Compare scores fingerprint a against fingerprint b without a store, e.g. to check that a
+// re-encode (a) still matches its master (b)
+func Compare(a, b *Fingerprint, opts CompareOptions) Similarity {
+	if opts.ClampMinutes > 0 && len(a.Times) > 0 {
+		a = a.newClampedTo(opts.ClampMinutes)
+	}
+	if opts.Trim {
+		a, _ = a.NewTrimmed()
+	}
+
+	var s Similarity
+	if len(a.Codes) == 0 || len(b.Codes) == 0 {
+		return s
+	}
+
+	scorer := opts.Scorer
+	if scorer == nil {
+		scorer = HistogramScorer{Slop: histogramMatchSlop, Partial: true}
+	}
+	d := scorer.Score(a, b)
+
+	// the two top offsets can score more than the codes overlapping, as when matching
+	s.Confidence = float32(math.Min(float64(d.Confidence), maxConfidence))
+	s.RawConfidence = float32(math.Min(float64(d.RawConfidence), maxConfidence))
+	s.Match = s.Confidence >= opts.Thresholds.minConfidence(a.Quality())
+	s.Offset = d.Offset
+	s.Overlap = d.Aligned
+	s.CodeOverlap = d.CodeOverlap
+	if opts.Histogram > 0 {
+		s.Histogram = offsetHistogram(a, b, opts.Histogram)
+	}
+
+	return s
+}
+
+// offsetHistogram counts the matching codes of a and b at each time offset, like the histogram
+// scorer does, returning the top most popular offsets
+func offsetHistogram(a, b *Fingerprint, top int) []OffsetCount {
+	codeMap, _, _ := getCodeTimeMap(b, len(b.Codes), histogramMatchSlop)
+
+	counts := make(map[int]int)
+	for i, code := range a.Codes {
+		aTime := a.Times[i] / histogramMatchSlop * histogramMatchSlop
+		for _, bTime := range codeMap[code] {
+			counts[int(bTime)-int(aTime)]++
+		}
+	}
+
+	histogram := make([]OffsetCount, 0, len(counts))
+	for offset, count := range counts {
+		histogram = append(histogram, OffsetCount{FramesToDuration(offset), count})
+	}
+	sort.Slice(histogram, func(i, j int) bool {
+		if histogram[i].Count != histogram[j].Count {
+			return histogram[i].Count > histogram[j].Count
+		}
+		return histogram[i].Offset < histogram[j].Offset
+	})
+	if len(histogram) > top {
+		histogram = histogram[:top]
+	}
+
+	return histogram
+}
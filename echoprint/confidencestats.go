@@ -0,0 +1,151 @@
+package echoprint
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// confidenceBins divide the confidences from 0 to maxConfidence into equal bins
+	confidenceBins     = 20
+	confidenceBinWidth = maxConfidence / confidenceBins
+)
+
+// ConfidenceHistogram counts the confidences of the candidates scored in a day for queries of
+// a quality tier, split by whether they were accepted as matches. Bin i counts confidences from
+// i*BinWidth up to the next bin. Only counts are kept, no tracks or queries, so the histograms
+// show whether the thresholds still separate the distributions as the catalog changes
+type ConfidenceHistogram struct {
+	Day      string  `json:"day"`
+	Quality  string  `json:"quality"`
+	BinWidth float32 `json:"bin_width"`
+	Accepted []int64 `json:"accepted"`
+	Rejected []int64 `json:"rejected"`
+}
+
+// confidenceStats keeps the daily confidence histograms
+type confidenceStats struct {
+	days int
+
+	mu         sync.Mutex
+	histograms map[confidenceKey]*ConfidenceHistogram
+}
+
+type confidenceKey struct {
+	day     string
+	quality string
+}
+
+// confidenceCounts are the counts of a single query, merged once it has been scored so the
+// stats aren't locked for every candidate
+type confidenceCounts struct {
+	accepted [confidenceBins]int64
+	rejected [confidenceBins]int64
+}
+
+// WithConfidenceStats records the confidence histograms of the last days
+func WithConfidenceStats(days int) Option {
+	return func(m *Matcher) { m.confidences = newConfidenceStats(days) }
+}
+
+// EnableConfidenceStats records the confidence histograms of the package level functions
+func EnableConfidenceStats(days int) {
+	defaultMatcher.confidences = newConfidenceStats(days)
+}
+
+func newConfidenceStats(days int) *confidenceStats {
+	return &confidenceStats{days: days, histograms: make(map[confidenceKey]*ConfidenceHistogram)}
+}
+
+// ConfidenceHistograms returns the histograms recorded by the package level functions
+func ConfidenceHistograms() []ConfidenceHistogram {
+	return defaultMatcher.ConfidenceHistograms()
+}
+
+// ConfidenceHistograms returns the recorded histograms ordered by day and quality, nil when
+// the stats aren't recorded
+func (m *Matcher) ConfidenceHistograms() []ConfidenceHistogram {
+	s := m.confidences
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := make([]ConfidenceHistogram, 0, len(s.histograms))
+	for _, h := range s.histograms {
+		c := *h
+		c.Accepted = append([]int64(nil), h.Accepted...)
+		c.Rejected = append([]int64(nil), h.Rejected...)
+		list = append(list, c)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Day != list[j].Day {
+			return list[i].Day < list[j].Day
+		}
+		return list[i].Quality < list[j].Quality
+	})
+	return list
+}
+
+func (c *confidenceCounts) add(confidence float32, accepted bool) {
+	bin := int(confidence / confidenceBinWidth)
+	if bin < 0 {
+		bin = 0
+	} else if bin >= confidenceBins {
+		bin = confidenceBins - 1
+	}
+
+	if accepted {
+		c.accepted[bin]++
+	} else {
+		c.rejected[bin]++
+	}
+}
+
+// record merges the counts of a query into the histogram of the day
+func (s *confidenceStats) record(quality string, counts *confidenceCounts) {
+	if s == nil {
+		return
+	}
+
+	now := time.Now().UTC()
+	key := confidenceKey{now.Format("2006-01-02"), quality}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h, ok := s.histograms[key]
+	if !ok {
+		h = &ConfidenceHistogram{
+			Day:      key.day,
+			Quality:  quality,
+			BinWidth: confidenceBinWidth,
+			Accepted: make([]int64, confidenceBins),
+			Rejected: make([]int64, confidenceBins),
+		}
+		s.histograms[key] = h
+		s.expire(now)
+	}
+
+	for i := range counts.accepted {
+		h.Accepted[i] += counts.accepted[i]
+		h.Rejected[i] += counts.rejected[i]
+	}
+}
+
+// expire drops the histograms of the days no longer kept, must be called with the lock held
+func (s *confidenceStats) expire(now time.Time) {
+	if s.days <= 0 {
+		return
+	}
+
+	oldest := now.AddDate(0, 0, 1-s.days).Format("2006-01-02")
+	for key := range s.histograms {
+		if key.day < oldest {
+			delete(s.histograms, key)
+		}
+	}
+}
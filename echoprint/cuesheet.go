@@ -0,0 +1,217 @@
+package echoprint
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// long queries are matched in overlapping windows of 30 seconds, every 15 seconds, unless
+	// CueSheetOptions say otherwise
+	cueWindow = 30 * time.Second
+	cueStep   = 15 * time.Second
+)
+
+// Cue is a track identified within a long query, times are from the start of the query
+type Cue struct {
+	Start time.Duration
+	End   time.Duration
+	Match *MatchResult
+
+	// lastWindow is the start of the last window the track was identified in
+	lastWindow time.Duration
+}
+
+// MarshalJSON implements json.Marshaler, times are given in seconds
+func (c *Cue) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Start float64      `json:"start"`
+		End   float64      `json:"end"`
+		Match *MatchResult `json:"match"`
+	}{c.Start.Seconds(), c.End.Seconds(), c.Match})
+}
+
+// UnmarshalJSON implements json.Unmarshaler, times are given in seconds
+func (c *Cue) UnmarshalJSON(data []byte) error {
+	var seconds struct {
+		Start float64      `json:"start"`
+		End   float64      `json:"end"`
+		Match *MatchResult `json:"match"`
+	}
+	if err := json.Unmarshal(data, &seconds); err != nil {
+		return err
+	}
+
+	*c = Cue{Start: secondsToDuration(seconds.Start), End: secondsToDuration(seconds.End), Match: seconds.Match}
+	return nil
+}
+
+// CueSheetOptions controls how a long query is split into windows and how the tracks
+// identified in them are turned into cues, the zero value uses 30 second windows every 15
+// seconds and keeps every cue
+type CueSheetOptions struct {
+	Window time.Duration
+	Step   time.Duration
+
+	// MinDuration drops cues identified for less than this long as spurious, a track is
+	// credited with a Step for every window it's identified in
+	MinDuration time.Duration
+
+	// MaxGap merges cues of the same track separated by up to this long, e.g. by windows lost
+	// to a scratch or a spurious hit
+	MaxGap time.Duration
+
+	// Transitions places the change between overlapping cues halfway through their overlap,
+	// so every cue ends where the next starts
+	Transitions bool
+}
+
+// MarshalJSON implements json.Marshaler, times are given in seconds
+func (o CueSheetOptions) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Window      float64 `json:"window"`
+		Step        float64 `json:"step"`
+		MinDuration float64 `json:"min_duration,omitempty"`
+		MaxGap      float64 `json:"max_gap,omitempty"`
+		Transitions bool    `json:"transitions,omitempty"`
+	}{o.window().Seconds(), o.step().Seconds(), o.MinDuration.Seconds(), o.MaxGap.Seconds(), o.Transitions})
+}
+
+// UnmarshalJSON implements json.Unmarshaler, times are given in seconds
+func (o *CueSheetOptions) UnmarshalJSON(data []byte) error {
+	var seconds struct {
+		Window      float64 `json:"window"`
+		Step        float64 `json:"step"`
+		MinDuration float64 `json:"min_duration"`
+		MaxGap      float64 `json:"max_gap"`
+		Transitions bool    `json:"transitions"`
+	}
+	if err := json.Unmarshal(data, &seconds); err != nil {
+		return err
+	}
+
+	toDuration := func(s float64) time.Duration { return time.Duration(s * float64(time.Second)) }
+	*o = CueSheetOptions{toDuration(seconds.Window), toDuration(seconds.Step), toDuration(seconds.MinDuration), toDuration(seconds.MaxGap), seconds.Transitions}
+	return nil
+}
+
+func (o CueSheetOptions) window() time.Duration {
+	if o.Window > 0 {
+		return o.Window
+	}
+	return cueWindow
+}
+
+func (o CueSheetOptions) step() time.Duration {
+	if o.Step > 0 {
+		return o.Step
+	}
+	return cueStep
+}
+
+// tidy drops the spurious cues, merges the cues of a track interrupted by a gap and places
+// the transitions between the cues
+func (o CueSheetOptions) tidy(cues []*Cue) []*Cue {
+	if o.MinDuration > 0 {
+		kept := cues[:0]
+		for _, cue := range cues {
+			if cue.lastWindow-cue.Start+o.step() < o.MinDuration {
+				glog.V(2).Infof("Dropping spurious cue of TrackID=%d at %s", cue.Match.TrackID, cue.Start)
+				continue
+			}
+			kept = append(kept, cue)
+		}
+		cues = kept
+	}
+
+	if o.MaxGap > 0 {
+		merged := cues[:0]
+		for _, cue := range cues {
+			if last := len(merged) - 1; last >= 0 && merged[last].Match.TrackID == cue.Match.TrackID && cue.Start-merged[last].End <= o.MaxGap {
+				merged[last].End = cue.End
+				merged[last].lastWindow = cue.lastWindow
+				if cue.Match.Confidence > merged[last].Match.Confidence {
+					merged[last].Match = cue.Match
+				}
+				continue
+			}
+			merged = append(merged, cue)
+		}
+		cues = merged
+	}
+
+	if o.Transitions {
+		for i := 1; i < len(cues); i++ {
+			if prev := cues[i-1]; prev.End > cues[i].Start {
+				transition := (prev.End + cues[i].Start) / 2
+				prev.End, cues[i].Start = transition, transition
+			}
+		}
+	}
+
+	return cues
+}
+
+// CueSheet builds a cue sheet against the database connected by DBConnect
+func CueSheet(fp *Fingerprint, opts MatchOptions) ([]*Cue, error) {
+	return defaultMatcher.CueSheet(fp, opts)
+}
+
+// CueSheet matches a long query (radio air-check, DJ set) in sliding windows and returns the
+// chronological list of tracks identified within it
+func (m *Matcher) CueSheet(fp *Fingerprint, opts MatchOptions) ([]*Cue, error) {
+	t := trackTime("CueSheet")
+	defer t.finish()
+
+	// windows can start anywhere in a candidate, so candidates can't be limited to the length of the query
+	if opts.Scorer == nil {
+		opts.Scorer = HistogramScorer{Slop: histogramMatchSlop, Partial: true}
+	}
+	opts.Experiment = nil
+
+	minTime, maxTime := fp.timeRange()
+	duration := FramesToDuration(int(maxTime - minTime))
+	offset := FramesToDuration(int(minTime))
+
+	var cues []*Cue
+	for start := time.Duration(0); start < duration; start += opts.CueSheet.step() {
+		end := start + opts.CueSheet.window()
+		windowFp := fp.newSegment(offset+start, offset+end)
+		windowFp.clamped = true
+		if len(windowFp.Codes) == 0 {
+			continue
+		}
+
+		matches, _, err := m.Match(windowFp, opts)
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 || !matches[0].Best {
+			glog.V(2).Infof("No best match for window %s-%s", start, end)
+			continue
+		}
+
+		best := matches[0]
+		if last := len(cues) - 1; last >= 0 && cues[last].Match.TrackID == best.TrackID && cues[last].End >= start {
+			cues[last].End = end
+			cues[last].lastWindow = start
+			if best.Confidence > cues[last].Match.Confidence {
+				cues[last].Match = best
+			}
+			continue
+		}
+
+		glog.V(1).Infof("Window %s-%s matched TrackID=%d", start, end, best.TrackID)
+		cues = append(cues, &Cue{Start: start, End: end, Match: best, lastWindow: start})
+	}
+	cues = opts.CueSheet.tidy(cues)
+
+	// the final window may extend past the end of the query
+	if last := len(cues) - 1; last >= 0 && cues[last].End > duration {
+		cues[last].End = duration
+	}
+
+	return cues, nil
+}
@@ -0,0 +1,35 @@
+package echoprint
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// TestCueJSON decodes encoded cues back, times are in seconds
+func TestCueJSON(t *testing.T) {
+	cues := []*Cue{
+		{Start: 1500 * time.Millisecond, End: 30 * time.Second, Match: &MatchResult{TrackID: 1}},
+		{Start: 30 * time.Second, End: 45 * time.Second},
+	}
+
+	data, err := json.Marshal(cues)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded []*Cue
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("decoding %s: %s", data, err)
+	}
+	if len(decoded) != len(cues) {
+		t.Fatalf("%d cues decoded as %d", len(cues), len(decoded))
+	}
+	for i, cue := range cues {
+		if decoded[i].Start != cue.Start || decoded[i].End != cue.End {
+			t.Errorf("cue %s-%s decoded as %s-%s", cue.Start, cue.End, decoded[i].Start, decoded[i].End)
+		}
+		if (decoded[i].Match == nil) != (cue.Match == nil) || cue.Match != nil && decoded[i].Match.TrackID != cue.Match.TrackID {
+			t.Errorf("cue %d match %+v decoded as %+v", i, cue.Match, decoded[i].Match)
+		}
+	}
+}
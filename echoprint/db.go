@@ -1,12 +1,22 @@
+//go:build !js
+// +build !js
+
 package echoprint
 
 import (
+	"crypto/cipher"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"math"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/boltdb/bolt"
@@ -19,63 +29,106 @@ const (
 	maxSolrBooleanTerms = 4096
 )
 
-type dbResult struct {
-	fp         *Fingerprint
-	score      float32
-	ingestedAt string
-}
-
 type dbConnection struct {
 	boltDb   *bolt.DB
 	solrConn *solr.Connection
+
+	// catalog names the database for its encryption key, encrypted is set once the database
+	// holds encrypted values and aead once the key was provided
+	catalog   string
+	encrypted bool
+	aead      cipher.AEAD
 }
 
-var errTrackNotFound = errors.New("Failed to find Track in database")
-var db *dbConnection
+var errCorruptCodeIndex = errors.New("Corrupt code index")
+
+var trackIDSequenceBucket = []byte("track_id_sequence")
+var externalIDsBucket = []byte("external_ids")
+
+// changelogBucket maps the changelog sequence (big endian, so keys sort in order) to the
+// TrackID and variant of every saved fingerprint, for incremental snapshots
+var changelogBucket = []byte("changelog")
 
 // Purge deletes everything from the databases, used for testing
 func Purge() error {
 	DBDisconnect()
 	os.Remove("echoprint.db")
-	db.solrDelete("*:*")
-	db = nil
+	if conn, ok := defaultMatcher.Store.(*dbConnection); ok {
+		conn.solrDelete("*:*")
+	}
+	defaultMatcher.Store = nil
 
 	return DBConnect()
 }
 
-// DBConnect establishes necessary databases connections
+// DBConnect establishes the database connections used by the package level functions
 // TODO: config for db
 func DBConnect() error {
-	var err error
-
-	if db == nil {
-		db = &dbConnection{}
-		db.boltDb, err = bolt.Open("echoprint.db", 0600, &bolt.Options{Timeout: 5 * time.Second})
-		if err != nil {
-			return err
-		}
+	if defaultMatcher.Store != nil {
+		return nil
+	}
 
-		//db.solrConn, err = solr.Init("72.251.236.164", 8983, "echoprint")
-		db.solrConn, err = solr.Init("vagrant-env-platform", 8980, "echoprint")
+	//store, err := NewDBStore("echoprint.db", "72.251.236.164", 8983, "echoprint")
+	store, err := NewDBStore("echoprint.db", "vagrant-env-platform", 8980, "echoprint")
+	if store != nil {
+		defaultMatcher.Store = store
 	}
 
 	return err
 }
 
-// DBDisconnect closes database connections
+// DBDisconnect closes the database connections used by the package level functions
 func DBDisconnect() {
-	if db != nil {
-		db.boltDb.Close()
+	if defaultMatcher.Store != nil {
+		defaultMatcher.Store.Close()
 	}
 }
 
-// Query matches fingerprints against the database that meet the minimum code score
-func (db *dbConnection) query(fp *Fingerprint, start int, rows int, minScore float32) ([]dbResult, error) {
-	t := trackTime("dbConnection.Query")
-	defer t.finish()
+// NewDBStore opens the bolt database at boltPath for fingerprint data and connects to the
+// solr core used to search codes
+func NewDBStore(boltPath string, solrHost string, solrPort int, solrCore string) (Store, error) {
+	conn := &dbConnection{catalog: strings.TrimSuffix(filepath.Base(boltPath), filepath.Ext(boltPath))}
+	var err error
+	conn.boltDb, err = bolt.Open(boltPath, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	conn.boltDb.View(func(tx *bolt.Tx) error {
+		conn.encrypted = tx.Bucket(encryptionBucket) != nil
+		return nil
+	})
+
+	conn.solrConn, err = solr.Init(solrHost, solrPort, solrCore)
+	return conn, err
+}
+
+func (db *dbConnection) Close() error {
+	return db.boltDb.Close()
+}
+
+// solrCursor pages through the solr documents matching a query's codes
+type solrCursor struct {
+	db       *dbConnection
+	querySet map[uint32]struct{}
+	q        string
+	minScore float32
+	filter   *MetadataFilter
+
+	// cursorMark is where the next page starts, solr returns the same mark once exhausted
+	cursorMark string
+	done       bool
+
+	// spans are the times solr and bolt took to serve the last page
+	spans []RetrievalSpan
+}
 
-	glog.V(2).Infof("Querying database rows from %d to %d", start, start+rows)
+func (db *dbConnection) backendName() string {
+	return "solr " + db.solrConn.URL
+}
 
+// candidates returns a cursor over the fingerprints sharing codes with the query in the
+// order of solr's relevance
+func (db *dbConnection) candidates(fp *Fingerprint, minScore float32, filter *MetadataFilter) candidateCursor {
 	// build the unique set of codes for scoring
 	var querySet = make(map[uint32]struct{})
 	for _, code := range fp.Codes {
@@ -98,115 +151,531 @@ func (db *dbConnection) query(fp *Fingerprint, start int, rows int, minScore flo
 		}
 	}
 
-	q := solr.Query{
-		Params: solr.URLParamMap{
-			"q": []string{"codes:" + strings.Join(codeListParams, " ")},
-		},
-		Rows:  rows,
-		Start: start,
+	return &solrCursor{
+		db:         db,
+		querySet:   querySet,
+		q:          "codes:" + strings.Join(codeListParams, " "),
+		minScore:   minScore,
+		filter:     filter,
+		cursorMark: "*",
 	}
+}
+
+// next matches the next rows documents against the database, returning those that meet the
+// minimum code score
+func (c *solrCursor) next(rows int) ([]dbResult, bool, error) {
+	t := trackTime("dbConnection.Query")
+	defer t.finish()
 
-	resp, err := db.solrSelect(&q)
+	if c.done {
+		return nil, false, nil
+	}
+	glog.V(2).Infof("Querying database %d rows from cursor %s", rows, c.cursorMark)
+
+	// the cursor needs the unique key to break ties, documents of the same relevance are
+	// otherwise returned in an order that can change between pages
+	params := url.Values{
+		"q":          {c.q},
+		"fq":         c.filter.solrFilterQueries(),
+		"rows":       {strconv.Itoa(rows)},
+		"sort":       {"score desc,id asc"},
+		"cursorMark": {c.cursorMark},
+	}
+
+	selectStart := time.Now()
+	page, err := c.db.solrSelectCursor(params)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
+	docs := page.Response.Docs
+	c.done = len(docs) < rows || page.NextCursorMark == c.cursorMark
+	c.cursorMark = page.NextCursorMark
+
+	glog.V(1).Infof("Solr Matched %d documents in %dms", len(docs), page.ResponseHeader.QTime)
+	loadStart := time.Now()
+	c.spans = []RetrievalSpan{{
+		Backend:    c.db.backendName(),
+		Operation:  "select",
+		Results:    len(docs),
+		Elapsed:    loadStart.Sub(selectStart),
+		ServerTime: time.Duration(page.ResponseHeader.QTime) * time.Millisecond,
+	}}
+
+	// the candidates are loaded in a single transaction so the query sees a consistent snapshot
+	// while ingests proceed, documents whose data isn't committed yet are skipped
+	var results []dbResult
+	err = c.db.boltDb.View(func(tx *bolt.Tx) error {
+		for _, doc := range docs {
+			var variant uint32
+			if v, ok := doc["variant"].(float64); ok {
+				variant = uint32(v)
+			}
+
+			fp, err := c.db.loadTx(tx, uint32(doc["trackId"].(float64)), variant)
+			if err == ErrTrackNotFound {
+				glog.V(2).Infof("DB Match not committed yet, skipping TrackID=%v", doc["trackId"])
+				continue
+			} else if err != nil {
+				return err
+			}
+
+			// tracks indexed before the filterable fields were added pass the solr filter
+			// queries, they are filtered on their stored metadata
+			if !c.filter.allows(fp.Meta) {
+				glog.V(3).Infof("DB Match excluded by metadata filter, Meta=%+v", fp.Meta)
+				continue
+			}
+
+			result := dbResult{
+				fp:         fp,
+				ingestedAt: doc["ingestedAt"].(string),
+			}
+
+			// construct a unique array of codepoints on the matching fp to calculate the code score
+			matchSet := make(map[uint32]struct{})
+			for _, code := range result.fp.Codes {
+				matchSet[code] = struct{}{}
+			}
+
+			result.score = calculateCodeScore(c.querySet, matchSet)
+			if result.score >= c.minScore {
+				glog.V(2).Infof("DB Match above minimum threshold, Score=%f, Meta=%+v", result.score, fp.Meta)
+				results = append(results, result)
+			} else {
+				glog.V(3).Infof("DB Match below minimum threshold, Score=%f, Meta=%+v", result.score, fp.Meta)
+			}
+		}
+		return nil
+	})
+	c.spans = append(c.spans, RetrievalSpan{Backend: "bolt " + c.db.boltDb.Path(), Operation: "load", Results: len(results), Elapsed: time.Since(loadStart)})
+
+	return results, !c.done, err
+}
 
-	glog.V(1).Infof("Solr Matched %d documents in %dms", resp.Results.Len(), resp.QTime)
+func (c *solrCursor) lastSpans() []RetrievalSpan {
+	return c.spans
+}
 
-	var results []dbResult
-	for i := 0; i < resp.Results.Len(); i++ {
-		doc := resp.Results.Get(i)
-		fp, err := db.load(uint32(doc.Field("trackId").(float64)))
+// save stores the fingerprint in the database for matching
+func (db *dbConnection) save(fp *Fingerprint) error {
+	t := trackTime("dbConnection.save")
+	defer t.finish()
+
+	trackIDKey := make([]byte, 4)
+	binary.LittleEndian.PutUint32(trackIDKey, fp.Meta.TrackID)
+
+	// the fingerprint data is committed before the solr document, so a query never finds a
+	// document without its data. Creating the track bucket also guards against concurrent
+	// ingests of the same TrackID, and new variants are numbered in the same transaction
+	err := db.boltDb.Update(func(tx *bolt.Tx) error {
+		if fp.newVariant {
+			fp.variant = variantCount(tx.Bucket(trackIDKey))
+		}
+		if fp.variant == 0 && tx.Bucket(trackIDKey) != nil {
+			return ErrTrackIDExists
+		}
+
+		b, err := tx.CreateBucketIfNotExists(trackIDKey)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
-		result := dbResult{
-			fp:         fp,
-			ingestedAt: doc.Field("ingestedAt").(string),
+		// additional fingerprints of the track share its metadata
+		if fp.variant > 0 {
+			if b.Bucket(variantKey(fp.variant)) != nil {
+				return ErrTrackIDExists
+			}
+			vb, err := b.CreateBucket(variantKey(fp.variant))
+			if err != nil {
+				return err
+			}
+
+			if err := logChange(tx, fp.Meta.TrackID, fp.variant); err != nil {
+				return err
+			}
+			return db.putAll(vb, valueAAD(trackIDKey, fp.variant), map[string][]byte{
+				"codes":      uint32ArrayToBytes(fp.Codes),
+				"times":      uint32ArrayToBytes(fp.Times),
+				"code_index": codeIndexToBytes(newCodeIndex(fp)),
+				"sparsity":   optionalUint32(fp.sparsity > 1, fp.sparsity),
+			})
 		}
 
-		// construct a unique array of codepoints on the matching fp to calculate the code score
-		matchSet := make(map[uint32]struct{})
-		for _, code := range result.fp.Codes {
-			matchSet[code] = struct{}{}
+		if err := logChange(tx, fp.Meta.TrackID, fp.variant); err != nil {
+			return err
 		}
 
-		result.score = calculateCodeScore(querySet, matchSet)
-		if result.score >= minScore {
-			glog.V(2).Infof("DB Match above minimum threshold, Score=%f, Meta=%+v", result.score, fp.Meta)
-			results = append(results, result)
-		} else {
-			glog.V(3).Infof("DB Match below minimum threshold, Score=%f, Meta=%+v", result.score, fp.Meta)
+		values := map[string][]byte{
+			"codes":      uint32ArrayToBytes(fp.Codes),
+			"times":      uint32ArrayToBytes(fp.Times),
+			"code_index": codeIndexToBytes(newCodeIndex(fp)),
+			"version":    float64ToBytes(fp.Meta.Version),
+			"upc":        []byte(fp.Meta.UPC),
+			"isrc":       []byte(fp.Meta.ISRC),
+			"filename":   []byte(fp.Meta.Filename),
+			"duration":   float64ToBytes(fp.Meta.Duration),
+			"bitrate":    float64ToBytes(fp.Meta.Bitrate),
+			"quality":    []byte(fp.storedQuality()),
+			"sparsity":   optionalUint32(fp.sparsity > 1, fp.sparsity),
+		}
+		if len(fp.Meta.Tags) > 0 {
+			if values["tags"], err = json.Marshal(fp.Meta.Tags); err != nil {
+				return err
+			}
+		}
+		if fp.Meta.ExternalID != "" {
+			values["external_id"] = []byte(fp.Meta.ExternalID)
+			ids, err := tx.CreateBucketIfNotExists(externalIDsBucket)
+			if err != nil {
+				return err
+			}
+			if err := ids.Put([]byte(fp.Meta.ExternalID), trackIDKey); err != nil {
+				return err
+			}
+		}
+		if fp.Meta.SegmentEnd > 0 {
+			values["parent_track_id"] = uint32ToBytes(fp.Meta.ParentTrackID)
+			values["segment_start"] = float64ToBytes(fp.Meta.SegmentStart)
+			values["segment_end"] = float64ToBytes(fp.Meta.SegmentEnd)
 		}
+		return db.putAll(b, valueAAD(trackIDKey, 0), values)
+	})
+	if err != nil {
+		return err
 	}
 
-	return results, nil
-}
-
-// save stores the fingerprint in the database for matching
-func (db *dbConnection) save(fp *Fingerprint) error {
-	t := trackTime("dbConnection.save")
-	defer t.finish()
-
 	doc := map[string]interface{}{
 		"add": []interface{}{
-			map[string]interface{}{"trackId": fp.Meta.TrackID, "codes": fp.Codes},
+			map[string]interface{}{
+				"id":      solrDocID(fp.Meta.TrackID, fp.variant),
+				"trackId": fp.Meta.TrackID,
+				"variant": fp.variant,
+				"codes":   fp.indexedCodes(),
+				"upc":     fp.Meta.UPC,
+				"tags":    solrTags(fp.Meta.Tags),
+				"quality": fp.storedQuality(),
+			},
 		},
 	}
 
-	err := db.solrUpdate(doc, false)
+	if err = db.solrUpdate(doc, false); err != nil {
+		db.boltDb.Update(func(tx *bolt.Tx) error {
+			if fp.variant > 0 {
+				return tx.Bucket(trackIDKey).DeleteBucket(variantKey(fp.variant))
+			}
+			if ids := tx.Bucket(externalIDsBucket); ids != nil && fp.Meta.ExternalID != "" {
+				ids.Delete([]byte(fp.Meta.ExternalID))
+			}
+			return tx.DeleteBucket(trackIDKey)
+		})
+	}
+
+	return err
+}
+
+// logChange appends the fingerprint to the changelog
+func logChange(tx *bolt.Tx, trackID, variant uint32) error {
+	b, err := tx.CreateBucketIfNotExists(changelogBucket)
+	if err != nil {
+		return err
+	}
+	seq, err := b.NextSequence()
 	if err != nil {
 		return err
 	}
 
-	trackIDKey := make([]byte, 4)
-	binary.LittleEndian.PutUint32(trackIDKey, fp.Meta.TrackID)
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return b.Put(key, append(uint32ToBytes(trackID), uint32ToBytes(variant)...))
+}
 
-	err = db.boltDb.Update(func(tx *bolt.Tx) error {
-		b, err := tx.CreateBucketIfNotExists(trackIDKey)
-		if err != nil {
-			return err
+// changesSince returns the fingerprints saved after the changelog sequence
+func (db *dbConnection) changesSince(sequence uint64) ([]fingerprintKey, uint64, error) {
+	var changes []fingerprintKey
+	var current uint64
+	err := db.boltDb.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(changelogBucket)
+		if b == nil {
+			return nil
+		}
+		current = b.Sequence()
+		if sequence >= current {
+			return nil
 		}
 
-		err = b.Put([]byte("codes"), uint32ArrayToBytes(fp.Codes))
-		err = b.Put([]byte("times"), uint32ArrayToBytes(fp.Times))
-		err = b.Put([]byte("version"), float64ToBytes(fp.Meta.Version))
-		err = b.Put([]byte("upc"), []byte(fp.Meta.UPC))
-		err = b.Put([]byte("isrc"), []byte(fp.Meta.ISRC))
-		err = b.Put([]byte("filename"), []byte(fp.Meta.Filename))
-		return err
+		start := make([]byte, 8)
+		binary.BigEndian.PutUint64(start, sequence+1)
+		c := b.Cursor()
+		for k, v := c.Seek(start); k != nil; k, v = c.Next() {
+			changes = append(changes, fingerprintKey{
+				trackID: binary.LittleEndian.Uint32(v[:4]),
+				variant: binary.LittleEndian.Uint32(v[4:]),
+			})
+		}
+		return nil
 	})
 
-	if err != nil {
-		db.solrDeleteTrack(fp.Meta.TrackID)
-	}
+	return changes, current, err
+}
 
-	return err
+func optionalUint32(ok bool, i uint32) []byte {
+	if !ok {
+		return nil
+	}
+	return uint32ToBytes(i)
 }
 
-func (db *dbConnection) load(trackID uint32) (*Fingerprint, error) {
+func (db *dbConnection) load(trackID uint32, variant uint32) (*Fingerprint, error) {
 	t := trackTime("dbConnection.loadMeta")
 	defer t.finish()
 
-	fp := &Fingerprint{}
+	var fp *Fingerprint
 	err := db.boltDb.View(func(tx *bolt.Tx) error {
+		var err error
+		fp, err = db.loadTx(tx, trackID, variant)
+		return err
+	})
+
+	return fp, err
+}
+
+// loadTx reads a fingerprint within an existing transaction
+func (db *dbConnection) loadTx(tx *bolt.Tx, trackID uint32, variant uint32) (*Fingerprint, error) {
+	fp := &Fingerprint{}
+	trackIDKey := uint32ToBytes(trackID)
+	b := tx.Bucket(trackIDKey)
+	if b == nil {
+		return nil, ErrTrackNotFound
+	}
+	r := &bucketReader{db: db, b: b, aad: valueAAD(trackIDKey, 0)}
+
+	fp.Codes = bytesToUint32Array(r.get("codes"))
+	fp.Times = bytesToUint32Array(r.get("times"))
+	fp.Meta.TrackID = trackID
+	fp.Meta.Version = bytesTofloat64(r.get("version"))
+	fp.Meta.UPC = string(r.get("upc"))
+	fp.Meta.ISRC = string(r.get("isrc"))
+	fp.Meta.Filename = string(r.get("filename"))
+	if duration := r.get("duration"); duration != nil {
+		fp.Meta.Duration = bytesTofloat64(duration)
+	}
+	if bitrate := r.get("bitrate"); bitrate != nil {
+		fp.Meta.Bitrate = bytesTofloat64(bitrate)
+	}
+	fp.quality = string(r.get("quality"))
+	fp.Meta.ExternalID = ExternalID(r.get("external_id"))
+	if sparsity := r.get("sparsity"); sparsity != nil {
+		fp.sparsity = binary.LittleEndian.Uint32(sparsity)
+	}
+	if tags := r.get("tags"); tags != nil {
+		if err := json.Unmarshal(tags, &fp.Meta.Tags); err != nil {
+			return nil, err
+		}
+	}
+	if parentTrackID := r.get("parent_track_id"); parentTrackID != nil {
+		fp.Meta.ParentTrackID = binary.LittleEndian.Uint32(parentTrackID)
+		fp.Meta.SegmentStart = bytesTofloat64(r.get("segment_start"))
+		fp.Meta.SegmentEnd = bytesTofloat64(r.get("segment_end"))
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if err := readCodeIndex(r, fp); err != nil {
+		return nil, err
+	}
+
+	if variant > 0 {
+		vb := b.Bucket(variantKey(variant))
+		if vb == nil {
+			return nil, ErrTrackNotFound
+		}
+		r = &bucketReader{db: db, b: vb, aad: valueAAD(trackIDKey, variant)}
+
+		fp.variant = variant
+		fp.Codes = bytesToUint32Array(r.get("codes"))
+		fp.Times = bytesToUint32Array(r.get("times"))
+		fp.sparsity = 0
+		if sparsity := r.get("sparsity"); sparsity != nil {
+			fp.sparsity = binary.LittleEndian.Uint32(sparsity)
+		}
+		if r.err != nil {
+			return nil, r.err
+		}
+		if err := readCodeIndex(r, fp); err != nil {
+			return nil, err
+		}
+	}
+
+	return fp, nil
+}
+
+// readCodeIndex reads the code index saved with the fingerprint, fingerprints saved before
+// code indexes were stored are left without one
+func readCodeIndex(r *bucketReader, fp *Fingerprint) error {
+	fp.codeIndex = nil
+	data := r.get("code_index")
+	if r.err != nil || data == nil {
+		return r.err
+	}
+
+	idx, err := bytesToCodeIndex(data, fp)
+	if err != nil {
+		return err
+	}
+	fp.codeIndex = idx
+	return nil
+}
+
+// setQuality stores the quality tier with the track and reindexes its solr documents, which
+// are rebuilt from the stored codes as the codes field isn't stored in solr. The track is
+// logged as changed so deltas carry the tier
+func (db *dbConnection) setQuality(trackID uint32, quality string) error {
+	var docs []interface{}
+	err := db.boltDb.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket(uint32ToBytes(trackID))
 		if b == nil {
-			return errTrackNotFound
+			return ErrTrackNotFound
+		}
+		if err := db.put(b, valueAAD(uint32ToBytes(trackID), 0), "quality", []byte(quality)); err != nil {
+			return err
+		}
+		if err := logChange(tx, trackID, 0); err != nil {
+			return err
+		}
+
+		for variant := uint32(0); ; variant++ {
+			fp, err := db.loadTx(tx, trackID, variant)
+			if err == ErrTrackNotFound {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			docs = append(docs, map[string]interface{}{
+				"id":      solrDocID(trackID, variant),
+				"trackId": trackID,
+				"variant": variant,
+				"codes":   fp.indexedCodes(),
+				"upc":     fp.Meta.UPC,
+				"tags":    solrTags(fp.Meta.Tags),
+				"quality": quality,
+			})
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	// keep the original ingest times, the documents would otherwise default to now
+	resp, err := db.solrSelect(&solr.Query{
+		Params: solr.URLParamMap{"q": []string{"trackId:" + strconv.Itoa(int(trackID))}},
+		Rows:   len(docs),
+	})
+	if err != nil {
+		return err
+	}
+	ingestedAt := make(map[string]interface{})
+	for i := 0; i < resp.Results.Len(); i++ {
+		doc := resp.Results.Get(i)
+		if id, ok := doc.Field("id").(string); ok {
+			ingestedAt[id] = doc.Field("ingestedAt")
+		}
+	}
+	for _, doc := range docs {
+		doc := doc.(map[string]interface{})
+		if t, ok := ingestedAt[doc["id"].(string)]; ok {
+			doc["ingestedAt"] = t
 		}
+	}
+
+	return db.solrUpdate(map[string]interface{}{"add": docs}, false)
+}
+
+// trackIDs returns the TrackIDs of every stored track
+func (db *dbConnection) trackIDs() ([]uint32, error) {
+	var trackIDs []uint32
+	err := db.boltDb.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			// track buckets are keyed by the 4 byte TrackID, the others are named
+			if len(name) == 4 {
+				trackIDs = append(trackIDs, binary.LittleEndian.Uint32(name))
+			}
+			return nil
+		})
+	})
+
+	return trackIDs, err
+}
 
-		fp.Codes = bytesToUint32Array(b.Get([]byte("codes")))
-		fp.Times = bytesToUint32Array(b.Get([]byte("times")))
-		fp.Meta.TrackID = trackID
-		fp.Meta.Version = bytesTofloat64(b.Get([]byte("version")))
-		fp.Meta.UPC = string(b.Get([]byte("upc")))
-		fp.Meta.ISRC = string(b.Get([]byte("isrc")))
-		fp.Meta.Filename = string(b.Get([]byte("filename")))
+// trackIDForExternalID returns the TrackID an external ID was ingested under, 0 if it doesn't exist
+func (db *dbConnection) trackIDForExternalID(id ExternalID) (uint32, error) {
+	var trackID uint32
+	err := db.boltDb.View(func(tx *bolt.Tx) error {
+		if ids := tx.Bucket(externalIDsBucket); ids != nil {
+			if v := ids.Get([]byte(id)); v != nil {
+				trackID = binary.LittleEndian.Uint32(v)
+			}
+		}
 		return nil
 	})
 
-	return fp, err
+	return trackID, err
+}
+
+// allocateTrackID returns the next unused TrackID from the database sequence
+func (db *dbConnection) allocateTrackID() (uint32, error) {
+	var trackID uint32
+	err := db.boltDb.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(trackIDSequenceBucket)
+		if err != nil {
+			return err
+		}
+
+		// skip over any ids that were provided by clients
+		for {
+			seq, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			if seq > math.MaxUint32 {
+				return errors.New("TrackID sequence exhausted")
+			}
+
+			trackID = uint32(seq)
+			if tx.Bucket(uint32ToBytes(trackID)) == nil {
+				return nil
+			}
+		}
+	})
+
+	return trackID, err
+}
+
+// nextVariant returns the variant number the next fingerprint of a track should be stored under
+func (db *dbConnection) nextVariant(trackID uint32) (uint32, error) {
+	var variant uint32
+	err := db.boltDb.View(func(tx *bolt.Tx) error {
+		variant = variantCount(tx.Bucket(uint32ToBytes(trackID)))
+		return nil
+	})
+
+	return variant, err
+}
+
+// variantCount returns the number of fingerprints stored in a track's bucket, 0 when nil
+func variantCount(b *bolt.Bucket) uint32 {
+	if b == nil {
+		return 0
+	}
+
+	variant := uint32(1)
+	b.ForEach(func(k, v []byte) error {
+		// nested buckets have no value
+		if v == nil {
+			variant++
+		}
+		return nil
+	})
+	return variant
 }
 
 func (db *dbConnection) checkTrackExists(trackID uint32) (bool, error) {
@@ -224,6 +693,23 @@ func (db *dbConnection) solrDeleteTrack(trackID uint32) error {
 	return db.solrDelete("trackId:" + strconv.Itoa(int(trackID)))
 }
 
+func (db *dbConnection) solrDeleteID(id string) error {
+	return db.solrDelete("id:\"" + id + "\"")
+}
+
+// solrDocID is the unique key of a fingerprint's solr document, the first fingerprint of a
+// track is keyed by the TrackID alone
+func solrDocID(trackID uint32, variant uint32) string {
+	if variant == 0 {
+		return strconv.Itoa(int(trackID))
+	}
+	return strconv.Itoa(int(trackID)) + "." + strconv.Itoa(int(variant))
+}
+
+func variantKey(variant uint32) []byte {
+	return append([]byte("variant"), uint32ToBytes(variant)...)
+}
+
 func (db *dbConnection) solrDelete(q string) error {
 	doc := map[string]interface{}{
 		"delete": map[string]interface{}{
@@ -236,7 +722,9 @@ func (db *dbConnection) solrDelete(q string) error {
 
 func (db *dbConnection) solrUpdate(document map[string]interface{}, commit bool) (err error) {
 	resp, err := db.solrConn.Update(document, commit)
-	if err == nil && !resp.Success {
+	if err != nil {
+		err = &BackendError{err}
+	} else if !resp.Success {
 		err = errors.New(resp.String())
 	}
 
@@ -245,27 +733,103 @@ func (db *dbConnection) solrUpdate(document map[string]interface{}, commit bool)
 
 func (db *dbConnection) solrSelect(q *solr.Query) (resp *solr.SelectResponse, err error) {
 	resp, err = db.solrConn.Select(q)
-	if err == nil && resp.Status != 0 {
+	if err != nil {
+		err = &BackendError{err}
+	} else if resp.Status != 0 {
 		err = errors.New("Solr select() failed")
 	}
 
 	return
 }
 
-// calculateCodeScore does a basic intersection on the unique code values
-// to determine if we should even consider it for a histogram match
-func calculateCodeScore(qSet, mSet map[uint32]struct{}) float32 {
-	t := trackTime("calculateCodeScore")
-	defer t.finish()
+// solrTransport pools the connections of the cursor queries to solr, apart from the default
+// transport shared by every other client
+var solrTransport = newSolrTransport(64)
 
-	var count int
-	for code := range qSet {
-		if _, ok := mSet[code]; ok {
-			count++
-		}
+// solrClient sends the cursor queries
+var solrClient = &http.Client{Transport: solrTransport}
+
+// solrConns counts the connections the cursor queries opened and reused
+var solrConns struct {
+	opened int64
+	reused int64
+}
+
+func newSolrTransport(maxIdleConns int) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = maxIdleConns
+	transport.MaxIdleConnsPerHost = maxIdleConns
+	return transport
+}
+
+// SetSolrMaxIdleConns sets the idle keep-alive connections kept open to solr, the default
+// transport only keeps 2 per host and concurrent queries would mostly reconnect. Call it
+// before connecting
+func SetSolrMaxIdleConns(n int) {
+	solrTransport.MaxIdleConns = n
+	solrTransport.MaxIdleConnsPerHost = n
+}
+
+// SolrConnStats are the connections the candidate queries opened to solr and reused from the
+// idle pool
+type SolrConnStats struct {
+	Opened int64 `json:"opened"`
+	Reused int64 `json:"reused"`
+}
+
+// SolrConnectionStats returns the solr connection counters
+func SolrConnectionStats() SolrConnStats {
+	return SolrConnStats{Opened: atomic.LoadInt64(&solrConns.opened), Reused: atomic.LoadInt64(&solrConns.reused)}
+}
+
+// countSolrConn is the httptrace hook counting the pooled connections
+func countSolrConn(info httptrace.GotConnInfo) {
+	if info.Reused {
+		atomic.AddInt64(&solrConns.reused, 1)
+	} else {
+		atomic.AddInt64(&solrConns.opened, 1)
 	}
+}
 
-	return float32(count) / float32(len(qSet)) * 100.00
+// solrPage is a page of the documents selected by a cursor query
+type solrPage struct {
+	ResponseHeader struct {
+		Status int `json:"status"`
+		QTime  int `json:"QTime"`
+	} `json:"responseHeader"`
+	Response struct {
+		NumFound int                      `json:"numFound"`
+		Docs     []map[string]interface{} `json:"docs"`
+	} `json:"response"`
+	NextCursorMark string `json:"nextCursorMark"`
+}
+
+// solrSelectCursor selects a page of a cursor query, the solr client doesn't return the
+// cursor mark of the next page
+func (db *dbConnection) solrSelectCursor(params url.Values) (*solrPage, error) {
+	req, err := http.NewRequest("GET", db.solrConn.URL+"/select?wt=json&"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{GotConn: countSolrConn}))
+	resp, err := solrClient.Do(req)
+	if err != nil {
+		return nil, &BackendError{err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("Solr select() failed: " + resp.Status)
+	}
+	var page solrPage
+	if err := json.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return nil, &BackendError{err}
+	}
+	if page.ResponseHeader.Status != 0 {
+		return nil, errors.New("Solr select() failed")
+	}
+
+	return &page, nil
 }
 
 func uint32ToBytes(i uint32) []byte {
@@ -302,3 +866,36 @@ func bytesToUint32Array(bytes []byte) []uint32 {
 	}
 	return data
 }
+
+// codeIndexToBytes encodes the index as the number of unique codes followed by its codes, starts
+// and positions, the times are rebuilt from the fingerprint when it is loaded
+func codeIndexToBytes(idx *codeIndex) []byte {
+	values := make([]uint32, 0, len(idx.codes)+len(idx.starts)+len(idx.positions))
+	values = append(append(append(values, idx.codes...), idx.starts...), idx.positions...)
+	return append(uint32ToBytes(uint32(len(idx.codes))), uint32ArrayToBytes(values)...)
+}
+
+// bytesToCodeIndex decodes the index of the fingerprint
+func bytesToCodeIndex(bytes []byte, fp *Fingerprint) (*codeIndex, error) {
+	if len(bytes) < 4 || len(bytes)%4 != 0 {
+		return nil, errCorruptCodeIndex
+	}
+	unique := int(binary.LittleEndian.Uint32(bytes))
+	values := bytesToUint32Array(bytes[4:])
+	if len(values) != 2*unique+1+len(fp.Codes) {
+		return nil, errCorruptCodeIndex
+	}
+
+	idx := &codeIndex{
+		codes:     values[:unique],
+		starts:    values[unique : 2*unique+1],
+		positions: values[2*unique+1:],
+	}
+	for _, pos := range idx.positions {
+		if int(pos) >= len(fp.Times) {
+			return nil, errCorruptCodeIndex
+		}
+	}
+	idx.fillTimes(fp.Times)
+	return idx, nil
+}
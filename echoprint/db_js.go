@@ -0,0 +1,21 @@
+package echoprint
+
+// WebAssembly builds have no solr or bolt, fingerprints are kept in an in-memory index
+
+// Purge deletes everything from the index
+func Purge() error {
+	UseMemoryStore()
+	return nil
+}
+
+// DBConnect creates the in-memory index
+func DBConnect() error {
+	if defaultMatcher.Store == nil {
+		UseMemoryStore()
+	}
+	return nil
+}
+
+// DBDisconnect is a no-op for the in-memory index
+func DBDisconnect() {
+}
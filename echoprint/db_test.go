@@ -0,0 +1,51 @@
+package echoprint
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/rtt/Go-Solr"
+)
+
+// TestSolrCursor pages through the candidates with solr's cursor marks rather than offsets
+func TestSolrCursor(t *testing.T) {
+	pages := map[string]string{
+		"*": `{"response":{"numFound":3,"docs":[{"trackId":1},{"trackId":2}]},"nextCursorMark":"a"}`,
+		"a": `{"response":{"numFound":3,"docs":[{"trackId":3}]},"nextCursorMark":"b"}`,
+	}
+	var marks []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("start") != "" || query.Get("sort") != "score desc,id asc" {
+			t.Errorf("select %s isn't a cursor query", r.URL.RawQuery)
+		}
+		marks = append(marks, query.Get("cursorMark"))
+		w.Write([]byte(pages[query.Get("cursorMark")]))
+	}))
+	defer server.Close()
+
+	boltDb, err := bolt.Open(filepath.Join(t.TempDir(), "echoprint.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer boltDb.Close()
+	db := &dbConnection{boltDb: boltDb, solrConn: &solr.Connection{URL: server.URL}}
+
+	before := SolrConnectionStats()
+	c := db.candidates(&Fingerprint{Codes: []uint32{1, 2, 3}, Times: []uint32{0, 1, 2}}, 0, nil)
+	for more := true; more; {
+		if _, more, err = c.next(2); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !reflect.DeepEqual(marks, []string{"*", "a"}) {
+		t.Errorf("selected from cursor marks %v", marks)
+	}
+	if after := SolrConnectionStats(); after.Opened+after.Reused != before.Opened+before.Reused+2 {
+		t.Errorf("counted %+v connections after %+v for 2 pages", after, before)
+	}
+}
@@ -0,0 +1,67 @@
+package echoprint
+
+import (
+	"github.com/golang/glog"
+)
+
+const (
+	defaultDepthPageSize  = 50
+	defaultDepthKneeRatio = 0.5
+)
+
+// AdaptiveDepth fetches candidates from the store in pages instead of a fixed number of rows by
+// quality. Fetching stops at the knee point where a page's best screening score falls below
+// KneeRatio of the top candidate's, as the candidates beyond it are very unlikely to match
+type AdaptiveDepth struct {
+	// PageSize is the number of candidates fetched per page, defaults to 50
+	PageSize int
+	// MaxRows bounds the candidates fetched, defaults to the fixed search depth for the quality
+	MaxRows int
+	// KneeRatio of the top screening score ends the search, defaults to 0.5
+	KneeRatio float32
+}
+
+// fetch pages through the candidates until the knee point, returning the candidates and the
+// number of pages fetched
+func (d *AdaptiveDepth) fetch(cursor candidateCursor, maxRows int) ([]dbResult, int, error) {
+	pageSize := orDefaultInt(d.PageSize, defaultDepthPageSize)
+	maxRows = orDefaultInt(d.MaxRows, maxRows)
+	kneeRatio := orDefault(d.KneeRatio, defaultDepthKneeRatio)
+
+	var results []dbResult
+	var topScore float32
+	var pages int
+	for start := 0; start < maxRows; start += pageSize {
+		rows := pageSize
+		if start+rows > maxRows {
+			rows = maxRows - start
+		}
+
+		page, more, err := cursor.next(rows)
+		if err != nil {
+			return nil, pages, err
+		}
+		pages++
+		results = append(results, page...)
+
+		var pageScore float32
+		for _, r := range page {
+			if r.score > pageScore {
+				pageScore = r.score
+			}
+		}
+		if !more {
+			break
+		}
+		if pageScore > topScore {
+			topScore = pageScore
+		} else if pageScore < topScore*kneeRatio {
+			// pages without a single candidate above the minimum score fall below any knee
+			glog.V(2).Infof("Screening scores fell to %f%% of the top %f%% after %d pages, stopping", pageScore, topScore, pages)
+			break
+		}
+	}
+	glog.V(2).Infof("Fetched %d candidates in %d pages", len(results), pages)
+
+	return results, pages, nil
+}
@@ -0,0 +1,168 @@
+//go:build !js
+// +build !js
+
+package echoprint
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+var detectionsBucket = []byte("detections")
+
+// DetectionStore persists the detections made by the stream Monitor for rights reporting
+type DetectionStore struct {
+	db *bolt.DB
+}
+
+// PlayCount is the number of detections for a track, stream and/or day depending on the report
+type PlayCount struct {
+	Day      string `json:"day,omitempty"`
+	TrackID  uint32 `json:"track_id,omitempty"`
+	StreamID string `json:"stream_id,omitempty"`
+	Plays    int    `json:"plays"`
+}
+
+// NewDetectionStore opens (or creates) the bolt database at path for storing detections
+func NewDetectionStore(path string) (*DetectionStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(detectionsBucket)
+		return err
+	})
+
+	return &DetectionStore{db: db}, err
+}
+
+// detectionKey orders detections by start time, the stream ID keeps them unique
+func detectionKey(start time.Time, streamID string) []byte {
+	key := make([]byte, 8, 8+len(streamID))
+	binary.BigEndian.PutUint64(key, uint64(start.UnixNano()))
+	return append(key, streamID...)
+}
+
+// Save stores a detection
+func (s *DetectionStore) Save(d *Detection) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(detectionsBucket).Put(detectionKey(d.Start, d.StreamID), data)
+	})
+}
+
+// List returns the detections that started within [from, to), optionally limited to a stream
+func (s *DetectionStore) List(from, to time.Time, streamID string) ([]*Detection, error) {
+	var detections []*Detection
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(detectionsBucket).Cursor()
+		end := detectionKey(to, "")
+
+		for k, v := c.Seek(detectionKey(from, "")); k != nil && string(k) < string(end); k, v = c.Next() {
+			d := &Detection{}
+			if err := json.Unmarshal(v, d); err != nil {
+				return err
+			}
+			if streamID == "" || d.StreamID == streamID {
+				detections = append(detections, d)
+			}
+		}
+		return nil
+	})
+
+	return detections, err
+}
+
+// Purge deletes the detections that started within [from, to), optionally limited to a
+// stream, returning how many were deleted. A zero from or to is unbounded
+func (s *DetectionStore) Purge(from, to time.Time, streamID string) (int, error) {
+	var purged int
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(detectionsBucket)
+		c := b.Cursor()
+
+		k, v := c.First()
+		if !from.IsZero() {
+			k, v = c.Seek(detectionKey(from, ""))
+		}
+
+		end := detectionKey(to, "")
+		var keys [][]byte
+		for ; k != nil && (to.IsZero() || string(k) < string(end)); k, v = c.Next() {
+			if streamID != "" {
+				d := &Detection{}
+				if err := json.Unmarshal(v, d); err != nil {
+					return err
+				}
+				if d.StreamID != streamID {
+					continue
+				}
+			}
+			keys = append(keys, append([]byte(nil), k...))
+		}
+
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		purged = len(keys)
+		return nil
+	})
+
+	return purged, err
+}
+
+// Close closes the underlying database
+func (s *DetectionStore) Close() error {
+	return s.db.Close()
+}
+
+// PlaysPerTrackPerDay counts the detections of each track on each (UTC) day
+func PlaysPerTrackPerDay(detections []*Detection) []PlayCount {
+	return countPlays(detections, func(d *Detection) PlayCount {
+		return PlayCount{Day: d.Start.UTC().Format("2006-01-02"), TrackID: d.TrackID}
+	})
+}
+
+// PlaysPerStream counts the detections of each track on each stream
+func PlaysPerStream(detections []*Detection) []PlayCount {
+	return countPlays(detections, func(d *Detection) PlayCount {
+		return PlayCount{StreamID: d.StreamID, TrackID: d.TrackID}
+	})
+}
+
+func countPlays(detections []*Detection, key func(*Detection) PlayCount) []PlayCount {
+	counts := make(map[PlayCount]int)
+	for _, d := range detections {
+		counts[key(d)]++
+	}
+
+	plays := make([]PlayCount, 0, len(counts))
+	for pc, count := range counts {
+		pc.Plays = count
+		plays = append(plays, pc)
+	}
+
+	sort.Slice(plays, func(i, j int) bool {
+		a, b := plays[i], plays[j]
+		if a.Day != b.Day {
+			return a.Day < b.Day
+		}
+		if a.StreamID != b.StreamID {
+			return a.StreamID < b.StreamID
+		}
+		return a.TrackID < b.TrackID
+	})
+	return plays
+}
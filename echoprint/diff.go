@@ -0,0 +1,132 @@
+package echoprint
+
+import (
+	"sort"
+)
+
+// DiffOptions controls how two catalogs are compared by DiffCatalogs
+type DiffOptions struct {
+	// Samples is the number of tracks present in both catalogs that are queried against
+	// both, spread evenly over the TrackIDs. 0 only compares the inventories
+	Samples int
+	// Match are the options the sampled queries are matched with
+	Match MatchOptions
+}
+
+// DiffReport is the result of comparing two catalogs, A being the reference (e.g. the
+// backend being migrated from) and B the catalog being validated
+type DiffReport struct {
+	TracksA int `json:"tracks_a"`
+	TracksB int `json:"tracks_b"`
+
+	// MissingFromA are the TrackIDs only stored in B, MissingFromB those only stored in A
+	MissingFromA []uint32 `json:"missing_from_a"`
+	MissingFromB []uint32 `json:"missing_from_b"`
+
+	Sampled       int                `json:"sampled"`
+	Disagreements []DiffDisagreement `json:"disagreements"`
+}
+
+// DiffDisagreement is a sampled track whose best matches differ between the two catalogs, a
+// TrackID of 0 means no best match was found
+type DiffDisagreement struct {
+	TrackID     uint32  `json:"track_id"`
+	MatchA      uint32  `json:"match_a"`
+	MatchB      uint32  `json:"match_b"`
+	ConfidenceA float32 `json:"confidence_a"`
+	ConfidenceB float32 `json:"confidence_b"`
+	Error       string  `json:"error,omitempty"`
+}
+
+// DiffCatalogs compares the track inventories of two matchers' stores and cross queries a
+// sample of the shared tracks against both, reporting where they disagree. It is meant to
+// validate a migration between backends before switching over
+func DiffCatalogs(a, b *Matcher, opts DiffOptions) (*DiffReport, error) {
+	trackIDsA, err := a.Store.trackIDs()
+	if err != nil {
+		return nil, err
+	}
+	trackIDsB, err := b.Store.trackIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &DiffReport{TracksA: len(trackIDsA), TracksB: len(trackIDsB)}
+
+	inB := make(map[uint32]struct{}, len(trackIDsB))
+	for _, trackID := range trackIDsB {
+		inB[trackID] = struct{}{}
+	}
+
+	var shared []uint32
+	for _, trackID := range trackIDsA {
+		if _, ok := inB[trackID]; ok {
+			shared = append(shared, trackID)
+			delete(inB, trackID)
+		} else {
+			report.MissingFromB = append(report.MissingFromB, trackID)
+		}
+	}
+	for trackID := range inB {
+		report.MissingFromA = append(report.MissingFromA, trackID)
+	}
+	sortTrackIDs(report.MissingFromA)
+	sortTrackIDs(report.MissingFromB)
+	sortTrackIDs(shared)
+
+	if opts.Samples <= 0 || len(shared) == 0 {
+		return report, nil
+	}
+
+	step := len(shared) / opts.Samples
+	if step < 1 {
+		step = 1
+	}
+	for i := 0; i < len(shared) && report.Sampled < opts.Samples; i += step {
+		report.Sampled++
+		if d, ok := diffTrack(a, b, shared[i], opts.Match); !ok {
+			report.Disagreements = append(report.Disagreements, d)
+		}
+	}
+
+	return report, nil
+}
+
+// diffTrack queries the track's fingerprint stored in A against both catalogs and reports
+// whether the best matches agree
+func diffTrack(a, b *Matcher, trackID uint32, opts MatchOptions) (DiffDisagreement, bool) {
+	d := DiffDisagreement{TrackID: trackID}
+
+	fp, err := a.Store.load(trackID, 0)
+	if err != nil {
+		d.Error = err.Error()
+		return d, false
+	}
+
+	matchesA, _, err := a.Match(fp, opts)
+	if err != nil {
+		d.Error = err.Error()
+		return d, false
+	}
+	matchesB, _, err := b.Match(fp, opts)
+	if err != nil {
+		d.Error = err.Error()
+		return d, false
+	}
+
+	d.MatchA, d.ConfidenceA = bestMatch(matchesA)
+	d.MatchB, d.ConfidenceB = bestMatch(matchesB)
+
+	return d, d.MatchA == d.MatchB
+}
+
+func bestMatch(matches []*MatchResult) (uint32, float32) {
+	if len(matches) == 0 || !matches[0].Best {
+		return 0, 0
+	}
+	return matches[0].TrackID, matches[0].Confidence
+}
+
+func sortTrackIDs(trackIDs []uint32) {
+	sort.Slice(trackIDs, func(i, j int) bool { return trackIDs[i] < trackIDs[j] })
+}
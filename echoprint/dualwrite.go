@@ -0,0 +1,63 @@
+package echoprint
+
+import (
+	"github.com/golang/glog"
+)
+
+// dualWriteStore serves everything from the primary store while mirroring saves to the
+// secondary, so a new backend can be filled and validated before switching over to it
+type dualWriteStore struct {
+	Store
+	secondary Store
+}
+
+// NewDualWriteStore returns a store that reads from primary and writes to both stores. Saves
+// to the secondary are best effort: failures are logged but never fail the ingest,
+// TrackIDs and variants are always allocated by the primary
+func NewDualWriteStore(primary, secondary Store) Store {
+	return &dualWriteStore{Store: primary, secondary: secondary}
+}
+
+// EnableDualWrite mirrors the ingests of the package level functions to the secondary store
+func EnableDualWrite(secondary Store) {
+	defaultMatcher.Store = NewDualWriteStore(defaultMatcher.Store, secondary)
+}
+
+// backendName is the primary's, candidates are only looked up in the primary
+func (s *dualWriteStore) backendName() string {
+	return storeBackendName(s.Store)
+}
+
+func (s *dualWriteStore) Close() error {
+	if err := s.secondary.Close(); err != nil {
+		glog.Errorf("Closing secondary store failed: %s", err)
+	}
+	return s.Store.Close()
+}
+
+func (s *dualWriteStore) save(fp *Fingerprint) error {
+	if err := s.Store.save(fp); err != nil {
+		return err
+	}
+
+	// the secondary stores the variant the primary numbered
+	secondary := *fp
+	secondary.newVariant = false
+	if err := s.secondary.save(&secondary); err != nil {
+		glog.Errorf("Dual write of TrackID=%d to the secondary store failed: %s", fp.Meta.TrackID, err)
+	}
+
+	return nil
+}
+
+func (s *dualWriteStore) setQuality(trackID uint32, quality string) error {
+	if err := s.Store.setQuality(trackID, quality); err != nil {
+		return err
+	}
+
+	if err := s.secondary.setQuality(trackID, quality); err != nil {
+		glog.Errorf("Dual write of TrackID=%d quality to the secondary store failed: %s", trackID, err)
+	}
+
+	return nil
+}
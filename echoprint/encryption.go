@@ -0,0 +1,224 @@
+//go:build !js
+// +build !js
+
+package echoprint
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/boltdb/bolt"
+	"github.com/golang/glog"
+)
+
+// ErrEncryptionKeyMissing is returned when reading or writing an encrypted database without its key
+var ErrEncryptionKeyMissing = errors.New("Database is encrypted, an encryption key is required")
+
+// ErrWrongEncryptionKey is returned when enabling encryption with a key the database wasn't encrypted with
+var ErrWrongEncryptionKey = errors.New("Encryption key does not match the database")
+
+// ErrUnencryptedDatabase is returned when enabling encryption on a database already holding
+// plaintext tracks, they have to be migrated with a snapshot restore into a new database
+var ErrUnencryptedDatabase = errors.New("Database already holds unencrypted tracks")
+
+// ErrEncryptionUnsupported is returned when enabling encryption on a store without files at rest
+var ErrEncryptionUnsupported = errors.New("Store does not support encryption at rest")
+
+var errCorruptValue = errors.New("Encrypted value is corrupt")
+
+// encryptionBucket holds a value encrypted with the database's key, its presence marks the
+// database as encrypted and decrypting it checks the key
+var encryptionBucket = []byte("encryption")
+
+var keyCheckName = []byte("key_check")
+
+const keyCheck = "echoprint catalog key check"
+
+// KeyProvider returns the AES key (16, 24 or 32 bytes) of a catalog, the catalog being the
+// name of its bolt file without extension
+type KeyProvider func(catalog string) ([]byte, error)
+
+// EnvKeyProvider reads base64 keys from the ECHOPRINT_KEY_<CATALOG> environment variables,
+// e.g. ECHOPRINT_KEY_ECHOPRINT for echoprint.db
+func EnvKeyProvider(catalog string) ([]byte, error) {
+	name := "ECHOPRINT_KEY_" + strings.Map(func(r rune) rune {
+		if 'a' <= r && r <= 'z' {
+			return r - 'a' + 'A'
+		} else if 'A' <= r && r <= 'Z' || '0' <= r && r <= '9' {
+			return r
+		}
+		return '_'
+	}, catalog)
+
+	value := os.Getenv(name)
+	if value == "" {
+		return nil, errors.New("Missing encryption key " + name)
+	}
+	return base64.StdEncoding.DecodeString(value)
+}
+
+// CommandKeyProvider runs the command with the catalog as its argument and reads the base64
+// key from its output, the hook for fetching (or unwrapping) keys from a KMS
+func CommandKeyProvider(command string) KeyProvider {
+	return func(catalog string) ([]byte, error) {
+		output, err := exec.Command(command, catalog).Output()
+		if err != nil {
+			return nil, err
+		}
+		return base64.StdEncoding.DecodeString(string(bytes.TrimSpace(output)))
+	}
+}
+
+// EnableEncryption encrypts the fingerprints of the database connected by DBConnect at rest
+func EnableEncryption(keys KeyProvider) error {
+	db, ok := defaultMatcher.Store.(*dbConnection)
+	if !ok {
+		return ErrEncryptionUnsupported
+	}
+	return db.enableEncryption(keys)
+}
+
+// EnableStoreEncryption encrypts the fingerprints of a store opened by NewDBStore at rest
+func EnableStoreEncryption(s Store, keys KeyProvider) error {
+	db, ok := s.(*dbConnection)
+	if !ok {
+		return ErrEncryptionUnsupported
+	}
+	return db.enableEncryption(keys)
+}
+
+// enableEncryption encrypts every value of the track buckets with AES-GCM using the catalog's
+// key. The bucket names (TrackIDs), the external ID index and the changelog stay readable so
+// tracks can be found, and the solr index is unaffected
+func (db *dbConnection) enableEncryption(keys KeyProvider) error {
+	key, err := keys(db.catalog)
+	if err != nil {
+		return err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+
+	err = db.boltDb.Update(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(encryptionBucket); b != nil {
+			check, err := open(aead, b.Get(keyCheckName), keyCheckName)
+			if err != nil || string(check) != keyCheck {
+				return ErrWrongEncryptionKey
+			}
+			return nil
+		}
+
+		hasTracks := false
+		tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+			hasTracks = hasTracks || len(name) == 4
+			return nil
+		})
+		if hasTracks {
+			return ErrUnencryptedDatabase
+		}
+
+		b, err := tx.CreateBucket(encryptionBucket)
+		if err != nil {
+			return err
+		}
+		check, err := seal(aead, []byte(keyCheck), keyCheckName)
+		if err != nil {
+			return err
+		}
+		return b.Put(keyCheckName, check)
+	})
+	if err != nil {
+		return err
+	}
+
+	db.aead = aead
+	db.encrypted = true
+	glog.Infof("Encrypting catalog %s at rest", db.catalog)
+
+	return nil
+}
+
+// put stores a value of a track bucket, encrypted when the database is
+func (db *dbConnection) put(b *bolt.Bucket, aad []byte, name string, value []byte) error {
+	if db.encrypted {
+		if db.aead == nil {
+			return ErrEncryptionKeyMissing
+		}
+		var err error
+		if value, err = seal(db.aead, value, append(append([]byte(nil), aad...), name...)); err != nil {
+			return err
+		}
+	}
+	return b.Put([]byte(name), value)
+}
+
+// putAll stores every non nil value in the bucket
+func (db *dbConnection) putAll(b *bolt.Bucket, aad []byte, values map[string][]byte) error {
+	for name, value := range values {
+		if value == nil {
+			continue
+		}
+		if err := db.put(b, aad, name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bucketReader reads the values of a track bucket, decrypting them when the database is
+// encrypted. The first error is kept so a fingerprint can be read without checking each value
+type bucketReader struct {
+	db  *dbConnection
+	b   *bolt.Bucket
+	aad []byte
+	err error
+}
+
+func (r *bucketReader) get(name string) []byte {
+	value := r.b.Get([]byte(name))
+	if value == nil || !r.db.encrypted || r.err != nil {
+		return value
+	}
+	if r.db.aead == nil {
+		r.err = ErrEncryptionKeyMissing
+		return nil
+	}
+
+	value, r.err = open(r.db.aead, value, append(append([]byte(nil), r.aad...), name...))
+	return value
+}
+
+// valueAAD binds encrypted values to their track and variant, so values can't be swapped
+// between tracks without failing to decrypt
+func valueAAD(trackIDKey []byte, variant uint32) []byte {
+	return append(append([]byte(nil), trackIDKey...), variantKey(variant)...)
+}
+
+// seal encrypts the value with a random nonce prepended to the ciphertext
+func seal(aead cipher.AEAD, value []byte, aad []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(value)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, value, aad), nil
+}
+
+func open(aead cipher.AEAD, value []byte, aad []byte) ([]byte, error) {
+	if len(value) < aead.NonceSize() {
+		return nil, errCorruptValue
+	}
+	return aead.Open(nil, value[:aead.NonceSize()], value[aead.NonceSize():], aad)
+}
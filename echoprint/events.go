@@ -0,0 +1,157 @@
+package echoprint
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// types of the catalog events
+const (
+	EventIngested       = "ingested"
+	EventQualityUpdated = "quality_updated"
+)
+
+// subscriptionBuffer is the number of events a subscriber may fall behind by before it is
+// dropped, it resumes from the last event it received by subscribing again
+const subscriptionBuffer = 256
+
+// ErrEventsDisabled is returned when subscribing to a Matcher that doesn't publish events
+var ErrEventsDisabled = errors.New("Catalog events are disabled")
+
+// CatalogEvent is a change of the stored catalog. Sequences are assigned by the process
+// publishing the events and restart from 1 with it
+type CatalogEvent struct {
+	Sequence   uint64     `json:"sequence"`
+	Type       string     `json:"type"`
+	TrackID    uint32     `json:"track_id"`
+	Variant    uint32     `json:"variant,omitempty"`
+	ExternalID ExternalID `json:"external_id,omitempty"`
+	Quality    string     `json:"quality,omitempty"`
+	Time       time.Time  `json:"time"`
+}
+
+// eventHub fans the catalog events out to the subscribers, keeping the latest so subscribers
+// that reconnect can catch up on those they missed
+type eventHub struct {
+	mu       sync.Mutex
+	sequence uint64
+	// recent holds the event of each sequence at sequence % len(recent)
+	recent      []CatalogEvent
+	subscribers map[*EventSubscription]struct{}
+}
+
+// EventSubscription receives the catalog events published after it was created
+type EventSubscription struct {
+	// Backlog are the retained events after the sequence subscribed from, to be handled before
+	// those of Events
+	Backlog []CatalogEvent
+	// Missed is set when events after the sequence subscribed from are no longer retained (or
+	// the sequence is from before a restart), the subscriber must resync its copy of the catalog
+	Missed bool
+
+	events chan CatalogEvent
+	hub    *eventHub
+}
+
+// WithEvents publishes catalog events, retaining the latest retain for subscribers catching up
+func WithEvents(retain int) Option {
+	return func(m *Matcher) { m.events = newEventHub(retain) }
+}
+
+// EnableEvents publishes the catalog events of the package level functions
+func EnableEvents(retain int) {
+	defaultMatcher.events = newEventHub(retain)
+}
+
+func newEventHub(retain int) *eventHub {
+	return &eventHub{recent: make([]CatalogEvent, retain), subscribers: make(map[*EventSubscription]struct{})}
+}
+
+// SubscribeEvents subscribes to the catalog events of the package level functions
+func SubscribeEvents(since uint64) (*EventSubscription, error) {
+	return defaultMatcher.SubscribeEvents(since)
+}
+
+// SubscribeEvents subscribes to the catalog events published after the since sequence, 0 for
+// only those published from now on
+func (m *Matcher) SubscribeEvents(since uint64) (*EventSubscription, error) {
+	h := m.events
+	if h == nil {
+		return nil, ErrEventsDisabled
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	sub := &EventSubscription{events: make(chan CatalogEvent, subscriptionBuffer), hub: h}
+	if since > 0 {
+		switch {
+		case since > h.sequence:
+			sub.Missed = true
+		case since < h.sequence:
+			if retained := uint64(len(h.recent)); h.sequence-since > retained {
+				sub.Missed = true
+				since = h.sequence - retained
+			}
+			for sequence := since + 1; sequence <= h.sequence; sequence++ {
+				sub.Backlog = append(sub.Backlog, h.recent[sequence%uint64(len(h.recent))])
+			}
+		}
+	}
+	h.subscribers[sub] = struct{}{}
+
+	return sub, nil
+}
+
+// Events delivers the events, it is closed when the subscriber fell too far behind or the
+// subscription is closed
+func (s *EventSubscription) Events() <-chan CatalogEvent {
+	return s.events
+}
+
+// Close stops the delivery of events
+func (s *EventSubscription) Close() {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	s.hub.unsubscribe(s)
+}
+
+// unsubscribe must be called with the lock held
+func (h *eventHub) unsubscribe(s *EventSubscription) {
+	if _, ok := h.subscribers[s]; ok {
+		delete(h.subscribers, s)
+		close(s.events)
+	}
+}
+
+// publish assigns the event its sequence and sends it to every subscriber
+func (h *eventHub) publish(event CatalogEvent) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.sequence++
+	event.Sequence = h.sequence
+	event.Time = time.Now().UTC()
+
+	if len(h.recent) > 0 {
+		h.recent[h.sequence%uint64(len(h.recent))] = event
+	}
+
+	for sub := range h.subscribers {
+		select {
+		case sub.events <- event:
+		default:
+			h.unsubscribe(sub)
+		}
+	}
+}
+
+// publishSaved publishes the ingest of a stored fingerprint
+func (h *eventHub) publishSaved(fp *Fingerprint) {
+	h.publish(CatalogEvent{Type: EventIngested, TrackID: fp.Meta.TrackID, Variant: fp.variant, ExternalID: fp.Meta.ExternalID, Quality: fp.Quality()})
+}
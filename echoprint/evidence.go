@@ -0,0 +1,87 @@
+package echoprint
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// evidenceVersion prefixes the signed payload, it changes whenever the payload does
+const evidenceVersion = "echoprint-evidence-v1"
+
+// Evidence is a signed statement of what a query matched and when, so detection reports used
+// in licensing disputes can later be shown to be unmodified. Anyone holding the server's
+// public key can check it with Verify
+type Evidence struct {
+	// QueryHash is the hex SHA-256 of the query's codegen code string
+	QueryHash string          `json:"query_hash"`
+	Matches   []EvidenceMatch `json:"matches"`
+	Timestamp time.Time       `json:"timestamp"`
+
+	// KeyID identifies the key that signed the evidence, Signature is the Ed25519 signature
+	KeyID     string `json:"key_id"`
+	Signature []byte `json:"signature"`
+}
+
+// EvidenceMatch is a matched track covered by the signature
+type EvidenceMatch struct {
+	TrackID    uint32  `json:"track_id"`
+	Confidence float32 `json:"confidence"`
+}
+
+// SignEvidence signs the matches found for the codegen query at the given time, results
+// reporting an error matched no track and are left out
+func SignEvidence(key ed25519.PrivateKey, query *CodegenFp, matches []*MatchResult, at time.Time) *Evidence {
+	hash := sha256.Sum256([]byte(query.Code))
+	e := &Evidence{
+		QueryHash: hex.EncodeToString(hash[:]),
+		Matches:   make([]EvidenceMatch, 0, len(matches)),
+		Timestamp: at.UTC(),
+		KeyID:     EvidenceKeyID(key.Public().(ed25519.PublicKey)),
+	}
+	for _, match := range matches {
+		if match.Error != nil {
+			continue
+		}
+		e.Matches = append(e.Matches, EvidenceMatch{match.TrackID, match.Confidence})
+	}
+	e.Signature = ed25519.Sign(key, e.payload())
+
+	return e
+}
+
+// Verify reports whether the evidence was signed by the key and left unmodified since
+func (e *Evidence) Verify(key ed25519.PublicKey) bool {
+	return e.KeyID == EvidenceKeyID(key) && ed25519.Verify(key, e.payload(), e.Signature)
+}
+
+// VerifyQuery reports whether the evidence covers the codegen query
+func (e *Evidence) VerifyQuery(query *CodegenFp) bool {
+	hash := sha256.Sum256([]byte(query.Code))
+	return e.QueryHash == hex.EncodeToString(hash[:])
+}
+
+// EvidenceKeyID is a short fingerprint of a public key, identifying the key after rotations
+func EvidenceKeyID(key ed25519.PublicKey) string {
+	hash := sha256.Sum256(key)
+	return hex.EncodeToString(hash[:8])
+}
+
+// payload is the signed representation of the evidence, a line based format rather than json
+// so it doesn't depend on how an encoder orders fields or formats numbers
+func (e *Evidence) payload() []byte {
+	lines := []string{
+		evidenceVersion,
+		e.KeyID,
+		e.QueryHash,
+		e.Timestamp.UTC().Format(time.RFC3339Nano),
+	}
+	for _, match := range e.Matches {
+		lines = append(lines, strconv.FormatUint(uint64(match.TrackID), 10)+" "+strconv.FormatFloat(float64(match.Confidence), 'f', -1, 32))
+	}
+
+	return []byte(strings.Join(lines, "\n"))
+}
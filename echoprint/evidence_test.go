@@ -0,0 +1,34 @@
+package echoprint
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestSignEvidence signs the tracks matched and leaves the error results out
+func TestSignEvidence(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := &CodegenFp{Code: "eJwrSS0uAQAEXQHB"}
+	matches := []*MatchResult{
+		{TrackID: 7, Confidence: 92},
+		{Error: errors.New("Matching timed out")},
+	}
+
+	e := SignEvidence(private, query, matches, time.Now())
+	if len(e.Matches) != 1 || e.Matches[0] != (EvidenceMatch{7, 92}) {
+		t.Errorf("signed %+v, want only track 7", e.Matches)
+	}
+	if !e.Verify(public) || !e.VerifyQuery(query) {
+		t.Error("evidence doesn't verify")
+	}
+
+	e.Matches = append(e.Matches, EvidenceMatch{0, 0})
+	if e.Verify(public) {
+		t.Error("evidence verifies with a match added")
+	}
+}
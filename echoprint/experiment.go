@@ -0,0 +1,114 @@
+package echoprint
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Experiment runs an alternative Scorer and/or set of thresholds in shadow mode against a
+// sample of production queries. The differences in results and latency are logged, the
+// shadow results never affect the response
+type Experiment struct {
+	Name string
+	// SampleRate is the fraction (0-1) of queries that are also run through the experiment
+	SampleRate float64
+	// Options are used for the shadow match in place of the production options
+	Options MatchOptions
+	// Matcher runs the shadow match, e.g. against the secondary store of a backend migration,
+	// nil uses the production matcher
+	Matcher *Matcher
+	// MaxConcurrent is the number of shadow matches run at once, samples taken while they
+	// all run are dropped (0 for 2). Shadow matches run outside the QoS pools and throttle
+	MaxConcurrent int
+
+	queries     int64
+	differences int64
+	dropped     int64
+	running     int64
+}
+
+// defaultExperimentConcurrency is the number of shadow matches run at once by default
+const defaultExperimentConcurrency = 2
+
+// ExperimentStats is a snapshot of an Experiment's counters
+type ExperimentStats struct {
+	Name        string
+	SampleRate  float64
+	Queries     int64
+	Differences int64
+	// Dropped is the number of samples not run because MaxConcurrent shadow matches were running
+	Dropped int64
+}
+
+// Stats returns a snapshot of the experiment's counters
+func (e *Experiment) Stats() ExperimentStats {
+	return ExperimentStats{
+		Name:        e.Name,
+		SampleRate:  e.SampleRate,
+		Queries:     atomic.LoadInt64(&e.queries),
+		Differences: atomic.LoadInt64(&e.differences),
+		Dropped:     atomic.LoadInt64(&e.dropped),
+	}
+}
+
+func (e *Experiment) sample() bool {
+	return e != nil && e.SampleRate > 0 && rand.Float64() < e.SampleRate
+}
+
+// startShadow runs the shadow match in the background unless MaxConcurrent are running, in
+// which case the sample is dropped
+func (e *Experiment) startShadow(m *Matcher, fp *Fingerprint, matches []*MatchResult, elapsed time.Duration) {
+	maxConcurrent := int64(e.MaxConcurrent)
+	if maxConcurrent <= 0 {
+		maxConcurrent = defaultExperimentConcurrency
+	}
+	if atomic.AddInt64(&e.running, 1) > maxConcurrent {
+		atomic.AddInt64(&e.running, -1)
+		atomic.AddInt64(&e.dropped, 1)
+		return
+	}
+
+	go func() {
+		defer atomic.AddInt64(&e.running, -1)
+		e.shadow(m, fp, matches, elapsed)
+	}()
+}
+
+// shadow matches the fingerprint with the experiment's options and logs how the results
+// differ from the production matches
+func (e *Experiment) shadow(m *Matcher, fp *Fingerprint, matches []*MatchResult, elapsed time.Duration) {
+	if e.Matcher != nil {
+		m = e.Matcher
+	}
+
+	start := time.Now()
+	shadowMatches, _, err := m.match(fp, e.Options)
+	shadowElapsed := time.Since(start)
+
+	atomic.AddInt64(&e.queries, 1)
+	if err != nil {
+		glog.Errorf("Experiment %s: shadow match failed: %s", e.Name, err)
+		return
+	}
+
+	best, shadowBest := bestTrackID(matches), bestTrackID(shadowMatches)
+	if best != shadowBest || len(matches) != len(shadowMatches) {
+		atomic.AddInt64(&e.differences, 1)
+		glog.Infof("Experiment %s: results differ, TrackID=%d Best=%d Matches=%d (%s) Shadow Best=%d Matches=%d (%s)",
+			e.Name, fp.Meta.TrackID, best, len(matches), elapsed, shadowBest, len(shadowMatches), shadowElapsed)
+	} else {
+		glog.V(2).Infof("Experiment %s: results agree, TrackID=%d Best=%d Matches=%d (%s) Shadow (%s)",
+			e.Name, fp.Meta.TrackID, best, len(matches), elapsed, shadowElapsed)
+	}
+}
+
+// bestTrackID returns the TrackID of the best match or 0 when there isn't one
+func bestTrackID(matches []*MatchResult) uint32 {
+	if len(matches) > 0 && matches[0].Best {
+		return matches[0].TrackID
+	}
+	return 0
+}
@@ -0,0 +1,32 @@
+package echoprint
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestExperimentConcurrency drops the samples taken while MaxConcurrent shadow matches run
+func TestExperimentConcurrency(t *testing.T) {
+	fp := firstFingerprint(t, "../test-data/fp1.json")
+	m := New(WithStore(NewMemoryStore()))
+	e := &Experiment{Name: "test", SampleRate: 1, MaxConcurrent: 1}
+
+	atomic.StoreInt64(&e.running, 1)
+	e.startShadow(m, fp, nil, 0)
+	if stats := e.Stats(); stats.Dropped != 1 || stats.Queries != 0 {
+		t.Errorf("sample taken while the shadow matches all run gave %+v", stats)
+	}
+
+	atomic.StoreInt64(&e.running, 0)
+	e.startShadow(m, fp, nil, 0)
+	for deadline := time.Now().Add(5 * time.Second); atomic.LoadInt64(&e.running) != 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("shadow match still running")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if stats := e.Stats(); stats.Dropped != 1 || stats.Queries != 1 {
+		t.Errorf("sample with a free slot gave %+v", stats)
+	}
+}
@@ -0,0 +1,140 @@
+package echoprint
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"math"
+	"os"
+	"sync"
+	"time"
+)
+
+// ErrFeedbackIndex is returned for feedback on a fingerprint the audited query didn't have
+var ErrFeedbackIndex = errors.New("The query has no fingerprint at this index")
+
+// Feedback labels a track as a correct or incorrect result of a fingerprint of an audited
+// query, along with the confidence it scored so thresholds can be tuned offline. A track that
+// should have matched but wasn't returned is labeled correct and scored when the feedback is
+// given
+type Feedback struct {
+	RequestID  string    `json:"request_id"`
+	Index      int       `json:"index"`
+	TrackID    uint32    `json:"track_id"`
+	Correct    bool      `json:"correct"`
+	Confidence float32   `json:"confidence"`
+	Quality    string    `json:"quality"`
+	Profile    string    `json:"profile,omitempty"`
+	Time       time.Time `json:"time"`
+}
+
+// LabelFeedback scores the feedback on the index-th fingerprint of the audited query against
+// the database connected by DBConnect
+func LabelFeedback(record *AuditRecord, index int, trackID uint32, correct bool, opts MatchOptions) (Feedback, error) {
+	return defaultMatcher.LabelFeedback(record, index, trackID, correct, opts)
+}
+
+// LabelFeedback returns the feedback on the index-th fingerprint of the audited query, opts
+// being the options the query was matched with. The confidence is the one recorded when the
+// track was returned, otherwise the track is scored against the query the way it was matched
+func (m *Matcher) LabelFeedback(record *AuditRecord, index int, trackID uint32, correct bool, opts MatchOptions) (Feedback, error) {
+	f := Feedback{RequestID: record.RequestID, Index: index, TrackID: trackID, Correct: correct, Time: time.Now().UTC()}
+	if index < 0 || index >= len(record.Query) {
+		return f, ErrFeedbackIndex
+	}
+
+	fp, err := NewFingerprint(record.Query[index])
+	if err != nil {
+		return f, err
+	}
+	f.Quality = fp.Quality()
+
+	if index < len(record.Groups) {
+		for _, match := range record.Groups[index].Matches {
+			if match.TrackID == trackID && match.Error == nil {
+				f.Confidence = match.Confidence
+				return f, nil
+			}
+		}
+	}
+
+	opts = m.withDefaults(opts)
+	candidate, err := m.Store.load(trackID, 0)
+	if err != nil {
+		return f, err
+	}
+	query, _ := m.prepareQuery(fp, opts)
+	if len(query.Codes) > 0 {
+		d := opts.scorer().Score(query, candidate)
+		f.Confidence = float32(math.Min(float64(d.Confidence), maxConfidence))
+	}
+
+	return f, nil
+}
+
+// FeedbackLog appends feedback to a file as json lines, the input of TuneThresholds
+type FeedbackLog struct {
+	mu   sync.Mutex
+	path string
+}
+
+// NewFeedbackLog returns a log appending to the file at path
+func NewFeedbackLog(path string) *FeedbackLog {
+	return &FeedbackLog{path: path}
+}
+
+// Add appends the feedback to the log
+func (l *FeedbackLog) Add(f Feedback) error {
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	file, err := os.OpenFile(l.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(data, '\n'))
+	return err
+}
+
+// ReadFeedback reads the feedback logged to the file at path. When a track was labeled more
+// than once for the same fingerprint of a query the latest label is kept
+func ReadFeedback(path string) ([]Feedback, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	type labelKey struct {
+		requestID string
+		index     int
+		trackID   uint32
+	}
+	var list []Feedback
+	labels := make(map[labelKey]int)
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var feedback Feedback
+		if err := json.Unmarshal(scanner.Bytes(), &feedback); err != nil {
+			return nil, err
+		}
+
+		key := labelKey{feedback.RequestID, feedback.Index, feedback.TrackID}
+		if i, ok := labels[key]; ok {
+			list[i] = feedback
+			continue
+		}
+		labels[key] = len(list)
+		list = append(list, feedback)
+	}
+
+	return list, scanner.Err()
+}
@@ -0,0 +1,121 @@
+package echoprint
+
+import (
+	"sort"
+	"strings"
+)
+
+// MetadataFilter restricts match candidates by their metadata, the zero value allows every track
+type MetadataFilter struct {
+	// UPCPrefix only allows tracks whose UPC starts with the prefix
+	UPCPrefix string
+	// UPCPrefixes only allows tracks whose UPC starts with any one of the prefixes
+	UPCPrefixes []string
+	// Tags only allows tracks carrying every one of the tags with the same value
+	Tags map[string]string
+	// And only allows tracks also passing every one of the filters
+	And []*MetadataFilter
+}
+
+func (f *MetadataFilter) empty() bool {
+	if f == nil {
+		return true
+	}
+	for _, and := range f.And {
+		if !and.empty() {
+			return false
+		}
+	}
+	return f.UPCPrefix == "" && len(f.UPCPrefixes) == 0 && len(f.Tags) == 0
+}
+
+// allows reports whether a track's metadata passes the filter
+func (f *MetadataFilter) allows(meta metadata) bool {
+	if f.empty() {
+		return true
+	}
+
+	if !strings.HasPrefix(meta.UPC, f.UPCPrefix) {
+		return false
+	}
+	if len(f.UPCPrefixes) > 0 && !hasAnyPrefix(meta.UPC, f.UPCPrefixes) {
+		return false
+	}
+	for key, value := range f.Tags {
+		if meta.Tags[key] != value {
+			return false
+		}
+	}
+	for _, and := range f.And {
+		if !and.allows(meta) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// solrFilterQueries returns the filter as solr fq params so out of scope tracks are never
+// returned as candidates. Documents indexed before the filterable fields were added lack them,
+// they are let through and filtered by allows once loaded
+func (f *MetadataFilter) solrFilterQueries() []string {
+	if f.empty() {
+		return nil
+	}
+
+	var fq []string
+	if f.UPCPrefix != "" {
+		fq = append(fq, solrOrUnindexed("upc", solrEscape(f.UPCPrefix)+"*"))
+	}
+	if len(f.UPCPrefixes) > 0 {
+		terms := make([]string, len(f.UPCPrefixes))
+		for i, prefix := range f.UPCPrefixes {
+			terms[i] = solrEscape(prefix) + "*"
+		}
+		fq = append(fq, solrOrUnindexed("upc", "("+strings.Join(terms, " OR ")+")"))
+	}
+	for _, tag := range solrTags(f.Tags) {
+		fq = append(fq, solrOrUnindexed("tags", solrEscape(tag)))
+	}
+	// solr intersects every filter query
+	for _, and := range f.And {
+		fq = append(fq, and.solrFilterQueries()...)
+	}
+
+	return fq
+}
+
+// solrOrUnindexed matches the field query or the documents without the field at all
+func solrOrUnindexed(field, query string) string {
+	return field + ":" + query + " OR (*:* -" + field + ":[* TO *])"
+}
+
+// solrTags flattens tags to the key=value terms indexed in the multi valued tags field
+func solrTags(tags map[string]string) []string {
+	terms := make([]string, 0, len(tags))
+	for key, value := range tags {
+		terms = append(terms, key+"="+value)
+	}
+	sort.Strings(terms)
+
+	return terms
+}
+
+var solrEscaper = strings.NewReplacer(
+	`\`, `\\`, `+`, `\+`, `-`, `\-`, `&`, `\&`, `|`, `\|`, `!`, `\!`, `(`, `\(`, `)`, `\)`,
+	`{`, `\{`, `}`, `\}`, `[`, `\[`, `]`, `\]`, `^`, `\^`, `"`, `\"`, `~`, `\~`, `*`, `\*`,
+	`?`, `\?`, `:`, `\:`, `/`, `\/`, ` `, `\ `,
+)
+
+func solrEscape(term string) string {
+	return solrEscaper.Replace(term)
+}
@@ -4,8 +4,12 @@ import (
 	"bytes"
 	"compress/zlib"
 	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/golang/glog"
 )
@@ -15,6 +19,15 @@ const (
 	fpSixtySecOffset = 2586
 	fpClampMinutes   = 4
 
+	// segments of ~2 seconds (2*1000 / 23.2) are inspected for silence / low information
+	lowInfoWindow = 86
+	// a segment with fewer codes than this ratio of the average segment is considered silence
+	lowInfoMinDensityRatio = 0.25
+	// a segment where less than this ratio of the codes are unique is considered low information
+	lowInfoMinUniqueRatio = 0.25
+	// the ratio of low information segments at which results are flagged as unreliable
+	lowInfoFlagRatio = 0.50
+
 	mediumQualityThreshold = 256
 	lowQualityThreshold    = 128
 
@@ -23,6 +36,34 @@ const (
 	qualityLow    = "low"
 )
 
+// ExternalID is a caller supplied track identifier that doesn't fit a uint32 TrackID, either
+// a 64-bit integer or a string (UUID etc). In json it may be given as a number or a string
+type ExternalID string
+
+// UnmarshalJSON implements json.Unmarshaler, accepting numbers as well as strings
+func (id *ExternalID) UnmarshalJSON(data []byte) error {
+	if len(data) > 0 && data[0] == '"' {
+		var s string
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		*id = ExternalID(s)
+		return nil
+	}
+
+	if string(data) == "null" {
+		*id = ""
+		return nil
+	}
+
+	var n json.Number
+	if err := json.Unmarshal(data, &n); err != nil {
+		return err
+	}
+	*id = ExternalID(n.String())
+	return nil
+}
+
 type metadata struct {
 	TrackID  uint32  `json:"track_id"`
 	UPC      string  `json:"upc"`
@@ -31,6 +72,18 @@ type metadata struct {
 	Filename string  `json:"filename"`
 	Bitrate  float64 `json:"bitrate"`
 	Duration float64 `json:"duration"`
+
+	// ExternalID identifies the track in catalogs using 64-bit or string identifiers, the
+	// TrackID is then allocated internally
+	ExternalID ExternalID `json:"external_id"`
+
+	// Tags are arbitrary integrator fields (label, territory, licensing) stored with the track
+	Tags map[string]string `json:"tags"`
+
+	// segment ingestion registers only a clip (in seconds) of a logical parent track
+	ParentTrackID uint32  `json:"parent_track_id"`
+	SegmentStart  float64 `json:"segment_start"`
+	SegmentEnd    float64 `json:"segment_end"`
 }
 
 // Fingerprint contains the uncompressed and decoded codegen fingerprint string
@@ -40,6 +93,24 @@ type Fingerprint struct {
 	Times   []uint32
 	Meta    metadata
 	clamped bool
+	trimmed bool
+
+	// sparsity is N when only every Nth code of the fingerprint was stored, 0 or 1 when dense
+	sparsity uint32
+	// variant numbers the additional fingerprints (encodes, edits) stored for a TrackID
+	variant uint32
+	// newVariant has save number the fingerprint as the track's next variant in the
+	// transaction that stores it, rather than storing it under variant
+	newVariant bool
+	// quality is the tier persisted when the fingerprint was stored, it goes stale when the
+	// quality thresholds change and is empty for tracks stored before tiers were persisted
+	quality string
+	// indexCodes are the codes the fingerprint is indexed under when posting lists are
+	// capped, nil indexes every code
+	indexCodes []uint32
+	// codeIndex is built when the fingerprint is saved or prepared as a query, nil otherwise
+	// and for fingerprints saved before code indexes were stored
+	codeIndex *codeIndex
 }
 
 // func (fp *Fingerprint) NewClamped() *Fingerprint {
@@ -64,6 +135,10 @@ type Fingerprint struct {
 // clamps the codes to only the first band of the fingerprint, we need 180+
 // seconds worth of codes to be accurate in a large DB
 func (fp *Fingerprint) NewClamped() *Fingerprint {
+	return fp.newClampedTo(fpClampMinutes)
+}
+
+func (fp *Fingerprint) newClampedTo(minutes int) *Fingerprint {
 	clampedFp := &Fingerprint{Codes: fp.Codes, Times: fp.Times, Meta: fp.Meta, clamped: true}
 
 	glog.V(3).Infof("%d Fingerprint Codes Before Clamping", len(fp.Codes))
@@ -71,7 +146,7 @@ func (fp *Fingerprint) NewClamped() *Fingerprint {
 	// if we use the codegen on a file with start/stop times, the first timestamp
 	// is ~= the start time given. There might be a (slightly) earlier timestamp
 	// in another band, but this is good enough
-	clampDuration := fpSixtySecOffset*fpClampMinutes + fp.Times[0]
+	clampDuration := uint32(fpSixtySecOffset*minutes) + fp.Times[0]
 	for i, time := range fp.Times {
 		if time > clampDuration {
 			clampedFp.Codes = fp.Codes[:i]
@@ -84,6 +159,178 @@ func (fp *Fingerprint) NewClamped() *Fingerprint {
 	return clampedFp
 }
 
+// newSampled returns a new Fingerprint keeping all the codes in the first fullMinutes and
+// every Nth code after that, when sampleEvery is 0 the codes after fullMinutes are dropped
+func (fp *Fingerprint) newSampled(fullMinutes int, sampleEvery int) *Fingerprint {
+	sampledFp := &Fingerprint{Meta: fp.Meta, clamped: fp.clamped, trimmed: fp.trimmed}
+	if len(fp.Times) == 0 {
+		return sampledFp
+	}
+
+	minTime, _ := fp.timeRange()
+
+	var skipped int
+	cutoff := minTime + uint32(fullMinutes*fpSixtySecOffset)
+	for i, time := range fp.Times {
+		if time > cutoff {
+			skipped++
+			if sampleEvery == 0 || skipped%sampleEvery != 0 {
+				continue
+			}
+		}
+		sampledFp.Codes = append(sampledFp.Codes, fp.Codes[i])
+		sampledFp.Times = append(sampledFp.Times, time)
+	}
+
+	glog.V(3).Infof("%d Fingerprint Codes After Sampling (%d before)", len(sampledFp.Codes), len(fp.Codes))
+	return sampledFp
+}
+
+// newSegment returns a new Fingerprint containing only the codes between start and end
+func (fp *Fingerprint) newSegment(start, end time.Duration) *Fingerprint {
+	segmentFp := &Fingerprint{Meta: fp.Meta, clamped: fp.clamped, trimmed: fp.trimmed, sparsity: fp.sparsity}
+
+	startTime := DurationToFrames(start)
+	endTime := DurationToFrames(end)
+	for i, time := range fp.Times {
+		if time >= startTime && time <= endTime {
+			segmentFp.Codes = append(segmentFp.Codes, fp.Codes[i])
+			segmentFp.Times = append(segmentFp.Times, time)
+		}
+	}
+
+	return segmentFp
+}
+
+// indexedCodes returns the codes to index the fingerprint under
+func (fp *Fingerprint) indexedCodes() []uint32 {
+	if fp.indexCodes != nil {
+		return fp.indexCodes
+	}
+	return fp.Codes
+}
+
+// timeRange returns the earliest and latest time in the fingerprint, Times are only
+// sorted within each band so the whole fingerprint must be scanned
+func (fp *Fingerprint) timeRange() (uint32, uint32) {
+	if len(fp.Times) == 0 {
+		return 0, 0
+	}
+
+	minTime, maxTime := fp.Times[0], fp.Times[0]
+	for _, time := range fp.Times {
+		if time < minTime {
+			minTime = time
+		}
+		if time > maxTime {
+			maxTime = time
+		}
+	}
+
+	return minTime, maxTime
+}
+
+// FrameDuration is the length of a codegen time offset, the unit of Fingerprint.Times
+const FrameDuration = time.Minute / fpSixtySecOffset
+
+// FramesToDuration converts a number of codegen time offsets (Fingerprint.Times) to a duration,
+// the frames may be negative for offsets between fingerprints
+func FramesToDuration(frames int) time.Duration {
+	return time.Duration(frames) * time.Minute / fpSixtySecOffset
+}
+
+// DurationToFrames converts a duration to a codegen time offset, negative durations are 0
+func DurationToFrames(d time.Duration) uint32 {
+	if d <= 0 {
+		return 0
+	}
+	return uint32(d * fpSixtySecOffset / time.Minute)
+}
+
+// secondsToDuration converts the seconds of codegen metadata and json APIs to a duration
+func secondsToDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// NewTrimmed returns a new Fingerprint with the codes from silent or low information
+// segments removed, along with the ratio of the fingerprint's duration that was considered
+// low information. Silence heavy clips tend to match other silence heavy tracks with
+// misleadingly high confidence, so these codes are dropped before matching
+func (fp *Fingerprint) NewTrimmed() (*Fingerprint, float32) {
+	trimmedFp := &Fingerprint{Meta: fp.Meta, clamped: fp.clamped, trimmed: true}
+	if len(fp.Codes) == 0 {
+		return trimmedFp, 0
+	}
+
+	minTime, maxTime := fp.timeRange()
+	numSegments := int((maxTime-minTime)/lowInfoWindow) + 1
+	segmentCodes := make([]map[uint32]uint16, numSegments)
+	segmentCounts := make([]int, numSegments)
+	for i, code := range fp.Codes {
+		segment := (fp.Times[i] - minTime) / lowInfoWindow
+		if segmentCodes[segment] == nil {
+			segmentCodes[segment] = make(map[uint32]uint16)
+		}
+		segmentCodes[segment][code]++
+		segmentCounts[segment]++
+	}
+
+	// the number of codes per segment varies with the number of bands in the fingerprint
+	// so silence is judged relative to the average density
+	minCodes := float32(len(fp.Codes)) / float32(numSegments) * lowInfoMinDensityRatio
+
+	lowInfo := make([]bool, numSegments)
+	var numLowInfo int
+	for segment, count := range segmentCounts {
+		uniqueRatio := float32(len(segmentCodes[segment])) / float32(count)
+		if float32(count) < minCodes || uniqueRatio < lowInfoMinUniqueRatio {
+			lowInfo[segment] = true
+			numLowInfo++
+		}
+	}
+
+	for i, code := range fp.Codes {
+		if !lowInfo[(fp.Times[i]-minTime)/lowInfoWindow] {
+			trimmedFp.Codes = append(trimmedFp.Codes, code)
+			trimmedFp.Times = append(trimmedFp.Times, fp.Times[i])
+		}
+	}
+
+	lowInfoRatio := float32(numLowInfo) / float32(numSegments)
+	glog.V(3).Infof("%d Fingerprint Codes After Trimming %d/%d low information segments", len(trimmedFp.Codes), numLowInfo, numSegments)
+	return trimmedFp, lowInfoRatio
+}
+
+// newTimeScaled returns a copy of the Fingerprint with all of its Times multiplied by factor,
+// used to undo the speed up/slow down applied by radio stations
+func (fp *Fingerprint) newTimeScaled(factor float32) *Fingerprint {
+	scaledFp := &Fingerprint{Codes: fp.Codes, Meta: fp.Meta, clamped: fp.clamped, trimmed: fp.trimmed}
+	scaledFp.Times = make([]uint32, len(fp.Times))
+	for i, time := range fp.Times {
+		scaledFp.Times[i] = uint32(float32(time)*factor + 0.5)
+	}
+
+	return scaledFp
+}
+
+// NewIndexed returns a copy of the Fingerprint with its codes sorted and indexed, as stored
+// fingerprints are. A query compared with many fingerprints is indexed once up front so the
+// HistogramScorer can merge join it with each of them
+func (fp *Fingerprint) NewIndexed() *Fingerprint {
+	indexedFp := *fp
+	indexedFp.codeIndex = newCodeIndex(fp)
+	return &indexedFp
+}
+
+// storedQuality is the tier a fingerprint is saved with, the tier it was restored with or
+// else its current one
+func (fp *Fingerprint) storedQuality() string {
+	if fp.quality != "" {
+		return fp.quality
+	}
+	return fp.Quality()
+}
+
 // Quality returns a string representation of the audio quality of the fingerprint
 // based on the bitrate provided in the codegen metadata
 func (fp *Fingerprint) Quality() string {
@@ -105,6 +352,15 @@ func (fp *Fingerprint) isMediumQuality() bool {
 	return fp.Meta.Bitrate > mediumQualityThreshold
 }
 
+// InvalidFingerprintError is returned by NewFingerprint when the codegen data can't be decoded
+type InvalidFingerprintError struct {
+	Err error
+}
+
+func (e *InvalidFingerprintError) Error() string {
+	return e.Err.Error()
+}
+
 // NewFingerprint decodes the codegen data and splits the audio fingerprint into a pair of
 // Code/Time integer arrays of equal size
 func NewFingerprint(codegenFp *CodegenFp) (*Fingerprint, error) {
@@ -114,11 +370,63 @@ func NewFingerprint(codegenFp *CodegenFp) (*Fingerprint, error) {
 	inflated, err := inflate(codegenFp.Code)
 	if err != nil {
 		glog.Error(err)
-		return nil, err
+		return nil, &InvalidFingerprintError{err}
 	}
 
 	fp.Codes, fp.Times, err = decode(inflated)
-	return fp, err
+	if err != nil {
+		return fp, &InvalidFingerprintError{err}
+	}
+	quirksFor(fp.Meta.Version).normalizeTimes(fp.Times)
+
+	return fp, nil
+}
+
+// ErrCodegenRange is returned when encoding a fingerprint whose codes or times don't fit the
+// 20 bits codegen writes them in
+var ErrCodegenRange = errors.New("Fingerprint code or time out of the codegen range")
+
+// maxCodegenValue is the largest code or time codegen can write in 5 hex digits
+const maxCodegenValue = 0xfffff
+
+// Codegen encodes the fingerprint back into codegen data, e.g. to write synthesized
+// fingerprints. The times are current release frames, so is the version
+func (fp *Fingerprint) Codegen() (*CodegenFp, error) {
+	var buf strings.Builder
+	buf.Grow(len(fp.Codes) * 10)
+	for _, values := range [][]uint32{fp.Times, fp.Codes} {
+		for _, value := range values {
+			if value > maxCodegenValue {
+				return nil, ErrCodegenRange
+			}
+			fmt.Fprintf(&buf, "%05x", value)
+		}
+	}
+
+	code, err := deflate(buf.String())
+	if err != nil {
+		return nil, err
+	}
+
+	meta := fp.Meta
+	if meta.Version != 0 {
+		meta.Version = CurrentCodegenVersion
+	}
+	return &CodegenFp{Meta: meta, Code: code}, nil
+}
+
+// deflate compresses and encodes data the way codegen does, the reverse of inflate
+func deflate(data string) (string, error) {
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	if _, err := w.Write([]byte(data)); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+
+	return base64.URLEncoding.EncodeToString(buf.Bytes()), nil
 }
 
 // inflate decodes and decompresses the data generated by codegen
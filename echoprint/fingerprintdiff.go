@@ -0,0 +1,109 @@
+package echoprint
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Kinds of Divergence
+const (
+	// DivergenceRemoved is material of a missing from b, e.g. a cut or a dropped intro
+	DivergenceRemoved = "removed"
+	// DivergenceInserted is material of b missing from a, e.g. an extended outro
+	DivergenceInserted = "inserted"
+	// DivergenceReplaced is material of a replaced by other material in b, e.g. a censored line
+	DivergenceReplaced = "replaced"
+)
+
+// TimeRange is a range of time in a fingerprint
+type TimeRange struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+// MarshalJSON implements json.Marshaler, times are given in seconds
+func (r TimeRange) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Start float64 `json:"start"`
+		End   float64 `json:"end"`
+	}{r.Start.Seconds(), r.End.Seconds()})
+}
+
+// Divergence is where two fingerprints differ, A and B are the time ranges in each of them.
+// The range is empty in the fingerprint the material is missing from, where it would be
+type Divergence struct {
+	Kind string    `json:"kind"`
+	A    TimeRange `json:"a"`
+	B    TimeRange `json:"b"`
+}
+
+// FingerprintDiff lists where two near identical fingerprints diverge
+type FingerprintDiff struct {
+	// Identical is set when no divergence was found
+	Identical   bool         `json:"identical"`
+	Divergences []Divergence `json:"divergences"`
+	Alignment   Alignment    `json:"alignment"`
+}
+
+// DiffFingerprints reports where fingerprint b diverges from fingerprint a, e.g. a re-delivery
+// from its master. The fingerprints are mapped out by Align, the material between two matching
+// regions of a that doesn't line up in b is a divergence, as is the material before the first
+// and after the last. Boundaries are as precise as the alignment windows, divergences shorter
+// than the offset tolerance are ignored
+func DiffFingerprints(a, b *Fingerprint, opts AlignmentOptions) FingerprintDiff {
+	report := FingerprintDiff{Alignment: Align(a, b, opts)}
+	if len(a.Codes) == 0 || len(b.Codes) == 0 {
+		return report
+	}
+
+	tolerance := opts.OffsetTolerance
+	if tolerance <= 0 {
+		tolerance = defaultAlignmentOffsetTolerance
+	}
+	aStart, aEnd := a.timeRange()
+	bStart, bEnd := b.timeRange()
+
+	// the cursors are where the last matching region ended in each fingerprint
+	aCursor, bCursor := FramesToDuration(int(aStart)), FramesToDuration(int(bStart))
+	diverge := func(aNext, bNext time.Duration) {
+		aLength, bLength := aNext-aCursor, bNext-bCursor
+		// b running ahead of a means a's material was dropped before b caught up
+		if bLength < 0 {
+			aLength -= bLength
+			bLength = 0
+		}
+		if aLength < 0 {
+			bLength -= aLength
+			aLength = 0
+		}
+
+		var kind string
+		switch {
+		case aLength > tolerance && bLength > tolerance:
+			kind = DivergenceReplaced
+		case aLength > tolerance:
+			kind = DivergenceRemoved
+		case bLength > tolerance:
+			kind = DivergenceInserted
+		default:
+			return
+		}
+		report.Divergences = append(report.Divergences, Divergence{
+			Kind: kind,
+			A:    TimeRange{aCursor, aCursor + aLength},
+			B:    TimeRange{bCursor, bCursor + bLength},
+		})
+	}
+
+	for _, region := range report.Alignment.Regions {
+		if !region.Match {
+			continue
+		}
+		diverge(region.Start, region.Start+region.Offset)
+		aCursor, bCursor = region.End, region.End+region.Offset
+	}
+	diverge(FramesToDuration(int(aEnd)), FramesToDuration(int(bEnd)))
+
+	report.Identical = len(report.Divergences) == 0
+	return report
+}
@@ -0,0 +1,159 @@
+package echoprint
+
+import (
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// fingerprints with fewer codes than this can't reach the minimum code score reliably
+	healthMinCodes = 100
+	// a code found in more than this ratio of the catalog's fingerprints is ultra-common
+	healthCommonCodeRatio = 0.05
+	// fingerprints with more than this ratio of ultra-common codes match everything and nothing
+	healthMaxCommonRatio = 0.8
+	// codes are only judged ultra-common in catalogs of at least this many fingerprints
+	healthMinCatalog = 50
+)
+
+const (
+	problemFewCodes     = "few_codes"
+	problemCommonCodes  = "common_codes"
+	problemZeroDuration = "zero_duration"
+)
+
+// HealthScan looks for degenerate fingerprints in the catalog that can never be matched, the
+// zero value scans the database connected by DBConnect with the default limits
+type HealthScan struct {
+	// Matcher is scanned, nil scans the database connected by DBConnect
+	Matcher *Matcher
+
+	// MinCodes is the fewest codes a healthy fingerprint has, defaults to 100
+	MinCodes int
+	// CommonCodeRatio is the ratio of the catalog's fingerprints a code must be found in to be
+	// ultra-common, defaults to 5%
+	CommonCodeRatio float32
+	// MaxCommonRatio is the largest ratio of a healthy fingerprint's unique codes that may be
+	// ultra-common, defaults to 80%
+	MaxCommonRatio float32
+}
+
+// HealthReport lists the degenerate fingerprints found by a HealthScan
+type HealthReport struct {
+	Fingerprints int          `json:"fingerprints"`
+	Issues       []TrackIssue `json:"issues"`
+	// SuggestedDeletions are the tracks whose every fingerprint is degenerate
+	SuggestedDeletions []uint32  `json:"suggested_deletions"`
+	Started            time.Time `json:"started"`
+	Elapsed            float64   `json:"elapsed"`
+}
+
+// TrackIssue describes a degenerate fingerprint and what is wrong with it
+type TrackIssue struct {
+	TrackID  uint32   `json:"track_id"`
+	Variant  uint32   `json:"variant,omitempty"`
+	Filename string   `json:"filename,omitempty"`
+	Problems []string `json:"problems"`
+	Codes    int      `json:"codes"`
+	// CommonRatio is the ratio of the fingerprint's unique codes that are ultra-common
+	CommonRatio float32 `json:"common_ratio"`
+}
+
+// Run scans every fingerprint of the catalog twice, first counting the fingerprints each code
+// is found in, then judging each fingerprint against those counts
+func (s *HealthScan) Run() (*HealthReport, error) {
+	report := &HealthReport{Started: time.Now().UTC(), Issues: []TrackIssue{}, SuggestedDeletions: []uint32{}}
+	db := s.Matcher.orDefault().Store
+
+	trackIDs, err := db.trackIDs()
+	if err != nil {
+		return nil, err
+	}
+	sortTrackIDs(trackIDs)
+
+	variants := make([]uint32, len(trackIDs))
+	codeCounts := make(map[uint32]int)
+	for i, trackID := range trackIDs {
+		if variants[i], err = db.nextVariant(trackID); err != nil {
+			return nil, err
+		}
+		for variant := uint32(0); variant < variants[i]; variant++ {
+			fp, err := db.load(trackID, variant)
+			if err != nil {
+				return nil, err
+			}
+			for code := range uniqueCodes(fp) {
+				codeCounts[code]++
+			}
+			report.Fingerprints++
+		}
+	}
+
+	commonCount := int(float32(report.Fingerprints) * orDefault(s.CommonCodeRatio, healthCommonCodeRatio))
+	judgeCommon := report.Fingerprints >= healthMinCatalog
+	glog.Infof("Scanning %d fingerprints of %d tracks for degenerate entries", report.Fingerprints, len(trackIDs))
+
+	for i, trackID := range trackIDs {
+		degenerate := uint32(0)
+		for variant := uint32(0); variant < variants[i]; variant++ {
+			fp, err := db.load(trackID, variant)
+			if err != nil {
+				return nil, err
+			}
+
+			issue := TrackIssue{TrackID: trackID, Variant: variant, Filename: fp.Meta.Filename, Codes: len(fp.Codes)}
+			if len(fp.Codes) < s.minCodes() {
+				issue.Problems = append(issue.Problems, problemFewCodes)
+			}
+			if minTime, maxTime := fp.timeRange(); minTime == maxTime {
+				issue.Problems = append(issue.Problems, problemZeroDuration)
+			}
+			if judgeCommon {
+				unique := uniqueCodes(fp)
+				var common int
+				for code := range unique {
+					if codeCounts[code] > commonCount {
+						common++
+					}
+				}
+				if len(unique) > 0 {
+					issue.CommonRatio = float32(common) / float32(len(unique))
+				}
+				if issue.CommonRatio > orDefault(s.MaxCommonRatio, healthMaxCommonRatio) {
+					issue.Problems = append(issue.Problems, problemCommonCodes)
+				}
+			}
+
+			if len(issue.Problems) > 0 {
+				glog.V(2).Infof("TrackID=%d variant %d is degenerate: %v", trackID, variant, issue.Problems)
+				report.Issues = append(report.Issues, issue)
+				degenerate++
+			}
+		}
+
+		if degenerate > 0 && degenerate == variants[i] {
+			report.SuggestedDeletions = append(report.SuggestedDeletions, trackID)
+		}
+	}
+
+	report.Elapsed = time.Since(report.Started).Seconds()
+	glog.Infof("Found %d degenerate fingerprints, %d tracks suggested for deletion", len(report.Issues), len(report.SuggestedDeletions))
+
+	return report, nil
+}
+
+func (s *HealthScan) minCodes() int {
+	if s.MinCodes > 0 {
+		return s.MinCodes
+	}
+	return healthMinCodes
+}
+
+func uniqueCodes(fp *Fingerprint) map[uint32]struct{} {
+	codes := make(map[uint32]struct{}, len(fp.Codes))
+	for _, code := range fp.Codes {
+		codes[code] = struct{}{}
+	}
+	return codes
+}
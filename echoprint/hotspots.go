@@ -0,0 +1,326 @@
+package echoprint
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"runtime/pprof"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrProfilerBusy is returned by ProfileMatching while another CPU profile is running
+var ErrProfilerBusy = errors.New("A CPU profile is already running")
+
+var errMalformedProfile = errors.New("Malformed CPU profile")
+
+// hotSpotTopFunctions is the number of functions reported for each phase
+const hotSpotTopFunctions = 5
+
+const packagePrefix = "github.com/AudioAddict/go-echoprint/echoprint."
+
+// hotSpotPhases attribute a stack to a phase by the innermost frame in one of the functions,
+// types or packages listed. Stacks of the matching subsystem in none of them count as other
+var hotSpotPhases = []struct {
+	phase string
+	names []string
+}{
+	{"inflate", []string{packagePrefix + "inflate", "compress/zlib", "compress/flate", "encoding/base64"}},
+	{"decode", []string{packagePrefix + "decode", packagePrefix + "NewFingerprint"}},
+	{"db", []string{
+		packagePrefix + "(*dbConnection)", packagePrefix + "(*solrCursor)",
+		packagePrefix + "(*memoryStore)", packagePrefix + "(*memoryCursor)", packagePrefix + "(*batchingStore)",
+		"github.com/rtt/Go-Solr", "github.com/boltdb/bolt",
+	}},
+	{"score", []string{
+		packagePrefix + "calculateConfidence", packagePrefix + "calculateCodeScore",
+		packagePrefix + "getCodeTimeMap", packagePrefix + "HistogramScorer",
+	}},
+}
+
+// HotSpotReport aggregates the CPU time spent matching queries while ProfileMatching ran
+type HotSpotReport struct {
+	Seconds float64 `json:"seconds"`
+	// CPUSeconds is the CPU time of the whole process, MatchingSeconds the part of it spent
+	// matching queries which the phases break down
+	CPUSeconds      float64   `json:"cpu_seconds"`
+	MatchingSeconds float64   `json:"matching_seconds"`
+	Phases          []HotSpot `json:"phases"`
+}
+
+// HotSpot is the CPU time spent in one phase of matching (inflate, decode, db, score or other)
+type HotSpot struct {
+	Phase   string  `json:"phase"`
+	Seconds float64 `json:"seconds"`
+	// Share is the fraction of the matching CPU time spent in this phase
+	Share     float64           `json:"share"`
+	Functions []HotSpotFunction `json:"functions"`
+}
+
+// HotSpotFunction is a function the CPU time of a phase was spent in, excluding its callees
+type HotSpotFunction struct {
+	Function string  `json:"function"`
+	Seconds  float64 `json:"seconds"`
+}
+
+// ProfileMatching runs a CPU profile for the duration and reports the time spent matching
+// queries broken down into inflating, decoding, querying the database and scoring. Only one
+// CPU profile can run at a time, ErrProfilerBusy is returned otherwise
+func ProfileMatching(duration time.Duration) (*HotSpotReport, error) {
+	start := time.Now()
+	var buf bytes.Buffer
+	if err := pprof.StartCPUProfile(&buf); err != nil {
+		return nil, ErrProfilerBusy
+	}
+	time.Sleep(duration)
+	pprof.StopCPUProfile()
+
+	stacks, err := parseCPUProfile(&buf)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &HotSpotReport{Seconds: time.Since(start).Seconds()}
+	phases := make(map[string]*HotSpot)
+	functions := make(map[string]map[string]float64)
+	for _, stack := range stacks {
+		seconds := time.Duration(stack.nanos).Seconds()
+		report.CPUSeconds += seconds
+
+		phase, ok := classifyStack(stack.frames)
+		if !ok {
+			continue
+		}
+		report.MatchingSeconds += seconds
+
+		spot := phases[phase]
+		if spot == nil {
+			spot = &HotSpot{Phase: phase}
+			phases[phase] = spot
+			functions[phase] = make(map[string]float64)
+		}
+		spot.Seconds += seconds
+		functions[phase][stack.frames[0]] += seconds
+	}
+
+	for phase, spot := range phases {
+		spot.Share = spot.Seconds / report.MatchingSeconds
+		for function, seconds := range functions[phase] {
+			spot.Functions = append(spot.Functions, HotSpotFunction{function, seconds})
+		}
+		sort.Slice(spot.Functions, func(i, j int) bool { return spot.Functions[i].Seconds > spot.Functions[j].Seconds })
+		if len(spot.Functions) > hotSpotTopFunctions {
+			spot.Functions = spot.Functions[:hotSpotTopFunctions]
+		}
+		report.Phases = append(report.Phases, *spot)
+	}
+	sort.Slice(report.Phases, func(i, j int) bool { return report.Phases[i].Seconds > report.Phases[j].Seconds })
+
+	return report, nil
+}
+
+// classifyStack attributes a sampled stack, innermost function first, to a phase of matching.
+// Stacks outside of matching a query (ingests, http handling, the runtime) are skipped
+func classifyStack(frames []string) (string, bool) {
+	matching := false
+	for _, frame := range frames {
+		if isFunction(frame, packagePrefix+"(*Matcher).match") || isFunction(frame, packagePrefix+"(*Matcher).Match") ||
+			isFunction(frame, packagePrefix+"(*Matcher).matchEach") {
+			matching = true
+			break
+		}
+	}
+	if !matching {
+		return "", false
+	}
+
+	for _, frame := range frames {
+		for _, p := range hotSpotPhases {
+			for _, name := range p.names {
+				if isFunction(frame, name) {
+					return p.phase, true
+				}
+			}
+		}
+	}
+
+	return "other", true
+}
+
+// isFunction reports whether the frame is the function, one of its closures or a function of
+// the type or package name
+func isFunction(frame string, name string) bool {
+	return frame == name || strings.HasPrefix(frame, name+".")
+}
+
+// cpuStack is a sampled stack of a CPU profile, innermost function first
+type cpuStack struct {
+	frames []string
+	nanos  int64
+}
+
+// parseCPUProfile reads the stacks of a gzipped pprof CPU profile. Only the few fields needed
+// are decoded so no protobuf dependency is required
+func parseCPUProfile(buf *bytes.Buffer) ([]cpuStack, error) {
+	gz, err := gzip.NewReader(buf)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(gz)
+	if err != nil {
+		return nil, err
+	}
+
+	type sample struct {
+		locations []uint64
+		values    []uint64
+	}
+	var samples []sample
+	var strs []string
+	locations := make(map[uint64][]uint64) // location id -> function ids, innermost first
+	functions := make(map[uint64]uint64)   // function id -> name string index
+
+	err = readProto(data, func(field int, value uint64, msg []byte) error {
+		switch field {
+		case 2: // sample
+			var s sample
+			err := readProto(msg, func(field int, value uint64, msg []byte) error {
+				switch field {
+				case 1:
+					s.locations = appendPacked(s.locations, value, msg)
+				case 2:
+					s.values = appendPacked(s.values, value, msg)
+				}
+				return nil
+			})
+			samples = append(samples, s)
+			return err
+		case 4: // location
+			var id uint64
+			var lines []uint64
+			err := readProto(msg, func(field int, value uint64, msg []byte) error {
+				switch field {
+				case 1:
+					id = value
+				case 4: // line
+					return readProto(msg, func(field int, value uint64, msg []byte) error {
+						if field == 1 {
+							lines = append(lines, value)
+						}
+						return nil
+					})
+				}
+				return nil
+			})
+			locations[id] = lines
+			return err
+		case 5: // function
+			var id, name uint64
+			err := readProto(msg, func(field int, value uint64, msg []byte) error {
+				switch field {
+				case 1:
+					id = value
+				case 2:
+					name = value
+				}
+				return nil
+			})
+			functions[id] = name
+			return err
+		case 6: // string table
+			strs = append(strs, string(msg))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	stacks := make([]cpuStack, 0, len(samples))
+	for _, s := range samples {
+		// CPU profiles sample the count and the nanoseconds
+		if len(s.values) < 2 {
+			return nil, errMalformedProfile
+		}
+		stack := cpuStack{nanos: int64(s.values[1])}
+		for _, location := range s.locations {
+			for _, function := range locations[location] {
+				if name := functions[function]; name < uint64(len(strs)) {
+					stack.frames = append(stack.frames, strs[name])
+				}
+			}
+		}
+		if len(stack.frames) > 0 {
+			stacks = append(stacks, stack)
+		}
+	}
+
+	return stacks, nil
+}
+
+// readProto calls fn with every field of a protobuf message, varints are passed as value and
+// length delimited fields as msg. Fixed width fields are skipped
+func readProto(data []byte, fn func(field int, value uint64, msg []byte) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errMalformedProfile
+		}
+		data = data[n:]
+
+		var value uint64
+		var msg []byte
+		switch key & 7 {
+		case 0:
+			if value, n = binary.Uvarint(data); n <= 0 {
+				return errMalformedProfile
+			}
+			data = data[n:]
+		case 1:
+			if len(data) < 8 {
+				return errMalformedProfile
+			}
+			data = data[8:]
+			continue
+		case 2:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < length {
+				return errMalformedProfile
+			}
+			msg, data = data[n:n+int(length)], data[n+int(length):]
+		case 5:
+			if len(data) < 4 {
+				return errMalformedProfile
+			}
+			data = data[4:]
+			continue
+		default:
+			return errMalformedProfile
+		}
+
+		if err := fn(int(key>>3), value, msg); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// appendPacked appends a repeated varint field, which is either a single value or packed
+func appendPacked(values []uint64, value uint64, msg []byte) []uint64 {
+	if msg == nil {
+		return append(values, value)
+	}
+	for len(msg) > 0 {
+		v, n := binary.Uvarint(msg)
+		if n <= 0 {
+			break
+		}
+		values = append(values, v)
+		msg = msg[n:]
+	}
+	return values
+}
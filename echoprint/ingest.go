@@ -9,8 +9,33 @@ import (
 
 // IngestResult represents the status of ingesting a fingerprint
 type IngestResult struct {
-	TrackID uint32      `json:"track_id"`
-	Error   interface{} `json:"error"`
+	TrackID    uint32      `json:"track_id"`
+	ExternalID ExternalID  `json:"external_id,omitempty"`
+	Error      interface{} `json:"error"`
+
+	// RemappedFrom is the requested TrackID when it collided with different audio and
+	// the fingerprint was stored under a newly allocated TrackID instead
+	RemappedFrom uint32 `json:"remapped_from,omitempty"`
+
+	// SelfMatchConfidence is the confidence the fingerprint matched itself with when self
+	// matches are verified, Unverified is set when it was stored regardless of falling short
+	SelfMatchConfidence float32 `json:"self_match_confidence,omitempty"`
+	Unverified          bool    `json:"unverified,omitempty"`
+
+	// Allocated is set when a new TrackID was allocated for the fingerprint, Variant is the
+	// variant it was stored as for an existing TrackID
+	Allocated bool   `json:"allocated,omitempty"`
+	Variant   uint32 `json:"variant,omitempty"`
+
+	// Codes is the number of codes stored for the fingerprint, fewer than it holds when long
+	// fingerprints are sampled
+	Codes int `json:"codes,omitempty"`
+
+	// DryRun is set when nothing was written and the result is what the ingest would have done,
+	// TrackIDs that would be allocated are reported as 0. Duplicates are the other tracks the
+	// fingerprint already matches, only looked for in dry runs
+	DryRun     bool     `json:"dry_run,omitempty"`
+	Duplicates []uint32 `json:"duplicates,omitempty"`
 }
 
 // ErrTrackIDExists is returned during ingestion when the provided TrackID already exists in the database
@@ -19,17 +44,78 @@ var ErrTrackIDExists = errors.New("TrackID already exists in the database")
 // ErrTrackIDMissing is returned during ingestion when no TrackID is provided
 var ErrTrackIDMissing = errors.New("Missing Track ID")
 
-// IngestAll takes an array of CodegenFp and stores them in the database in parallel
-func IngestAll(codegenList []*CodegenFp) []IngestResult {
+// ErrInvalidSegment is returned during ingestion when a segment's end is not after its start
+var ErrInvalidSegment = errors.New("Segment end must be after segment start")
+
+// ErrTrackIDCollision is returned during ingestion when the provided TrackID already exists
+// in the database with different audio
+var ErrTrackIDCollision = errors.New("TrackID already exists in the database with different audio")
+
+// CollisionPolicy decides what happens when an ingest reuses an existing TrackID
+type CollisionPolicy int
+
+const (
+	// CollisionIgnore rejects every reused TrackID with ErrTrackIDExists without comparing the audio
+	CollisionIgnore CollisionPolicy = iota
+	// CollisionReject compares the audio and rejects different audio with ErrTrackIDCollision
+	CollisionReject
+	// CollisionRemap compares the audio and stores different audio under a newly allocated TrackID
+	CollisionRemap
+)
+
+// IngestOptions controls how fingerprints are stored, the zero value stores every code
+type IngestOptions struct {
+	// FullMinutes keeps every code in the first FullMinutes of the fingerprint,
+	// 0 disables ingest-time truncation (independent of query-time clamping)
+	FullMinutes int
+	// SampleEvery keeps every Nth code after FullMinutes, 0 drops them
+	SampleEvery int
+
+	// SparseMinutes stores fingerprints longer than this many minutes (audiobooks, DJ sets)
+	// at a reduced density of every SparseEvery codes, 0 disables sparse ingestion. The
+	// scorer compensates for the missing codes when matching against sparse fingerprints
+	SparseMinutes int
+	SparseEvery   int
+
+	// Variants allows storing another fingerprint (different master, radio edit) for an
+	// existing TrackID instead of rejecting it, matches against any of them count as the track
+	Variants bool
+
+	// AllocateTrackIDs assigns the next TrackID from the database sequence to fingerprints
+	// ingested without one, rather than rejecting them
+	AllocateTrackIDs bool
+	// Collisions decides how a reused TrackID with different audio is handled
+	Collisions CollisionPolicy
+
+	// Throttle reduces the parallelism of IngestAll under memory pressure, nil disables it
+	Throttle *Throttle
+
+	// SelfMatch verifies each fingerprint of IngestAll matches itself, nil disables it
+	SelfMatch *SelfMatch
+
+	// DryRun runs every check of the ingest without storing anything or allocating TrackIDs,
+	// the results report what the ingest would do and the tracks the fingerprints duplicate
+	DryRun bool
+}
+
+// IngestAll stores the fingerprints in the database connected by DBConnect in parallel
+func IngestAll(codegenList []*CodegenFp, opts IngestOptions) []IngestResult {
+	return defaultMatcher.IngestAll(codegenList, opts)
+}
+
+// IngestAll takes an array of CodegenFp and stores them in the store in parallel
+func (m *Matcher) IngestAll(codegenList []*CodegenFp, opts IngestOptions) []IngestResult {
 	var results = make([]IngestResult, len(codegenList))
 	var wg sync.WaitGroup
 
 	for i, codegenFp := range codegenList {
 		wg.Add(1)
+		opts.Throttle.acquire()
 		go func(group int, codegenFp *CodegenFp) {
 			defer wg.Done()
+			defer opts.Throttle.release()
 
-			glog.Infof("Processing codegen %+v\n", codegenFp.Meta)
+			m.log().Infof("Processing codegen %+v", codegenFp.Meta)
 
 			fp, err := NewFingerprint(codegenFp)
 			if err != nil {
@@ -37,14 +123,52 @@ func IngestAll(codegenList []*CodegenFp) []IngestResult {
 				return
 			}
 
-			err = Ingest(fp)
+			var selfMatch float32
+			var verified = true
+			if opts.SelfMatch != nil {
+				if selfMatch, verified, err = opts.SelfMatch.verify(m, fp, opts); err == nil && !verified && opts.SelfMatch.Reject {
+					err = ErrSelfMatchFailed
+				}
+				if err != nil {
+					results[group] = IngestResult{TrackID: fp.Meta.TrackID, ExternalID: fp.Meta.ExternalID, Error: err.Error(), SelfMatchConfidence: selfMatch}
+					return
+				}
+			}
+
+			var duplicates []uint32
+			if opts.DryRun {
+				if duplicates, err = m.duplicates(fp); err != nil {
+					results[group] = IngestResult{TrackID: fp.Meta.TrackID, ExternalID: fp.Meta.ExternalID, Error: err.Error(), DryRun: true}
+					return
+				}
+			}
+
+			requestedTrackID := fp.Meta.TrackID
+			allocated, codes, err := m.ingest(fp, opts)
 			if err != nil {
-				results[group] = IngestResult{TrackID: fp.Meta.TrackID, Error: err.Error()}
+				results[group] = IngestResult{TrackID: fp.Meta.TrackID, ExternalID: fp.Meta.ExternalID, Error: err.Error(), DryRun: opts.DryRun, Duplicates: duplicates}
 				return
 			}
 
-			glog.Infof("Ingested Fingerprint %+v", fp.Meta)
-			results[group] = IngestResult{TrackID: fp.Meta.TrackID}
+			if opts.DryRun {
+				m.log().Infof("Checked Fingerprint %+v without storing it", fp.Meta)
+			} else {
+				m.log().Infof("Ingested Fingerprint %+v", fp.Meta)
+			}
+			results[group] = IngestResult{
+				TrackID:             fp.Meta.TrackID,
+				ExternalID:          fp.Meta.ExternalID,
+				SelfMatchConfidence: selfMatch,
+				Unverified:          !verified,
+				Allocated:           allocated,
+				Variant:             fp.variant,
+				Codes:               codes,
+				DryRun:              opts.DryRun,
+				Duplicates:          duplicates,
+			}
+			if requestedTrackID != 0 && requestedTrackID != fp.Meta.TrackID {
+				results[group].RemappedFrom = requestedTrackID
+			}
 		}(i, codegenFp)
 	}
 
@@ -53,28 +177,192 @@ func IngestAll(codegenList []*CodegenFp) []IngestResult {
 	return results
 }
 
-// Ingest takes a single CodegenFp and stores it in the database for matching
-func Ingest(fp *Fingerprint) error {
+// Ingest stores a single fingerprint in the database connected by DBConnect
+func Ingest(fp *Fingerprint, opts IngestOptions) error {
+	return defaultMatcher.Ingest(fp, opts)
+}
+
+// Ingest takes a single CodegenFp and stores it in the store for matching, the
+// fingerprint's TrackID is updated when one is allocated for it
+func (m *Matcher) Ingest(fp *Fingerprint, opts IngestOptions) error {
+	_, _, err := m.ingest(fp, opts)
+	return err
+}
+
+// ingest stores the fingerprint, or only checks it can be stored in a dry run, and returns
+// whether a TrackID was allocated for it and the number of codes stored. Dry runs leave the
+// TrackIDs they would allocate 0
+func (m *Matcher) ingest(fp *Fingerprint, opts IngestOptions) (allocated bool, codes int, err error) {
+	db := m.Store
+
+	allocate := func() error {
+		allocated = true
+		if opts.DryRun {
+			fp.Meta.TrackID = 0
+			return nil
+		}
+		fp.Meta.TrackID, err = db.allocateTrackID()
+		return err
+	}
+
+	// tracks ingested without an ID get a new one, anything else may race another ingest
+	if fp.Meta.TrackID != 0 || fp.Meta.ExternalID != "" {
+		defer m.lockIngest(fp)()
+	}
 
-	if fp.Meta.TrackID == 0 {
+	// external IDs are mapped onto the internal uint32 TrackIDs, new ones always get allocated
+	if fp.Meta.ExternalID != "" && fp.Meta.TrackID == 0 {
+		if fp.Meta.TrackID, err = db.trackIDForExternalID(fp.Meta.ExternalID); err != nil {
+			m.log().Errorf("%s", err)
+			return false, 0, err
+		}
+		if fp.Meta.TrackID == 0 {
+			if err = allocate(); err != nil {
+				m.log().Errorf("%s", err)
+				return false, 0, err
+			}
+			glog.V(3).Infof("Allocated TrackID=%d for ExternalID=%s", fp.Meta.TrackID, fp.Meta.ExternalID)
+		}
+	}
+
+	if fp.Meta.TrackID == 0 && !allocated && opts.AllocateTrackIDs {
+		if err = allocate(); err != nil {
+			m.log().Errorf("%s", err)
+			return false, 0, err
+		}
+		glog.V(3).Infof("Allocated TrackID=%d", fp.Meta.TrackID)
+	}
+
+	if fp.Meta.TrackID == 0 && !allocated {
 		glog.V(3).Info("TrackID is missing, aborting ingestion")
-		return ErrTrackIDMissing
+		return false, 0, ErrTrackIDMissing
 	}
 
-	exists, err := db.checkTrackExists(fp.Meta.TrackID)
-	if err != nil {
-		glog.Error(err)
-		return err
+	// the TrackIDs a dry run would allocate are new
+	var exists bool
+	if fp.Meta.TrackID != 0 {
+		if exists, err = db.checkTrackExists(fp.Meta.TrackID); err != nil {
+			m.log().Errorf("%s", err)
+			return false, 0, err
+		}
 	}
 
-	if exists {
+	if exists && opts.Collisions != CollisionIgnore {
+		same, err := m.isSameAudio(fp)
+		if err != nil {
+			m.log().Errorf("%s", err)
+			return false, 0, err
+		}
+
+		if !same && opts.Collisions == CollisionReject {
+			glog.V(3).Infof("TrackID=%d already exists with different audio, aborting ingestion", fp.Meta.TrackID)
+			return false, 0, ErrTrackIDCollision
+		} else if !same {
+			requestedTrackID := fp.Meta.TrackID
+			if err = allocate(); err != nil {
+				m.log().Errorf("%s", err)
+				return false, 0, err
+			}
+			glog.V(3).Infof("TrackID=%d already exists with different audio, remapped to TrackID=%d", requestedTrackID, fp.Meta.TrackID)
+			exists = false
+		}
+	}
+
+	if exists && opts.Variants {
+		// save numbers the variant in the transaction that stores it, so concurrent ingests
+		// of the track can't pick the same one. Dry runs only report the next one
+		fp.newVariant = true
+		if opts.DryRun {
+			if fp.variant, err = db.nextVariant(fp.Meta.TrackID); err != nil {
+				m.log().Errorf("%s", err)
+				return false, 0, err
+			}
+		}
+		glog.V(3).Infof("TrackID=%d already exists, storing as a new variant", fp.Meta.TrackID)
+	} else if exists {
 		glog.V(3).Infof("TrackID=%d already exists, aborting ingestion", fp.Meta.TrackID)
-		return ErrTrackIDExists
+		return false, 0, ErrTrackIDExists
+	} else {
+		glog.V(3).Infof("TrackID=%d does not exist, starting ingestion", fp.Meta.TrackID)
 	}
 
-	glog.V(3).Infof("TrackID=%d does not exist, starting ingestion", fp.Meta.TrackID)
+	ingested := fp
+	if fp, err = fp.forStorage(opts); err != nil {
+		return false, 0, err
+	}
+	fp.variant, fp.newVariant = ingested.variant, ingested.newVariant
 
-	err = db.save(fp)
+	if opts.DryRun {
+		return allocated, len(fp.Codes), nil
+	}
 
-	return err
+	stored := m.hashCodes(fp)
+	if m.postings != nil {
+		indexed := *stored
+		indexed.indexCodes = m.postings.index(stored)
+		stored = &indexed
+	}
+
+	if err = db.save(stored); err != nil {
+		return false, 0, err
+	}
+	ingested.variant, fp.variant = stored.variant, stored.variant
+	m.negatives.invalidate()
+	m.events.publishSaved(fp)
+
+	return allocated, len(fp.Codes), nil
+}
+
+// duplicates returns the tracks other than its own the fingerprint already matches
+func (m *Matcher) duplicates(fp *Fingerprint) ([]uint32, error) {
+	matches, _, err := m.match(fp, MatchOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	var duplicates []uint32
+	for _, match := range matches {
+		if match.TrackID != fp.Meta.TrackID {
+			duplicates = append(duplicates, match.TrackID)
+		}
+	}
+	return duplicates, nil
+}
+
+// forStorage returns the fingerprint as it's stored by an ingest with the options, only the
+// registered segment of segment ingests and fewer codes of long fingerprints are kept
+func (fp *Fingerprint) forStorage(opts IngestOptions) (*Fingerprint, error) {
+	if fp.Meta.SegmentStart != 0 || fp.Meta.SegmentEnd != 0 {
+		if fp.Meta.SegmentEnd <= fp.Meta.SegmentStart {
+			return nil, ErrInvalidSegment
+		}
+		glog.V(3).Infof("TrackID=%d registering segment %.1fs-%.1fs of ParentTrackID=%d", fp.Meta.TrackID, fp.Meta.SegmentStart, fp.Meta.SegmentEnd, fp.Meta.ParentTrackID)
+		fp = fp.newSegment(secondsToDuration(fp.Meta.SegmentStart), secondsToDuration(fp.Meta.SegmentEnd))
+	}
+
+	minTime, maxTime := fp.timeRange()
+	if opts.SparseMinutes > 0 && opts.SparseEvery > 1 && maxTime-minTime > uint32(opts.SparseMinutes*fpSixtySecOffset) {
+		glog.V(3).Infof("TrackID=%d is longer than %d minutes, storing every %d codes", fp.Meta.TrackID, opts.SparseMinutes, opts.SparseEvery)
+		fp = fp.newSampled(0, opts.SparseEvery)
+		fp.sparsity = uint32(opts.SparseEvery)
+	} else if opts.FullMinutes > 0 {
+		fp = fp.newSampled(opts.FullMinutes, opts.SampleEvery)
+	}
+
+	return fp, nil
+}
+
+// isSameAudio compares the fingerprint with the one already stored under its TrackID
+func (m *Matcher) isSameAudio(fp *Fingerprint) (bool, error) {
+	storedFp, err := m.Store.load(fp.Meta.TrackID, 0)
+	if err != nil {
+		return false, err
+	}
+	fp = m.hashCodes(fp)
+
+	scorer := HistogramScorer{Slop: histogramMatchSlop, Partial: true}
+	confidence := scorer.Score(fp.NewClamped(), storedFp).Confidence
+	glog.V(3).Infof("TrackID=%d compared to the stored fingerprint with Confidence=%f", fp.Meta.TrackID, confidence)
+
+	return confidence >= defaultThresholds.MinConfidenceLowQuality, nil
 }
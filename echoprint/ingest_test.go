@@ -0,0 +1,100 @@
+package echoprint
+
+import (
+	"sync"
+	"testing"
+)
+
+// TestConcurrentIngest ingests the same TrackID twice at once, exactly one of the ingests
+// must store it. Run with -race
+func TestConcurrentIngest(t *testing.T) {
+	list, err := ParseCodegenFile("../test-data/fp1.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for round := 0; round < 20; round++ {
+		m := New(WithStore(NewMemoryStore()))
+
+		var wg sync.WaitGroup
+		start := make(chan struct{})
+		errs := make([]error, 2)
+		for i := range errs {
+			fp, err := NewFingerprint(list[i])
+			if err != nil {
+				t.Fatal(err)
+			}
+			fp.Meta.TrackID = 1
+
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				<-start
+				errs[i] = m.Ingest(fp, IngestOptions{})
+			}(i)
+		}
+		close(start)
+		wg.Wait()
+
+		if !(errs[0] == nil && errs[1] == ErrTrackIDExists) && !(errs[0] == ErrTrackIDExists && errs[1] == nil) {
+			t.Fatalf("round %d: concurrent ingests returned %v, want one success and one ErrTrackIDExists", round, errs)
+		}
+		if variants, err := m.Store.nextVariant(1); err != nil || variants != 1 {
+			t.Fatalf("round %d: stored %d fingerprints (%v), want 1", round, variants, err)
+		}
+	}
+}
+
+// TestConcurrentVariantIngest ingests new variants of a track at once through matchers that
+// share the store, so the ingest locks don't serialize them. Each must get its own variant
+func TestConcurrentVariantIngest(t *testing.T) {
+	list, err := ParseCodegenFile("../test-data/fp1.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for round := 0; round < 20; round++ {
+		store := NewMemoryStore()
+		fp, err := NewFingerprint(list[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		fp.Meta.TrackID = 1
+		if err := New(WithStore(store)).Ingest(fp, IngestOptions{}); err != nil {
+			t.Fatal(err)
+		}
+
+		var wg sync.WaitGroup
+		start := make(chan struct{})
+		errs := make([]error, 2)
+		variants := make([]uint32, 2)
+		for i := range errs {
+			fp, err := NewFingerprint(list[i])
+			if err != nil {
+				t.Fatal(err)
+			}
+			fp.Meta.TrackID = 1
+			m := New(WithStore(store))
+
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				<-start
+				errs[i] = m.Ingest(fp, IngestOptions{Variants: true})
+				variants[i] = fp.variant
+			}(i)
+		}
+		close(start)
+		wg.Wait()
+
+		if errs[0] != nil || errs[1] != nil {
+			t.Fatalf("round %d: concurrent variant ingests returned %v", round, errs)
+		}
+		if variants[0]+variants[1] != 3 || variants[0] == variants[1] {
+			t.Fatalf("round %d: stored as variants %v, want 1 and 2", round, variants)
+		}
+		if next, err := store.nextVariant(1); err != nil || next != 3 {
+			t.Fatalf("round %d: stored %d fingerprints (%v), want 3", round, next, err)
+		}
+	}
+}
@@ -1,8 +1,12 @@
 package echoprint
 
 import (
-	"sort"
+	"cmp"
+	"encoding/json"
+	"math"
+	"slices"
 	"sync"
+	"time"
 
 	"github.com/golang/glog"
 )
@@ -11,220 +15,959 @@ const (
 	maxIngestDuration  = 60 * 60 * 4
 	histogramMatchSlop = 2
 
-	minDBScorePercent = 0.30 * 100
-	bestMatchDiff     = 0.25
-	maxConfidence     = 100.00
-
-	minMatchConfidenceHighQuality   = 0.70 * 100
-	minMatchConfidenceMediumQuality = 0.55 * 100
-	minMatchConfidenceLowQuality    = 0.35 * 100
+	bestMatchDiff = 0.25
+	maxConfidence = 100.00
 
 	searchDepthHighQuality   = 200
 	searchDepthMediumQuality = 350
 	searchDepthLowQuality    = 500
+
+	// only the top candidates are cross matched when clustering recordings
+	maxClusterCandidates = 10
+	// candidates that cross match above this confidence are considered the same recording
+	minClusterConfidence = 0.70 * 100
+
+	nearMatchMinConfidence  = 0.20 * 100
+	nearMatchMinAlignment   = 0.5
+	nearMatchMaxCodeOverlap = 0.6
 )
 
+// defaultThresholds are used for the thresholds not set by the query, the Matcher or its
+// profile
+var defaultThresholds = Thresholds{
+	MinConfidenceHighQuality:   0.70 * 100,
+	MinConfidenceMediumQuality: 0.55 * 100,
+	MinConfidenceLowQuality:    0.35 * 100,
+	MinDBScoreHighQuality:      0.30 * 100,
+	MinDBScoreMediumQuality:    0.30 * 100,
+	MinDBScoreLowQuality:       0.30 * 100,
+}
+
+// broadcasts are commonly sped up (or slowed down) by a few percent, these are the factors
+// tried against the query's Times when time scaling is enabled
+var timeScaleFactors = []float32{0.97, 0.98, 0.99, 1.01, 1.02, 1.03}
+
+// MatchOptions controls the optional behaviour of the matching algorithm, the zero value
+// matches using the defaults
+type MatchOptions struct {
+	// TimeScaling retries the confidence calculation with the query's Times scaled by
+	// small factors so that sped up or slowed down captures still identify
+	TimeScaling bool
+
+	// BestMatchPolicy decides whether the top match is distinct enough to be marked as the
+	// best match, defaults to a 25% separation ratio
+	BestMatchPolicy BestMatchPolicy
+
+	// ClusterRecordings groups matches that are the same recording under different TrackIDs
+	// (different UPCs etc.) so they don't prevent each other being the best match
+	ClusterRecordings bool
+
+	// GroupByISRC returns the matches sharing an ISRC as a single match, the most confident,
+	// with the others nested in its Grouped matches
+	GroupByISRC bool
+
+	// ScoreDetails adds the rank and the components of the confidence score to each
+	// match, for downstream systems that re-rank results
+	ScoreDetails bool
+
+	// Scorer compares the query against each candidate, defaults to the time offset
+	// histogram scorer
+	Scorer Scorer
+
+	// Thresholds overrides the minimum confidence required for a match
+	Thresholds Thresholds
+
+	// ClampMinutes limits the length of the query, defaults to 4 minutes
+	ClampMinutes int
+
+	// Unclamped matches the whole query rather than its first ClampMinutes, for forensic
+	// comparisons of full length recordings. Scoring costs grow with the length of the query
+	Unclamped bool
+
+	// Filter restricts the candidates to tracks matching metadata predicates
+	Filter *MetadataFilter
+
+	// DurationTolerance discards candidates whose stored duration differs from the query's
+	// claimed duration by more than this ratio (0.2 = 20%), 0 disables the check. Tracks
+	// without a known duration are never discarded
+	DurationTolerance float32
+
+	// Concurrency limits how many fingerprints of MatchAll are matched in parallel, 0 matches
+	// them all at once
+	Concurrency int
+
+	// Throttle reduces the parallelism of MatchAll under memory pressure, nil disables it
+	Throttle *Throttle
+
+	// RequestID identifies the request the match is performed for in logs and errors
+	RequestID string
+
+	// Experiment runs an alternative configuration in shadow mode on a sample of queries
+	Experiment *Experiment
+
+	// LatencyBudget bounds the time spent matching a fingerprint, candidates not scored in
+	// time are skipped and the matches found so far are returned flagged as partial. 0
+	// scores every candidate
+	LatencyBudget time.Duration
+
+	// EarlyExit stops scoring once a dominant match is found, nil scores every candidate
+	EarlyExit *EarlyExit
+
+	// AdaptiveDepth fetches candidates in pages until their screening scores fall off, nil
+	// fetches the fixed search depth for the query's quality in one go
+	AdaptiveDepth *AdaptiveDepth
+
+	// CueSheet controls how CueSheet splits long queries and tidies the cues it identifies
+	CueSheet CueSheetOptions
+
+	// Trace records the time each backend took to serve the candidate retrieval in
+	// MatchStats.Trace
+	Trace bool
+
+	// Tiers are searched in order, each only until one finds a best match, so the frontline
+	// releases can be searched before the long tail. Nil searches every track at once
+	Tiers []Tier
+
+	// Samples declares the fingerprints of MatchAll to be clips of the same asset (e.g. a few
+	// random excerpts of a file), their evidence is combined into a single MatchGroup
+	Samples bool
+
+	// NearMatches reports the candidates that fall short of a match but look like another
+	// version of the same recording in MatchStats.NearMatches, nil doesn't look for them
+	NearMatches *NearMatches
+
+	// VerifyBest re-scores the best match against the full query with a tighter slop
+	// before it is marked best, nil trusts the best match policy alone
+	VerifyBest *BestMatchVerification
+
+	// Alignment maps out which regions of the query match each match and which differ, nil
+	// doesn't. Combined with Unclamped it compares full length recordings
+	Alignment *AlignmentOptions
+
+	// scores memoizes the comparisons of a MatchAll request, nil outside of one
+	scores *scoreCache
+}
+
+// EarlyExit ends the scoring of candidates when one is an obvious hit. Candidates are scored
+// in order of their screening (code) score, once a candidate reaches MinConfidence and every
+// remaining candidate's screening score is below MaxScreeningRatio of its own, the remaining
+// candidates can't realistically compete and are skipped
+type EarlyExit struct {
+	// MinConfidence is the confidence a match needs to end the search, e.g. 95
+	MinConfidence float32
+	// MaxScreeningRatio is the highest screening score of the remaining candidates, relative
+	// to the dominant match's, that still ends the search, e.g. 0.5
+	MaxScreeningRatio float32
+}
+
+// scorer returns the Scorer of the options, the histogram scorer when none is set
+func (o MatchOptions) scorer() Scorer {
+	if o.Scorer == nil {
+		return HistogramScorer{Slop: histogramMatchSlop}
+	}
+	return o.Scorer
+}
+
+// dominates reports whether the scored candidate makes the next candidate's screening score
+// too low to be worth scoring
+func (e *EarlyExit) dominates(confidence float32, screening float32, next dbResult) bool {
+	return e != nil && confidence >= e.MinConfidence && next.score < screening*e.MaxScreeningRatio
+}
+
+// NearMatches flags candidates scoring below the match threshold as likely alternate versions
+// (remasters, edits, live takes) when the codes they share with the query line up consistently
+// in time but too few of the query's codes are found in them. Zero values use the defaults. Only
+// candidates above the minimum db score are scored, so that bounds the code overlap from below
+type NearMatches struct {
+	// MinConfidence is the bottom of the confidence band, its top is the match threshold,
+	// defaults to 20
+	MinConfidence float32
+	// MinAlignment is the ratio of the shared codes that must line up at the best time offset,
+	// defaults to 0.5
+	MinAlignment float32
+	// MaxCodeOverlap is the highest ratio of the query's codes found in the candidate, higher
+	// overlaps are the same recording matched poorly rather than another version, defaults to 0.6
+	MaxCodeOverlap float32
+}
+
+// near reports whether a candidate scored below the match threshold is a near match
+func (n *NearMatches) near(fp *Fingerprint, d ScoreDetail) bool {
+	if n == nil || d.CodeOverlap == 0 || d.Confidence < orDefault(n.MinConfidence, nearMatchMinConfidence) {
+		return false
+	}
+
+	alignment := float32(d.Score) / float32(d.CodeOverlap)
+	overlap := float32(d.CodeOverlap) / float32(len(fp.Codes))
+	return alignment >= orDefault(n.MinAlignment, nearMatchMinAlignment) && overlap <= orDefault(n.MaxCodeOverlap, nearMatchMaxCodeOverlap)
+}
+
+// Thresholds are the minimum scores required for a match by fingerprint quality, zero
+// values use the defaults
+type Thresholds struct {
+	MinConfidenceHighQuality   float32 `json:"min_confidence_high_quality,omitempty"`
+	MinConfidenceMediumQuality float32 `json:"min_confidence_medium_quality,omitempty"`
+	MinConfidenceLowQuality    float32 `json:"min_confidence_low_quality,omitempty"`
+
+	// minimum code score (percentage of unique query codes found) for a database
+	// candidate to be considered at all
+	MinDBScoreHighQuality   float32 `json:"min_db_score_high_quality,omitempty"`
+	MinDBScoreMediumQuality float32 `json:"min_db_score_medium_quality,omitempty"`
+	MinDBScoreLowQuality    float32 `json:"min_db_score_low_quality,omitempty"`
+}
+
+// overriddenBy returns the thresholds with every non-zero value of o replacing its own
+func (t Thresholds) overriddenBy(o Thresholds) Thresholds {
+	t.MinConfidenceHighQuality = orDefault(o.MinConfidenceHighQuality, t.MinConfidenceHighQuality)
+	t.MinConfidenceMediumQuality = orDefault(o.MinConfidenceMediumQuality, t.MinConfidenceMediumQuality)
+	t.MinConfidenceLowQuality = orDefault(o.MinConfidenceLowQuality, t.MinConfidenceLowQuality)
+	t.MinDBScoreHighQuality = orDefault(o.MinDBScoreHighQuality, t.MinDBScoreHighQuality)
+	t.MinDBScoreMediumQuality = orDefault(o.MinDBScoreMediumQuality, t.MinDBScoreMediumQuality)
+	t.MinDBScoreLowQuality = orDefault(o.MinDBScoreLowQuality, t.MinDBScoreLowQuality)
+	return t
+}
+
+func (t Thresholds) minConfidence(quality string) float32 {
+	t = defaultThresholds.overriddenBy(t)
+	return byQuality(quality, t.MinConfidenceHighQuality, t.MinConfidenceMediumQuality, t.MinConfidenceLowQuality)
+}
+
+func (t Thresholds) minDBScore(quality string) float32 {
+	t = defaultThresholds.overriddenBy(t)
+	return byQuality(quality, t.MinDBScoreHighQuality, t.MinDBScoreMediumQuality, t.MinDBScoreLowQuality)
+}
+
+func byQuality(quality string, high, medium, low float32) float32 {
+	switch quality {
+	case qualityHigh:
+		return high
+	case qualityMedium:
+		return medium
+	default:
+		return low
+	}
+}
+
+func orDefault(value, def float32) float32 {
+	if value == 0 {
+		return def
+	}
+	return value
+}
+
+// BestMatchPolicy decides if a match is too close to the top match for the top match to
+// be declared the best
+type BestMatchPolicy interface {
+	Tied(top, match *MatchResult) bool
+}
+
+// SeparationRatio requires the top match to beat the others by a ratio of its own confidence
+type SeparationRatio float32
+
+// Tied implements BestMatchPolicy
+func (p SeparationRatio) Tied(top, match *MatchResult) bool {
+	return top.Confidence-match.Confidence < top.Confidence*float32(p)
+}
+
+// AbsoluteMargin requires the top match to beat the others by a fixed confidence margin
+type AbsoluteMargin float32
+
+// Tied implements BestMatchPolicy
+func (p AbsoluteMargin) Tied(top, match *MatchResult) bool {
+	return top.Confidence-match.Confidence < float32(p)
+}
+
+// TopMatch always marks the top match as the best
+type TopMatch struct{}
+
+// Tied implements BestMatchPolicy
+func (p TopMatch) Tied(top, match *MatchResult) bool {
+	return false
+}
+
 // MatchResult represents a response from the fingerprint matching algorithm
 type MatchResult struct {
 	fp         *Fingerprint
-	Best       bool        `json:"best"`
-	TrackID    uint32      `json:"track_id"`
-	Filename   string      `json:"filename"`
-	UPC        string      `json:"upc"`
-	ISRC       string      `json:"isrc"`
-	Confidence float32     `json:"confidence"`
-	IngestedAt string      `json:"ingested_at"`
-	Error      interface{} `json:"error"`
+	Best       bool              `json:"best"`
+	TrackID    uint32            `json:"track_id"`
+	ExternalID ExternalID        `json:"external_id,omitempty"`
+	Filename   string            `json:"filename"`
+	UPC        string            `json:"upc"`
+	ISRC       string            `json:"isrc"`
+	Tags       map[string]string `json:"tags,omitempty"`
+	Confidence float32           `json:"confidence"`
+	IngestedAt string            `json:"ingested_at"`
+	Error      interface{}       `json:"error"`
+
+	// RequestID is set on errors so failures reported by clients can be traced in the logs
+	RequestID string `json:"request_id,omitempty"`
+
+	// RawConfidence is the confidence relative to the entire query rather than only the
+	// part of the query that overlaps the match (Confidence), they only differ with a
+	// MinOverlapRatio below 1
+	RawConfidence float32 `json:"raw_confidence"`
+
+	// score components, only reported when MatchOptions.ScoreDetails is set
+	Rank             int     `json:"rank,omitempty"`
+	RawScore         int     `json:"raw_score,omitempty"`
+	CodeOverlapCount int     `json:"code_overlap_count,omitempty"`
+	AlignedSeconds   float32 `json:"aligned_seconds,omitempty"`
+	// OffsetSeconds is where the start of the query lines up in the track
+	OffsetSeconds float32 `json:"offset_seconds,omitempty"`
+
+	// Tier names the tier the match was found in, when searching tiers
+	Tier string `json:"tier,omitempty"`
+
+	// Samples is the number of clips the track was found in, when matching samples
+	Samples int `json:"samples,omitempty"`
+
+	// Variants is the number of the track's fingerprints that matched, when more than one
+	Variants int `json:"variants,omitempty"`
+
+	// Segment is the registered clip of ParentTrackID that was matched, for segment ingests
+	ParentTrackID uint32   `json:"parent_track_id,omitempty"`
+	Segment       *Segment `json:"segment,omitempty"`
+
+	// TimeScale is the factor applied to the query's Times that scored best, only
+	// reported when time scaling is enabled
+	TimeScale float32 `json:"time_scale,omitempty"`
+
+	// Cluster identifies the recording the match was grouped into when clustering is enabled,
+	// the first match of each cluster is its representative
+	Cluster int `json:"cluster,omitempty"`
+
+	// Tied is set on all the matches that were too close to each other to declare a best match
+	Tied bool `json:"tied,omitempty"`
+
+	// Demoted is set on the match that would have been best but failed the verification
+	Demoted bool `json:"demoted,omitempty"`
+
+	// Alignment maps out the regions of the query that match the track, when requested
+	Alignment *Alignment `json:"alignment,omitempty"`
+
+	// LowInformation is set when a large part of the query was silent or otherwise
+	// too repetitive to match against, the confidence should be treated with suspicion
+	LowInformation bool `json:"low_information"`
+
+	// Grouped are the other matches sharing the match's ISRC when grouping by ISRC
+	Grouped []*MatchResult `json:"grouped,omitempty"`
+
+	// CodegenVersion is the codegen release the matched track was fingerprinted with, when
+	// known. Queries and tracks from different releases are the usual suspects of mismatches
+	CodegenVersion float64 `json:"codegen_version,omitempty"`
+}
+
+// Segment is the time range of a parent track registered by a segment ingest
+type Segment struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+// MarshalJSON implements json.Marshaler, times are given in seconds
+func (s *Segment) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Start float64 `json:"start"`
+		End   float64 `json:"end"`
+	}{s.Start.Seconds(), s.End.Seconds()})
 }
 
-// implement sort.Interface for MatchResults to sort by confidence (descending)
-type byConfidence []*MatchResult
+// UnmarshalJSON implements json.Unmarshaler, times are given in seconds
+func (s *Segment) UnmarshalJSON(data []byte) error {
+	var seconds struct {
+		Start float64 `json:"start"`
+		End   float64 `json:"end"`
+	}
+	if err := json.Unmarshal(data, &seconds); err != nil {
+		return err
+	}
+
+	*s = Segment{Start: secondsToDuration(seconds.Start), End: secondsToDuration(seconds.End)}
+	return nil
+}
 
-func (m byConfidence) Len() int           { return len(m) }
-func (m byConfidence) Swap(i, j int)      { m[i], m[j] = m[j], m[i] }
-func (m byConfidence) Less(i, j int) bool { return m[i].Confidence > m[j].Confidence }
+// byConfidence orders MatchResults by confidence (descending), for slices.SortFunc
+func byConfidence(a, b *MatchResult) int {
+	return cmp.Compare(b.Confidence, a.Confidence)
+}
+
+// byScreeningScore orders candidates by their screening (code) score (descending)
+func byScreeningScore(a, b dbResult) int {
+	return cmp.Compare(b.score, a.score)
+}
+
+func newMatchResult(r dbResult, d ScoreDetail) *MatchResult {
+	var segment *Segment
+	if r.fp.Meta.SegmentEnd > 0 {
+		segment = &Segment{Start: secondsToDuration(r.fp.Meta.SegmentStart), End: secondsToDuration(r.fp.Meta.SegmentEnd)}
+	}
 
-func newMatchResult(r dbResult, confidence float32) *MatchResult {
 	return &MatchResult{
-		fp:         r.fp,
-		TrackID:    r.fp.Meta.TrackID,
-		Filename:   r.fp.Meta.Filename,
-		UPC:        r.fp.Meta.UPC,
-		ISRC:       r.fp.Meta.ISRC,
-		IngestedAt: r.ingestedAt,
-		Confidence: confidence,
+		fp:             r.fp,
+		TrackID:        r.fp.Meta.TrackID,
+		ExternalID:     r.fp.Meta.ExternalID,
+		Filename:       r.fp.Meta.Filename,
+		UPC:            r.fp.Meta.UPC,
+		ISRC:           r.fp.Meta.ISRC,
+		Tags:           r.fp.Meta.Tags,
+		IngestedAt:     r.ingestedAt,
+		Confidence:     d.Confidence,
+		RawConfidence:  d.RawConfidence,
+		ParentTrackID:  r.fp.Meta.ParentTrackID,
+		Segment:        segment,
+		CodegenVersion: r.fp.Meta.Version,
 	}
 }
 
-func newMatchGroupError(err error) []*MatchResult {
-	return []*MatchResult{&MatchResult{Error: err.Error()}}
+// newScoredMatchResult is newMatchResult with the time scale and, when requested, the score
+// components of the match
+func newScoredMatchResult(r dbResult, d ScoreDetail, timeScale float32, scoreDetails bool) *MatchResult {
+	match := newMatchResult(r, d)
+	match.TimeScale = timeScale
+	if scoreDetails {
+		match.RawScore = d.Score
+		match.CodeOverlapCount = d.CodeOverlap
+		match.AlignedSeconds = float32(d.Aligned.Seconds())
+		match.OffsetSeconds = float32(d.Offset.Seconds())
+	}
+
+	return match
+}
+
+// durationsCompatible reports whether the durations are within tolerance of each other
+func durationsCompatible(query, candidate float64, tolerance float32) bool {
+	if tolerance <= 0 || query <= 0 || candidate <= 0 {
+		return true
+	}
+
+	return math.Abs(query-candidate) <= math.Max(query, candidate)*float64(tolerance)
+}
+
+// MatchStats describes the work done to match a single fingerprint
+type MatchStats struct {
+	Candidates int           `json:"candidates"`
+	Elapsed    time.Duration `json:"elapsed"`
+
+	// Partial is set when the latency budget ran out before every candidate was scored,
+	// Unscored is the number of candidates that were skipped
+	Partial  bool `json:"partial,omitempty"`
+	Unscored int  `json:"unscored,omitempty"`
+
+	// Skipped is the number of candidates not scored because an early exit found a dominant match
+	Skipped int `json:"skipped,omitempty"`
+
+	// Tiers is the number of tiers searched, when searching tiers
+	Tiers int `json:"tiers,omitempty"`
+
+	// Pages is the number of candidate pages fetched from the store with adaptive depth
+	Pages int `json:"pages,omitempty"`
+
+	// Cached is set when the "no match" outcome was served from the negative cache
+	Cached bool `json:"cached,omitempty"`
+
+	// Coalesced is set when the results were shared by an identical query matched concurrently
+	Coalesced bool `json:"coalesced,omitempty"`
+
+	// ScoresCached is the number of candidates whose score was already computed for another
+	// fingerprint of the same MatchAll request
+	ScoresCached int `json:"scores_cached,omitempty"`
+
+	// Trace is the time each backend took to serve the candidate retrieval, when tracing
+	Trace []RetrievalSpan `json:"trace,omitempty"`
+
+	// StopCodes are the query's codes left out of the candidate query because their posting
+	// lists are over the cap
+	StopCodes []uint32 `json:"stop_codes,omitempty"`
+
+	// NearMatches are the likely alternate versions found when MatchOptions.NearMatches is
+	// set, MatchAll moves them to the MatchGroup
+	NearMatches []*MatchResult `json:"-"`
+}
+
+// MatchGroup holds the matches found for a single fingerprint of MatchAll
+type MatchGroup struct {
+	Matches     []*MatchResult `json:"matches"`
+	NearMatches []*MatchResult `json:"near_matches,omitempty"`
+	Stats       MatchStats     `json:"stats"`
+
+	// Err is the error the fingerprint failed to match with, reported as the Error of the
+	// group's only match. It isn't encoded, so decoded groups only have the message
+	Err error `json:"-"`
+}
+
+func newMatchGroupError(err error, requestID string) MatchGroup {
+	return MatchGroup{Matches: []*MatchResult{&MatchResult{Error: err.Error(), RequestID: requestID}}, Err: err}
+}
+
+// MatchAll performs mutiple matches in parallel against the database connected by DBConnect
+func MatchAll(codegenList []*CodegenFp, opts MatchOptions) []MatchGroup {
+	return defaultMatcher.MatchAll(codegenList, opts)
 }
 
 // MatchAll performs mutiple matches in parallel, results are grouped by the index of the
-// fingerprint list so they may be returned in the order they are received
-func MatchAll(codegenList []*CodegenFp) [][]*MatchResult {
-	var allMatches = make([][]*MatchResult, len(codegenList))
+// fingerprint list so they may be returned in the order they are received. Samples are
+// returned as a single group
+func (m *Matcher) MatchAll(codegenList []*CodegenFp, opts MatchOptions) []MatchGroup {
+	if opts.Samples {
+		return []MatchGroup{m.matchSamples(codegenList, opts)}
+	}
+
+	var allMatches = make([]MatchGroup, len(codegenList))
+	m.matchEach(codegenList, opts, func(group int, matchGroup MatchGroup) {
+		allMatches[group] = matchGroup
+	})
+
+	return allMatches
+}
+
+// MatchEach performs the matches of MatchAll against the database connected by DBConnect
+func MatchEach(codegenList []*CodegenFp, opts MatchOptions, done func(group int, matchGroup MatchGroup)) {
+	defaultMatcher.MatchEach(codegenList, opts, done)
+}
+
+// MatchEach performs the same matches as MatchAll but calls done with each group as soon as it
+// completes rather than returning them all at the end, so results can be streamed to the
+// client. done may be called concurrently and in any order, samples are not supported
+func (m *Matcher) MatchEach(codegenList []*CodegenFp, opts MatchOptions, done func(group int, matchGroup MatchGroup)) {
+	m.matchEach(codegenList, opts, done)
+}
+
+// matchEach matches every fingerprint in parallel and calls done with each group as it
+// completes, done may be called concurrently
+func (m *Matcher) matchEach(codegenList []*CodegenFp, opts MatchOptions, done func(group int, matchGroup MatchGroup)) {
 	var wg sync.WaitGroup
+	opts.scores = newScoreCache()
+
+	var workers chan struct{}
+	if opts.Concurrency > 0 {
+		workers = make(chan struct{}, opts.Concurrency)
+	}
 
 	for i, codegenFp := range codegenList {
 		wg.Add(1)
+		if workers != nil {
+			workers <- struct{}{}
+		}
+		opts.Throttle.acquire()
 		go func(group int, codegenFp *CodegenFp) {
 			defer wg.Done()
+			defer opts.Throttle.release()
+			if workers != nil {
+				defer func() { <-workers }()
+			}
 
-			glog.Infof("Processing codegen %+v\n", codegenFp.Meta)
+			m.log().Infof("[%s] Processing codegen %+v", opts.RequestID, codegenFp.Meta)
 
 			fp, err := NewFingerprint(codegenFp)
 			if err != nil {
-				allMatches[group] = newMatchGroupError(err)
+				m.log().Errorf("[%s] Invalid fingerprint: %s", opts.RequestID, err)
+				done(group, newMatchGroupError(err, opts.RequestID))
 				return
 			}
 
-			matches, err := Match(fp)
+			matches, stats, err := m.Match(fp, opts)
 			if err != nil {
-				allMatches[group] = newMatchGroupError(err)
+				m.log().Errorf("[%s] Match failed: %s", opts.RequestID, err)
+				done(group, newMatchGroupError(err, opts.RequestID))
 				return
 			}
 
-			glog.Info("Number of matches found:", len(matches))
-			allMatches[group] = matches
+			m.log().Infof("[%s] Number of matches found: %d", opts.RequestID, len(matches))
+			nearMatches := stats.NearMatches
+			stats.NearMatches = nil
+			done(group, MatchGroup{Matches: matches, NearMatches: nearMatches, Stats: stats})
 		}(i, codegenFp)
 	}
 
 	wg.Wait()
+}
 
-	return allMatches
+// Match attempts to find the fingerprint in the database connected by DBConnect
+func Match(fp *Fingerprint, opts MatchOptions) ([]*MatchResult, MatchStats, error) {
+	return defaultMatcher.Match(fp, opts)
+}
+
+// Match attempts to find the fingerprint provided in the store and returns an array of MatchResult
+func (m *Matcher) Match(fp *Fingerprint, opts MatchOptions) ([]*MatchResult, MatchStats, error) {
+	start := time.Now()
+
+	var key uint64
+	if m.negatives != nil {
+		key = negativeCacheKey(fp, m.withDefaults(opts))
+		if m.negatives.contains(key) {
+			return nil, MatchStats{Cached: true, Elapsed: time.Since(start)}, nil
+		}
+	}
+
+	var flight uint64
+	if m.coalescer != nil {
+		flight = coalesceKey(fp, m.withDefaults(opts))
+	}
+	matches, stats, err := m.coalescer.do(flight, func() ([]*MatchResult, MatchStats, error) {
+		return m.matchTiers(fp, opts)
+	})
+	stats.Elapsed = time.Since(start)
+
+	// partial results may have missed the match, they are never cached
+	if err == nil && len(matches) == 0 && !stats.Partial {
+		m.negatives.add(key)
+	}
+
+	if err == nil && opts.Experiment.sample() {
+		opts.Experiment.startShadow(m, fp, matches, stats.Elapsed)
+	}
+
+	return matches, stats, err
 }
 
-// Match attempts to find the fingerprint provided in the database and returns an array of MatchResult
-func Match(fp *Fingerprint) ([]*MatchResult, error) {
+func (m *Matcher) match(fp *Fingerprint, opts MatchOptions) ([]*MatchResult, MatchStats, error) {
 	t := trackTime("Match")
 	defer t.finish()
 
-	if !fp.clamped {
-		fp = fp.NewClamped()
+	var stats MatchStats
+	opts = m.withDefaults(opts)
+
+	var deadline time.Time
+	if opts.LatencyBudget > 0 {
+		deadline = time.Now().Add(opts.LatencyBudget)
 	}
 
-	var numRows int
-	var minMatchConfidence float32
-	switch fp.Quality() {
-	case qualityHigh:
-		numRows = searchDepthHighQuality
-		minMatchConfidence = minMatchConfidenceHighQuality
-	case qualityMedium:
-		numRows = searchDepthMediumQuality
-		minMatchConfidence = minMatchConfidenceMediumQuality
-	default:
-		numRows = searchDepthLowQuality
-		minMatchConfidence = minMatchConfidenceLowQuality
+	query := fp
+	fp, lowInfoRatio := m.prepareQuery(fp, opts)
+
+	if len(fp.Codes) == 0 {
+		glog.V(2).Info("Fingerprint contains no usable codes after trimming low information segments")
+		return nil, stats, nil
 	}
 
-	glog.V(2).Infof("Fingerprint quality is '%s', search depth is %d rows, min confidence is %f%%", fp.Quality(), numRows, minMatchConfidence)
+	numRows := m.searchDepth.rows(fp.Quality())
+	minMatchConfidence := opts.Thresholds.minConfidence(fp.Quality())
+	minDBScore := opts.Thresholds.minDBScore(fp.Quality())
+
+	glog.V(2).Infof("Fingerprint quality is '%s', search depth is %d rows, min db score is %f%%, min confidence is %f%%", fp.Quality(), numRows, minDBScore, minMatchConfidence)
+
+	var matches, nearMatches []*MatchResult
+	var results []dbResult
+	var err error
+	// learned stop codes are never looked up nor scored, those of full posting lists only
+	// stop selecting candidates and the candidates are still scored on every code
+	fp, learned := m.postings.learnedStopCodes(fp)
+	fp = fp.NewIndexed()
+	queryFp, stopCodes := m.postings.stopCodes(fp)
+	if stopCodes = append(learned, stopCodes...); len(stopCodes) > 0 {
+		glog.V(2).Infof("Excluded %d stop codes from the candidate query: %v", len(stopCodes), stopCodes)
+		stats.StopCodes = stopCodes
+	}
+	if len(queryFp.Codes) == 0 {
+		glog.V(2).Info("Fingerprint contains only stop codes")
+		return nil, stats, nil
+	}
 
-	var matches []*MatchResult
-	results, err := db.query(fp, 0, numRows, minDBScorePercent)
+	var cursor candidateCursor
+	if opts.Trace {
+		cursor = m.tracedCandidates(queryFp, minDBScore, opts.Filter, &stats.Trace)
+	} else {
+		cursor = m.Store.candidates(queryFp, minDBScore, opts.Filter)
+	}
+	if opts.AdaptiveDepth != nil {
+		results, stats.Pages, err = opts.AdaptiveDepth.fetch(cursor, numRows)
+	} else {
+		results, _, err = cursor.next(numRows)
+	}
 
 	if err != nil {
-		glog.Error(err)
-		return nil, err
+		m.log().Errorf("%s", err)
+		return nil, stats, err
+	}
+	stats.Candidates = len(results)
+
+	// screening scores only decrease from one candidate to the next so an early exit never
+	// skips a candidate that screened better than the dominant match
+	if opts.EarlyExit != nil {
+		slices.SortStableFunc(results, byScreeningScore)
 	}
 
-	for _, r := range results {
-		confidence := calculateConfidence(fp, r.fp, uint32(histogramMatchSlop))
-		if confidence >= minMatchConfidence {
-			glog.V(1).Info("Match result above minimum threshold, Confidence=", confidence, " TrackID=", r.fp.Meta.TrackID)
-			matches = append(matches, newMatchResult(r, confidence))
+	scaledFps := m.timeScaled(fp, opts)
+	scorer := opts.scorer()
+	batchScorer, _ := scorer.(BatchScorer)
+	scoreKey := opts.scores.queryKey(fp, opts)
+	var batch []ScoreDetail
+	var batchTimeScales []float32
+	var confidences confidenceCounts
+
+	for i, r := range results {
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			stats.Partial = true
+			stats.Unscored = len(results) - i
+			glog.V(1).Infof("Latency budget of %s exhausted, %d of %d candidates unscored", opts.LatencyBudget, stats.Unscored, len(results))
+			break
+		}
+		if batchScorer != nil && i%scoreBatchSize == 0 {
+			batch, batchTimeScales = m.scoreBatch(batchScorer, fp, scaledFps, results[i:min(i+scoreBatchSize, len(results))])
+		}
+
+		if !durationsCompatible(fp.Meta.Duration, r.fp.Meta.Duration, opts.DurationTolerance) {
+			glog.V(2).Info("Match candidate discarded by duration, Duration=", r.fp.Meta.Duration, " QueryDuration=", fp.Meta.Duration, " TrackID=", r.fp.Meta.TrackID)
+			continue
+		}
+
+		d, timeScale, cached := opts.scores.get(scoreKey, r.fp)
+		switch {
+		case cached:
+			stats.ScoresCached++
+		case batchScorer != nil:
+			d, timeScale = batch[i%scoreBatchSize], batchTimeScales[i%scoreBatchSize]
+		default:
+			d, timeScale = m.score(scorer, fp, scaledFps, r.fp)
+			opts.scores.put(scoreKey, r.fp, d, timeScale)
+		}
+
+		confidences.add(d.Confidence, d.Confidence >= minMatchConfidence)
+		if d.Confidence >= minMatchConfidence {
+			glog.V(1).Info("Match result above minimum threshold, Confidence=", d.Confidence, " RawConfidence=", d.RawConfidence, " TrackID=", r.fp.Meta.TrackID)
+			matches = append(matches, newScoredMatchResult(r, d, timeScale, opts.ScoreDetails))
+		} else if opts.NearMatches.near(fp, d) {
+			glog.V(1).Info("Near match below minimum threshold, Confidence=", d.Confidence, " CodeOverlap=", d.CodeOverlap, " Score=", d.Score, " TrackID=", r.fp.Meta.TrackID)
+			nearMatches = append(nearMatches, newScoredMatchResult(r, d, timeScale, opts.ScoreDetails))
 		} else {
-			glog.V(2).Info("Match result below minimum threshold, Confidence=", confidence, " TrackID=", r.fp.Meta.TrackID)
+			glog.V(2).Info("Match result below minimum threshold, Confidence=", d.Confidence, " RawConfidence=", d.RawConfidence, " TrackID=", r.fp.Meta.TrackID)
+		}
+
+		if i+1 < len(results) && opts.EarlyExit.dominates(d.Confidence, r.score, results[i+1]) {
+			stats.Skipped = len(results) - i - 1
+			glog.V(1).Infof("Dominant match found, TrackID=%d Confidence=%f, skipping %d candidates", r.fp.Meta.TrackID, d.Confidence, stats.Skipped)
+			break
 		}
 	}
 
+	m.confidences.record(fp.Quality(), &confidences)
+
+	matches = mergeVariants(matches)
 	numMatches := len(matches)
+	if len(nearMatches) > 0 {
+		stats.NearMatches = nearVersions(mergeVariants(nearMatches), matches)
+	}
 
 	if numMatches > 0 {
-		sort.Sort(byConfidence(matches))
-		determineBestMatch(matches)
-		clampMatchConfidence(matches)
+		matches = rankMatches(matches, opts, scorer)
+		opts.VerifyBest.verify(m, query, matches, scorer, minMatchConfidence)
+		opts.Alignment.alignMatches(fp, matches, minMatchConfidence)
+
+		if lowInfoRatio >= lowInfoFlagRatio {
+			glog.V(2).Infof("%.0f%% of the fingerprint is low information, flagging matches", lowInfoRatio*100)
+			for _, match := range matches {
+				match.LowInformation = true
+			}
+		}
 	}
-	return matches, nil
+	return matches, stats, nil
 }
 
-// determine if we have a "best" match
-func determineBestMatch(matches []*MatchResult) {
-	if len(matches) == 1 {
-		matches[0].Best = true
-		glog.V(2).Infof("Single good match, marking as best: %+v", matches[0])
-	} else {
-		// top match is different enough to call it best
-		if matches[0].Confidence-matches[1].Confidence >= matches[0].Confidence*bestMatchDiff {
-			matches[0].Best = true
-			glog.V(2).Infof("Multiple good matches, top result is different enough, marking as best: %+v", matches[0])
-		} else {
-			glog.V(2).Info("Multiple good matches, top result is not different enough, no best match found")
+// prepareQuery hashes, clamps and trims the query fingerprint as required before scoring it,
+// also returning the ratio of the query trimmed as low information
+func (m *Matcher) prepareQuery(fp *Fingerprint, opts MatchOptions) (*Fingerprint, float32) {
+	fp = m.hashCodes(fp)
+
+	if !fp.clamped && !opts.Unclamped {
+		clampMinutes := opts.ClampMinutes
+		if clampMinutes == 0 {
+			clampMinutes = fpClampMinutes
 		}
+		fp = fp.newClampedTo(clampMinutes)
+	}
+
+	var lowInfoRatio float32
+	if !fp.trimmed {
+		fp, lowInfoRatio = fp.NewTrimmed()
 	}
+
+	return fp, lowInfoRatio
 }
 
-func clampMatchConfidence(matches []*MatchResult) {
+// timeScaled returns the query scaled by each of the time scale factors when time scaling is
+// enabled, nil otherwise
+func (m *Matcher) timeScaled(fp *Fingerprint, opts MatchOptions) []*Fingerprint {
+	if !opts.TimeScaling {
+		return nil
+	}
+
+	scaledFps := make([]*Fingerprint, len(m.scaleFactors()))
+	for i, factor := range m.scaleFactors() {
+		scaledFps[i] = fp.newTimeScaled(factor)
+	}
+	return scaledFps
+}
+
+// score compares the query against the candidate, and its time scaled versions when there are
+// any, returning the best score and the time scale factor it was found at (0 without scaling)
+func (m *Matcher) score(scorer Scorer, fp *Fingerprint, scaledFps []*Fingerprint, candidate *Fingerprint) (ScoreDetail, float32) {
+	d := scorer.Score(fp, candidate)
+	if scaledFps == nil {
+		return d, 0
+	}
+
+	timeScale := float32(1)
+	for i, scaledFp := range scaledFps {
+		if scaled := scorer.Score(scaledFp, candidate); scaled.Confidence > d.Confidence {
+			d = scaled
+			timeScale = m.scaleFactors()[i]
+		}
+	}
+	glog.V(2).Info("Best time scale factor=", timeScale, " TrackID=", candidate.Meta.TrackID)
+
+	return d, timeScale
+}
+
+// rankMatches sorts the matches, groups them as requested and determines the best match
+func rankMatches(matches []*MatchResult, opts MatchOptions, scorer Scorer) []*MatchResult {
+	slices.SortFunc(matches, byConfidence)
+	if opts.GroupByISRC {
+		matches = groupByISRC(matches)
+	}
+	if opts.ScoreDetails {
+		for i, match := range matches {
+			match.Rank = i + 1
+		}
+	}
+	policy := opts.BestMatchPolicy
+	if policy == nil {
+		policy = SeparationRatio(bestMatchDiff)
+	}
+	if opts.ClusterRecordings {
+		determineBestMatch(clusterMatches(matches, scorer), policy)
+	} else {
+		determineBestMatch(matches, policy)
+	}
+	clampMatchConfidence(matches)
+
+	return matches
+}
+
+// nearVersions returns the near matches of tracks that didn't match outright (through another
+// of their fingerprints), sorted by confidence
+func nearVersions(nearMatches, matches []*MatchResult) []*MatchResult {
+	matched := make(map[uint32]bool, len(matches))
 	for _, match := range matches {
-		if match.Confidence > maxConfidence {
-			match.Confidence = maxConfidence
+		matched[match.TrackID] = true
+	}
+
+	versions := nearMatches[:0]
+	for _, match := range nearMatches {
+		if !matched[match.TrackID] {
+			versions = append(versions, match)
 		}
 	}
+	slices.SortFunc(versions, byConfidence)
+
+	return versions
 }
 
-func calculateConfidence(fp *Fingerprint, matchFp *Fingerprint, slop uint32) float32 {
-	t := trackTime("calculateConfidence")
-	defer t.finish()
+// mergeVariants combines the matches of multiple fingerprints of the same track into a single
+// match (the most confident) so they don't compete with each other for the best match
+func mergeVariants(matches []*MatchResult) []*MatchResult {
+	byTrackID := make(map[uint32]*MatchResult, len(matches))
+	merged := matches[:0]
+	for _, match := range matches {
+		existing, ok := byTrackID[match.TrackID]
+		if !ok {
+			byTrackID[match.TrackID] = match
+			merged = append(merged, match)
+			continue
+		}
 
-	timeDiffs := make(map[int]uint16)
+		if existing.Variants == 0 {
+			existing.Variants = 1
+		}
+		existing.Variants++
+		if match.Confidence > existing.Confidence {
+			variants := existing.Variants
+			*existing = *match
+			existing.Variants = variants
+		}
+	}
 
-	// limit the number of codes we map out to the length of the query FP
-	// anything beyond that is useless due to the way we clamp (see Fingerprint.NewClamped())
-	// this is dramatically faster for song matches, but prevents us from finding partials (mixes)
-	matchCodeMap := getCodeTimeMap(matchFp, len(fp.Codes), slop)
+	return merged
+}
 
-	for i, code := range fp.Codes {
-		fpTime := fp.Times[i] / slop * slop
+// groupByISRC nests the matches sharing an ISRC under the most confident of them, matches
+// must be sorted by confidence. Matches without an ISRC are never grouped
+func groupByISRC(matches []*MatchResult) []*MatchResult {
+	byISRC := make(map[string]*MatchResult)
+	grouped := matches[:0]
+	for _, match := range matches {
+		if match.ISRC == "" {
+			grouped = append(grouped, match)
+			continue
+		}
 
-		if matchTimes, ok := matchCodeMap[code]; ok {
-			for _, matchTime := range matchTimes {
-				dist := int(fpTime - matchTime)
-				if dist < 0 {
-					dist = -dist
-				}
-				timeDiffs[dist]++
-			}
+		if first, ok := byISRC[match.ISRC]; ok {
+			first.Grouped = append(first.Grouped, match)
+			continue
 		}
+		byISRC[match.ISRC] = match
+		grouped = append(grouped, match)
 	}
 
-	var timeDiffVals []int
-	for _, key := range timeDiffs {
-		timeDiffVals = append(timeDiffVals, int(key))
+	glog.V(2).Infof("Grouped %d matches into %d by ISRC", len(matches), len(grouped))
+	return grouped
+}
+
+// determine if we have a "best" match, matches must be sorted by confidence
+func determineBestMatch(matches []*MatchResult, policy BestMatchPolicy) {
+	if len(matches) == 1 {
+		matches[0].Best = true
+		glog.V(2).Infof("Single good match, marking as best: %+v", matches[0])
+		return
 	}
-	sort.Sort(sort.Reverse(sort.IntSlice(timeDiffVals)))
 
-	var score int
-	if len(timeDiffVals) > 0 {
-		score = timeDiffVals[0]
-		if len(timeDiffVals) > 1 {
-			score += timeDiffVals[1]
+	// matches are sorted so the first one that isn't tied ends the run of ties
+	for _, match := range matches[1:] {
+		if !policy.Tied(matches[0], match) {
+			break
 		}
+		match.Tied = true
 	}
 
-	return float32(score) / float32(len(fp.Codes)) * 100.00
+	if matches[1].Tied {
+		matches[0].Tied = true
+		glog.V(2).Info("Multiple good matches, top result is not different enough, no best match found")
+	} else {
+		// top match is different enough to call it best
+		matches[0].Best = true
+		glog.V(2).Infof("Multiple good matches, top result is different enough, marking as best: %+v", matches[0])
+	}
 }
 
-func getCodeTimeMap(fp *Fingerprint, limit int, slop uint32) map[uint32][]uint32 {
-	if len(fp.Codes) < limit {
-		limit = len(fp.Codes)
-	}
+// clusterMatches groups the top matches by cross matching them against each other, matches must
+// be sorted by confidence. Returns the representative (highest confidence) match of each cluster
+func clusterMatches(matches []*MatchResult, scorer Scorer) []*MatchResult {
+	t := trackTime("clusterMatches")
+	defer t.finish()
 
-	codeMap := make(map[uint32][]uint32, limit)
-	for i := 0; i < limit; i++ {
-		code := fp.Codes[i]
-		time := fp.Times[i] / slop * slop
-		codeMap[code] = append(codeMap[code], time)
+	var representatives []*MatchResult
+	for i, match := range matches {
+		if i < maxClusterCandidates {
+			clampedFp := match.fp.NewClamped()
+			for _, rep := range representatives {
+				if scorer.Score(clampedFp, rep.fp).Confidence >= minClusterConfidence {
+					match.Cluster = rep.Cluster
+					break
+				}
+			}
+		}
+
+		if match.Cluster == 0 {
+			match.Cluster = len(representatives) + 1
+			representatives = append(representatives, match)
+		}
 	}
 
-	return codeMap
+	glog.V(2).Infof("Clustered %d matches into %d recordings", len(matches), len(representatives))
+	return representatives
+}
+
+func clampMatchConfidence(matches []*MatchResult) {
+	for _, match := range matches {
+		if match.Confidence > maxConfidence {
+			match.Confidence = maxConfidence
+		}
+	}
 }
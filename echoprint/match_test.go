@@ -0,0 +1,48 @@
+package echoprint
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// TestUnclampedLongQuery matches a query of over 45 minutes in full against itself
+func TestUnclampedLongQuery(t *testing.T) {
+	m := New(WithStore(NewMemoryStore()))
+	fp := repeatedFingerprint(t, "../test-data/fp1.json", 8)
+	fp.Meta.TrackID = 1
+	if err := m.Ingest(fp, IngestOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, unclamped := range []bool{false, true} {
+		matches, _, err := m.Match(fp, MatchOptions{Unclamped: unclamped, ScoreDetails: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(matches) == 0 || !matches[0].Best || matches[0].TrackID != 1 || matches[0].Confidence != maxConfidence {
+			t.Fatalf("unclamped=%v: want track 1 as the best match at %.0f, got %+v", unclamped, maxConfidence, matches)
+		}
+		if unclamped && matches[0].RawScore <= 1<<16 {
+			t.Errorf("unclamped query only scored %d codes", matches[0].RawScore)
+		}
+	}
+}
+
+// TestSegmentJSON decodes the segments of encoded results back, times are in seconds
+func TestSegmentJSON(t *testing.T) {
+	segment := Segment{Start: 1500 * time.Millisecond, End: 90 * time.Second}
+	group := MatchGroup{Matches: []*MatchResult{{TrackID: 1, Segment: &segment}}}
+
+	data, err := json.Marshal(group)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded MatchGroup
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("decoding %s: %s", data, err)
+	}
+	if got := decoded.Matches[0].Segment; got == nil || *got != segment {
+		t.Errorf("segment %+v decoded as %+v", segment, got)
+	}
+}
@@ -0,0 +1,57 @@
+package echoprint
+
+import (
+	"hash/fnv"
+	"strconv"
+	"sync"
+)
+
+// ingests of the same TrackID (or external ID) are serialized on one of these locks
+const ingestLockStripes = 64
+
+// Matcher ingests fingerprints into and matches them against its Store. A Matcher holds no
+// global state, so an application may run several independent Matchers (different catalogs
+// or backends) in one process
+type Matcher struct {
+	Store Store
+
+	// defaults fill in the MatchOptions not provided by each query
+	defaults         MatchOptions
+	searchDepth      SearchDepth
+	timeScaleFactors []float32
+	logger           Logger
+	negatives        *negativeCache
+	coalescer        *coalescer
+	events           *eventHub
+	confidences      *confidenceStats
+	codeHasher       CodeHasher
+	postings         *postingCounts
+
+	ingestLocks [ingestLockStripes]sync.Mutex
+}
+
+// defaultMatcher backs the package level functions, its Store is set by DBConnect
+var defaultMatcher = &Matcher{}
+
+// lockIngest serializes ingests of the same track between the existence checks and the save,
+// the returned function releases the lock
+func (m *Matcher) lockIngest(fp *Fingerprint) func() {
+	key := string(fp.Meta.ExternalID)
+	if key == "" {
+		key = strconv.FormatUint(uint64(fp.Meta.TrackID), 10)
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	lock := &m.ingestLocks[h.Sum32()%ingestLockStripes]
+	lock.Lock()
+	return lock.Unlock
+}
+
+// orDefault returns the matcher, or the package level matcher when nil
+func (m *Matcher) orDefault() *Matcher {
+	if m == nil {
+		return defaultMatcher
+	}
+	return m
+}
@@ -0,0 +1,242 @@
+package echoprint
+
+import (
+	"errors"
+	"math"
+	"slices"
+	"sync"
+	"time"
+)
+
+// memoryStore keeps every fingerprint in memory and scans all of them on query, for small
+// embedded indexes (kiosks, WebAssembly builds) that have no solr or bolt
+type memoryStore struct {
+	mu          sync.RWMutex
+	tracks      map[uint32][]*memoryTrack
+	externalIDs map[ExternalID]uint32
+	sequence    uint32
+	// changelog holds every saved fingerprint, the changelog sequence is its length
+	changelog []fingerprintKey
+}
+
+type memoryTrack struct {
+	fp         *Fingerprint
+	codeSet    map[uint32]struct{}
+	ingestedAt string
+}
+
+// NewMemoryStore returns an empty in-memory index, for small embedded catalogs
+func NewMemoryStore() Store {
+	return &memoryStore{
+		tracks:      make(map[uint32][]*memoryTrack),
+		externalIDs: make(map[ExternalID]uint32),
+	}
+}
+
+// UseMemoryStore replaces the database of the package level functions with an empty
+// in-memory index
+func UseMemoryStore() {
+	defaultMatcher.Store = NewMemoryStore()
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
+
+func (s *memoryStore) backendName() string {
+	return "memory"
+}
+
+// memoryCursor pages through the candidates of a scan, best screened first
+type memoryCursor struct {
+	results []dbResult
+}
+
+func (s *memoryStore) candidates(fp *Fingerprint, minScore float32, filter *MetadataFilter) candidateCursor {
+	return s.candidatesBatch([]candidateQuery{{fp: fp, minScore: minScore, filter: filter}})[0]
+}
+
+// candidatesBatch scores every stored fingerprint against all the queries in a single scan
+func (s *memoryStore) candidatesBatch(queries []candidateQuery) []candidateCursor {
+	t := trackTime("memoryStore.query")
+	defer t.finish()
+
+	querySets := make([]map[uint32]struct{}, len(queries))
+	for i, query := range queries {
+		querySets[i] = make(map[uint32]struct{})
+		for _, code := range query.fp.Codes {
+			querySets[i][code] = struct{}{}
+		}
+	}
+
+	results := make([][]dbResult, len(queries))
+	s.mu.RLock()
+	for _, variants := range s.tracks {
+		for _, track := range variants {
+			for i, query := range queries {
+				if !query.filter.allows(track.fp.Meta) {
+					continue
+				}
+				if score := calculateCodeScore(querySets[i], track.codeSet); score >= query.minScore {
+					results[i] = append(results[i], dbResult{fp: track.fp, score: score, ingestedAt: track.ingestedAt})
+				}
+			}
+		}
+	}
+	s.mu.RUnlock()
+
+	cursors := make([]candidateCursor, len(queries))
+	for i := range results {
+		slices.SortFunc(results[i], byScreeningScore)
+		cursors[i] = &memoryCursor{results: results[i]}
+	}
+
+	return cursors
+}
+
+func (c *memoryCursor) next(rows int) ([]dbResult, bool, error) {
+	if rows > len(c.results) {
+		rows = len(c.results)
+	}
+	page := c.results[:rows]
+	c.results = c.results[rows:]
+
+	return page, len(c.results) > 0, nil
+}
+
+func (s *memoryStore) save(fp *Fingerprint) error {
+	fp.quality = fp.storedQuality()
+	fp.codeIndex = newCodeIndex(fp)
+	track := &memoryTrack{
+		fp:         fp,
+		codeSet:    make(map[uint32]struct{}),
+		ingestedAt: time.Now().UTC().Format(time.RFC3339),
+	}
+	for _, code := range fp.indexedCodes() {
+		track.codeSet[code] = struct{}{}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	variants := s.tracks[fp.Meta.TrackID]
+	if fp.newVariant {
+		fp.variant = uint32(len(variants))
+	}
+	if int(fp.variant) < len(variants) {
+		return ErrTrackIDExists
+	} else if int(fp.variant) > len(variants) {
+		return errors.New("Variant out of sequence")
+	}
+	if fp.variant > 0 {
+		// additional fingerprints of the track share its metadata
+		variantFp := *fp
+		variantFp.Meta = variants[0].fp.Meta
+		variantFp.quality = variants[0].fp.quality
+		track.fp = &variantFp
+	}
+
+	s.tracks[fp.Meta.TrackID] = append(variants, track)
+	s.changelog = append(s.changelog, fingerprintKey{fp.Meta.TrackID, fp.variant})
+	if fp.Meta.ExternalID != "" {
+		s.externalIDs[fp.Meta.ExternalID] = fp.Meta.TrackID
+	}
+
+	return nil
+}
+
+func (s *memoryStore) load(trackID uint32, variant uint32) (*Fingerprint, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	variants := s.tracks[trackID]
+	if int(variant) >= len(variants) {
+		return nil, ErrTrackNotFound
+	}
+
+	return variants[variant].fp, nil
+}
+
+func (s *memoryStore) trackIDs() ([]uint32, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	trackIDs := make([]uint32, 0, len(s.tracks))
+	for trackID := range s.tracks {
+		trackIDs = append(trackIDs, trackID)
+	}
+
+	return trackIDs, nil
+}
+
+func (s *memoryStore) trackIDForExternalID(id ExternalID) (uint32, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.externalIDs[id], nil
+}
+
+func (s *memoryStore) allocateTrackID() (uint32, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for {
+		if s.sequence == math.MaxUint32 {
+			return 0, errors.New("TrackID sequence exhausted")
+		}
+		s.sequence++
+		if _, exists := s.tracks[s.sequence]; !exists {
+			return s.sequence, nil
+		}
+	}
+}
+
+func (s *memoryStore) nextVariant(trackID uint32) (uint32, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return uint32(len(s.tracks[trackID])), nil
+}
+
+func (s *memoryStore) checkTrackExists(trackID uint32) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, exists := s.tracks[trackID]
+	return exists, nil
+}
+
+func (s *memoryStore) setQuality(trackID uint32, quality string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	variants := s.tracks[trackID]
+	if len(variants) == 0 {
+		return ErrTrackNotFound
+	}
+
+	// queries may still hold the previous fingerprints, so they are replaced rather than modified
+	for _, track := range variants {
+		updatedFp := *track.fp
+		updatedFp.quality = quality
+		track.fp = &updatedFp
+	}
+	s.changelog = append(s.changelog, fingerprintKey{trackID, 0})
+
+	return nil
+}
+
+func (s *memoryStore) changesSince(sequence uint64) ([]fingerprintKey, uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	current := uint64(len(s.changelog))
+	if sequence >= current {
+		return nil, current, nil
+	}
+
+	changes := make([]fingerprintKey, current-sequence)
+	copy(changes, s.changelog[sequence:])
+
+	return changes, current, nil
+}
@@ -0,0 +1,461 @@
+package echoprint
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// ErrStreamNotFound is returned when a stream ID isn't being monitored
+var ErrStreamNotFound = errors.New("Stream not found")
+
+// ErrStreamURL is returned when a stream or one of its segments isn't an http(s) URL of an
+// allowed host
+var ErrStreamURL = errors.New("Stream URL must be http(s) on an allowed host")
+
+// ErrStreamAddress is returned when a stream of a host that isn't explicitly allowed resolves
+// to a loopback, private or link-local address
+var ErrStreamAddress = errors.New("Stream resolves to a loopback, private or link-local address")
+
+const (
+	// streamRequestTimeout bounds the HLS playlist and segment requests
+	streamRequestTimeout = 30 * time.Second
+	// minCaptureInterval spaces the captures of a stream when the capture length is shorter
+	minCaptureInterval = time.Second
+)
+
+// publicStreamTransport only dials public addresses, so streams added by any caller can't
+// reach the server's own or internal networks (e.g. cloud metadata). It doesn't use proxies,
+// which would dial the stream on its behalf
+var publicStreamTransport = newPublicStreamTransport()
+
+func newPublicStreamTransport() *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+				return ErrStreamAddress
+			}
+			return nil
+		},
+	}
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = nil
+	t.DialContext = dialer.DialContext
+	return t
+}
+
+// isPublicIP reports whether the address is routable outside the server's networks
+func isPublicIP(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsPrivate() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsInterfaceLocalMulticast() && !ip.IsMulticast() && !ip.IsUnspecified()
+}
+
+// Stream is a broadcast (Icecast or HLS) being monitored
+type Stream struct {
+	ID      string     `json:"id"`
+	URL     string     `json:"url"`
+	Current *Detection `json:"current"`
+	Error   string     `json:"error,omitempty"`
+
+	stop chan struct{}
+}
+
+// Detection is a track identified on a monitored stream
+type Detection struct {
+	StreamID   string    `json:"stream_id"`
+	TrackID    uint32    `json:"track_id"`
+	Start      time.Time `json:"start"`
+	End        time.Time `json:"end"`
+	Confidence float32   `json:"confidence"`
+}
+
+// Monitor continuously captures, fingerprints and matches a set of streams, turning the
+// service into a self contained broadcast monitor
+type Monitor struct {
+	// Capture is the length of audio fingerprinted for each match
+	Capture time.Duration
+	// Options are used to match each capture
+	Options MatchOptions
+	// OnDetection is called when a detection ends (the stream moved on to something else)
+	OnDetection func(*Detection)
+	// Matcher matches the captures, nil uses the database connected by DBConnect
+	Matcher *Matcher
+	// AllowedHosts are the hosts streams and their HLS segments may be captured from, empty
+	// allows any host that resolves to a public address
+	AllowedHosts []string
+
+	mu      sync.Mutex
+	streams map[string]*Stream
+}
+
+// NewMonitor returns a Monitor that matches captures of the given length
+func NewMonitor(capture time.Duration, opts MatchOptions, onDetection func(*Detection)) *Monitor {
+	// captures are taken from anywhere in a track
+	if opts.Scorer == nil {
+		opts.Scorer = HistogramScorer{Slop: histogramMatchSlop, Partial: true}
+	}
+
+	return &Monitor{
+		Capture:     capture,
+		Options:     opts,
+		OnDetection: onDetection,
+		streams:     make(map[string]*Stream),
+	}
+}
+
+// Add starts monitoring the stream at streamURL
+func (m *Monitor) Add(streamURL string) (*Stream, error) {
+	u, err := url.ParseRequestURI(streamURL)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.checkURL(u); err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, 8)
+	rand.Read(b)
+	stream := &Stream{ID: hex.EncodeToString(b), URL: streamURL, stop: make(chan struct{})}
+
+	m.mu.Lock()
+	m.streams[stream.ID] = stream
+	m.mu.Unlock()
+
+	glog.Infof("Monitoring stream %s [%s]", stream.ID, stream.URL)
+	go m.run(stream)
+	return stream, nil
+}
+
+// Remove stops monitoring a stream
+func (m *Monitor) Remove(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	stream, ok := m.streams[id]
+	if !ok {
+		return ErrStreamNotFound
+	}
+
+	close(stream.stop)
+	delete(m.streams, id)
+	return nil
+}
+
+// Streams returns a snapshot of the monitored streams sorted by URL
+func (m *Monitor) Streams() []Stream {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	streams := make([]Stream, 0, len(m.streams))
+	for _, stream := range m.streams {
+		s := *stream
+		if s.Current != nil {
+			current := *s.Current
+			s.Current = &current
+		}
+		streams = append(streams, s)
+	}
+
+	sort.Slice(streams, func(i, j int) bool { return streams[i].URL < streams[j].URL })
+	return streams
+}
+
+// checkURL returns ErrStreamURL unless the URL is http(s) on an allowed host. Without allowed
+// hosts, addresses that aren't public are rejected here and host names when they are dialed
+func (m *Monitor) checkURL(u *url.URL) error {
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return ErrStreamURL
+	}
+	if len(m.AllowedHosts) == 0 {
+		if ip := net.ParseIP(u.Hostname()); ip != nil && !isPublicIP(ip) {
+			return ErrStreamURL
+		}
+		return nil
+	}
+	for _, host := range m.AllowedHosts {
+		if strings.EqualFold(u.Hostname(), host) {
+			return nil
+		}
+	}
+	return ErrStreamURL
+}
+
+// client returns the client streams are requested with, the allowed hosts are trusted
+// wherever they resolve while any other host may only be on a public address
+func (m *Monitor) client(timeout time.Duration) *http.Client {
+	if len(m.AllowedHosts) > 0 {
+		return &http.Client{Timeout: timeout}
+	}
+	return &http.Client{Timeout: timeout, Transport: publicStreamTransport}
+}
+
+func (m *Monitor) run(stream *Stream) {
+	// cancels the capture in flight when the stream is removed
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stream.stop
+		cancel()
+	}()
+
+	for {
+		select {
+		case <-stream.stop:
+			m.finish(stream, nil)
+			return
+		default:
+		}
+
+		captureStart := time.Now()
+		match, err := m.matchCapture(ctx, stream)
+
+		m.mu.Lock()
+		if err != nil {
+			glog.Errorf("Stream %s: %s", stream.ID, err)
+			stream.Error = err.Error()
+		} else {
+			stream.Error = ""
+		}
+		m.mu.Unlock()
+
+		if err == nil {
+			m.detect(stream, match, captureStart)
+		}
+
+		// captures start at most once per capture length, a stream that is down or ends at
+		// once mustn't be hammered
+		interval := max(m.Capture, minCaptureInterval)
+		wait := interval - time.Since(captureStart)
+		if err != nil {
+			wait = interval
+		}
+		select {
+		case <-stream.stop:
+		case <-time.After(wait):
+		}
+	}
+}
+
+// detect extends the current detection if the same track is still playing, otherwise the
+// current detection is finished and a new one started
+func (m *Monitor) detect(stream *Stream, match *MatchResult, captureStart time.Time) {
+	m.mu.Lock()
+	current := stream.Current
+	if current != nil && match != nil && current.TrackID == match.TrackID {
+		current.End = time.Now()
+		if match.Confidence > current.Confidence {
+			current.Confidence = match.Confidence
+		}
+		m.mu.Unlock()
+		return
+	}
+	m.mu.Unlock()
+
+	var detection *Detection
+	if match != nil {
+		detection = &Detection{
+			StreamID:   stream.ID,
+			TrackID:    match.TrackID,
+			Start:      captureStart,
+			End:        time.Now(),
+			Confidence: match.Confidence,
+		}
+		glog.Infof("Stream %s: detected TrackID=%d Confidence=%f", stream.ID, match.TrackID, match.Confidence)
+	}
+	m.finish(stream, detection)
+}
+
+// finish ends the stream's current detection and replaces it with next
+func (m *Monitor) finish(stream *Stream, next *Detection) {
+	m.mu.Lock()
+	current := stream.Current
+	stream.Current = next
+	m.mu.Unlock()
+
+	if current != nil && m.OnDetection != nil {
+		m.OnDetection(current)
+	}
+}
+
+// matchCapture captures audio from the stream and returns the best match, or nil
+func (m *Monitor) matchCapture(ctx context.Context, stream *Stream) (*MatchResult, error) {
+	f, err := ioutil.TempFile("", "echoprint-capture-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if strings.HasSuffix(strings.ToLower(stream.URL), ".m3u8") {
+		err = m.captureHLS(ctx, stream.URL, f)
+	} else {
+		err = m.captureHTTP(ctx, stream.URL, f)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	codegenList, err := RunCodegen(ctx, f.Name())
+	if err != nil {
+		return nil, err
+	}
+	if len(codegenList) == 0 {
+		return nil, nil
+	}
+
+	fp, err := NewFingerprint(codegenList[0])
+	if err != nil || len(fp.Codes) == 0 {
+		return nil, err
+	}
+
+	matches, _, err := m.Matcher.orDefault().Match(fp, m.Options)
+	if err != nil || len(matches) == 0 || !matches[0].Best {
+		return nil, err
+	}
+	return matches[0], nil
+}
+
+// captureHTTP records a continuous (Icecast/Shoutcast) stream for the capture length
+func (m *Monitor) captureHTTP(ctx context.Context, streamURL string, w io.Writer) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", streamURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := m.client(m.Capture).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("Stream returned " + resp.Status)
+	}
+
+	// the client timeout ends the capture, whatever was received up to then is used
+	_, err = io.Copy(w, resp.Body)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil && !isTimeout(err) {
+		return err
+	}
+	return nil
+}
+
+// captureHLS downloads the most recent media segments listed in an HLS playlist covering the
+// capture length, segments are held to the same hosts as streams
+func (m *Monitor) captureHLS(ctx context.Context, playlistURL string, w io.Writer) error {
+	base, err := url.Parse(playlistURL)
+	if err != nil {
+		return err
+	}
+
+	resp, err := m.getStream(ctx, playlistURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var segments []string
+	var durations []time.Duration
+	var segmentDuration time.Duration
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case strings.HasPrefix(line, "#EXTINF:"):
+			seconds := strings.SplitN(strings.TrimPrefix(line, "#EXTINF:"), ",", 2)[0]
+			if d, err := time.ParseDuration(seconds + "s"); err == nil {
+				segmentDuration = d
+			}
+		case line != "" && !strings.HasPrefix(line, "#"):
+			segments = append(segments, line)
+			durations = append(durations, segmentDuration)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	// live playlists list the most recent segments last
+	first := len(segments)
+	var captured time.Duration
+	for first > 0 && captured < m.Capture {
+		first--
+		captured += durations[first]
+	}
+
+	for _, segment := range segments[first:] {
+		segmentURL, err := base.Parse(segment)
+		if err != nil {
+			return err
+		}
+		if err := m.checkURL(segmentURL); err != nil {
+			return err
+		}
+
+		segmentResp, err := m.getStream(ctx, segmentURL.String())
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(w, segmentResp.Body)
+		segmentResp.Body.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	// wait out the captured duration so the playlist has moved on before the next capture
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(captured):
+	}
+	return nil
+}
+
+// getStream requests an HLS playlist or segment, failing unless it is returned whole
+func (m *Monitor) getStream(ctx context.Context, streamURL string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", streamURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := m.client(streamRequestTimeout).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, errors.New("Stream returned " + resp.Status)
+	}
+	return resp, nil
+}
+
+func isTimeout(err error) bool {
+	timeout, ok := err.(interface {
+		Timeout() bool
+	})
+	return ok && timeout.Timeout()
+}
@@ -0,0 +1,109 @@
+package echoprint
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestMonitorStreamURLs only monitors http(s) streams of the allowed hosts, HLS segments included
+func TestMonitorStreamURLs(t *testing.T) {
+	var segments int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/local.m3u8":
+			w.Write([]byte("#EXTM3U\n#EXTINF:10,\nsegment.ts\n"))
+		case "/remote.m3u8":
+			w.Write([]byte("#EXTM3U\n#EXTINF:10,\nhttp://elsewhere.invalid/segment.ts\n"))
+		default:
+			atomic.AddInt32(&segments, 1)
+		}
+	}))
+	defer server.Close()
+
+	m := NewMonitor(10*time.Second, MatchOptions{}, nil)
+	m.AllowedHosts = []string{"127.0.0.1"}
+	for _, streamURL := range []string{"file:///etc/passwd", "ftp://127.0.0.1/stream", "http://elsewhere.invalid/stream"} {
+		if _, err := m.Add(streamURL); err != ErrStreamURL {
+			t.Errorf("Add(%s) = %v, want ErrStreamURL", streamURL, err)
+		}
+	}
+
+	if err := m.captureHLS(context.Background(), server.URL+"/remote.m3u8", ioutil.Discard); err != ErrStreamURL {
+		t.Errorf("captured a segment of another host: %v", err)
+	}
+
+	// the capture waits out the segments unless it is cancelled
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	if err := m.captureHLS(ctx, server.URL+"/local.m3u8", ioutil.Discard); err != context.Canceled {
+		t.Errorf("cancelled capture returned %v", err)
+	}
+	if n := atomic.LoadInt32(&segments); n != 1 || time.Since(start) > 5*time.Second {
+		t.Errorf("captured %d segments in %s", n, time.Since(start))
+	}
+}
+
+// TestMonitorInternalAddresses keeps streams off the server's own and internal networks unless
+// their hosts are explicitly allowed
+func TestMonitorInternalAddresses(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("#EXTM3U\n"))
+	}))
+	defer server.Close()
+
+	m := NewMonitor(10*time.Second, MatchOptions{}, nil)
+	for _, streamURL := range []string{"http://127.0.0.1/stream", "http://10.0.0.1/stream", "http://169.254.169.254/latest/meta-data/", "http://[::1]/stream"} {
+		if _, err := m.Add(streamURL); err != ErrStreamURL {
+			t.Errorf("Add(%s) = %v, want ErrStreamURL", streamURL, err)
+		}
+	}
+
+	// host names are checked once resolved
+	localhost := strings.Replace(server.URL, "127.0.0.1", "localhost", 1)
+	if err := m.captureHLS(context.Background(), localhost+"/stream.m3u8", ioutil.Discard); !errors.Is(err, ErrStreamAddress) {
+		t.Errorf("captured a stream resolving to loopback: %v", err)
+	}
+
+	m.AllowedHosts = []string{"localhost"}
+	if err := m.captureHLS(context.Background(), localhost+"/stream.m3u8", ioutil.Discard); err != nil {
+		t.Errorf("capture of an allowed host failed: %s", err)
+	}
+}
+
+// TestMonitorCaptureInterval doesn't capture again at once when a stream ends immediately
+func TestMonitorCaptureInterval(t *testing.T) {
+	defer func(binary string) { CodegenBinary = binary }(CodegenBinary)
+	CodegenBinary = filepath.Join(t.TempDir(), "codegen")
+	if err := os.WriteFile(CodegenBinary, []byte("#!/bin/sh\necho '[]'\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+	}))
+	defer server.Close()
+
+	m := NewMonitor(10*time.Second, MatchOptions{}, nil)
+	m.AllowedHosts = []string{"127.0.0.1"}
+	stream, err := m.Add(server.URL + "/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(500 * time.Millisecond)
+	m.Remove(stream.ID)
+
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("captured %d times in 500ms, want 1", n)
+	}
+}
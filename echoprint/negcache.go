@@ -0,0 +1,137 @@
+package echoprint
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// negativeCache remembers queries that found no match, monitoring traffic repeats the same
+// speech and adverts that aren't in the catalog over and over. Any ingest through the Matcher
+// clears it, ingests by other processes sharing the store are only picked up once the TTL expires
+type negativeCache struct {
+	ttl        time.Duration
+	maxEntries int
+
+	mu      sync.Mutex
+	expires map[uint64]time.Time
+
+	hits   int64
+	misses int64
+}
+
+// CacheStats is a snapshot of a cache's counters
+type CacheStats struct {
+	Entries int   `json:"entries"`
+	Hits    int64 `json:"hits"`
+	Misses  int64 `json:"misses"`
+}
+
+// WithNegativeCache caches "no match" outcomes for ttl, holding at most maxEntries queries
+func WithNegativeCache(ttl time.Duration, maxEntries int) Option {
+	return func(m *Matcher) { m.negatives = newNegativeCache(ttl, maxEntries) }
+}
+
+// EnableNegativeCache caches the "no match" outcomes of the package level functions
+func EnableNegativeCache(ttl time.Duration, maxEntries int) {
+	defaultMatcher.negatives = newNegativeCache(ttl, maxEntries)
+}
+
+func newNegativeCache(ttl time.Duration, maxEntries int) *negativeCache {
+	return &negativeCache{ttl: ttl, maxEntries: maxEntries, expires: make(map[uint64]time.Time)}
+}
+
+// NegativeCacheStats returns the negative cache counters of the package level functions
+func NegativeCacheStats() CacheStats {
+	return defaultMatcher.NegativeCacheStats()
+}
+
+// NegativeCacheStats returns the negative cache counters, all zero when the cache is disabled
+func (m *Matcher) NegativeCacheStats() CacheStats {
+	c := m.negatives
+	if c == nil {
+		return CacheStats{}
+	}
+
+	c.mu.Lock()
+	entries := len(c.expires)
+	c.mu.Unlock()
+
+	return CacheStats{Entries: entries, Hits: atomic.LoadInt64(&c.hits), Misses: atomic.LoadInt64(&c.misses)}
+}
+
+// negativeCacheKey hashes the fingerprint along with the options that change its outcome
+func negativeCacheKey(fp *Fingerprint, opts MatchOptions) uint64 {
+	h := fnv.New64a()
+	buf := make([]byte, 4)
+	for i, code := range fp.Codes {
+		binary.LittleEndian.PutUint32(buf, code)
+		h.Write(buf)
+		binary.LittleEndian.PutUint32(buf, fp.Times[i])
+		h.Write(buf)
+	}
+	fmt.Fprintf(h, "%+v|%+v|%v|%v|%v|%d|%v|%T%+v",
+		opts.Thresholds, opts.Filter, opts.DurationTolerance, opts.TimeScaling, fp.Meta.Duration, opts.ClampMinutes, opts.Unclamped, opts.Scorer, opts.Scorer)
+	for _, tier := range opts.Tiers {
+		fmt.Fprintf(h, "|%s%+v", tier.Name, tier.Filter)
+	}
+
+	return h.Sum64()
+}
+
+func (c *negativeCache) contains(key uint64) bool {
+	if c == nil {
+		return false
+	}
+
+	c.mu.Lock()
+	expires, ok := c.expires[key]
+	if ok && time.Now().After(expires) {
+		delete(c.expires, key)
+		ok = false
+	}
+	c.mu.Unlock()
+
+	if ok {
+		atomic.AddInt64(&c.hits, 1)
+	} else {
+		atomic.AddInt64(&c.misses, 1)
+	}
+	return ok
+}
+
+func (c *negativeCache) add(key uint64) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if len(c.expires) >= c.maxEntries {
+		for k, expires := range c.expires {
+			if now.After(expires) {
+				delete(c.expires, k)
+			}
+		}
+		if len(c.expires) >= c.maxEntries {
+			return
+		}
+	}
+	c.expires[key] = now.Add(c.ttl)
+}
+
+// invalidate forgets every cached outcome, a newly ingested track may match any of them
+func (c *negativeCache) invalidate() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	c.expires = make(map[uint64]time.Time)
+	c.mu.Unlock()
+}
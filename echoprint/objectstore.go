@@ -0,0 +1,470 @@
+package echoprint
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// minPartSize is the smallest part S3 accepts in a multipart upload, except for the last
+	minPartSize     = 5 * 1024 * 1024
+	defaultPartSize = 16 * 1024 * 1024
+)
+
+// ErrUnsupportedObjectURL is returned for object URLs other than s3://, gs:// and http(s)://
+var ErrUnsupportedObjectURL = errors.New("Unsupported object URL, expected s3://, gs:// or https://")
+
+var errUploadAborted = errors.New("Upload aborted")
+
+// ObjectStore reads and writes objects (snapshots) in S3 or Google Cloud Storage. Requests are
+// signed with AWS signature v4, GCS is reached through its S3 compatible XML API using HMAC keys
+type ObjectStore struct {
+	// Endpoint overrides the service URL (e.g. for S3 compatible stores), defaults to AWS S3
+	// for s3:// URLs and storage.googleapis.com for gs:// URLs
+	Endpoint string
+	// Region is used to sign requests, defaults to us-east-1 for S3 and auto for GCS
+	Region string
+
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+
+	// PartSize is the size of each part of a multipart upload, defaults to 16MB
+	PartSize int
+	// Client sends the requests, defaults to http.DefaultClient
+	Client *http.Client
+}
+
+// objectLocation is a parsed object URL
+type objectLocation struct {
+	url      *url.URL
+	endpoint string
+	region   string
+}
+
+func (s *ObjectStore) locate(rawurl string) (*objectLocation, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	// http(s) URLs have no region so they are never signed, the credentials must not be sent
+	// to whichever host the URL names and presigned URLs keep their query
+	if u.Scheme == "http" || u.Scheme == "https" {
+		return &objectLocation{url: u}, nil
+	}
+
+	loc, err := s.locateBucket(u)
+	if err != nil {
+		return nil, err
+	}
+	if strings.Trim(u.Path, "/") == "" {
+		return nil, ErrUnsupportedObjectURL
+	}
+
+	loc.url.Path += "/" + strings.TrimLeft(u.Path, "/")
+	return loc, nil
+}
+
+// locateBucket locates the bucket of an s3:// or gs:// URL
+func (s *ObjectStore) locateBucket(u *url.URL) (*objectLocation, error) {
+	loc := &objectLocation{endpoint: s.Endpoint, region: s.Region}
+	switch u.Scheme {
+	case "s3":
+		if loc.region == "" {
+			loc.region = "us-east-1"
+		}
+		if loc.endpoint == "" {
+			loc.endpoint = "https://s3." + loc.region + ".amazonaws.com"
+		}
+	case "gs":
+		if loc.region == "" {
+			loc.region = "auto"
+		}
+		if loc.endpoint == "" {
+			loc.endpoint = "https://storage.googleapis.com"
+		}
+	default:
+		return nil, ErrUnsupportedObjectURL
+	}
+
+	if u.Host == "" {
+		return nil, ErrUnsupportedObjectURL
+	}
+
+	// objects are addressed path style, which works for every bucket name and endpoint
+	var err error
+	loc.url, err = url.Parse(strings.TrimRight(loc.endpoint, "/") + "/" + u.Host)
+	return loc, err
+}
+
+// Open downloads an object, http(s) URLs (e.g. presigned URLs) are fetched without signing
+func (s *ObjectStore) Open(rawurl string) (io.ReadCloser, error) {
+	loc, err := s.locate(rawurl)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.do(loc, "GET", nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
+// Create starts writing an object, it is uploaded in parts as it is written and only becomes
+// visible once the writer is closed
+func (s *ObjectStore) Create(rawurl string) (*ObjectWriter, error) {
+	loc, err := s.locate(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if loc.region == "" {
+		return nil, ErrUnsupportedObjectURL
+	}
+
+	partSize := s.PartSize
+	if partSize == 0 {
+		partSize = defaultPartSize
+	} else if partSize < minPartSize {
+		partSize = minPartSize
+	}
+
+	return &ObjectWriter{store: s, loc: loc, partSize: partSize}, nil
+}
+
+// List returns the URLs of the objects directly under an s3:// or gs:// prefix, like a directory
+// listing objects in nested "folders" are left out
+func (s *ObjectStore) List(prefix string) ([]string, error) {
+	u, err := url.Parse(prefix)
+	if err != nil {
+		return nil, err
+	}
+	loc, err := s.locateBucket(u)
+	if err != nil {
+		return nil, err
+	}
+
+	query := url.Values{
+		"list-type": {"2"},
+		"prefix":    {strings.TrimLeft(u.Path, "/")},
+		"delimiter": {"/"},
+	}
+	var urls []string
+	for {
+		resp, err := s.do(loc, "GET", query, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var listing struct {
+			Contents []struct {
+				Key string
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&listing)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, object := range listing.Contents {
+			urls = append(urls, u.Scheme+"://"+u.Host+"/"+object.Key)
+		}
+		if !listing.IsTruncated {
+			return urls, nil
+		}
+		query.Set("continuation-token", listing.NextContinuationToken)
+	}
+}
+
+// Delete removes an object
+func (s *ObjectStore) Delete(rawurl string) error {
+	loc, err := s.locate(rawurl)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.do(loc, "DELETE", nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// ObjectWriter uploads an object with a multipart upload, objects smaller than a single part
+// are uploaded with a single request
+type ObjectWriter struct {
+	store    *ObjectStore
+	loc      *objectLocation
+	partSize int
+
+	buf      bytes.Buffer
+	uploadID string
+	etags    []string
+	err      error
+}
+
+func (w *ObjectWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	w.buf.Write(p)
+	for w.buf.Len() >= w.partSize {
+		if w.err = w.uploadPart(w.buf.Next(w.partSize)); w.err != nil {
+			w.Abort()
+			return 0, w.err
+		}
+	}
+
+	return len(p), nil
+}
+
+// Close uploads the remaining data and completes the upload
+func (w *ObjectWriter) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+
+	if w.uploadID == "" {
+		resp, err := w.store.do(w.loc, "PUT", nil, w.buf.Bytes())
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	}
+
+	if w.buf.Len() > 0 {
+		if w.err = w.uploadPart(w.buf.Bytes()); w.err != nil {
+			w.Abort()
+			return w.err
+		}
+	}
+
+	var complete struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []struct {
+			PartNumber int
+			ETag       string
+		} `xml:"Part"`
+	}
+	for i, etag := range w.etags {
+		complete.Parts = append(complete.Parts, struct {
+			PartNumber int
+			ETag       string
+		}{i + 1, etag})
+	}
+	body, err := xml.Marshal(&complete)
+	if err != nil {
+		return err
+	}
+
+	resp, err := w.store.do(w.loc, "POST", url.Values{"uploadId": {w.uploadID}}, body)
+	if err != nil {
+		w.Abort()
+		return err
+	}
+	resp.Body.Close()
+	glog.V(1).Infof("Uploaded %s in %d parts", w.loc.url, len(w.etags))
+
+	return nil
+}
+
+// Abort cancels the upload so the parts uploaded so far are discarded
+func (w *ObjectWriter) Abort() {
+	if w.err == nil {
+		w.err = errUploadAborted
+	}
+	if w.uploadID == "" {
+		return
+	}
+
+	resp, err := w.store.do(w.loc, "DELETE", url.Values{"uploadId": {w.uploadID}}, nil)
+	if err != nil {
+		glog.Errorf("Aborting upload of %s failed: %s", w.loc.url, err)
+		return
+	}
+	resp.Body.Close()
+	w.uploadID = ""
+}
+
+func (w *ObjectWriter) uploadPart(part []byte) error {
+	if w.uploadID == "" {
+		resp, err := w.store.do(w.loc, "POST", url.Values{"uploads": {""}}, nil)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		var initiated struct {
+			UploadID string `xml:"UploadId"`
+		}
+		if err := xml.NewDecoder(resp.Body).Decode(&initiated); err != nil {
+			return err
+		}
+		w.uploadID = initiated.UploadID
+	}
+
+	query := url.Values{
+		"partNumber": {strconv.Itoa(len(w.etags) + 1)},
+		"uploadId":   {w.uploadID},
+	}
+	resp, err := w.store.do(w.loc, "PUT", query, part)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	w.etags = append(w.etags, resp.Header.Get("ETag"))
+
+	return nil
+}
+
+// do sends a request for the object, signing it when the location requires it. Responses
+// other than 2xx are returned as errors
+func (s *ObjectStore) do(loc *objectLocation, method string, query url.Values, body []byte) (*http.Response, error) {
+	// http(s) URLs are sent as provided, presigned URLs carry their signature in the query
+	u := *loc.url
+	if loc.region != "" {
+		u.RawPath = uriEncode(u.Path, false)
+		u.RawQuery = canonicalQuery(query)
+	}
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if loc.region != "" {
+		s.sign(req, loc.region, time.Now().UTC())
+	}
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, &BackendError{err}
+	}
+	if resp.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s %s failed with %s: %s", method, loc.url, resp.Status, message)
+	}
+
+	return resp, nil
+}
+
+// sign adds an AWS signature v4 to the request, the payload is left unsigned unless its hash
+// is already set so parts don't have to be hashed twice
+func (s *ObjectStore) sign(req *http.Request, region string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := amzDate[:8]
+	scope := date + "/" + region + "/s3/aws4_request"
+
+	payloadHash := req.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash == "" {
+		payloadHash = "UNSIGNED-PAYLOAD"
+		req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	}
+	req.Header.Set("X-Amz-Date", amzDate)
+	if s.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for key := range req.Header {
+		if name := strings.ToLower(key); strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(req.Header.Get(key))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalQuery encodes the query sorted by key as required by signature v4, the same
+// encoding is sent so the signed and sent queries always agree
+func canonicalQuery(query url.Values) string {
+	params := make([]string, 0, len(query))
+	for key, values := range query {
+		for _, value := range values {
+			params = append(params, uriEncode(key, true)+"="+uriEncode(value, true))
+		}
+	}
+	sort.Strings(params)
+
+	return strings.Join(params, "&")
+}
+
+// uriEncode percent encodes everything but the unreserved characters, slashes are kept
+// in paths
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
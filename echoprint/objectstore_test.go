@@ -0,0 +1,50 @@
+package echoprint
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestObjectStoreSigning(t *testing.T) {
+	var got *http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		w.Write([]byte("object"))
+	}))
+	defer server.Close()
+
+	s := &ObjectStore{Endpoint: server.URL, Region: "eu-west-1", AccessKey: "key", SecretKey: "secret", SessionToken: "token"}
+
+	// plain and presigned URLs are fetched as given, without our credentials
+	presigned := "/bucket/object?X-Amz-Signature=abc&X-Amz-Expires=60"
+	body, err := s.Open(server.URL + presigned)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(body)
+	body.Close()
+	if string(data) != "object" {
+		t.Errorf("Open read %q", data)
+	}
+	if got.URL.String() != presigned {
+		t.Errorf("Open requested %s, want %s", got.URL, presigned)
+	}
+	for _, header := range []string{"Authorization", "X-Amz-Security-Token", "X-Amz-Date"} {
+		if value := got.Header.Get(header); value != "" {
+			t.Errorf("Open sent %s: %s", header, value)
+		}
+	}
+
+	// bucket URLs are signed
+	body, err = s.Open("s3://bucket/object")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body.Close()
+	if got.URL.Path != "/bucket/object" || !strings.HasPrefix(got.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") {
+		t.Errorf("Open of an s3 URL requested %s, Authorization %q", got.URL, got.Header.Get("Authorization"))
+	}
+}
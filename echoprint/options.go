@@ -0,0 +1,155 @@
+package echoprint
+
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+)
+
+// Option configures a Matcher created by New
+type Option func(*Matcher)
+
+// Logger receives a Matcher's informational and error logs, verbose debugging output is
+// always written to glog
+type Logger interface {
+	Infof(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+type glogLogger struct{}
+
+func (glogLogger) Infof(format string, args ...interface{}) {
+	glog.InfoDepth(1, fmt.Sprintf(format, args...))
+}
+
+func (glogLogger) Errorf(format string, args ...interface{}) {
+	glog.ErrorDepth(1, fmt.Sprintf(format, args...))
+}
+
+// SearchDepth is the number of candidates fetched from the store by fingerprint quality, zero
+// values use the defaults
+type SearchDepth struct {
+	HighQuality   int
+	MediumQuality int
+	LowQuality    int
+}
+
+func (d SearchDepth) rows(quality string) int {
+	switch quality {
+	case qualityHigh:
+		return orDefaultInt(d.HighQuality, searchDepthHighQuality)
+	case qualityMedium:
+		return orDefaultInt(d.MediumQuality, searchDepthMediumQuality)
+	default:
+		return orDefaultInt(d.LowQuality, searchDepthLowQuality)
+	}
+}
+
+func orDefaultInt(value, def int) int {
+	if value == 0 {
+		return def
+	}
+	return value
+}
+
+// New returns a Matcher configured by opts, every setting not provided uses the defaults
+func New(opts ...Option) *Matcher {
+	m := &Matcher{}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// WithStore sets the store the Matcher ingests into and matches against
+func WithStore(s Store) Option {
+	return func(m *Matcher) { m.Store = s }
+}
+
+// WithThresholds sets the default match thresholds, queries may still override them
+func WithThresholds(t Thresholds) Option {
+	return func(m *Matcher) { m.defaults.Thresholds = t }
+}
+
+// WithScorer sets the default Scorer
+func WithScorer(s Scorer) Option {
+	return func(m *Matcher) { m.defaults.Scorer = s }
+}
+
+// WithBestMatchPolicy sets the default BestMatchPolicy
+func WithBestMatchPolicy(p BestMatchPolicy) Option {
+	return func(m *Matcher) { m.defaults.BestMatchPolicy = p }
+}
+
+// WithClampMinutes sets the default length queries are clamped to
+func WithClampMinutes(minutes int) Option {
+	return func(m *Matcher) { m.defaults.ClampMinutes = minutes }
+}
+
+// WithEarlyExit sets the default EarlyExit
+func WithEarlyExit(e *EarlyExit) Option {
+	return func(m *Matcher) { m.defaults.EarlyExit = e }
+}
+
+// WithBestMatchVerification sets the default VerifyBest
+func WithBestMatchVerification(v *BestMatchVerification) Option {
+	return func(m *Matcher) { m.defaults.VerifyBest = v }
+}
+
+// WithAdaptiveDepth sets the default AdaptiveDepth
+func WithAdaptiveDepth(d *AdaptiveDepth) Option {
+	return func(m *Matcher) { m.defaults.AdaptiveDepth = d }
+}
+
+// WithSearchDepth sets the number of candidates fetched from the store
+func WithSearchDepth(d SearchDepth) Option {
+	return func(m *Matcher) { m.searchDepth = d }
+}
+
+// WithTimeScaleFactors sets the factors tried against the query's Times when time scaling
+func WithTimeScaleFactors(factors []float32) Option {
+	return func(m *Matcher) { m.timeScaleFactors = factors }
+}
+
+// WithLogger sets the Logger, defaults to glog
+func WithLogger(l Logger) Option {
+	return func(m *Matcher) { m.logger = l }
+}
+
+// withDefaults fills in the settings of opts that weren't provided from the Matcher's defaults
+func (m *Matcher) withDefaults(opts MatchOptions) MatchOptions {
+	opts.Thresholds = m.defaults.Thresholds.overriddenBy(opts.Thresholds)
+	if opts.Scorer == nil {
+		opts.Scorer = m.defaults.Scorer
+	}
+	if opts.BestMatchPolicy == nil {
+		opts.BestMatchPolicy = m.defaults.BestMatchPolicy
+	}
+	if opts.ClampMinutes == 0 {
+		opts.ClampMinutes = m.defaults.ClampMinutes
+	}
+	if opts.EarlyExit == nil {
+		opts.EarlyExit = m.defaults.EarlyExit
+	}
+	if opts.AdaptiveDepth == nil {
+		opts.AdaptiveDepth = m.defaults.AdaptiveDepth
+	}
+	if opts.VerifyBest == nil {
+		opts.VerifyBest = m.defaults.VerifyBest
+	}
+	return opts
+}
+
+func (m *Matcher) log() Logger {
+	if m.logger == nil {
+		return glogLogger{}
+	}
+	return m.logger
+}
+
+func (m *Matcher) scaleFactors() []float32 {
+	if m.timeScaleFactors == nil {
+		return timeScaleFactors
+	}
+	return m.timeScaleFactors
+}
@@ -0,0 +1,266 @@
+package echoprint
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+
+	"github.com/golang/glog"
+)
+
+// PostingOverflow decides what happens to a code once its posting list, the fingerprints
+// indexed under it, reaches the cap
+type PostingOverflow int
+
+const (
+	// OverflowTruncate stops indexing the code for fingerprints ingested afterwards
+	OverflowTruncate PostingOverflow = iota
+	// OverflowSample keeps indexing the code for a shrinking random sample of the fingerprints
+	// ingested afterwards, so the posting list still covers recent ingests
+	OverflowSample
+	// OverflowStopCode stops indexing the code and drops it from queries, it no longer
+	// selects candidates at all
+	OverflowStopCode
+)
+
+// PostingCap limits the posting list of every code, extremely common codes otherwise pull
+// huge numbers of candidates into every query
+type PostingCap struct {
+	MaxPostings int
+	Overflow    PostingOverflow
+}
+
+// postingCounts tracks the number of fingerprints containing each code, the counts of codes
+// over the cap are still counted so sampling can keep thinning them out
+type postingCounts struct {
+	limit PostingCap
+	// learn is the number of most frequent codes learned as stop codes, 0 learns none
+	learn int
+
+	mu     sync.RWMutex
+	counts map[uint32]int
+	// learned are the stop codes excluded from queries and scoring. They are still indexed so
+	// their posting lists are complete once relearning drops them
+	learned map[uint32]bool
+}
+
+// WithPostingCap caps the posting lists of the Matcher's index, CountPostings must be called
+// once the store holds fingerprints for existing posting lists to count
+func WithPostingCap(limit PostingCap) Option {
+	return func(m *Matcher) {
+		if m.postings == nil {
+			m.postings = newPostingCounts(limit)
+		}
+		m.postings.limit = limit
+	}
+}
+
+// EnablePostingCap caps the posting lists of the database connected by DBConnect,
+// CountPostings must be called once enabled
+func EnablePostingCap(limit PostingCap) {
+	WithPostingCap(limit)(defaultMatcher)
+}
+
+func newPostingCounts(limit PostingCap) *postingCounts {
+	return &postingCounts{limit: limit, counts: make(map[uint32]int)}
+}
+
+// CountPostings counts the posting lists of the database connected by DBConnect
+func CountPostings() error {
+	return defaultMatcher.CountPostings()
+}
+
+// CountPostings counts the fingerprints of the store containing each code, which caps
+// posting lists to the fingerprints stored before the Matcher was created
+func (m *Matcher) CountPostings() error {
+	p := m.postings
+	if p == nil {
+		return nil
+	}
+
+	trackIDs, err := m.Store.trackIDs()
+	if err != nil {
+		return err
+	}
+
+	counts := make(map[uint32]int)
+	for _, trackID := range trackIDs {
+		variants, err := m.Store.nextVariant(trackID)
+		if err != nil {
+			return err
+		}
+		for variant := uint32(0); variant < variants; variant++ {
+			fp, err := m.Store.load(trackID, variant)
+			if err != nil {
+				return err
+			}
+			for code := range uniqueCodes(fp) {
+				counts[code]++
+			}
+		}
+	}
+
+	p.mu.Lock()
+	p.counts = counts
+	p.mu.Unlock()
+	if p.limit.MaxPostings > 0 {
+		glog.Infof("Counted the posting lists of %d codes, %d are over the cap of %d", len(counts), len(p.overCap()), p.limit.MaxPostings)
+	}
+	m.LearnStopCodes()
+
+	return nil
+}
+
+// index returns the codes of the fingerprint to index, counting the fingerprint in the
+// posting lists of all of its codes. An empty (non nil) list indexes none
+func (p *postingCounts) index(fp *Fingerprint) []uint32 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	indexed := []uint32{}
+	var capped int
+	for code := range uniqueCodes(fp) {
+		count := p.counts[code]
+		p.counts[code] = count + 1
+
+		if p.limit.MaxPostings == 0 || count < p.limit.MaxPostings ||
+			p.limit.Overflow == OverflowSample && rand.Float64() < float64(p.limit.MaxPostings)/float64(count+1) {
+			indexed = append(indexed, code)
+		} else {
+			capped++
+		}
+	}
+	glog.V(3).Infof("TrackID=%d not indexed under %d codes with full posting lists", fp.Meta.TrackID, capped)
+
+	return indexed
+}
+
+// stopCodes splits the codes of a query into those that select candidates and the stop codes,
+// which are only dropped when the overflow is OverflowStopCode
+func (p *postingCounts) stopCodes(fp *Fingerprint) (*Fingerprint, []uint32) {
+	if p == nil || p.limit.MaxPostings == 0 || p.limit.Overflow != OverflowStopCode {
+		return fp, nil
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return withoutCodes(fp, func(code uint32) bool { return p.counts[code] > p.limit.MaxPostings })
+}
+
+// learnedStopCodes removes the learned stop codes from a query, unlike the stop codes of
+// full posting lists they are neither looked up nor scored
+func (p *postingCounts) learnedStopCodes(fp *Fingerprint) (*Fingerprint, []uint32) {
+	if p == nil || p.learn == 0 {
+		return fp, nil
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return withoutCodes(fp, func(code uint32) bool { return p.learned[code] })
+}
+
+// withoutCodes returns a copy of the fingerprint without the codes to exclude, along with the
+// codes excluded. The fingerprint itself is returned when no code is excluded
+func withoutCodes(fp *Fingerprint, exclude func(code uint32) bool) (*Fingerprint, []uint32) {
+	var excludedCodes []uint32
+	var excluded map[uint32]bool
+	for code := range uniqueCodes(fp) {
+		if exclude(code) {
+			if excluded == nil {
+				excluded = make(map[uint32]bool)
+			}
+			excluded[code] = true
+			excludedCodes = append(excludedCodes, code)
+		}
+	}
+	if len(excludedCodes) == 0 {
+		return fp, nil
+	}
+
+	filteredFp := &Fingerprint{Meta: fp.Meta, clamped: fp.clamped, trimmed: fp.trimmed}
+	for i, code := range fp.Codes {
+		if !excluded[code] {
+			filteredFp.Codes = append(filteredFp.Codes, code)
+			filteredFp.Times = append(filteredFp.Times, fp.Times[i])
+		}
+	}
+	sort.Slice(excludedCodes, func(i, j int) bool { return excludedCodes[i] < excludedCodes[j] })
+
+	return filteredFp, excludedCodes
+}
+
+// WithStopCodes learns the n most frequent codes of the Matcher's store as stop codes, which
+// are excluded from queries and scoring like stopwords of a text search. They are still
+// indexed, so a code dropped by relearning finds every fingerprint containing it. The codes
+// are learned by CountPostings and relearned by LearnStopCodes
+func WithStopCodes(n int) Option {
+	return func(m *Matcher) {
+		if m.postings == nil {
+			m.postings = newPostingCounts(PostingCap{})
+		}
+		m.postings.learn = n
+	}
+}
+
+// EnableStopCodes learns the n most frequent codes of the database connected by DBConnect as
+// stop codes, CountPostings must be called once enabled
+func EnableStopCodes(n int) {
+	WithStopCodes(n)(defaultMatcher)
+}
+
+// LearnStopCodes relearns the stop codes of the database connected by DBConnect
+func LearnStopCodes() []uint32 {
+	return defaultMatcher.LearnStopCodes()
+}
+
+// LearnStopCodes relearns the most frequent codes as stop codes from the counts kept up to
+// date by ingests, which is cheap enough to run periodically. It returns the stop codes
+func (m *Matcher) LearnStopCodes() []uint32 {
+	p := m.postings
+	if p == nil || p.learn == 0 {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	codes := make([]uint32, 0, len(p.counts))
+	for code := range p.counts {
+		codes = append(codes, code)
+	}
+	sort.Slice(codes, func(i, j int) bool {
+		if p.counts[codes[i]] != p.counts[codes[j]] {
+			return p.counts[codes[i]] > p.counts[codes[j]]
+		}
+		return codes[i] < codes[j]
+	})
+	if len(codes) > p.learn {
+		codes = codes[:p.learn]
+	}
+
+	p.learned = make(map[uint32]bool, len(codes))
+	for _, code := range codes {
+		p.learned[code] = true
+	}
+	if len(codes) > 0 {
+		glog.Infof("Learned %d stop codes found in %d to %d fingerprints", len(codes), p.counts[codes[len(codes)-1]], p.counts[codes[0]])
+	}
+
+	return codes
+}
+
+// overCap returns the codes whose posting lists are over the cap
+func (p *postingCounts) overCap() []uint32 {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	var codes []uint32
+	for code, count := range p.counts {
+		if count > p.limit.MaxPostings {
+			codes = append(codes, code)
+		}
+	}
+	return codes
+}
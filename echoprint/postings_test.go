@@ -0,0 +1,22 @@
+package echoprint
+
+import "testing"
+
+// TestIndexLearnedStopCodes ingests fingerprints while their codes are learned stop codes,
+// they must still be indexed under them so relearning can drop the stop codes
+func TestIndexLearnedStopCodes(t *testing.T) {
+	m := New(WithStore(NewMemoryStore()), WithStopCodes(1))
+	fp := &Fingerprint{Codes: []uint32{7, 7, 9}, Times: []uint32{0, 1, 2}}
+	m.postings.index(fp)
+	if codes := m.LearnStopCodes(); len(codes) != 1 || codes[0] != 7 {
+		t.Fatalf("learned stop codes %v, want [7]", codes)
+	}
+
+	indexed := m.postings.index(fp)
+	if len(indexed) != 2 {
+		t.Errorf("indexed codes %v, want the stop code 7 and 9", indexed)
+	}
+	if query, excluded := m.postings.learnedStopCodes(fp); len(excluded) != 1 || excluded[0] != 7 || len(query.Codes) != 1 {
+		t.Errorf("query codes %v excluding %v, want [9] excluding [7]", query.Codes, excluded)
+	}
+}
@@ -0,0 +1,204 @@
+package echoprint
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrInvalidProfile is returned for profiles without a name or with out of range settings
+var ErrInvalidProfile = errors.New("Invalid profile")
+
+// profileName are the names profiles may have, they end up in urls and flags
+var profileName = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// Profile is a named set of matching settings tuned for a type of content
+type Profile struct {
+	Name            string     `json:"name"`
+	Slop            uint32     `json:"slop"`
+	Partial         bool       `json:"partial"`
+	MinOverlapRatio float32    `json:"min_overlap_ratio"`
+	ClampMinutes    int        `json:"clamp_minutes"`
+	Thresholds      Thresholds `json:"thresholds"`
+	TimeScaling     bool       `json:"time_scaling"`
+
+	// CueSheet replaces the cue sheet options, nil keeps them
+	CueSheet *CueSheetOptions `json:"cue_sheet,omitempty"`
+}
+
+// profilesMu guards profiles, which may be replaced while queries look them up
+var profilesMu sync.RWMutex
+
+var profiles = map[string]Profile{
+	// strict only reports matches that leave little doubt, for takedowns and royalty claims
+	"strict": Profile{
+		Name: "strict",
+		Thresholds: Thresholds{
+			MinConfidenceHighQuality:   0.80 * 100,
+			MinConfidenceMediumQuality: 0.70 * 100,
+			MinConfidenceLowQuality:    0.55 * 100,
+			MinDBScoreHighQuality:      0.40 * 100,
+			MinDBScoreMediumQuality:    0.40 * 100,
+			MinDBScoreLowQuality:       0.40 * 100,
+		},
+	},
+	// broadcast captures start and end mid track, under talk over, and are often sped up by a
+	// few percent
+	"broadcast": Profile{
+		Name:        "broadcast",
+		Partial:     true,
+		TimeScaling: true,
+		Thresholds: Thresholds{
+			MinConfidenceHighQuality:   0.60 * 100,
+			MinConfidenceMediumQuality: 0.50 * 100,
+			MinConfidenceLowQuality:    0.35 * 100,
+		},
+	},
+	// user generated content is re-encoded, pitched and recorded off speakers, so it's
+	// aligned loosely and fewer of its codes are expected to be found
+	"ugc": Profile{
+		Name:        "ugc",
+		Slop:        3,
+		Partial:     true,
+		TimeScaling: true,
+		Thresholds: Thresholds{
+			MinConfidenceHighQuality:   0.50 * 100,
+			MinConfidenceMediumQuality: 0.40 * 100,
+			MinConfidenceLowQuality:    0.30 * 100,
+			MinDBScoreHighQuality:      0.20 * 100,
+			MinDBScoreMediumQuality:    0.20 * 100,
+			MinDBScoreLowQuality:       0.20 * 100,
+		},
+	},
+	// short (5-15s) ads and jingles have few codes, so alignment needs to be tighter and
+	// the confidence needs a larger share of the query to line up
+	"short-form": Profile{
+		Name:            "short-form",
+		Slop:            1,
+		MinOverlapRatio: 0.50,
+		ClampMinutes:    1,
+		Thresholds: Thresholds{
+			MinConfidenceHighQuality:   0.60 * 100,
+			MinConfidenceMediumQuality: 0.50 * 100,
+			MinConfidenceLowQuality:    0.40 * 100,
+		},
+	},
+	// continuous DJ mixes are beatmatched (sped up or slowed down) and crossfaded, so the
+	// query is matched at other speeds with looser alignment in short windows. Detections are
+	// tidied into a tracklist with a transition time between every pair of tracks
+	"dj-mix": Profile{
+		Name:        "dj-mix",
+		Slop:        4,
+		Partial:     true,
+		TimeScaling: true,
+		Thresholds: Thresholds{
+			MinConfidenceHighQuality:   0.50 * 100,
+			MinConfidenceMediumQuality: 0.40 * 100,
+			MinConfidenceLowQuality:    0.30 * 100,
+		},
+		CueSheet: &CueSheetOptions{
+			Window:      20 * time.Second,
+			Step:        5 * time.Second,
+			MinDuration: 10 * time.Second,
+			MaxGap:      30 * time.Second,
+			Transitions: true,
+		},
+	},
+}
+
+// LookupProfile returns the named matching profile
+func LookupProfile(name string) (Profile, bool) {
+	profilesMu.RLock()
+	defer profilesMu.RUnlock()
+
+	p, ok := profiles[name]
+	return p, ok
+}
+
+// Profiles returns every matching profile ordered by name
+func Profiles() []Profile {
+	profilesMu.RLock()
+	defer profilesMu.RUnlock()
+
+	list := make([]Profile, 0, len(profiles))
+	for _, p := range profiles {
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// SetProfile adds the profile or replaces the one of the same name, queries started after it
+// returns use it
+func SetProfile(p Profile) error {
+	return SetProfiles([]Profile{p})
+}
+
+// SetProfiles adds or replaces the profiles, none of them are when one is invalid
+func SetProfiles(list []Profile) error {
+	for _, p := range list {
+		if err := p.validate(); err != nil {
+			return err
+		}
+	}
+
+	profilesMu.Lock()
+	defer profilesMu.Unlock()
+
+	for _, p := range list {
+		profiles[p.Name] = p
+	}
+	return nil
+}
+
+// LoadProfiles reads a json array of profiles, as written by ExportProfiles, and adds or
+// replaces them
+func LoadProfiles(r io.Reader) error {
+	var list []Profile
+	if err := json.NewDecoder(r).Decode(&list); err != nil {
+		return err
+	}
+	return SetProfiles(list)
+}
+
+// ExportProfiles writes every profile as a json array
+func ExportProfiles(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(Profiles())
+}
+
+func (p Profile) validate() error {
+	if !profileName.MatchString(p.Name) || p.ClampMinutes < 0 || p.MinOverlapRatio < 0 || p.MinOverlapRatio > 1 {
+		return ErrInvalidProfile
+	}
+
+	t := p.Thresholds
+	for _, threshold := range []float32{t.MinConfidenceHighQuality, t.MinConfidenceMediumQuality, t.MinConfidenceLowQuality, t.MinDBScoreHighQuality, t.MinDBScoreMediumQuality, t.MinDBScoreLowQuality} {
+		if threshold < 0 || threshold > maxConfidence {
+			return ErrInvalidProfile
+		}
+	}
+	return nil
+}
+
+// Apply returns a copy of opts using the profile's settings
+func (p Profile) Apply(opts MatchOptions) MatchOptions {
+	slop := p.Slop
+	if slop == 0 {
+		slop = histogramMatchSlop
+	}
+
+	opts.Scorer = HistogramScorer{Slop: slop, Partial: p.Partial, MinOverlapRatio: p.MinOverlapRatio}
+	opts.ClampMinutes = p.ClampMinutes
+	opts.Thresholds = opts.Thresholds.overriddenBy(p.Thresholds)
+	opts.TimeScaling = opts.TimeScaling || p.TimeScaling
+	if p.CueSheet != nil {
+		opts.CueSheet = *p.CueSheet
+	}
+	return opts
+}
@@ -0,0 +1,49 @@
+package echoprint
+
+import (
+	"time"
+)
+
+// ReplayResult compares the matches recorded for an audited query with the matches the
+// same query returns against the current index
+type ReplayResult struct {
+	RequestID  string        `json:"request_id"`
+	RecordedAt time.Time     `json:"recorded_at"`
+	Groups     []ReplayGroup `json:"groups"`
+	// Changed is the number of groups whose best match changed
+	Changed int `json:"changed"`
+}
+
+// ReplayGroup holds the recorded and replayed matches of a single fingerprint of the query
+type ReplayGroup struct {
+	Recorded    []*MatchResult `json:"recorded"`
+	Replayed    []*MatchResult `json:"replayed"`
+	BestChanged bool           `json:"best_changed"`
+}
+
+// Replay re-executes an audited query against the database connected by DBConnect
+func Replay(record *AuditRecord, opts MatchOptions) ReplayResult {
+	return defaultMatcher.Replay(record, opts)
+}
+
+// Replay re-executes an audited query with the options it was recorded with, pairing each
+// group's recorded matches with the replayed ones so investigations can see what changed
+func (m *Matcher) Replay(record *AuditRecord, opts MatchOptions) ReplayResult {
+	result := ReplayResult{RequestID: record.RequestID, RecordedAt: record.Time}
+
+	replayed := m.MatchAll(record.Query, opts)
+	result.Groups = make([]ReplayGroup, len(replayed))
+	for i, group := range replayed {
+		result.Groups[i].Replayed = group.Matches
+		if i < len(record.Groups) {
+			result.Groups[i].Recorded = record.Groups[i].Matches
+		}
+
+		if bestTrackID(result.Groups[i].Recorded) != bestTrackID(result.Groups[i].Replayed) {
+			result.Groups[i].BestChanged = true
+			result.Changed++
+		}
+	}
+
+	return result
+}
@@ -0,0 +1,136 @@
+package echoprint
+
+import (
+	"sync"
+	"time"
+)
+
+// clips are matched with this minimum confidence so every candidate they score counts towards
+// the combined evidence, a zero threshold would use the defaults
+const minSampleConfidence = 0.01
+
+// sampleEvidence accumulates the confidence of a track over the clips of a sample query
+type sampleEvidence struct {
+	match         *MatchResult
+	confidence    float32
+	rawConfidence float32
+}
+
+// matchSamples matches the fingerprints as clips of the same asset and combines their evidence
+// into a single group. A track's confidence is its mean confidence over every clip, weighted by
+// the clips' codes, clips that didn't find the track count as 0 so a track has to match
+// consistently rather than strongly in a single clip
+func (m *Matcher) matchSamples(codegenList []*CodegenFp, opts MatchOptions) MatchGroup {
+	start := time.Now()
+	opts = m.withDefaults(opts)
+
+	fps := make([]*Fingerprint, len(codegenList))
+	for i, codegenFp := range codegenList {
+		fp, err := NewFingerprint(codegenFp)
+		if err != nil {
+			m.log().Errorf("[%s] Invalid fingerprint: %s", opts.RequestID, err)
+			return newMatchGroupError(err, opts.RequestID)
+		}
+		fps[i] = fp
+	}
+	if len(fps) == 0 {
+		return MatchGroup{}
+	}
+
+	// the thresholds and the best match apply to the combined evidence, an early exit could
+	// skip candidates the other clips find
+	clipOpts := opts
+	clipOpts.Thresholds.MinConfidenceHighQuality = minSampleConfidence
+	clipOpts.Thresholds.MinConfidenceMediumQuality = minSampleConfidence
+	clipOpts.Thresholds.MinConfidenceLowQuality = minSampleConfidence
+	clipOpts.GroupByISRC = false
+	clipOpts.ClusterRecordings = false
+	clipOpts.ScoreDetails = true
+	clipOpts.EarlyExit = nil
+	clipOpts.NearMatches = nil
+	clipOpts.VerifyBest = nil
+	clipOpts.Alignment = nil
+	// clips may come from anywhere in the asset rather than its beginning
+	if clipOpts.Scorer == nil {
+		clipOpts.Scorer = HistogramScorer{Slop: histogramMatchSlop, Partial: true}
+	}
+
+	clips := make([][]*MatchResult, len(fps))
+	clipStats := make([]MatchStats, len(fps))
+	errs := make([]error, len(fps))
+	var wg sync.WaitGroup
+	for i, fp := range fps {
+		wg.Add(1)
+		opts.Throttle.acquire()
+		go func(i int, fp *Fingerprint) {
+			defer wg.Done()
+			defer opts.Throttle.release()
+			clips[i], clipStats[i], errs[i] = m.match(fp, clipOpts)
+		}(i, fp)
+	}
+	wg.Wait()
+
+	var stats MatchStats
+	var totalCodes int
+	evidence := make(map[uint32]*sampleEvidence)
+	var order []uint32
+	for i, matches := range clips {
+		if errs[i] != nil {
+			m.log().Errorf("[%s] Match failed: %s", opts.RequestID, errs[i])
+			return newMatchGroupError(errs[i], opts.RequestID)
+		}
+
+		stats.Candidates += clipStats[i].Candidates
+		stats.Partial = stats.Partial || clipStats[i].Partial
+		stats.Unscored += clipStats[i].Unscored
+		stats.Pages += clipStats[i].Pages
+		stats.Trace = append(stats.Trace, clipStats[i].Trace...)
+
+		weight := float32(len(fps[i].Codes))
+		totalCodes += len(fps[i].Codes)
+		for _, match := range matches {
+			e, ok := evidence[match.TrackID]
+			if !ok {
+				e = &sampleEvidence{match: match}
+				evidence[match.TrackID] = e
+				order = append(order, match.TrackID)
+			} else {
+				e.match.RawScore += match.RawScore
+				e.match.CodeOverlapCount += match.CodeOverlapCount
+				e.match.AlignedSeconds += match.AlignedSeconds
+				e.match.LowInformation = e.match.LowInformation || match.LowInformation
+			}
+			e.match.Samples++
+			e.confidence += match.Confidence * weight
+			e.rawConfidence += match.RawConfidence * weight
+		}
+	}
+
+	minMatchConfidence := opts.Thresholds.minConfidence(fps[0].Quality())
+	var matches []*MatchResult
+	for _, trackID := range order {
+		e := evidence[trackID]
+		match := e.match
+		match.Confidence = e.confidence / float32(totalCodes)
+		match.RawConfidence = e.rawConfidence / float32(totalCodes)
+		if match.Confidence < minMatchConfidence {
+			continue
+		}
+
+		// the flags of the first clip's match don't apply to the combined evidence, nor does
+		// its offset as the clips come from different parts of the asset
+		match.Best, match.Tied, match.Rank, match.OffsetSeconds = false, false, 0, 0
+		if !opts.ScoreDetails {
+			match.RawScore, match.CodeOverlapCount, match.AlignedSeconds = 0, 0, 0
+		}
+		matches = append(matches, match)
+	}
+
+	if len(matches) > 0 {
+		matches = rankMatches(matches, opts, opts.scorer())
+	}
+	stats.Elapsed = time.Since(start)
+	m.log().Infof("[%s] Number of matches found in %d samples: %d", opts.RequestID, len(fps), len(matches))
+
+	return MatchGroup{Matches: matches, Stats: stats}
+}
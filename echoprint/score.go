@@ -0,0 +1,376 @@
+package echoprint
+
+import (
+	"math/bits"
+	"sync"
+	"time"
+)
+
+const (
+	// confidence is normalized by the overlapping codes, but never by less than this ratio
+	// of the query. The whole query by default, which is the scale the thresholds were
+	// derived on
+	minOverlapRatio = 1
+)
+
+// ScoreDetail is the result of comparing a query fingerprint with a candidate
+type ScoreDetail struct {
+	// Confidence is the score relative to the query codes that overlap the candidate at the
+	// best alignment, bounded by the scorer's MinOverlapRatio
+	Confidence float32
+	// RawConfidence is the score relative to all of the query codes
+	RawConfidence float32
+	// Offset is the time offset of the best alignment, the candidate's time minus the query's
+	Offset time.Duration
+	// Score is the number of codes that line up at the best alignment
+	Score int
+	// CodeOverlap is the number of query codes found anywhere in the candidate
+	CodeOverlap int
+	// Aligned is the length of time the query and candidate overlap at the best alignment
+	Aligned time.Duration
+}
+
+// Scorer compares a query fingerprint against a candidate fingerprint from the database,
+// implementations must be safe for concurrent use
+type Scorer interface {
+	Score(query, candidate *Fingerprint) ScoreDetail
+}
+
+// ScoreAlgorithm selects how the HistogramScorer finds the codes a query shares with a candidate
+type ScoreAlgorithm int
+
+const (
+	// AutoScoring merge joins when the query and candidate are of similar sizes and looks the
+	// query codes up otherwise
+	AutoScoring ScoreAlgorithm = iota
+	// MapScoring maps out the codes of the candidate on every comparison
+	MapScoring
+	// LookupScoring looks each query code up in the candidate's code index
+	LookupScoring
+	// MergeScoring merge joins the sorted codes of the query with the candidate's code index,
+	// queries that weren't indexed with NewIndexed are sorted on every comparison
+	MergeScoring
+)
+
+// HistogramScorer is the default Scorer, it builds a histogram of the time offsets between
+// matching codes and scores the two most popular offsets
+type HistogramScorer struct {
+	// Slop is the time quantization applied to both fingerprints, defaults to 2 frames as
+	// matching uses
+	Slop uint32
+	// Partial compares the query against the entire candidate rather than only its
+	// beginning, required to find queries taken from the middle of a track
+	Partial bool
+	// MinOverlapRatio is the smallest ratio of the query the confidence is normalized by,
+	// defaults to 1 which scores every query against all of its codes. Lower ratios raise the
+	// confidence of queries that only partly overlap the candidate, e.g. captures spanning
+	// two tracks, and need thresholds derived for them as impostors are raised too
+	MinOverlapRatio float32
+	// Algorithm defaults to AutoScoring, candidates without a stored code index are always
+	// mapped out
+	Algorithm ScoreAlgorithm
+}
+
+// Score implements Scorer
+func (s HistogramScorer) Score(query, candidate *Fingerprint) ScoreDetail {
+	return calculateConfidence(query, candidate, s.withDefaults())
+}
+
+// withDefaults fills in the zero settings, the times are divided by the slop
+func (s HistogramScorer) withDefaults() HistogramScorer {
+	if s.Slop == 0 {
+		s.Slop = histogramMatchSlop
+	}
+	return s
+}
+
+func calculateConfidence(fp *Fingerprint, matchFp *Fingerprint, s HistogramScorer) ScoreDetail {
+	t := trackTime("calculateConfidence")
+	defer t.finish()
+
+	slop := s.Slop
+	var codeOverlap int
+	limit := s.limit(fp, matchFp)
+
+	algorithm := s.algorithm(fp, matchFp)
+	if algorithm == MergeScoring && fp.codeIndex == nil {
+		fp = fp.NewIndexed()
+	}
+
+	// stored fingerprints come with their codes indexed, others are mapped out here
+	var matchCodeMap map[uint32][]uint32
+	var minMatchTime, maxMatchTime uint32
+	if algorithm == MapScoring {
+		matchCodeMap, minMatchTime, maxMatchTime = getCodeTimeMap(matchFp, limit, slop)
+	} else {
+		minMatchTime, maxMatchTime = timeRange(matchFp.Times[:limit], slop)
+	}
+
+	h := newHistogram(fp.Times, minMatchTime, maxMatchTime, slop)
+	defer h.release()
+
+	switch algorithm {
+	case MergeScoring:
+		codeOverlap = h.addJoined(fp.codeIndex, matchFp.codeIndex, limit)
+	case LookupScoring:
+		for i, code := range fp.Codes {
+			fpTime := fp.Times[i] / slop * slop
+			positions, times := matchFp.codeIndex.lookup(code)
+			if len(positions) > 0 && int(positions[0]) < limit {
+				codeOverlap++
+			}
+			for j, pos := range positions {
+				if int(pos) >= limit {
+					break
+				}
+				h.add(int(times[j]/slop*slop) - int(fpTime))
+			}
+		}
+	default:
+		for i, code := range fp.Codes {
+			fpTime := fp.Times[i] / slop * slop
+			if matchTimes, ok := matchCodeMap[code]; ok {
+				codeOverlap++
+				for _, matchTime := range matchTimes {
+					h.add(int(matchTime) - int(fpTime))
+				}
+			}
+		}
+	}
+
+	return s.detail(fp, matchFp, h.top, codeOverlap, minMatchTime, maxMatchTime)
+}
+
+// limit returns the number of the candidate's codes to compare the query with
+func (s HistogramScorer) limit(fp, matchFp *Fingerprint) int {
+	// limit the number of codes we map out to the length of the query FP
+	// anything beyond that is useless due to the way we clamp (see Fingerprint.NewClamped())
+	// this is dramatically faster for song matches, but prevents us from finding partials (mixes)
+	// sparse fingerprints are long form content, where the query may come from anywhere
+	if s.Partial || matchFp.sparsity > 1 {
+		return len(matchFp.Codes)
+	}
+	return min(len(fp.Codes), len(matchFp.Codes))
+}
+
+// detail scores the best alignment found by the histogram of offsets, given the time range of
+// the candidate's compared codes
+func (s HistogramScorer) detail(fp, matchFp *Fingerprint, top topBins, codeOverlap int, minMatchTime, maxMatchTime uint32) ScoreDetail {
+	slop := s.Slop
+	c := ScoreDetail{CodeOverlap: codeOverlap}
+
+	offset := top.offset
+	c.Offset = FramesToDuration(offset)
+	c.Score = int(top.count) + int(top.secondCount)
+
+	// only 1 in N of the query codes can line up with a sparse fingerprint
+	if matchFp.sparsity > 1 {
+		c.Score *= int(matchFp.sparsity)
+	}
+
+	// only the query codes that line up with the candidate's time range at the best
+	// alignment could have matched, a short overlap shouldn't be penalized for the rest
+	var overlap int
+	minAlignedTime, maxAlignedTime := int(maxMatchTime), int(minMatchTime)
+	for _, time := range fp.Times {
+		alignedTime := int(time/slop*slop) + offset
+		if alignedTime >= int(minMatchTime) && alignedTime <= int(maxMatchTime) {
+			overlap++
+			if alignedTime < minAlignedTime {
+				minAlignedTime = alignedTime
+			}
+			if alignedTime > maxAlignedTime {
+				maxAlignedTime = alignedTime
+			}
+		}
+	}
+	if overlap > 0 {
+		c.Aligned = FramesToDuration(maxAlignedTime - minAlignedTime)
+	}
+	if minOverlap := int(float32(len(fp.Codes)) * orDefault(s.MinOverlapRatio, minOverlapRatio)); overlap < minOverlap {
+		overlap = minOverlap
+	}
+
+	c.RawConfidence = float32(c.Score) / float32(len(fp.Codes)) * 100.00
+	if overlap > 0 {
+		c.Confidence = float32(c.Score) / float32(overlap) * 100.00
+	}
+
+	return c
+}
+
+// algorithm returns the algorithm to compare the fingerprints with, candidates without a code
+// index can only be mapped out
+func (s HistogramScorer) algorithm(query, candidate *Fingerprint) ScoreAlgorithm {
+	switch {
+	case candidate.codeIndex == nil || s.Algorithm == MapScoring:
+		return MapScoring
+	case s.Algorithm == LookupScoring || s.Algorithm == MergeScoring:
+		return s.Algorithm
+	case query.codeIndex == nil:
+		return LookupScoring
+	}
+
+	// merge joining steps through the unique codes of both, looking up binary searches the
+	// unique codes of the candidate for every query code
+	queryCodes, candidateCodes := len(query.codeIndex.codes), len(candidate.codeIndex.codes)
+	if queryCodes+candidateCodes <= len(query.Codes)*bits.Len(uint(candidateCodes)) {
+		return MergeScoring
+	}
+	return LookupScoring
+}
+
+// histogram counts the time offsets between matching codes. Both fingerprints are quantized by
+// slop, so every offset is a multiple of slop within the range spanned by the two and the bins
+// can be a dense slice indexed by offset/slop
+type histogram struct {
+	bins    *[]uint32
+	minDist int
+	slop    uint32
+	// only the two most popular offsets are scored, they are tracked as the histogram is built
+	// rather than by going through every bin afterwards
+	top topBins
+}
+
+func newHistogram(queryTimes []uint32, minMatchTime, maxMatchTime, slop uint32) histogram {
+	minTime, maxTime := timeRange(queryTimes, slop)
+	minDist := int(minMatchTime) - int(maxTime)
+	bins := (int(maxMatchTime)-minDist-int(minTime))/int(slop) + 1
+
+	return histogram{bins: getHistogram(bins), minDist: minDist, slop: slop}
+}
+
+func (h *histogram) add(dist int) {
+	bin := (dist - h.minDist) / int(h.slop)
+	(*h.bins)[bin]++
+	h.top.add(dist, (*h.bins)[bin])
+}
+
+// addJoined adds the offsets between the codes of an indexed query and candidate by merge
+// joining their sorted codes, ignoring the candidate's codes from position limit on. It returns
+// the number of query codes found in the candidate
+func (h *histogram) addJoined(query, candidate *codeIndex, limit int) int {
+	var overlap int
+	for i, j := 0, 0; i < len(query.codes) && j < len(candidate.codes); {
+		switch {
+		case query.codes[i] < candidate.codes[j]:
+			i++
+		case query.codes[i] > candidate.codes[j]:
+			j++
+		default:
+			_, queryTimes := query.entry(i)
+			positions, times := candidate.entry(j)
+			if int(positions[0]) < limit {
+				overlap += len(queryTimes)
+			}
+			for _, queryTime := range queryTimes {
+				queryTime = queryTime / h.slop * h.slop
+				for k, pos := range positions {
+					if int(pos) >= limit {
+						break
+					}
+					h.add(int(times[k]/h.slop*h.slop) - int(queryTime))
+				}
+			}
+			i++
+			j++
+		}
+	}
+	return overlap
+}
+
+func (h *histogram) release() {
+	putHistogram(h.bins)
+}
+
+// histograms recycles the offset histograms across candidates, they are cleared before being
+// put back
+var histograms = sync.Pool{New: func() interface{} { return new([]uint32) }}
+
+// getHistogram returns a zeroed histogram of n bins
+func getHistogram(n int) *[]uint32 {
+	h := histograms.Get().(*[]uint32)
+	if cap(*h) < n {
+		*h = make([]uint32, n)
+	}
+	*h = (*h)[:n]
+	return h
+}
+
+func putHistogram(h *[]uint32) {
+	clear(*h)
+	histograms.Put(h)
+}
+
+// topBins keeps the two most popular bins of a histogram whose counts only ever go up by one,
+// the smaller offset wins ties so the bins don't depend on the order the counts went up in
+type topBins struct {
+	offset, secondOffset int
+	count, secondCount   uint32
+}
+
+// add records that the bin at offset was incremented to count
+func (t *topBins) add(offset int, count uint32) {
+	switch {
+	case t.count > 0 && offset == t.offset:
+		t.count = count
+		return
+	case t.secondCount > 0 && offset == t.secondOffset:
+		t.secondCount = count
+	case beats(count, offset, t.secondCount, t.secondOffset):
+		t.secondOffset, t.secondCount = offset, count
+	default:
+		return
+	}
+
+	// the second bin may have overtaken the top one
+	if beats(t.secondCount, t.secondOffset, t.count, t.offset) {
+		t.offset, t.secondOffset = t.secondOffset, t.offset
+		t.count, t.secondCount = t.secondCount, t.count
+	}
+}
+
+// timeRange returns the earliest and latest of the (slop quantized) times
+func timeRange(times []uint32, slop uint32) (uint32, uint32) {
+	var minTime, maxTime uint32
+	for i, time := range times {
+		time = time / slop * slop
+		if i == 0 || time < minTime {
+			minTime = time
+		}
+		if time > maxTime {
+			maxTime = time
+		}
+	}
+	return minTime, maxTime
+}
+
+// beats reports whether a bin ranks above another
+func beats(count uint32, offset int, otherCount uint32, otherOffset int) bool {
+	return count > otherCount || count == otherCount && offset < otherOffset
+}
+
+// getCodeTimeMap maps the first limit codes of the fingerprint to their (slop quantized) times,
+// also returning the time range covered by those codes
+func getCodeTimeMap(fp *Fingerprint, limit int, slop uint32) (map[uint32][]uint32, uint32, uint32) {
+	if len(fp.Codes) < limit {
+		limit = len(fp.Codes)
+	}
+
+	var minTime, maxTime uint32
+	codeMap := make(map[uint32][]uint32, limit)
+	for i := 0; i < limit; i++ {
+		code := fp.Codes[i]
+		time := fp.Times[i] / slop * slop
+		codeMap[code] = append(codeMap[code], time)
+
+		if i == 0 || time < minTime {
+			minTime = time
+		}
+		if time > maxTime {
+			maxTime = time
+		}
+	}
+
+	return codeMap, minTime, maxTime
+}
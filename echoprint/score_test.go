@@ -0,0 +1,157 @@
+package echoprint
+
+import (
+	"flag"
+	"testing"
+)
+
+// the scorer benchmarks compare real fingerprints, any codegen files can be given with
+// go test -bench Scorer -args -bench-query <query.json> -bench-candidate <candidate.json>
+var (
+	benchQuery     = flag.String("bench-query", "../test-data/fp1.json", "codegen file of the benchmarked query")
+	benchCandidate = flag.String("bench-candidate", "../test-data/fp1.json", "codegen file of the benchmarked candidate")
+	benchSlop      = flag.Uint("bench-slop", histogramMatchSlop, "histogram slop of the benchmarked scorer")
+)
+
+// repeatedFingerprint returns the first fingerprint of the codegen file repeated times over,
+// each repetition's codes distinct from the others' so they only line up at offset 0
+func repeatedFingerprint(t *testing.T, path string, times int) *Fingerprint {
+	t.Helper()
+	list, err := ParseCodegenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp, err := NewFingerprint(list[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, last := fp.timeRange()
+	repeated := &Fingerprint{Meta: fp.Meta}
+	for r := 0; r < times; r++ {
+		for i := range fp.Codes {
+			repeated.Codes = append(repeated.Codes, fp.Codes[i]^uint32(r)<<20)
+			repeated.Times = append(repeated.Times, fp.Times[i]+uint32(r)*(last+1))
+		}
+	}
+	return repeated
+}
+
+// TestLongFingerprintConfidence compares a fingerprint of over 45 minutes with itself, the
+// offset 0 bin counts more than 65535 codes
+func TestLongFingerprintConfidence(t *testing.T) {
+	fp := repeatedFingerprint(t, "../test-data/fp1.json", 8)
+	if minutes := FramesToDuration(int(fp.Times[len(fp.Times)-1])).Minutes(); minutes < 45 {
+		t.Fatalf("fingerprint is only %.0f minutes long", minutes)
+	}
+	if len(fp.Codes) <= 1<<16 {
+		t.Fatalf("fingerprint has only %d codes", len(fp.Codes))
+	}
+
+	s := Compare(fp, fp, CompareOptions{})
+	if !s.Match || s.Confidence != maxConfidence || s.Offset != 0 {
+		t.Errorf("Compare = confidence %.1f, match %v, offset %s, want %.0f at offset 0", s.Confidence, s.Match, s.Offset, maxConfidence)
+	}
+
+	indexed := fp.NewIndexed()
+	for _, algorithm := range []ScoreAlgorithm{MapScoring, LookupScoring, MergeScoring} {
+		d := HistogramScorer{Slop: histogramMatchSlop, Algorithm: algorithm}.Score(indexed, indexed)
+		if d.Confidence < maxConfidence || d.Offset != 0 {
+			t.Errorf("algorithm %d = confidence %.1f at offset %s, want %.0f at offset 0", algorithm, d.Confidence, d.Offset, maxConfidence)
+		}
+	}
+}
+
+// TestHistogramScorerDefaultSlop scores with the zero value HistogramScorer
+func TestHistogramScorerDefaultSlop(t *testing.T) {
+	fp := firstFingerprint(t, "../test-data/fp1.json")
+	d := HistogramScorer{}.Score(fp, fp)
+	want := HistogramScorer{Slop: histogramMatchSlop}.Score(fp, fp)
+	if d != want {
+		t.Errorf("zero value scorer = %+v, want %+v", d, want)
+	}
+}
+
+// TestMinOverlapRatio normalizes the confidence by the overlap only when asked to, the
+// thresholds are on the scale of the whole query
+func TestMinOverlapRatio(t *testing.T) {
+	fp := firstFingerprint(t, "../test-data/fp1.json")
+	_, last := fp.timeRange()
+	candidate := &Fingerprint{Meta: fp.Meta}
+	query := &Fingerprint{Meta: fp.Meta}
+	for i, time := range fp.Times {
+		if time < last/2 {
+			candidate.Codes = append(candidate.Codes, fp.Codes[i])
+			candidate.Times = append(candidate.Times, time)
+		}
+		// the query's second half runs past the end of the candidate
+		if time >= last/4 && time < last*3/4 {
+			query.Codes = append(query.Codes, fp.Codes[i])
+			query.Times = append(query.Times, time-last/4)
+		}
+	}
+
+	d := HistogramScorer{Slop: histogramMatchSlop, Partial: true}.Score(query, candidate)
+	if d.Confidence != d.RawConfidence {
+		t.Errorf("default confidence %.1f, want the raw confidence %.1f", d.Confidence, d.RawConfidence)
+	}
+	normalized := HistogramScorer{Slop: histogramMatchSlop, Partial: true, MinOverlapRatio: 0.25}.Score(query, candidate)
+	if normalized.Confidence < 1.5*normalized.RawConfidence {
+		t.Errorf("confidence %.1f normalized by half the query, raw %.1f", normalized.Confidence, normalized.RawConfidence)
+	}
+}
+
+// BenchmarkHistogramScorer scores the query against the candidate with each scoring algorithm,
+// both indexed up front as stored fingerprints and prepared queries are
+func BenchmarkHistogramScorer(b *testing.B) {
+	query := firstFingerprint(b, *benchQuery).NewIndexed()
+	candidate := firstFingerprint(b, *benchCandidate).NewIndexed()
+	clamped := query.NewClamped().NewIndexed()
+	slop := uint32(*benchSlop)
+
+	algorithms := []struct {
+		name      string
+		algorithm ScoreAlgorithm
+	}{
+		{"auto", AutoScoring},
+		{"map", MapScoring},
+		{"lookup", LookupScoring},
+		{"merge", MergeScoring},
+	}
+	benchmarks := []struct {
+		name   string
+		query  *Fingerprint
+		scorer HistogramScorer
+	}{
+		{"clamped", clamped, HistogramScorer{Slop: slop}},
+		{"clamped partial", clamped, HistogramScorer{Slop: slop, Partial: true}},
+		{"whole partial", query, HistogramScorer{Slop: slop, Partial: true}},
+	}
+
+	for _, bench := range benchmarks {
+		for _, algorithm := range algorithms {
+			scorer := bench.scorer
+			scorer.Algorithm = algorithm.algorithm
+			query := bench.query
+			b.Run(bench.name+"/"+algorithm.name, func(b *testing.B) {
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					scorer.Score(query, candidate)
+				}
+			})
+		}
+	}
+}
+
+func firstFingerprint(tb testing.TB, path string) *Fingerprint {
+	tb.Helper()
+	list, err := ParseCodegenFile(path)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	fp, err := NewFingerprint(list[0])
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return fp
+}
@@ -0,0 +1,132 @@
+//go:build vectorscore
+// +build vectorscore
+
+package echoprint
+
+import (
+	"cmp"
+	"slices"
+)
+
+// vectorScorer scores a batch of candidates in a single pass over the query. The code indexes
+// of the candidates are merged into one column sorted by code, joined with the query's sorted
+// codes, and every offset is scattered into one flat slab holding the histograms of the whole
+// batch. That flat layout is what SIMD and GPU scatter-add kernels operate on, this is the
+// portable implementation of it
+type vectorScorer struct {
+	HistogramScorer
+}
+
+// NewVectorScorer returns a BatchScorer scoring like the HistogramScorer, candidates without a
+// stored code index are scored one at a time
+func NewVectorScorer(s HistogramScorer) (BatchScorer, error) {
+	return vectorScorer{s.withDefaults()}, nil
+}
+
+// lane is the part of the batch a candidate occupies
+type lane struct {
+	fp                         *Fingerprint
+	minMatchTime, maxMatchTime uint32
+	// bins of the slab from base on hold the candidate's histogram, from offset minDist on
+	base, minDist int
+	codeOverlap   int
+	top           topBins
+}
+
+// ScoreBatch implements BatchScorer
+func (s vectorScorer) ScoreBatch(query *Fingerprint, candidates []*Fingerprint) []ScoreDetail {
+	t := trackTime("vectorScorer.ScoreBatch")
+	defer t.finish()
+
+	details := make([]ScoreDetail, len(candidates))
+	if query.codeIndex == nil {
+		query = query.NewIndexed()
+	}
+	slop := s.Slop
+	minTime, maxTime := timeRange(query.Times, slop)
+
+	// the column holds the lane and time of every compared code of the batch, sorted by code
+	var codes, lanes, times []uint32
+	var batch []lane
+	var bins int
+	for i, candidate := range candidates {
+		if candidate.codeIndex == nil {
+			details[i] = s.Score(query, candidate)
+			continue
+		}
+
+		l := lane{fp: candidate, base: bins}
+		limit := s.limit(query, candidate)
+		l.minMatchTime, l.maxMatchTime = timeRange(candidate.Times[:limit], slop)
+		l.minDist = int(l.minMatchTime) - int(maxTime)
+		bins += (int(l.maxMatchTime)-l.minDist-int(minTime))/int(slop) + 1
+
+		idx := candidate.codeIndex
+		for j, pos := range idx.positions {
+			if int(pos) < limit {
+				codes = append(codes, candidate.Codes[pos])
+				lanes = append(lanes, uint32(len(batch)))
+				times = append(times, idx.times[j]/slop*slop)
+			}
+		}
+		batch = append(batch, l)
+	}
+	if len(batch) == 0 {
+		return details
+	}
+
+	order := make([]int, len(codes))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortStableFunc(order, func(a, b int) int { return cmp.Compare(codes[a], codes[b]) })
+
+	slab := getHistogram(bins)
+	defer putHistogram(slab)
+
+	queryIdx := query.codeIndex
+	for i, j := 0, 0; i < len(queryIdx.codes) && j < len(order); {
+		code := codes[order[j]]
+		switch {
+		case queryIdx.codes[i] < code:
+			i++
+		case queryIdx.codes[i] > code:
+			j++
+		default:
+			_, queryTimes := queryIdx.entry(i)
+			end := j
+			for end < len(order) && codes[order[end]] == code {
+				end++
+			}
+
+			// the entries of a lane are adjacent, the stable sort kept them in lane order
+			for k := j; k < end; k++ {
+				e := order[k]
+				l := &batch[lanes[e]]
+				if k == j || lanes[order[k-1]] != lanes[e] {
+					l.codeOverlap += len(queryTimes)
+				}
+				for _, queryTime := range queryTimes {
+					dist := int(times[e]) - int(queryTime/slop*slop)
+					bin := l.base + (dist-l.minDist)/int(slop)
+					(*slab)[bin]++
+					l.top.add(dist, (*slab)[bin])
+				}
+			}
+			i++
+			j = end
+		}
+	}
+
+	var n int
+	for i, candidate := range candidates {
+		if candidate.codeIndex == nil {
+			continue
+		}
+		l := batch[n]
+		details[i] = s.detail(query, candidate, l.top, l.codeOverlap, l.minMatchTime, l.maxMatchTime)
+		n++
+	}
+
+	return details
+}
@@ -0,0 +1,9 @@
+//go:build !vectorscore
+// +build !vectorscore
+
+package echoprint
+
+// NewVectorScorer is only available in builds with the vectorscore tag
+func NewVectorScorer(s HistogramScorer) (BatchScorer, error) {
+	return nil, ErrVectorScoringDisabled
+}
@@ -0,0 +1,75 @@
+package echoprint
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"sync"
+)
+
+// scoreCache memoizes the comparisons of a single MatchAll request. Dedupe jobs submit the same
+// or overlapping fingerprints many times over and tiered searches see a candidate again in each
+// tier, every (query, candidate) pair only needs scoring once per request
+type scoreCache struct {
+	mu     sync.Mutex
+	scores map[scoreKey]cachedScore
+}
+
+type scoreKey struct {
+	query   uint64
+	trackID uint32
+	variant uint32
+}
+
+type cachedScore struct {
+	detail    ScoreDetail
+	timeScale float32
+}
+
+func newScoreCache() *scoreCache {
+	return &scoreCache{scores: make(map[scoreKey]cachedScore)}
+}
+
+// queryKey hashes the prepared query along with the options that change its scores, 0 without
+// a cache
+func (c *scoreCache) queryKey(fp *Fingerprint, opts MatchOptions) uint64 {
+	if c == nil {
+		return 0
+	}
+
+	h := fnv.New64a()
+	buf := make([]byte, 4)
+	for i, code := range fp.Codes {
+		binary.LittleEndian.PutUint32(buf, code)
+		h.Write(buf)
+		binary.LittleEndian.PutUint32(buf, fp.Times[i])
+		h.Write(buf)
+	}
+	scorer := opts.scorer()
+	fmt.Fprintf(h, "%v|%T%+v", opts.TimeScaling, scorer, scorer)
+
+	return h.Sum64()
+}
+
+func (c *scoreCache) get(query uint64, candidate *Fingerprint) (ScoreDetail, float32, bool) {
+	if c == nil {
+		return ScoreDetail{}, 0, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	score, ok := c.scores[scoreKey{query, candidate.Meta.TrackID, candidate.variant}]
+	return score.detail, score.timeScale, ok
+}
+
+func (c *scoreCache) put(query uint64, candidate *Fingerprint, d ScoreDetail, timeScale float32) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.scores[scoreKey{query, candidate.Meta.TrackID, candidate.variant}] = cachedScore{d, timeScale}
+}
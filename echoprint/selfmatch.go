@@ -0,0 +1,79 @@
+package echoprint
+
+import (
+	"errors"
+
+	"github.com/golang/glog"
+)
+
+// ErrSelfMatchFailed is returned during ingestion when a fingerprint doesn't match itself and
+// SelfMatch.Reject is set
+var ErrSelfMatchFailed = errors.New("Fingerprint does not match itself")
+
+// selfMatchDefaultConfidence is the confidence a fingerprint must match itself with when
+// SelfMatch.MinConfidence isn't set
+var selfMatchDefaultConfidence = defaultThresholds.MinConfidenceHighQuality
+
+// SelfMatch verifies ingested fingerprints by querying them back, which catches corrupted
+// codegen output (garbled times, a handful of codes) before it pollutes the catalog
+type SelfMatch struct {
+	// MinConfidence is the confidence the fingerprint must match itself with, defaults to the
+	// high quality match threshold
+	MinConfidence float32
+	// Reject fails ingests that don't match themselves with ErrSelfMatchFailed, otherwise
+	// they are stored and flagged as unverified
+	Reject bool
+}
+
+// VerifySelfMatch queries a fingerprint back against the database connected by DBConnect
+func VerifySelfMatch(fp *Fingerprint, opts IngestOptions) (float32, error) {
+	return defaultMatcher.VerifySelfMatch(fp, opts)
+}
+
+// VerifySelfMatch queries the fingerprint, as an ingest with the options would store it, back
+// and returns the confidence it matches itself with. The query runs against an index of only
+// the fingerprint so a failing ingest never has to be removed from the store
+func (m *Matcher) VerifySelfMatch(fp *Fingerprint, opts IngestOptions) (float32, error) {
+	stored, err := fp.forStorage(opts)
+	if err != nil {
+		return 0, err
+	}
+	storedFp := *stored
+	storedFp.variant = 0
+	if storedFp.Meta.TrackID == 0 {
+		storedFp.Meta.TrackID = 1
+	}
+
+	index := &Matcher{Store: NewMemoryStore(), defaults: m.defaults, searchDepth: m.searchDepth}
+	if err := index.Store.save(&storedFp); err != nil {
+		return 0, err
+	}
+
+	// every confidence is reported, the caller decides what is good enough
+	matchOpts := MatchOptions{Thresholds: Thresholds{
+		MinConfidenceHighQuality:   0.01,
+		MinConfidenceMediumQuality: 0.01,
+		MinConfidenceLowQuality:    0.01,
+	}}
+	matches, _, err := index.match(fp, matchOpts)
+	if err != nil || len(matches) == 0 {
+		return 0, err
+	}
+
+	return matches[0].Confidence, nil
+}
+
+// verify checks the fingerprint matches itself with the minimum confidence
+func (s *SelfMatch) verify(m *Matcher, fp *Fingerprint, opts IngestOptions) (float32, bool, error) {
+	confidence, err := m.VerifySelfMatch(fp, opts)
+	if err != nil {
+		return 0, false, err
+	}
+
+	ok := confidence >= orDefault(s.MinConfidence, selfMatchDefaultConfidence)
+	if !ok {
+		glog.Warningf("TrackID=%d matches itself with Confidence=%f only, Filename=%s", fp.Meta.TrackID, confidence, fp.Meta.Filename)
+	}
+
+	return confidence, ok, nil
+}
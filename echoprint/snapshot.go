@@ -0,0 +1,281 @@
+package echoprint
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"math"
+
+	"github.com/golang/glog"
+)
+
+// snapshotHeader is the first line of a snapshot. Full snapshots hold every fingerprint stored
+// up to Sequence, deltas (Since > 0) the fingerprints stored after Since up to Sequence
+type snapshotHeader struct {
+	Since    uint64 `json:"since,omitempty"`
+	Sequence uint64 `json:"sequence"`
+}
+
+// snapshotRecord is a single stored fingerprint in a snapshot, snapshots are gzipped json
+// lines with every variant of a track following its first fingerprint
+type snapshotRecord struct {
+	Codes    []uint32 `json:"codes"`
+	Times    []uint32 `json:"times"`
+	Meta     metadata `json:"meta"`
+	Variant  uint32   `json:"variant,omitempty"`
+	Sparsity uint32   `json:"sparsity,omitempty"`
+	// Quality is the track's stored tier, which may differ from the tier of its bitrate
+	Quality string `json:"quality,omitempty"`
+}
+
+// SnapshotInfo describes a snapshot that was written or restored
+type SnapshotInfo struct {
+	Since        uint64 `json:"since,omitempty"`
+	Sequence     uint64 `json:"sequence"`
+	Fingerprints int    `json:"fingerprints"`
+	// Qualities is the number of existing tracks whose quality tier was updated by a restore
+	Qualities int `json:"qualities,omitempty"`
+}
+
+// CurrentSequence returns the sequence of the database connected by DBConnect
+func CurrentSequence() (uint64, error) {
+	return defaultMatcher.CurrentSequence()
+}
+
+// CurrentSequence returns the sequence of the last change stored. Snapshots and deltas written
+// afterwards cover at least up to it, so it may be announced before they are streamed
+func (m *Matcher) CurrentSequence() (uint64, error) {
+	// nothing changed after the largest sequence so only the current sequence is returned
+	_, sequence, err := m.Store.changesSince(math.MaxUint64)
+	return sequence, err
+}
+
+// WriteSnapshot writes every fingerprint of the database connected by DBConnect to w
+func WriteSnapshot(w io.Writer) (SnapshotInfo, error) {
+	return defaultMatcher.WriteSnapshot(w)
+}
+
+// WriteSnapshot writes every stored fingerprint to w in a backend independent format that
+// RestoreSnapshot can load into any store
+func (m *Matcher) WriteSnapshot(w io.Writer) (SnapshotInfo, error) {
+	// the sequence is read first, fingerprints stored while the snapshot is written may then
+	// also be part of the next delta which is harmless as restores skip existing fingerprints
+	sequence, err := m.CurrentSequence()
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+
+	trackIDs, err := m.Store.trackIDs()
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	sortTrackIDs(trackIDs)
+
+	var keys []fingerprintKey
+	for _, trackID := range trackIDs {
+		variants, err := m.Store.nextVariant(trackID)
+		if err != nil {
+			return SnapshotInfo{}, err
+		}
+		for variant := uint32(0); variant < variants; variant++ {
+			keys = append(keys, fingerprintKey{trackID, variant})
+		}
+	}
+
+	info := SnapshotInfo{Sequence: sequence}
+	if info.Fingerprints, err = m.writeSnapshot(w, snapshotHeader{Sequence: sequence}, keys); err != nil {
+		return info, err
+	}
+	glog.Infof("Wrote snapshot of %d tracks up to sequence %d", len(trackIDs), sequence)
+
+	return info, nil
+}
+
+// WriteDelta writes the fingerprints of the database connected by DBConnect stored after since
+func WriteDelta(w io.Writer, since uint64) (SnapshotInfo, error) {
+	return defaultMatcher.WriteDelta(w, since)
+}
+
+// WriteDelta writes an incremental snapshot of the fingerprints stored after the sequence
+// since, which is the Sequence of the previous full snapshot or delta. Applying the deltas in
+// order with RestoreSnapshot keeps standby nodes and backups current without full snapshots
+func (m *Matcher) WriteDelta(w io.Writer, since uint64) (SnapshotInfo, error) {
+	keys, sequence, err := m.Store.changesSince(since)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+
+	info := SnapshotInfo{Since: since, Sequence: sequence}
+	if info.Fingerprints, err = m.writeSnapshot(w, snapshotHeader{Since: since, Sequence: sequence}, keys); err != nil {
+		return info, err
+	}
+	glog.Infof("Wrote delta of %d fingerprints from sequence %d to %d", info.Fingerprints, since, sequence)
+
+	return info, nil
+}
+
+func (m *Matcher) writeSnapshot(w io.Writer, header snapshotHeader, keys []fingerprintKey) (int, error) {
+	gz := gzip.NewWriter(w)
+	encoder := json.NewEncoder(gz)
+	if err := encoder.Encode(&header); err != nil {
+		return 0, err
+	}
+
+	var written int
+	for _, key := range keys {
+		fp, err := m.Store.load(key.trackID, key.variant)
+		if err == ErrTrackNotFound {
+			// changes whose save was rolled back leave their sequence behind
+			continue
+		} else if err != nil {
+			return written, err
+		}
+
+		record := snapshotRecord{Codes: fp.Codes, Times: fp.Times, Meta: fp.Meta, Variant: fp.variant, Sparsity: fp.sparsity, Quality: fp.quality}
+		if err := encoder.Encode(&record); err != nil {
+			return written, err
+		}
+		written++
+	}
+
+	return written, gz.Close()
+}
+
+// RestoreSnapshot loads a snapshot into the database connected by DBConnect
+func RestoreSnapshot(r io.Reader) (SnapshotInfo, error) {
+	return defaultMatcher.RestoreSnapshot(r)
+}
+
+// RestoreSnapshot saves every fingerprint of a full snapshot or delta in the store, returning
+// its sequences and the number of fingerprints restored. Fingerprints that already exist are
+// skipped so an interrupted restore can be run again, only their quality tier is updated
+func (m *Matcher) RestoreSnapshot(r io.Reader) (SnapshotInfo, error) {
+	var info SnapshotInfo
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return info, err
+	}
+	defer gz.Close()
+
+	// restored fingerprints may match queries cached as unknown, even when the restore fails
+	defer func() {
+		if info.Fingerprints > 0 {
+			m.negatives.invalidate()
+		}
+	}()
+
+	decoder := json.NewDecoder(bufio.NewReader(gz))
+	var header snapshotHeader
+	if err := decoder.Decode(&header); err != nil {
+		return info, err
+	}
+	info.Since, info.Sequence = header.Since, header.Sequence
+
+	for {
+		var record snapshotRecord
+		if err := decoder.Decode(&record); err == io.EOF {
+			break
+		} else if err != nil {
+			return info, err
+		}
+
+		fp := &Fingerprint{
+			Codes:    record.Codes,
+			Times:    record.Times,
+			Meta:     record.Meta,
+			variant:  record.Variant,
+			sparsity: record.Sparsity,
+			quality:  record.Quality,
+		}
+		if err := m.Store.save(fp); err == ErrTrackIDExists {
+			glog.V(2).Infof("TrackID=%d variant %d already exists, skipping", fp.Meta.TrackID, fp.variant)
+			if updated, err := m.restoreQuality(fp); err != nil {
+				return info, err
+			} else if updated {
+				info.Qualities++
+			}
+			continue
+		} else if err != nil {
+			return info, err
+		}
+		m.events.publishSaved(fp)
+		info.Fingerprints++
+	}
+	glog.Infof("Restored %d fingerprints from snapshot up to sequence %d", info.Fingerprints, info.Sequence)
+
+	return info, nil
+}
+
+// restoreQuality updates the quality tier of an existing track to the restored fingerprint's,
+// deltas carry the tracks whose tier changed
+func (m *Matcher) restoreQuality(fp *Fingerprint) (bool, error) {
+	if fp.variant > 0 || fp.quality == "" {
+		return false, nil
+	}
+	existing, err := m.Store.load(fp.Meta.TrackID, 0)
+	if err != nil || existing.quality == fp.quality {
+		return false, err
+	}
+
+	if err := m.Store.setQuality(fp.Meta.TrackID, fp.quality); err != nil {
+		return false, err
+	}
+	m.events.publish(CatalogEvent{Type: EventQualityUpdated, TrackID: fp.Meta.TrackID, ExternalID: existing.Meta.ExternalID, Quality: fp.quality})
+	return true, nil
+}
+
+// UploadSnapshot writes a snapshot of the database connected by DBConnect to an object URL
+func UploadSnapshot(objects *ObjectStore, url string, since uint64) (SnapshotInfo, error) {
+	return defaultMatcher.UploadSnapshot(objects, url, since)
+}
+
+// UploadSnapshot writes a snapshot directly to an s3:// or gs:// URL with a multipart upload,
+// the object is only created when the whole snapshot was written. A since of 0 uploads a full
+// snapshot, anything else a delta of the fingerprints stored after it
+func (m *Matcher) UploadSnapshot(objects *ObjectStore, url string, since uint64) (SnapshotInfo, error) {
+	w, err := objects.Create(url)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+
+	var info SnapshotInfo
+	if since == 0 {
+		info, err = m.WriteSnapshot(w)
+	} else {
+		info, err = m.WriteDelta(w, since)
+	}
+	if err != nil {
+		w.Abort()
+		return info, err
+	}
+
+	return info, w.Close()
+}
+
+// BootstrapSnapshot restores the database connected by DBConnect from an object URL
+func BootstrapSnapshot(objects *ObjectStore, url string) (SnapshotInfo, error) {
+	return defaultMatcher.BootstrapSnapshot(objects, url)
+}
+
+// BootstrapSnapshot restores a fresh node's store from a snapshot at an s3://, gs:// or
+// http(s):// URL. Stores that already hold tracks are left as is
+func (m *Matcher) BootstrapSnapshot(objects *ObjectStore, url string) (SnapshotInfo, error) {
+	trackIDs, err := m.Store.trackIDs()
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	if len(trackIDs) > 0 {
+		glog.Infof("Store already holds %d tracks, skipping bootstrap from %s", len(trackIDs), url)
+		return SnapshotInfo{}, nil
+	}
+
+	r, err := objects.Open(url)
+	if err != nil {
+		return SnapshotInfo{}, err
+	}
+	defer r.Close()
+
+	glog.Infof("Bootstrapping store from %s", url)
+	return m.RestoreSnapshot(r)
+}
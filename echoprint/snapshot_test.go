@@ -0,0 +1,89 @@
+package echoprint
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestSnapshotQuality carries quality tier updates to a restored store through a delta
+func TestSnapshotQuality(t *testing.T) {
+	list, err := ParseCodegenFile("../test-data/fp1.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp, err := NewFingerprint(list[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	fp.Meta.TrackID = 1
+
+	primary := New(WithStore(NewMemoryStore()))
+	standby := New(WithStore(NewMemoryStore()))
+	if err := primary.Ingest(fp, IngestOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	var snapshot bytes.Buffer
+	full, err := primary.WriteSnapshot(&snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := standby.RestoreSnapshot(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := primary.Store.setQuality(1, qualityLow); err != nil {
+		t.Fatal(err)
+	}
+	var delta bytes.Buffer
+	if _, err := primary.WriteDelta(&delta, full.Sequence); err != nil {
+		t.Fatal(err)
+	}
+	info, err := standby.RestoreSnapshot(&delta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Fingerprints != 0 || info.Qualities != 1 {
+		t.Errorf("delta restored %+v, want only the quality tier", info)
+	}
+
+	restored, err := standby.Store.load(1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.quality != qualityLow {
+		t.Errorf("restored quality tier '%s', want '%s'", restored.quality, qualityLow)
+	}
+}
+
+// TestCurrentSequence announces the sequence a snapshot covers before it is written
+func TestCurrentSequence(t *testing.T) {
+	list, err := ParseCodegenFile("../test-data/fp1.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := New(WithStore(NewMemoryStore()))
+	for i, trackID := range []uint32{1, 2} {
+		fp, err := NewFingerprint(list[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		fp.Meta.TrackID = trackID
+		if err := m.Ingest(fp, IngestOptions{}); err != nil {
+			t.Fatal(err)
+		}
+
+		sequence, err := m.CurrentSequence()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var snapshot bytes.Buffer
+		info, err := m.WriteSnapshot(&snapshot)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sequence == 0 || sequence != info.Sequence || info.Fingerprints != i+1 {
+			t.Errorf("announced sequence %d for a snapshot of %+v", sequence, info)
+		}
+	}
+}
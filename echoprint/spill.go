@@ -0,0 +1,86 @@
+package echoprint
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// SpilledGroups holds the results of MatchAllSpilled in a temporary file, only the offsets
+// of the groups are kept in memory
+type SpilledGroups struct {
+	file    *os.File
+	offsets []int64
+	lengths []int64
+}
+
+// MatchAllSpilled performs MatchAllSpilled against the database connected by DBConnect
+func MatchAllSpilled(codegenList []*CodegenFp, opts MatchOptions, dir string) (*SpilledGroups, error) {
+	return defaultMatcher.MatchAllSpilled(codegenList, opts, dir)
+}
+
+// MatchAllSpilled performs the same matches as MatchAll but writes each group to a temporary
+// file in dir (the default temp dir when empty) as soon as it completes, bounding the memory
+// used by large batches. The caller must Close the result to remove the file
+func (m *Matcher) MatchAllSpilled(codegenList []*CodegenFp, opts MatchOptions, dir string) (*SpilledGroups, error) {
+	file, err := ioutil.TempFile(dir, "echoprint-spill-")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &SpilledGroups{
+		file:    file,
+		offsets: make([]int64, len(codegenList)),
+		lengths: make([]int64, len(codegenList)),
+	}
+
+	var mu sync.Mutex
+	var offset int64
+	var spillErr error
+	m.matchEach(codegenList, opts, func(group int, matchGroup MatchGroup) {
+		data, err := json.Marshal(matchGroup)
+
+		mu.Lock()
+		defer mu.Unlock()
+		if err == nil {
+			_, err = file.Write(data)
+		}
+		if err != nil {
+			spillErr = err
+			return
+		}
+
+		s.offsets[group] = offset
+		s.lengths[group] = int64(len(data))
+		offset += int64(len(data))
+	})
+
+	if spillErr != nil {
+		s.Close()
+		return nil, spillErr
+	}
+
+	return s, nil
+}
+
+// Len returns the number of groups
+func (s *SpilledGroups) Len() int {
+	return len(s.offsets)
+}
+
+// Get reads a group back from disk
+func (s *SpilledGroups) Get(group int) (MatchGroup, error) {
+	var matchGroup MatchGroup
+	r := io.NewSectionReader(s.file, s.offsets[group], s.lengths[group])
+	err := json.NewDecoder(r).Decode(&matchGroup)
+
+	return matchGroup, err
+}
+
+// Close removes the temporary file
+func (s *SpilledGroups) Close() error {
+	s.file.Close()
+	return os.Remove(s.file.Name())
+}
@@ -0,0 +1,81 @@
+package echoprint
+
+import (
+	"errors"
+)
+
+type dbResult struct {
+	fp         *Fingerprint
+	score      float32
+	ingestedAt string
+}
+
+// Store is the storage backend a Matcher ingests fingerprints into and matches against, either
+// the solr and bolt backed store of NewDBStore or the in-memory index of NewMemoryStore.
+//
+// Stores are safe for concurrent use. A query sees a consistent snapshot of the fingerprints
+// while ingests proceed: a fingerprint is either returned complete or not at all, never
+// partially written. save fails with ErrTrackIDExists rather than overwriting a fingerprint
+// saved concurrently under the same TrackID and variant
+type Store interface {
+	// Close releases the store's connections
+	Close() error
+
+	// candidates returns a cursor over the candidates sharing at least minScore percent of the
+	// query's unique codes, their fingerprints carry a code index when one was stored
+	candidates(fp *Fingerprint, minScore float32, filter *MetadataFilter) candidateCursor
+	save(fp *Fingerprint) error
+	load(trackID uint32, variant uint32) (*Fingerprint, error)
+	trackIDs() ([]uint32, error)
+	trackIDForExternalID(id ExternalID) (uint32, error)
+	allocateTrackID() (uint32, error)
+	nextVariant(trackID uint32) (uint32, error)
+	checkTrackExists(trackID uint32) (bool, error)
+	// setQuality persists a re-derived quality tier for every fingerprint of the track
+	setQuality(trackID uint32, quality string) error
+	// changesSince returns the fingerprints saved after the changelog sequence, oldest first,
+	// along with the current sequence
+	changesSince(sequence uint64) ([]fingerprintKey, uint64, error)
+}
+
+// candidateCursor pages through the candidates of a query, so matching can stream as many as
+// it needs without fetching a huge result set up front. Cursors are used by a single goroutine
+type candidateCursor interface {
+	// next examines up to rows more candidates and returns those that meet the minimum score,
+	// more is false once the candidates are exhausted
+	next(rows int) (page []dbResult, more bool, err error)
+}
+
+// fingerprintKey identifies a single stored fingerprint
+type fingerprintKey struct {
+	trackID uint32
+	variant uint32
+}
+
+// ErrTrackNotFound is returned when a TrackID isn't stored
+var ErrTrackNotFound = errors.New("Failed to find Track in database")
+
+// BackendError is returned when a storage backend can't be reached
+type BackendError struct {
+	Err error
+}
+
+func (e *BackendError) Error() string {
+	return e.Err.Error()
+}
+
+// calculateCodeScore does a basic intersection on the unique code values
+// to determine if we should even consider it for a histogram match
+func calculateCodeScore(qSet, mSet map[uint32]struct{}) float32 {
+	t := trackTime("calculateCodeScore")
+	defer t.finish()
+
+	var count int
+	for code := range qSet {
+		if _, ok := mSet[code]; ok {
+			count++
+		}
+	}
+
+	return float32(count) / float32(len(qSet)) * 100.00
+}
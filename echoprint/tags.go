@@ -0,0 +1,50 @@
+package echoprint
+
+// TagCount is the number of tracks carrying a tag value and the codes stored for all of
+// their fingerprints
+type TagCount struct {
+	Tracks int `json:"tracks"`
+	Codes  int `json:"codes"`
+}
+
+// CountTags counts the tracks of the database connected by DBConnect by the value of a tag
+func CountTags(key string) (map[string]TagCount, error) {
+	return defaultMatcher.CountTags(key)
+}
+
+// CountTags scans the store counting the tracks by the value of a tag, as carried by their
+// first fingerprint. Tracks without the tag are counted under ""
+func (m *Matcher) CountTags(key string) (map[string]TagCount, error) {
+	trackIDs, err := m.Store.trackIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]TagCount)
+	for _, trackID := range trackIDs {
+		variants, err := m.Store.nextVariant(trackID)
+		if err != nil {
+			return nil, err
+		}
+
+		var value string
+		var codes int
+		for variant := uint32(0); variant < variants; variant++ {
+			fp, err := m.Store.load(trackID, variant)
+			if err != nil {
+				return nil, err
+			}
+			if variant == 0 {
+				value = fp.Meta.Tags[key]
+			}
+			codes += len(fp.Codes)
+		}
+
+		count := counts[value]
+		count.Tracks++
+		count.Codes += codes
+		counts[value] = count
+	}
+
+	return counts, nil
+}
@@ -0,0 +1,142 @@
+package echoprint
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// Throttle watches the heap size and goroutine count and reduces the number of fingerprints
+// MatchAll and IngestAll process in parallel when either crosses its threshold, so ingest
+// storms slow down rather than getting the process OOM killed
+type Throttle struct {
+	// MaxHeapBytes is the heap size that triggers throttling, 0 ignores the heap
+	MaxHeapBytes uint64
+	// MaxGoroutines is the goroutine count that triggers throttling, 0 ignores goroutines
+	MaxGoroutines int
+	// MaxParallelism is the parallelism allowed without pressure, defaults to 4 per CPU
+	MaxParallelism int
+	// Interval between pressure checks, defaults to 1 second
+	Interval time.Duration
+
+	mu         sync.Mutex
+	cond       *sync.Cond
+	limit      int
+	active     int
+	heapBytes  uint64
+	goroutines int
+	throttled  int64
+	started    sync.Once
+}
+
+// ThrottleStats is a snapshot of a Throttle's state
+type ThrottleStats struct {
+	Limit      int    `json:"limit"`
+	Active     int    `json:"active"`
+	HeapBytes  uint64 `json:"heap_bytes"`
+	Goroutines int    `json:"goroutines"`
+	Throttled  int64  `json:"throttled"`
+}
+
+// Start begins monitoring in the background, it is safe to call more than once
+func (t *Throttle) Start() {
+	t.started.Do(func() {
+		t.mu.Lock()
+		t.cond = sync.NewCond(&t.mu)
+		t.limit = t.maxParallelism()
+		t.mu.Unlock()
+
+		interval := t.Interval
+		if interval <= 0 {
+			interval = time.Second
+		}
+		go func() {
+			for range time.Tick(interval) {
+				t.check()
+			}
+		}()
+	})
+}
+
+func (t *Throttle) maxParallelism() int {
+	if t.MaxParallelism > 0 {
+		return t.MaxParallelism
+	}
+	return runtime.NumCPU() * 4
+}
+
+// check halves the limit under pressure and doubles it again once the pressure has dropped
+// below 80% of the thresholds
+func (t *Throttle) check() {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	goroutines := runtime.NumGoroutine()
+
+	overHeap := t.MaxHeapBytes > 0 && mem.HeapAlloc > t.MaxHeapBytes
+	overGoroutines := t.MaxGoroutines > 0 && goroutines > t.MaxGoroutines
+	underHeap := t.MaxHeapBytes == 0 || mem.HeapAlloc < t.MaxHeapBytes/10*8
+	underGoroutines := t.MaxGoroutines == 0 || goroutines < t.MaxGoroutines/10*8
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.heapBytes = mem.HeapAlloc
+	t.goroutines = goroutines
+
+	switch {
+	case (overHeap || overGoroutines) && t.limit > 1:
+		t.limit /= 2
+		atomic.AddInt64(&t.throttled, 1)
+		glog.Warningf("Memory pressure (heap=%d bytes, goroutines=%d), throttling parallelism to %d", mem.HeapAlloc, goroutines, t.limit)
+	case underHeap && underGoroutines && t.limit < t.maxParallelism():
+		t.limit *= 2
+		if t.limit > t.maxParallelism() {
+			t.limit = t.maxParallelism()
+		}
+		glog.Infof("Memory pressure relieved, parallelism raised to %d", t.limit)
+		t.cond.Broadcast()
+	}
+}
+
+// acquire blocks until the work is allowed to run, a nil Throttle never blocks
+func (t *Throttle) acquire() {
+	if t == nil {
+		return
+	}
+	t.Start()
+
+	t.mu.Lock()
+	for t.active >= t.limit {
+		t.cond.Wait()
+	}
+	t.active++
+	t.mu.Unlock()
+}
+
+func (t *Throttle) release() {
+	if t == nil {
+		return
+	}
+
+	t.mu.Lock()
+	t.active--
+	t.cond.Signal()
+	t.mu.Unlock()
+}
+
+// Stats returns a snapshot of the throttle's state
+func (t *Throttle) Stats() ThrottleStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return ThrottleStats{
+		Limit:      t.limit,
+		Active:     t.active,
+		HeapBytes:  t.heapBytes,
+		Goroutines: t.goroutines,
+		Throttled:  atomic.LoadInt64(&t.throttled),
+	}
+}
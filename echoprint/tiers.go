@@ -0,0 +1,52 @@
+package echoprint
+
+import "github.com/golang/glog"
+
+// Tier is a subset of the catalog searched on its own by tiered search
+type Tier struct {
+	// Name labels the matches found in the tier
+	Name string
+	// Filter selects the tracks of the tier, nil selects every track so a last catch-all tier
+	// keeps the whole catalog covered
+	Filter *MetadataFilter
+}
+
+// matchTiers searches each tier in turn and returns the matches of the first tier with a best
+// match, or those of the last tier when none has one. The tiers' filters apply on top of the
+// options' Filter
+func (m *Matcher) matchTiers(fp *Fingerprint, opts MatchOptions) ([]*MatchResult, MatchStats, error) {
+	if len(opts.Tiers) == 0 {
+		return m.match(fp, opts)
+	}
+
+	var matches []*MatchResult
+	var stats MatchStats
+	for i, tier := range opts.Tiers {
+		tierOpts := opts
+		tierOpts.Filter = &MetadataFilter{And: []*MetadataFilter{opts.Filter, tier.Filter}}
+
+		tierMatches, tierStats, err := m.match(fp, tierOpts)
+		if err != nil {
+			return nil, stats, err
+		}
+
+		for i := range tierStats.Trace {
+			tierStats.Trace[i].Tier = tier.Name
+		}
+		candidates, trace := stats.Candidates+tierStats.Candidates, append(stats.Trace, tierStats.Trace...)
+		stats = tierStats
+		stats.Candidates, stats.Trace = candidates, trace
+		stats.Tiers = i + 1
+		matches = tierMatches
+		for _, match := range matches {
+			match.Tier = tier.Name
+		}
+
+		if len(matches) > 0 && matches[0].Best {
+			glog.V(2).Infof("Best match found in tier %d '%s'", i+1, tier.Name)
+			break
+		}
+	}
+
+	return matches, stats, nil
+}
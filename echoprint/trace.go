@@ -0,0 +1,77 @@
+package echoprint
+
+import (
+	"fmt"
+	"time"
+)
+
+// RetrievalSpan is the time a backend took to serve part of the candidate retrieval of a
+// query, traced when MatchOptions.Trace is set so latency anomalies can be pinned on a backend
+type RetrievalSpan struct {
+	// Backend identifies the backend that served the span, e.g. the URL of the solr core
+	Backend string `json:"backend"`
+	// Operation is what the backend was asked to do, e.g. select or load
+	Operation string `json:"operation"`
+	// Tier is the tier the span was part of, when searching tiers
+	Tier string `json:"tier,omitempty"`
+	// Page numbers the candidate pages fetched for the query from 1, 0 for the initial lookup
+	Page    int           `json:"page"`
+	Results int           `json:"results"`
+	Elapsed time.Duration `json:"elapsed"`
+	// ServerTime is the time the backend reports spending on the request, when it reports it
+	ServerTime time.Duration `json:"server_time,omitempty"`
+}
+
+// spanTracer is implemented by cursors that can break the time of their last page down by backend
+type spanTracer interface {
+	lastSpans() []RetrievalSpan
+}
+
+// backendNamer is implemented by stores that can identify their backend in traces
+type backendNamer interface {
+	backendName() string
+}
+
+func storeBackendName(s Store) string {
+	if namer, ok := s.(backendNamer); ok {
+		return namer.backendName()
+	}
+	return fmt.Sprintf("%T", s)
+}
+
+// tracingCursor times every page fetched through the cursor it wraps
+type tracingCursor struct {
+	candidateCursor
+	backend string
+	spans   *[]RetrievalSpan
+	page    int
+}
+
+func (c *tracingCursor) next(rows int) ([]dbResult, bool, error) {
+	start := time.Now()
+	page, more, err := c.candidateCursor.next(rows)
+	elapsed := time.Since(start)
+	c.page++
+
+	if tracer, ok := c.candidateCursor.(spanTracer); ok {
+		for _, span := range tracer.lastSpans() {
+			span.Page = c.page
+			*c.spans = append(*c.spans, span)
+		}
+	} else {
+		*c.spans = append(*c.spans, RetrievalSpan{Backend: c.backend, Operation: "next", Page: c.page, Results: len(page), Elapsed: elapsed})
+	}
+
+	return page, more, err
+}
+
+// tracedCandidates looks up the candidates of the query like Store.candidates, recording the
+// time taken by the lookup and every page fetched from the returned cursor in spans
+func (m *Matcher) tracedCandidates(fp *Fingerprint, minScore float32, filter *MetadataFilter, spans *[]RetrievalSpan) candidateCursor {
+	backend := storeBackendName(m.Store)
+	start := time.Now()
+	cursor := m.Store.candidates(fp, minScore, filter)
+	*spans = append(*spans, RetrievalSpan{Backend: backend, Operation: "lookup", Elapsed: time.Since(start)})
+
+	return &tracingCursor{candidateCursor: cursor, backend: backend, spans: spans}
+}
@@ -0,0 +1,130 @@
+package echoprint
+
+// TrackInfo describes a stored track and its fingerprints, for inspecting the catalog
+type TrackInfo struct {
+	TrackID    uint32            `json:"track_id"`
+	ExternalID ExternalID        `json:"external_id,omitempty"`
+	Filename   string            `json:"filename"`
+	UPC        string            `json:"upc"`
+	ISRC       string            `json:"isrc"`
+	Tags       map[string]string `json:"tags,omitempty"`
+
+	Fingerprints []FingerprintInfo `json:"fingerprints"`
+}
+
+// FingerprintInfo describes a single stored fingerprint of a track
+type FingerprintInfo struct {
+	Variant uint32  `json:"variant"`
+	Codes   int     `json:"codes"`
+	Version float64 `json:"version"`
+	// Duration is the length of the audio in seconds, as reported by codegen
+	Duration float64 `json:"duration"`
+	Bitrate  float64 `json:"bitrate"`
+	Quality  string  `json:"quality"`
+	// Sparsity is N when only every Nth code was stored
+	Sparsity uint32 `json:"sparsity,omitempty"`
+
+	ParentTrackID uint32  `json:"parent_track_id,omitempty"`
+	SegmentStart  float64 `json:"segment_start,omitempty"`
+	SegmentEnd    float64 `json:"segment_end,omitempty"`
+}
+
+// Track describes a track of the database connected by DBConnect
+func Track(trackID uint32) (*TrackInfo, error) {
+	return defaultMatcher.Track(trackID)
+}
+
+// Track describes a stored track and every one of its fingerprints, ErrTrackNotFound is
+// returned for unknown TrackIDs
+func (m *Matcher) Track(trackID uint32) (*TrackInfo, error) {
+	exists, err := m.Store.checkTrackExists(trackID)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrTrackNotFound
+	}
+
+	variants, err := m.Store.nextVariant(trackID)
+	if err != nil {
+		return nil, err
+	}
+
+	var info *TrackInfo
+	for variant := uint32(0); variant < variants; variant++ {
+		fp, err := m.Store.load(trackID, variant)
+		if err != nil {
+			return nil, err
+		}
+		if info == nil {
+			info = &TrackInfo{
+				TrackID:    trackID,
+				ExternalID: fp.Meta.ExternalID,
+				Filename:   fp.Meta.Filename,
+				UPC:        fp.Meta.UPC,
+				ISRC:       fp.Meta.ISRC,
+				Tags:       fp.Meta.Tags,
+			}
+		}
+
+		quality := fp.quality
+		if quality == "" {
+			quality = fp.Quality()
+		}
+		info.Fingerprints = append(info.Fingerprints, FingerprintInfo{
+			Variant:       variant,
+			Codes:         len(fp.Codes),
+			Version:       fp.Meta.Version,
+			Duration:      fp.Meta.Duration,
+			Bitrate:       fp.Meta.Bitrate,
+			Quality:       quality,
+			Sparsity:      fp.sparsity,
+			ParentTrackID: fp.Meta.ParentTrackID,
+			SegmentStart:  fp.Meta.SegmentStart,
+			SegmentEnd:    fp.Meta.SegmentEnd,
+		})
+	}
+
+	return info, nil
+}
+
+// Tracks pages through the TrackIDs of the database connected by DBConnect
+func Tracks(filter *MetadataFilter, offset, limit int) ([]uint32, int, error) {
+	return defaultMatcher.Tracks(filter, offset, limit)
+}
+
+// Tracks returns up to limit of the stored TrackIDs passing the filter in ascending order,
+// skipping the first offset, along with the total number passing it. Filtering loads every
+// track so it's only suited to browsing smaller catalogs
+func (m *Matcher) Tracks(filter *MetadataFilter, offset, limit int) ([]uint32, int, error) {
+	trackIDs, err := m.Store.trackIDs()
+	if err != nil {
+		return nil, 0, err
+	}
+	sortTrackIDs(trackIDs)
+
+	if !filter.empty() {
+		allowed := trackIDs[:0]
+		for _, trackID := range trackIDs {
+			fp, err := m.Store.load(trackID, 0)
+			if err != nil {
+				return nil, 0, err
+			}
+			if filter.allows(fp.Meta) {
+				allowed = append(allowed, trackID)
+			}
+		}
+		trackIDs = allowed
+	}
+
+	total := len(trackIDs)
+	if offset > total {
+		offset = total
+	}
+	trackIDs = trackIDs[offset:]
+	if limit > 0 && len(trackIDs) > limit {
+		trackIDs = trackIDs[:limit]
+	}
+
+	return trackIDs, total, nil
+}
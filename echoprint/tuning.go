@@ -0,0 +1,192 @@
+package echoprint
+
+import (
+	"sort"
+)
+
+const (
+	defaultTuningMinPrecision = 0.99
+	defaultTuningMinExamples  = 20
+)
+
+// TuningOptions controls TuneThresholds, the zero value uses the defaults
+type TuningOptions struct {
+	// MinPrecision is the precision the proposed thresholds must keep, the highest recall
+	// reaching it is proposed (0 for 0.99)
+	MinPrecision float64
+	// MinExamples is the number of labeled results a profile and quality tier needs before a
+	// threshold is proposed for it (0 for 20)
+	MinExamples int
+	// Thresholds are the server wide thresholds the profiles override, as the queries were
+	// matched with
+	Thresholds Thresholds
+}
+
+// ThresholdStats is how a minimum confidence classifies the labeled results
+type ThresholdStats struct {
+	Threshold      float32 `json:"threshold"`
+	Precision      float64 `json:"precision"`
+	Recall         float64 `json:"recall"`
+	TruePositives  int     `json:"true_positives"`
+	FalsePositives int     `json:"false_positives"`
+	FalseNegatives int     `json:"false_negatives"`
+}
+
+// ThresholdProposal compares the current minimum confidence of a profile and quality tier to
+// the one proposed from the feedback
+type ThresholdProposal struct {
+	Profile  string         `json:"profile,omitempty"`
+	Quality  string         `json:"quality"`
+	Examples int            `json:"examples"`
+	Correct  int            `json:"correct"`
+	Current  ThresholdStats `json:"current"`
+	Proposed ThresholdStats `json:"proposed"`
+
+	// InsufficientData is set when there were fewer than MinExamples labeled results, the
+	// current threshold is proposed
+	InsufficientData bool `json:"insufficient_data,omitempty"`
+}
+
+// TuneThresholds proposes the minimum confidence of every profile and quality tier with
+// feedback: the threshold with the highest recall that keeps MinPrecision, or the most
+// precise one when none does
+func TuneThresholds(feedback []Feedback, opts TuningOptions) []ThresholdProposal {
+	if opts.MinPrecision == 0 {
+		opts.MinPrecision = defaultTuningMinPrecision
+	}
+	if opts.MinExamples == 0 {
+		opts.MinExamples = defaultTuningMinExamples
+	}
+
+	type tier struct {
+		profile string
+		quality string
+	}
+	tiers := make(map[tier][]Feedback)
+	for _, f := range feedback {
+		key := tier{f.Profile, f.Quality}
+		tiers[key] = append(tiers[key], f)
+	}
+
+	var proposals []ThresholdProposal
+	for key, examples := range tiers {
+		thresholds := opts.Thresholds
+		if p, ok := LookupProfile(key.profile); ok {
+			thresholds = thresholds.overriddenBy(p.Thresholds)
+		}
+
+		p := ThresholdProposal{Profile: key.profile, Quality: key.quality, Examples: len(examples)}
+		for _, f := range examples {
+			if f.Correct {
+				p.Correct++
+			}
+		}
+		p.Current = classify(examples, thresholds.minConfidence(key.quality))
+		p.Proposed = p.Current
+
+		if len(examples) < opts.MinExamples {
+			p.InsufficientData = true
+		} else {
+			p.Proposed = proposeThreshold(examples, opts.MinPrecision)
+		}
+		proposals = append(proposals, p)
+	}
+
+	sort.Slice(proposals, func(i, j int) bool {
+		if proposals[i].Profile != proposals[j].Profile {
+			return proposals[i].Profile < proposals[j].Profile
+		}
+		return proposals[i].Quality < proposals[j].Quality
+	})
+	return proposals
+}
+
+// proposeThreshold tries the confidence of every example as the threshold, one of them is
+// where the classification changes. Among equally good thresholds the highest is proposed
+func proposeThreshold(examples []Feedback, minPrecision float64) ThresholdStats {
+	var best ThresholdStats
+	var bestPrecise bool
+	for i, f := range examples {
+		stats := classify(examples, f.Confidence)
+		precise := stats.Precision >= minPrecision
+
+		var better bool
+		switch {
+		case i == 0:
+			better = true
+		case precise != bestPrecise:
+			better = precise
+		case precise && stats.Recall != best.Recall:
+			better = stats.Recall > best.Recall
+		case !precise && stats.Precision != best.Precision:
+			better = stats.Precision > best.Precision
+		case !precise && stats.Recall != best.Recall:
+			better = stats.Recall > best.Recall
+		default:
+			better = stats.Threshold > best.Threshold
+		}
+
+		if better {
+			best, bestPrecise = stats, precise
+		}
+	}
+	return best
+}
+
+// classify counts the examples the threshold gets right and wrong, results reaching it are
+// matches
+func classify(examples []Feedback, threshold float32) ThresholdStats {
+	stats := ThresholdStats{Threshold: threshold, Precision: 1}
+	for _, f := range examples {
+		switch matched := f.Confidence >= threshold; {
+		case matched && f.Correct:
+			stats.TruePositives++
+		case matched:
+			stats.FalsePositives++
+		case f.Correct:
+			stats.FalseNegatives++
+		}
+	}
+
+	if matched := stats.TruePositives + stats.FalsePositives; matched > 0 {
+		stats.Precision = float64(stats.TruePositives) / float64(matched)
+	}
+	if correct := stats.TruePositives + stats.FalseNegatives; correct > 0 {
+		stats.Recall = float64(stats.TruePositives) / float64(correct)
+	}
+	return stats
+}
+
+// TunedProfiles returns the profiles with the thresholds proposed for them, to be imported
+// with SetProfiles once reviewed. Proposals without a profile or enough data are left out
+func TunedProfiles(proposals []ThresholdProposal) []Profile {
+	tuned := make(map[string]Profile)
+	for _, p := range proposals {
+		if p.Profile == "" || p.InsufficientData {
+			continue
+		}
+		profile, ok := tuned[p.Profile]
+		if !ok {
+			if profile, ok = LookupProfile(p.Profile); !ok {
+				continue
+			}
+		}
+
+		switch p.Quality {
+		case qualityHigh:
+			profile.Thresholds.MinConfidenceHighQuality = p.Proposed.Threshold
+		case qualityMedium:
+			profile.Thresholds.MinConfidenceMediumQuality = p.Proposed.Threshold
+		default:
+			profile.Thresholds.MinConfidenceLowQuality = p.Proposed.Threshold
+		}
+		tuned[p.Profile] = profile
+	}
+
+	list := make([]Profile, 0, len(tuned))
+	for _, p := range tuned {
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
@@ -6,12 +6,8 @@ import (
 	"github.com/golang/glog"
 )
 
-var timeTrackers map[string][]*timeTracker
-
-func init() {
-	timeTrackers = make(map[string][]*timeTracker, 0)
-}
-
+// timeTracker logs how long a function took, the timings are not retained so concurrent
+// matchers don't share state
 type timeTracker struct {
 	Label   string
 	Start   time.Time
@@ -24,15 +20,5 @@ func trackTime(label string) *timeTracker {
 
 func (tt *timeTracker) finish() {
 	tt.Elapsed = time.Since(tt.Start)
-	timeTrackers[tt.Label] = append(timeTrackers[tt.Label], tt)
 	glog.V(3).Infof("-- %s took %s", tt.Label, tt.Elapsed)
 }
-
-// TotalTime returns the total duration of all timed functions
-// func TotalTime() (total time.Duration) {
-// 	for _, tt := range timeTrackers {
-// 		total += tt.Elapsed
-// 	}
-//
-// 	return
-// }
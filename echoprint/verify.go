@@ -0,0 +1,148 @@
+package echoprint
+
+import (
+	"errors"
+	"math"
+	"sync"
+)
+
+// ErrNoClaim is returned when a fingerprint to verify claims neither a TrackID nor an ExternalID
+var ErrNoClaim = errors.New("Fingerprint claims no TrackID or ExternalID")
+
+// Verification is the outcome of checking a fingerprint against the track it claims to be
+type Verification struct {
+	TrackID    uint32     `json:"track_id"`
+	ExternalID ExternalID `json:"external_id,omitempty"`
+
+	// Match is set when the confidence reaches the minimum for a match at the fingerprint's quality
+	Match         bool    `json:"match"`
+	Confidence    float32 `json:"confidence"`
+	RawConfidence float32 `json:"raw_confidence"`
+
+	// Variant is the fingerprint of the track that scored best, when the track has several
+	Variant uint32 `json:"variant,omitempty"`
+	// TimeScale is the factor applied to the query's Times that scored best, only reported
+	// when time scaling is enabled
+	TimeScale float32 `json:"time_scale,omitempty"`
+
+	Error interface{} `json:"error,omitempty"`
+}
+
+// VerifyAll checks fingerprints against the tracks of the database connected by DBConnect
+func VerifyAll(codegenList []*CodegenFp, opts MatchOptions) []Verification {
+	return defaultMatcher.VerifyAll(codegenList, opts)
+}
+
+// VerifyAll checks each fingerprint against the track its metadata claims, by TrackID or
+// ExternalID, in parallel. Verifications are in the order of the fingerprints
+func (m *Matcher) VerifyAll(codegenList []*CodegenFp, opts MatchOptions) []Verification {
+	verifications := make([]Verification, len(codegenList))
+
+	var wg sync.WaitGroup
+	var workers chan struct{}
+	if opts.Concurrency > 0 {
+		workers = make(chan struct{}, opts.Concurrency)
+	}
+
+	for i, codegenFp := range codegenList {
+		wg.Add(1)
+		if workers != nil {
+			workers <- struct{}{}
+		}
+		opts.Throttle.acquire()
+		go func(i int, codegenFp *CodegenFp) {
+			defer wg.Done()
+			defer opts.Throttle.release()
+			if workers != nil {
+				defer func() { <-workers }()
+			}
+
+			verification := Verification{TrackID: codegenFp.Meta.TrackID, ExternalID: codegenFp.Meta.ExternalID}
+			fp, err := NewFingerprint(codegenFp)
+			if err == nil {
+				verification, err = m.Verify(fp, opts)
+			}
+			if err != nil {
+				m.log().Errorf("[%s] Verification failed: %s", opts.RequestID, err)
+				verification.Error = err.Error()
+			}
+			verifications[i] = verification
+		}(i, codegenFp)
+	}
+	wg.Wait()
+
+	return verifications
+}
+
+// Verify checks a fingerprint against the database connected by DBConnect
+func Verify(fp *Fingerprint, opts MatchOptions) (Verification, error) {
+	return defaultMatcher.Verify(fp, opts)
+}
+
+// Verify scores the fingerprint against only the track its metadata claims, by TrackID or
+// ExternalID, rather than searching the store for candidates. It's much cheaper than Match
+// when the question is whether a delivery is what its metadata says. ErrTrackNotFound is
+// returned when the claimed track isn't stored
+func (m *Matcher) Verify(fp *Fingerprint, opts MatchOptions) (Verification, error) {
+	t := trackTime("Verify")
+	defer t.finish()
+
+	opts = m.withDefaults(opts)
+	v := Verification{TrackID: fp.Meta.TrackID, ExternalID: fp.Meta.ExternalID}
+
+	var err error
+	if v.TrackID == 0 && v.ExternalID != "" {
+		if v.TrackID, err = m.Store.trackIDForExternalID(v.ExternalID); err != nil {
+			return v, err
+		}
+		if v.TrackID == 0 {
+			return v, ErrTrackNotFound
+		}
+	}
+	if v.TrackID == 0 {
+		return v, ErrNoClaim
+	}
+
+	exists, err := m.Store.checkTrackExists(v.TrackID)
+	if err != nil {
+		return v, err
+	}
+	if !exists {
+		return v, ErrTrackNotFound
+	}
+	variants, err := m.Store.nextVariant(v.TrackID)
+	if err != nil {
+		return v, err
+	}
+
+	fp, _ = m.prepareQuery(fp, opts)
+	fp, _ = m.postings.learnedStopCodes(fp)
+	if len(fp.Codes) == 0 {
+		return v, nil
+	}
+	fp = fp.NewIndexed()
+
+	scaledFps := m.timeScaled(fp, opts)
+	scorer := opts.scorer()
+	for variant := uint32(0); variant < variants; variant++ {
+		candidate, err := m.Store.load(v.TrackID, variant)
+		if err != nil {
+			return v, err
+		}
+
+		d, timeScale := m.score(scorer, fp, scaledFps, candidate)
+		if variant == 0 || d.Confidence > v.Confidence {
+			v.Confidence = d.Confidence
+			v.RawConfidence = d.RawConfidence
+			v.Variant = variant
+			v.TimeScale = timeScale
+		}
+	}
+
+	// the two top offsets can score more than the codes overlapping, as when matching
+	v.Confidence = float32(math.Min(float64(v.Confidence), maxConfidence))
+	v.RawConfidence = float32(math.Min(float64(v.RawConfidence), maxConfidence))
+	v.Match = v.Confidence >= opts.Thresholds.minConfidence(fp.Quality())
+
+	return v, nil
+}
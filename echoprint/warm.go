@@ -0,0 +1,87 @@
+package echoprint
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/golang/glog"
+)
+
+// WarmProgress reports how much of the fingerprint index has been loaded by a Warmer
+type WarmProgress struct {
+	Loaded int64 `json:"loaded"`
+	Total  int64 `json:"total"`
+	Done   bool  `json:"done"`
+}
+
+// Warmer loads every stored fingerprint once at startup so the first queries don't pay for
+// cold pages, the tracks are split into shards loaded in parallel
+type Warmer struct {
+	// Workers is the number of shards loaded in parallel, defaults to 1
+	Workers int
+	// Matcher is warmed, nil warms the database connected by DBConnect
+	Matcher *Matcher
+
+	loaded int64
+	total  int64
+	done   int32
+}
+
+// Run loads the index and blocks until it is complete, failing tracks are logged and skipped
+func (w *Warmer) Run() error {
+	db := w.Matcher.orDefault().Store
+	trackIDs, err := db.trackIDs()
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt64(&w.total, int64(len(trackIDs)))
+
+	workers := w.Workers
+	if workers < 1 {
+		workers = 1
+	}
+	glog.Infof("Warming %d tracks with %d workers", len(trackIDs), workers)
+
+	var wg sync.WaitGroup
+	for shard := 0; shard < workers; shard++ {
+		wg.Add(1)
+		go func(shard int) {
+			defer wg.Done()
+			for i := shard; i < len(trackIDs); i += workers {
+				if _, err := db.load(trackIDs[i], 0); err != nil {
+					glog.Errorf("Warming TrackID=%d failed: %s", trackIDs[i], err)
+				}
+				w.advance()
+			}
+		}(shard)
+	}
+	wg.Wait()
+
+	atomic.StoreInt32(&w.done, 1)
+	glog.Infof("Warmed %d tracks", len(trackIDs))
+
+	return nil
+}
+
+// advance counts a loaded track, logging progress every 10%
+func (w *Warmer) advance() {
+	loaded := atomic.AddInt64(&w.loaded, 1)
+	total := atomic.LoadInt64(&w.total)
+	if step := total / 10; step > 0 && loaded%step == 0 {
+		glog.Infof("Warming %d%% complete (%d/%d tracks)", loaded*100/total, loaded, total)
+	}
+}
+
+// Progress returns a snapshot of the warm up progress
+func (w *Warmer) Progress() WarmProgress {
+	return WarmProgress{
+		Loaded: atomic.LoadInt64(&w.loaded),
+		Total:  atomic.LoadInt64(&w.total),
+		Done:   atomic.LoadInt32(&w.done) == 1,
+	}
+}
+
+// Ready reports whether the warm up is complete
+func (w *Warmer) Ready() bool {
+	return atomic.LoadInt32(&w.done) == 1
+}
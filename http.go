@@ -1,14 +1,38 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"net/http"
 	"text/template"
+
+	"github.com/AudioAddict/go-echoprint/echoprint"
 )
 
+// errorResponse is the envelope every API error is reported in
 type errorResponse struct {
-	Error string `json:"error"`
+	Code      string      `json:"code"`
+	Message   string      `json:"message"`
+	Details   interface{} `json:"details,omitempty"`
+	RequestID string      `json:"request_id,omitempty"`
+}
+
+// requestError is an error reported with a specific HTTP status and error code
+type requestError struct {
+	status  int
+	code    string
+	message string
+	details interface{}
+}
+
+func (e *requestError) Error() string {
+	return e.message
+}
+
+func badRequest(format string, args ...interface{}) error {
+	return &requestError{status: http.StatusBadRequest, code: "invalid_request", message: fmt.Sprintf(format, args...)}
 }
 
 var views = template.Must(template.ParseGlob("views/*.html"))
@@ -31,8 +55,84 @@ func httpError(w http.ResponseWriter, err error) {
 }
 
 func apiError(w http.ResponseWriter, err error) {
-	w.WriteHeader(422)
-	renderResponse(w, &errorResponse{err.Error()})
+	status, code, details := errorStatus(err)
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	renderResponse(w, &errorResponse{
+		Code:      code,
+		Message:   err.Error(),
+		Details:   details,
+		RequestID: w.Header().Get("X-Request-ID"),
+	})
+}
+
+// errorStatus maps an error to the HTTP status and error code it is reported with, errors
+// that aren't recognised are reported as unprocessable
+func errorStatus(err error) (int, string, interface{}) {
+	switch e := err.(type) {
+	case *requestError:
+		return e.status, e.code, e.details
+	case *json.SyntaxError, *json.UnmarshalTypeError:
+		return http.StatusBadRequest, "malformed_request", nil
+	case *echoprint.InvalidFingerprintError:
+		return http.StatusUnprocessableEntity, "invalid_fingerprint", nil
+	case *echoprint.BackendError:
+		return http.StatusServiceUnavailable, "backend_unavailable", nil
+	}
+
+	switch err {
+	case errBatchTooLarge:
+		return http.StatusRequestEntityTooLarge, "too_large", map[string]int{"max_batch_size": *maxBatchSize}
+	case errServerBusy:
+		// saturated and warming replicas shed load with 503 and Retry-After, which load
+		// balancers act on. 429 is left to throttling a single API key
+		return http.StatusServiceUnavailable, "overloaded", nil
+	case errAuditDisabled, errDetectionsDisabled, errSigningDisabled, echoprint.ErrEventsDisabled, errConfidenceStatsDisabled, errFeedbackDisabled:
+		return http.StatusNotFound, "not_enabled", nil
+	case echoprint.ErrAuditRecordNotFound, echoprint.ErrStreamNotFound, errBackfillNotStarted, errHealthScanNotStarted, echoprint.ErrTrackNotFound, errProfileNotFound:
+		return http.StatusNotFound, "not_found", nil
+	case echoprint.ErrUnsupportedObjectURL, echoprint.ErrInvalidProfile, echoprint.ErrFeedbackIndex:
+		return http.StatusBadRequest, "invalid_request", nil
+	case errBackfillRunning, errHealthScanRunning, echoprint.ErrProfilerBusy:
+		return http.StatusConflict, "conflict", nil
+	}
+
+	return http.StatusUnprocessableEntity, "unprocessable", nil
+}
+
+// maxRequestIDLength bounds client provided request IDs, they end up in logs and audit keys
+const maxRequestIDLength = 128
+
+// assignRequestID accepts the X-Request-ID provided by the client or generates a new one, the
+// ID is stored back on the request for handlers and echoed in the response headers
+func assignRequestID(w http.ResponseWriter, r *http.Request) string {
+	id := r.Header.Get("X-Request-ID")
+	if !validRequestID(id) {
+		b := make([]byte, 16)
+		rand.Read(b)
+		id = hex.EncodeToString(b)
+	}
+
+	r.Header.Set("X-Request-ID", id)
+	w.Header().Set("X-Request-ID", id)
+	return id
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// requestID returns the ID assigned to the request by the logging handler
+func requestID(r *http.Request) string {
+	return r.Header.Get("X-Request-ID")
 }
 
 func indexHandler(w http.ResponseWriter, r *http.Request) {
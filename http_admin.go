@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/AudioAddict/go-echoprint/echoprint"
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+)
+
+var errAuditDisabled = errors.New("Audit logging is not enabled")
+
+var errBackfillRunning = errors.New("A quality backfill is already running")
+
+var errBackfillNotStarted = errors.New("No quality backfill has been started")
+
+var errHealthScanRunning = errors.New("A catalog health scan is already running")
+
+var errHealthScanNotStarted = errors.New("No catalog health scan has been started")
+
+var errProfileNotFound = errors.New("Matching profile not found")
+
+const (
+	defaultProfileSeconds = 10
+	maxProfileSeconds     = 120
+)
+
+// qualityBackfill is the most recent quality tier backfill, nil until one is started
+var (
+	qualityBackfill   *echoprint.QualityBackfill
+	qualityBackfillMu sync.Mutex
+)
+
+// healthScan is the state of the most recent catalog health scan, nil until one is started
+var (
+	healthScan   *healthScanStatus
+	healthScanMu sync.Mutex
+)
+
+type healthScanStatus struct {
+	Done   bool                    `json:"done"`
+	Error  string                  `json:"error,omitempty"`
+	Report *echoprint.HealthReport `json:"report,omitempty"`
+}
+
+func auditHandler(w http.ResponseWriter, r *http.Request) {
+	record, ok := readAuditRecord(w, r)
+	if !ok {
+		return
+	}
+
+	renderResponse(w, record)
+}
+
+// replayHandler re-executes an audited query with its recorded options against the current
+// index, rendering the recorded and replayed matches side by side
+func replayHandler(w http.ResponseWriter, r *http.Request) {
+	record, ok := readAuditRecord(w, r)
+	if !ok {
+		return
+	}
+
+	replayRequest := r.Clone(r.Context())
+	replayRequest.URL.RawQuery = url.Values(record.Options).Encode()
+	opts, err := parseMatchOptions(replayRequest)
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+	// replays are investigations, they never count towards an experiment's stats
+	opts.Experiment = nil
+
+	renderResponse(w, echoprint.Replay(record, opts))
+}
+
+// readAuditRecord reads the audit record of the request id in the route, writing the error
+// response when it can't be read
+func readAuditRecord(w http.ResponseWriter, r *http.Request) (*echoprint.AuditRecord, bool) {
+	if auditSink == nil {
+		apiError(w, errAuditDisabled)
+		return nil, false
+	}
+
+	record, err := auditSink.Read(mux.Vars(r)["id"])
+	if err == echoprint.ErrAuditRecordNotFound {
+		apiError(w, err)
+		return nil, false
+	} else if err != nil {
+		httpError(w, err)
+		return nil, false
+	}
+
+	return record, true
+}
+
+// startQualityBackfillHandler re-derives the stored quality tiers in the background after a
+// quality threshold change, only one backfill runs at a time
+func startQualityBackfillHandler(w http.ResponseWriter, r *http.Request) {
+	qualityBackfillMu.Lock()
+	defer qualityBackfillMu.Unlock()
+
+	if qualityBackfill != nil && !qualityBackfill.Progress().Done {
+		apiError(w, errBackfillRunning)
+		return
+	}
+
+	backfill := &echoprint.QualityBackfill{Workers: *backfillWorkers}
+	qualityBackfill = backfill
+	go func() {
+		if err := backfill.Run(); err != nil {
+			glog.Error(err)
+		}
+	}()
+
+	w.WriteHeader(http.StatusAccepted)
+	renderResponse(w, backfill.Progress())
+}
+
+func qualityBackfillHandler(w http.ResponseWriter, r *http.Request) {
+	qualityBackfillMu.Lock()
+	backfill := qualityBackfill
+	qualityBackfillMu.Unlock()
+
+	if backfill == nil {
+		apiError(w, errBackfillNotStarted)
+		return
+	}
+
+	renderResponse(w, backfill.Progress())
+}
+
+// startHealthScanHandler scans the catalog for degenerate fingerprints in the background,
+// only one scan runs at a time
+func startHealthScanHandler(w http.ResponseWriter, r *http.Request) {
+	scan := &echoprint.HealthScan{}
+	if value := r.URL.Query().Get("min_codes"); value != "" {
+		var err error
+		if scan.MinCodes, err = strconv.Atoi(value); err != nil || scan.MinCodes < 1 {
+			apiError(w, badRequest("Invalid min_codes '%s'", value))
+			return
+		}
+	}
+
+	healthScanMu.Lock()
+	defer healthScanMu.Unlock()
+
+	if healthScan != nil && !healthScan.Done {
+		apiError(w, errHealthScanRunning)
+		return
+	}
+
+	status := &healthScanStatus{}
+	healthScan = status
+	go func() {
+		report, err := scan.Run()
+
+		healthScanMu.Lock()
+		defer healthScanMu.Unlock()
+		status.Done, status.Report = true, report
+		if err != nil {
+			glog.Error(err)
+			status.Error = err.Error()
+		}
+	}()
+
+	w.WriteHeader(http.StatusAccepted)
+	renderResponse(w, status)
+}
+
+func healthScanHandler(w http.ResponseWriter, r *http.Request) {
+	healthScanMu.Lock()
+	defer healthScanMu.Unlock()
+
+	if healthScan == nil {
+		apiError(w, errHealthScanNotStarted)
+		return
+	}
+
+	renderResponse(w, healthScan)
+}
+
+// profileHandler runs a CPU profile for the seconds parameter and reports the
+// time spent inflating, decoding, querying the database and scoring, for operators without
+// pprof tooling at hand
+func profileHandler(w http.ResponseWriter, r *http.Request) {
+	seconds := defaultProfileSeconds
+	if value := r.URL.Query().Get("seconds"); value != "" {
+		var err error
+		if seconds, err = strconv.Atoi(value); err != nil || seconds < 1 || seconds > maxProfileSeconds {
+			apiError(w, badRequest("Invalid seconds '%s', expected 1 to %d", value, maxProfileSeconds))
+			return
+		}
+	}
+
+	glog.Infof("Profiling matching for %ds", seconds)
+	report, err := echoprint.ProfileMatching(time.Duration(seconds) * time.Second)
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+
+	renderResponse(w, report)
+}
+
+// matchProfilesHandler lists the matching profiles, in the format importMatchProfilesHandler and
+// -profiles-file read
+func matchProfilesHandler(w http.ResponseWriter, r *http.Request) {
+	renderResponse(w, echoprint.Profiles())
+}
+
+// importMatchProfilesHandler adds or replaces the json array of profiles, queries started after it
+// responds use them
+func importMatchProfilesHandler(w http.ResponseWriter, r *http.Request) {
+	if err := echoprint.LoadProfiles(r.Body); err != nil {
+		apiError(w, err)
+		return
+	}
+	glog.Info("Imported matching profiles")
+
+	renderResponse(w, echoprint.Profiles())
+}
+
+func matchProfileHandler(w http.ResponseWriter, r *http.Request) {
+	profile, ok := echoprint.LookupProfile(mux.Vars(r)["name"])
+	if !ok {
+		apiError(w, errProfileNotFound)
+		return
+	}
+
+	renderResponse(w, profile)
+}
+
+// setMatchProfileHandler adds or replaces a single profile
+func setMatchProfileHandler(w http.ResponseWriter, r *http.Request) {
+	var profile echoprint.Profile
+	if err := json.NewDecoder(r.Body).Decode(&profile); err != nil {
+		apiError(w, err)
+		return
+	}
+	profile.Name = mux.Vars(r)["name"]
+
+	if err := echoprint.SetProfile(profile); err != nil {
+		apiError(w, err)
+		return
+	}
+	glog.Infof("Updated matching profile '%s'", profile.Name)
+
+	renderResponse(w, profile)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AudioAddict/go-echoprint/echoprint"
+)
+
+// responseProfileEchoprint selects the response shape of the original echoprint-server, as
+// the profile parameter of the Accept header (application/json; profile=echoprint-server)
+const responseProfileEchoprint = "echoprint-server"
+
+// the response codes of the original echoprint-server, reported as the message
+const (
+	legacyCannotDecode      = "CANNOT_DECODE"
+	legacyNoResults         = "NO_RESULTS"
+	legacySingleGoodMatch   = "SINGLE_GOOD_MATCH"
+	legacySingleBadMatch    = "SINGLE_BAD_MATCH"
+	legacyMultipleGoodMatch = "MULTIPLE_GOOD_MATCH"
+	legacyMultipleBadMatch  = "MULTIPLE_BAD_HISTOGRAM_MATCH"
+)
+
+// legacyQueryResult is the /query response of the original echoprint-server, so clients
+// written for it can point at this service unchanged. Artist, release and track are read
+// from the matched track's tags of the same name
+type legacyQueryResult struct {
+	OK        bool   `json:"ok"`
+	Message   string `json:"message"`
+	Match     bool   `json:"match"`
+	Score     int    `json:"score"`
+	TrackID   string `json:"track_id,omitempty"`
+	QTime     int64  `json:"qtime"`
+	TotalTime int64  `json:"total_time"`
+	Artist    string `json:"artist,omitempty"`
+	Release   string `json:"release,omitempty"`
+	Track     string `json:"track,omitempty"`
+}
+
+// wantsLegacyResponse reports whether the client asked for the echoprint-server response shape
+func wantsLegacyResponse(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		if _, params, err := mime.ParseMediaType(accept); err == nil && params["profile"] == responseProfileEchoprint {
+			return true
+		}
+	}
+	return false
+}
+
+func newLegacyQueryResult(group echoprint.MatchGroup, startTime time.Time) legacyQueryResult {
+	qr := newQueryResult(group)
+	result := legacyQueryResult{
+		OK:        true,
+		QTime:     int64(group.Stats.Elapsed / time.Millisecond),
+		TotalTime: int64(time.Since(startTime) / time.Millisecond),
+	}
+
+	switch {
+	case qr.Status == statusError:
+		result.OK = false
+		result.Message = legacyCannotDecode
+		return result
+	case qr.Status == statusNoMatch:
+		result.Message = legacyNoResults
+		return result
+	case qr.Status == statusBestMatch && qr.MatchCount == 1:
+		result.Message = legacySingleGoodMatch
+	case qr.Status == statusBestMatch:
+		result.Message = legacyMultipleGoodMatch
+	case qr.MatchCount == 1:
+		result.Message = legacySingleBadMatch
+	default:
+		result.Message = legacyMultipleBadMatch
+	}
+
+	top := group.Matches[0]
+	result.Match = top.Best
+	result.Score = top.RawScore
+	result.TrackID = string(top.ExternalID)
+	if result.TrackID == "" {
+		result.TrackID = strconv.FormatUint(uint64(top.TrackID), 10)
+	}
+	result.Artist = top.Tags["artist"]
+	result.Release = top.Tags["release"]
+	result.Track = top.Tags["track"]
+
+	return result
+}
+
+// legacyQueryHandler serves the queries of clients written for the original echoprint-server,
+// which send the compressed code as the fp_code parameter (GET or form POST)
+func legacyQueryHandler(w http.ResponseWriter, r *http.Request) {
+	startTime := time.Now()
+
+	code := r.FormValue("fp_code")
+	if code == "" {
+		renderResponse(w, legacyQueryResult{Message: "Missing fp_code"})
+		return
+	}
+
+	opts, err := parseMatchOptions(r)
+	if err != nil {
+		renderResponse(w, legacyQueryResult{Message: err.Error()})
+		return
+	}
+	// the score is the raw histogram score
+	opts.ScoreDetails = true
+
+	var record *echoprint.AuditRecord
+	if auditSink != nil {
+		record = newAuditRecord(r, opts.RequestID)
+	}
+
+	groups := matchAudited([]*echoprint.CodegenFp{{Code: code}}, opts, record)
+	renderResponse(w, newLegacyQueryResult(groups[0], startTime))
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/AudioAddict/go-echoprint/echoprint"
+	"github.com/golang/glog"
+)
+
+type cueSheetResult struct {
+	Cues  []*echoprint.Cue `json:"cues"`
+	Error interface{}      `json:"error"`
+}
+
+func cueSheetHandler(w http.ResponseWriter, r *http.Request) {
+	jsonData, err := readCodegen(r)
+	if err != nil {
+		glog.Error(err)
+		apiError(w, err)
+		return
+	}
+
+	opts, err := parseMatchOptions(r)
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+
+	results, err := performCueSheet(jsonData, opts)
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+	renderResponse(w, results)
+}
+
+func performCueSheet(jsonData []byte, opts echoprint.MatchOptions) ([]cueSheetResult, error) {
+	codegenList, err := parseCodegen(jsonData)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]cueSheetResult, len(codegenList))
+	errs := make([]error, len(codegenList))
+	for i, codegenFp := range codegenList {
+		var fp *echoprint.Fingerprint
+		if fp, errs[i] = echoprint.NewFingerprint(codegenFp); errs[i] == nil {
+			results[i].Cues, errs[i] = echoprint.CueSheet(fp, opts)
+		}
+		if errs[i] != nil {
+			results[i].Error = errs[i].Error()
+		}
+	}
+
+	if err := commonError(errs); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
@@ -17,7 +17,8 @@ func init() {
 }
 
 type stats struct {
-	Memory *runtime.MemStats
+	Memory     *runtime.MemStats
+	Experiment *echoprint.ExperimentStats `json:",omitempty"`
 }
 
 func debugHandler(w http.ResponseWriter, r *http.Request) {
@@ -29,9 +30,12 @@ func debugHandler(w http.ResponseWriter, r *http.Request) {
 		var results interface{}
 		switch op {
 		case "Ingest":
-			results, err = peformIngest([]byte(data))
+			results, err = peformIngest([]byte(data), defaultCatalog, ingestOptions)
 		case "Query":
-			results, err = peformQuery([]byte(data))
+			var opts echoprint.MatchOptions
+			if opts, err = parseMatchOptions(r); err == nil {
+				results, err = peformQuery([]byte(data), opts, nil)
+			}
 		}
 
 		if err != nil {
@@ -47,6 +51,10 @@ func debugHandler(w http.ResponseWriter, r *http.Request) {
 
 func statsHandler(w http.ResponseWriter, r *http.Request) {
 	runtime.ReadMemStats(statsInfo.Memory)
+	if experiment != nil {
+		experimentStats := experiment.Stats()
+		statsInfo.Experiment = &experimentStats
+	}
 
 	renderResponse(w, statsInfo)
 }
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/AudioAddict/go-echoprint/echoprint"
+	"github.com/golang/glog"
+)
+
+// diffHandler reports where the second fingerprint of the codegen json diverges from the first,
+// e.g. a re-delivery from its master, without a database. The alignment window is set in
+// seconds with alignment_window
+func diffHandler(w http.ResponseWriter, r *http.Request) {
+	jsonData, err := readCodegen(r)
+	if err != nil {
+		glog.Error(err)
+		apiError(w, err)
+		return
+	}
+
+	var opts echoprint.AlignmentOptions
+	if window := r.URL.Query().Get("alignment_window"); window != "" {
+		value, err := strconv.Atoi(window)
+		if err != nil || value <= 0 {
+			apiError(w, badRequest("Invalid alignment_window '%s'", window))
+			return
+		}
+		opts.Window = time.Duration(value) * time.Second
+	}
+
+	codegenList, err := parseCodegen(jsonData)
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+	if len(codegenList) != 2 {
+		apiError(w, badRequest("Expected 2 fingerprints to diff, got %d", len(codegenList)))
+		return
+	}
+
+	a, err := echoprint.NewFingerprint(codegenList[0])
+	if err != nil {
+		apiError(w, badRequest("Invalid fingerprint a: %s", err))
+		return
+	}
+	b, err := echoprint.NewFingerprint(codegenList[1])
+	if err != nil {
+		apiError(w, badRequest("Invalid fingerprint b: %s", err))
+		return
+	}
+
+	renderResponse(w, echoprint.DiffFingerprints(a, b, opts))
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/AudioAddict/go-echoprint/echoprint"
+	"github.com/golang/glog"
+)
+
+// eventsHandler streams the catalog events as server-sent events, so downstream caches and
+// search indexes stay in sync without polling. A client reconnecting with Last-Event-ID (or
+// ?since=) first receives the events it missed, a reset event tells it they are no longer
+// retained and it must resync, e.g. from a snapshot delta
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	since := r.Header.Get("Last-Event-ID")
+	if since == "" {
+		since = r.URL.Query().Get("since")
+	}
+	var sequence uint64
+	if since != "" {
+		var err error
+		if sequence, err = strconv.ParseUint(since, 10, 64); err != nil {
+			apiError(w, badRequest("Invalid event sequence %q", since))
+			return
+		}
+	}
+
+	sub, err := echoprint.SubscribeEvents(sequence)
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+	defer sub.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher := http.NewResponseController(w)
+	// events are sent for as long as the client stays, -write-timeout doesn't apply
+	flusher.SetWriteDeadline(time.Time{})
+
+	if sub.Missed {
+		fmt.Fprint(w, "event: reset\ndata: {}\n\n")
+	}
+	for _, event := range sub.Backlog {
+		if !writeEvent(w, event) {
+			return
+		}
+	}
+	flusher.Flush()
+
+	var keepalive <-chan time.Time
+	if *streamKeepalive > 0 {
+		ticker := time.NewTicker(*streamKeepalive)
+		defer ticker.Stop()
+		keepalive = ticker.C
+	}
+
+	for {
+		select {
+		case event, ok := <-sub.Events():
+			if !ok {
+				// the client fell behind, it resumes from the last event by reconnecting
+				glog.Warningf("[%s] Event subscriber fell behind, disconnecting", requestID(r))
+				return
+			}
+			if !writeEvent(w, event) {
+				return
+			}
+		case <-keepalive:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// writeEvent writes a catalog event, false once the client is gone
+func writeEvent(w http.ResponseWriter, event echoprint.CatalogEvent) bool {
+	data, err := json.Marshal(event)
+	if err != nil {
+		glog.Error(err)
+		return false
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.Sequence, event.Type, data)
+	return err == nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/AudioAddict/go-echoprint/echoprint"
+)
+
+// signingKey signs the evidence attached to query results, nil when signing is disabled
+var signingKey ed25519.PrivateKey
+
+var errSigningDisabled = errors.New("Response signing is not enabled")
+
+var errInvalidSigningKey = errors.New("Signing key must be a PEM encoded PKCS#8 Ed25519 private key")
+
+// loadSigningKey reads an Ed25519 private key as written by `openssl genpkey -algorithm ed25519`
+func loadSigningKey(path string) (ed25519.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errInvalidSigningKey
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	privateKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, errInvalidSigningKey
+	}
+
+	return privateKey, nil
+}
+
+type signingKeyResult struct {
+	KeyID     string `json:"key_id"`
+	PublicKey string `json:"public_key"`
+}
+
+// signingKeyHandler publishes the PEM encoded public key evidence can be verified with
+func signingKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if signingKey == nil {
+		apiError(w, errSigningDisabled)
+		return
+	}
+
+	publicKey := signingKey.Public().(ed25519.PublicKey)
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+
+	renderResponse(w, signingKeyResult{
+		KeyID:     echoprint.EvidenceKeyID(publicKey),
+		PublicKey: string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+	})
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/AudioAddict/go-echoprint/echoprint"
+	"github.com/golang/glog"
+)
+
+var errFeedbackDisabled = errors.New("Feedback collection is not enabled")
+
+// feedbackLog collects the labeled results for threshold tuning, nil when disabled
+var feedbackLog *echoprint.FeedbackLog
+
+// feedbackRequest labels a track as a correct or incorrect result of the index-th fingerprint
+// of an audited query, tracks that should have matched but weren't returned are labeled correct
+type feedbackRequest struct {
+	RequestID string `json:"request_id"`
+	Index     int    `json:"index"`
+	TrackID   uint32 `json:"track_id"`
+	Correct   bool   `json:"correct"`
+}
+
+// feedbackHandler records client feedback on query results, a json object or array of them.
+// The queries must have been audited, their fingerprints and options are read back to score
+// the labeled tracks
+func feedbackHandler(w http.ResponseWriter, r *http.Request) {
+	if feedbackLog == nil {
+		apiError(w, errFeedbackDisabled)
+		return
+	}
+	if auditSink == nil {
+		apiError(w, errAuditDisabled)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	var requests []feedbackRequest
+	if body = bytes.TrimSpace(body); len(body) > 0 && body[0] == '[' {
+		err = json.Unmarshal(body, &requests)
+	} else {
+		requests = make([]feedbackRequest, 1)
+		err = json.Unmarshal(body, &requests[0])
+	}
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+
+	labeled := make([]echoprint.Feedback, 0, len(requests))
+	for _, req := range requests {
+		record, err := auditSink.Read(req.RequestID)
+		if err != nil {
+			apiError(w, err)
+			return
+		}
+
+		// the labeled tracks are scored with the options the query was matched with
+		queryRequest := r.Clone(r.Context())
+		queryRequest.URL.RawQuery = url.Values(record.Options).Encode()
+		opts, err := parseMatchOptions(queryRequest)
+		if err != nil {
+			apiError(w, err)
+			return
+		}
+
+		feedback, err := echoprint.LabelFeedback(record, req.Index, req.TrackID, req.Correct, opts)
+		if err != nil {
+			apiError(w, err)
+			return
+		}
+		feedback.Profile = requestProfile(queryRequest)
+		labeled = append(labeled, feedback)
+	}
+
+	for _, feedback := range labeled {
+		if err := feedbackLog.Add(feedback); err != nil {
+			glog.Error(err)
+			httpError(w, err)
+			return
+		}
+	}
+
+	renderResponse(w, labeled)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/AudioAddict/go-echoprint/echoprint"
+)
+
+// warmer loads the index at startup, nil when warming is disabled
+var warmer *echoprint.Warmer
+
+type readiness struct {
+	Ready   bool                    `json:"ready"`
+	Warming *echoprint.WarmProgress `json:"warming,omitempty"`
+}
+
+// readyzHandler reports 503 until the index is warm so load balancers hold traffic back
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	result := readiness{Ready: true}
+	if warmer != nil {
+		progress := warmer.Progress()
+		result.Ready = progress.Done
+		result.Warming = &progress
+	}
+
+	if !result.Ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	renderResponse(w, result)
+}
+
+// whenReady wraps a handler to shed requests until the index is warm, unless serving while
+// warming is enabled in which case the responses are flagged as degraded
+func whenReady(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if warmer != nil && !warmer.Ready() {
+			if !*serveWhileWarming {
+				shedLoad(w)
+				return
+			}
+			w.Header().Set("X-Echoprint-Degraded", "warming")
+		}
+
+		handler(w, r)
+	}
+}
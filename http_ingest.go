@@ -4,6 +4,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"runtime/debug"
+	"strconv"
 
 	"github.com/AudioAddict/go-echoprint/echoprint"
 	"github.com/golang/glog"
@@ -17,7 +18,24 @@ func ingestHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	results, err := peformIngest(jsonData)
+	opts := ingestOptions
+	if variants, err := strconv.ParseBool(r.URL.Query().Get("variants")); err == nil {
+		opts.Variants = variants
+	}
+	if allocate, err := strconv.ParseBool(r.URL.Query().Get("allocate_track_ids")); err == nil {
+		opts.AllocateTrackIDs = allocate
+	}
+	if dryRun, err := strconv.ParseBool(r.URL.Query().Get("dry_run")); err == nil {
+		opts.DryRun = dryRun
+	}
+	if collisions := r.URL.Query().Get("collisions"); collisions != "" {
+		if opts.Collisions, err = parseCollisionPolicy(collisions); err != nil {
+			apiError(w, err)
+			return
+		}
+	}
+
+	results, err := peformIngest(jsonData, requestUsageKey(r).Catalog, opts)
 	if err != nil {
 		apiError(w, err)
 		return
@@ -25,13 +43,44 @@ func ingestHandler(w http.ResponseWriter, r *http.Request) {
 	renderResponse(w, results)
 }
 
-func peformIngest(jsonData []byte) ([]echoprint.IngestResult, error) {
-	codegenList, err := echoprint.ParseCodegen(jsonData)
+func parseCollisionPolicy(policy string) (echoprint.CollisionPolicy, error) {
+	switch policy {
+	case "ignore":
+		return echoprint.CollisionIgnore, nil
+	case "reject":
+		return echoprint.CollisionReject, nil
+	case "remap":
+		return echoprint.CollisionRemap, nil
+	}
+	return echoprint.CollisionIgnore, badRequest("Unknown collision policy '%s'", policy)
+}
+
+func peformIngest(jsonData []byte, catalog string, opts echoprint.IngestOptions) ([]echoprint.IngestResult, error) {
+	codegenList, err := parseCodegen(jsonData)
 	if err != nil {
 		return nil, err
 	}
 
-	results := echoprint.IngestAll(codegenList)
+	if err := checkPhysicalCatalog(catalog); err != nil {
+		return nil, err
+	}
+
+	var results []echoprint.IngestResult
+	if quotas != nil {
+		var codes int
+		for _, codegenFp := range codegenList {
+			codes += codegenFp.CodeCount()
+		}
+		reserved, err := quotas.admit(catalog, len(codegenList), codes)
+		if err != nil {
+			return nil, err
+		}
+		// the reservation is released whatever happens to the ingest
+		defer func() { quotas.add(catalog, reserved, results) }()
+		tagCatalog(codegenList, catalog)
+	}
+
+	results = echoprint.IngestAll(codegenList, opts)
 
 	debug.FreeOSMemory()
 	return results, nil
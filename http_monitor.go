@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/AudioAddict/go-echoprint/echoprint"
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+)
+
+// monitor continuously matches the registered broadcast streams
+var monitor *echoprint.Monitor
+
+type streamRequest struct {
+	URL string `json:"url"`
+}
+
+func onDetection(detection *echoprint.Detection) {
+	glog.Infof("Detection on stream %s: TrackID=%d from %s to %s", detection.StreamID, detection.TrackID, detection.Start, detection.End)
+
+	if detectionStore != nil {
+		if err := detectionStore.Save(detection); err != nil {
+			glog.Error(err)
+		}
+	}
+}
+
+func streamsHandler(w http.ResponseWriter, r *http.Request) {
+	renderResponse(w, monitor.Streams())
+}
+
+func addStreamHandler(w http.ResponseWriter, r *http.Request) {
+	var req streamRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		apiError(w, err)
+		return
+	}
+
+	stream, err := monitor.Add(req.URL)
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+	renderResponse(w, stream)
+}
+
+func removeStreamHandler(w http.ResponseWriter, r *http.Request) {
+	err := monitor.Remove(mux.Vars(r)["id"])
+	if err == echoprint.ErrStreamNotFound {
+		apiError(w, err)
+		return
+	} else if err != nil {
+		httpError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -1,9 +1,13 @@
 package main
 
 import (
-	"io/ioutil"
+	"encoding/json"
+	"io"
 	"net/http"
 	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/AudioAddict/go-echoprint/echoprint"
 	"github.com/golang/glog"
@@ -18,14 +22,33 @@ const (
 )
 
 type queryResult struct {
-	Matches    []*echoprint.MatchResult `json:"matches"`
-	Status     string                   `json:"status"`
-	MatchCount int                      `json:"match_count"`
+	Matches      []*echoprint.MatchResult `json:"matches"`
+	Status       string                   `json:"status"`
+	MatchCount   int                      `json:"match_count"`
+	Ambiguous    bool                     `json:"ambiguous"`
+	TiedTrackIDs []uint32                 `json:"tied_track_ids,omitempty"`
+
+	// NearMatches are the likely alternate versions (remasters, edits etc.) of the query that
+	// fell short of a match, only reported with near_matches
+	NearMatches []*echoprint.MatchResult `json:"near_matches,omitempty"`
+
+	// Partial is set when the latency budget ran out before every candidate was scored
+	Partial            bool `json:"partial,omitempty"`
+	UnscoredCandidates int  `json:"unscored_candidates,omitempty"`
+
+	// Stats describe the work done for the match, only reported with score_details or trace
+	Stats *echoprint.MatchStats `json:"stats,omitempty"`
+
+	// Evidence is the signed statement of the matches, only reported when signing is enabled
+	Evidence *echoprint.Evidence `json:"evidence,omitempty"`
 }
 
-func newQueryResult(matches []*echoprint.MatchResult) queryResult {
-	qr := queryResult{Matches: matches}
+func newQueryResult(group echoprint.MatchGroup) queryResult {
+	matches := group.Matches
+	qr := queryResult{Matches: matches, NearMatches: group.NearMatches}
 	qr.MatchCount = len(matches)
+	qr.Partial = group.Stats.Partial
+	qr.UnscoredCandidates = group.Stats.Unscored
 
 	if qr.MatchCount > 0 {
 		if qr.MatchCount == 1 && matches[0].Error != nil {
@@ -43,38 +66,356 @@ func newQueryResult(matches []*echoprint.MatchResult) queryResult {
 		qr.Status = statusNoMatch
 	}
 
+	for _, match := range matches {
+		if match.Tied {
+			qr.TiedTrackIDs = append(qr.TiedTrackIDs, match.TrackID)
+		}
+	}
+	qr.Ambiguous = len(qr.TiedTrackIDs) > 0
+
 	return qr
 }
 
 func queryHandler(w http.ResponseWriter, r *http.Request) {
-	jsonData, err := ioutil.ReadAll(r.Body)
+	// clients of the original echoprint-server send the code alone
+	if r.FormValue("fp_code") != "" {
+		legacyQueryHandler(w, r)
+		return
+	}
+
+	jsonData, err := readCodegen(r)
 	if err != nil {
 		glog.Error(err)
 		apiError(w, err)
 		return
 	}
 
-	result, err := peformQuery(jsonData)
+	opts, err := parseMatchOptions(r)
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+
+	var record *echoprint.AuditRecord
+	if auditSink != nil {
+		record = newAuditRecord(r, opts.RequestID)
+	}
+
+	codegenList, err := parseCodegen(jsonData)
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+
+	if wantsLegacyResponse(r) {
+		startTime := time.Now()
+		opts.ScoreDetails = true
+		matchGroups := matchAudited(codegenList, opts, record)
+		results := make([]legacyQueryResult, len(matchGroups))
+		for i, group := range matchGroups {
+			results[i] = newLegacyQueryResult(group, startTime)
+		}
+		renderResponse(w, results)
+		return
+	}
+
+	if mode := streamMode(r); mode != "" && !opts.Samples {
+		streamQuery(w, mode, codegenList, opts, record)
+		return
+	}
+
+	if *spillThreshold > 0 && len(codegenList) > *spillThreshold && !opts.Samples {
+		streamSpilledQuery(w, codegenList, opts)
+		return
+	}
+
+	results, err := matchCodegen(codegenList, opts, record)
 	if err != nil {
 		apiError(w, err)
 		return
 	}
+	renderResponse(w, results)
+}
 
-	renderResponse(w, result)
+// requestProfile is the matching profile asked for with the profile param, or the default
+// profile of the request's catalog
+func requestProfile(r *http.Request) string {
+	if name := r.URL.Query().Get("profile"); name != "" {
+		return name
+	}
+	return catalogProfiles[requestUsageKey(r).Catalog]
 }
 
-func peformQuery(jsonData []byte) ([]queryResult, error) {
+// parseMatchOptions reads the optional matching settings from the url query string, the
+// request body is reserved for the codegen json
+func parseMatchOptions(r *http.Request) (echoprint.MatchOptions, error) {
+	params := r.URL.Query()
+
+	opts := echoprint.MatchOptions{
+		Thresholds:    thresholds,
+		Experiment:    experiment,
+		Throttle:      throttle,
+		RequestID:     requestID(r),
+		LatencyBudget: *latencyBudget,
+		EarlyExit:     earlyExit,
+		AdaptiveDepth: adaptiveDepth,
+		VerifyBest:    verifyBest,
+	}
+
+	if profileName := requestProfile(r); profileName != "" {
+		profile, ok := echoprint.LookupProfile(profileName)
+		if !ok {
+			return opts, badRequest("Unknown profile '%s'", profileName)
+		}
+		opts = profile.Apply(opts)
+	}
+
+	if qosClass(r) == qosBatch {
+		opts.Concurrency = *batchMatchConcurrency
+	}
+
+	if scaling, err := strconv.ParseBool(params.Get("time_scaling")); err == nil {
+		opts.TimeScaling = scaling
+	}
+	opts.ClusterRecordings, _ = strconv.ParseBool(params.Get("cluster"))
+	opts.Samples, _ = strconv.ParseBool(params.Get("samples"))
+	opts.GroupByISRC = *groupByISRC
+	if group, err := strconv.ParseBool(params.Get("group_isrc")); err == nil {
+		opts.GroupByISRC = group
+	}
+	opts.ScoreDetails, _ = strconv.ParseBool(params.Get("score_details"))
+	opts.Unclamped, _ = strconv.ParseBool(params.Get("unclamped"))
+	opts.Trace, _ = strconv.ParseBool(params.Get("trace"))
+	if near, _ := strconv.ParseBool(params.Get("near_matches")); near {
+		opts.NearMatches = &echoprint.NearMatches{}
+	}
+	if exit, err := strconv.ParseBool(params.Get("early_exit")); err == nil && !exit {
+		opts.EarlyExit = nil
+	}
+	if verify, err := strconv.ParseBool(params.Get("verify")); err == nil {
+		switch {
+		case !verify:
+			opts.VerifyBest = nil
+		case opts.VerifyBest == nil:
+			opts.VerifyBest = &echoprint.BestMatchVerification{}
+		}
+	}
+
+	if minDBScore := params.Get("min_db_score"); minDBScore != "" {
+		value, err := strconv.ParseFloat(minDBScore, 32)
+		if err != nil {
+			return opts, badRequest("Invalid min_db_score '%s'", minDBScore)
+		}
+		opts.Thresholds.MinDBScoreHighQuality = float32(value)
+		opts.Thresholds.MinDBScoreMediumQuality = float32(value)
+		opts.Thresholds.MinDBScoreLowQuality = float32(value)
+	}
+
+	if budget := params.Get("budget_ms"); budget != "" {
+		value, err := strconv.Atoi(budget)
+		if err != nil || value < 0 {
+			return opts, badRequest("Invalid budget_ms '%s'", budget)
+		}
+		opts.LatencyBudget = time.Duration(value) * time.Millisecond
+	}
+
+	if align, _ := strconv.ParseBool(params.Get("alignment")); align {
+		opts.Alignment = &echoprint.AlignmentOptions{}
+		if window := params.Get("alignment_window"); window != "" {
+			value, err := strconv.Atoi(window)
+			if err != nil || value <= 0 {
+				return opts, badRequest("Invalid alignment_window '%s'", window)
+			}
+			opts.Alignment.Window = time.Duration(value) * time.Second
+		}
+	}
+
+	if tolerance := params.Get("duration_tolerance"); tolerance != "" {
+		value, err := strconv.ParseFloat(tolerance, 32)
+		if err != nil {
+			return opts, badRequest("Invalid duration_tolerance '%s'", tolerance)
+		}
+		opts.DurationTolerance = float32(value)
+	}
+
+	if upcPrefix, tags := params.Get("upc_prefix"), params["tag"]; upcPrefix != "" || len(tags) > 0 {
+		opts.Filter = &echoprint.MetadataFilter{UPCPrefix: upcPrefix, Tags: make(map[string]string)}
+		for _, tag := range tags {
+			kv := strings.SplitN(tag, "=", 2)
+			if len(kv) != 2 || kv[0] == "" {
+				return opts, badRequest("Invalid tag '%s', expected key=value", tag)
+			}
+			opts.Filter.Tags[kv[0]] = kv[1]
+		}
+	}
+	opts.Filter = virtualCatalogFilter(requestUsageKey(r).Catalog, opts.Filter)
+	// a virtual catalog is already a subset of the index
+	if _, virtual := virtualCatalogs[requestUsageKey(r).Catalog]; !virtual {
+		opts.Tiers = searchTiers
+	}
+	if tiers, err := strconv.ParseBool(params.Get("tiers")); err == nil && !tiers {
+		opts.Tiers = nil
+	}
+
+	if policy := params.Get("best_match_policy"); policy != "" {
+		value, err := strconv.ParseFloat(params.Get("best_match_value"), 32)
+		if err != nil && policy != "top" {
+			return opts, badRequest("Invalid best_match_value for policy '%s'", policy)
+		}
+
+		switch policy {
+		case "ratio":
+			opts.BestMatchPolicy = echoprint.SeparationRatio(value)
+		case "margin":
+			opts.BestMatchPolicy = echoprint.AbsoluteMargin(value)
+		case "top":
+			opts.BestMatchPolicy = echoprint.TopMatch{}
+		default:
+			return opts, badRequest("Unknown best_match_policy '%s'", policy)
+		}
+	}
+
+	return opts, nil
+}
+
+// peformQuery matches the codegen json for the debug page, when record is provided the query is
+// written to the audit log. Score details, stats and the retrieval trace are always included,
+// and the errors are shown in their groups
+func peformQuery(jsonData []byte, opts echoprint.MatchOptions, record *echoprint.AuditRecord) ([]queryResult, error) {
+	opts.ScoreDetails = true
+	opts.Trace = true
+	codegenList, err := parseCodegen(jsonData)
+	if err != nil {
+		return nil, err
+	}
+
+	results, _ := matchCodegen(codegenList, opts, record)
+	return results, nil
+}
+
+func parseCodegen(jsonData []byte) ([]*echoprint.CodegenFp, error) {
 	codegenList, err := echoprint.ParseCodegen(jsonData)
 	if err != nil {
+		return nil, &requestError{status: http.StatusBadRequest, code: "malformed_codegen", message: err.Error()}
+	}
+	if err := checkBatchSize(codegenList); err != nil {
 		return nil, err
 	}
 
-	matchGroups := echoprint.MatchAll(codegenList)
+	return codegenList, nil
+}
+
+// matchCodegen matches the codegen and returns the result of each group, along with the error
+// they all failed with when every group failed with the same class of error
+func matchCodegen(codegenList []*echoprint.CodegenFp, opts echoprint.MatchOptions, record *echoprint.AuditRecord) ([]queryResult, error) {
+	startTime := time.Now()
+
+	matchGroups := matchAudited(codegenList, opts, record)
 	result := make([]queryResult, len(matchGroups))
+	errs := make([]error, len(matchGroups))
 	for i, group := range matchGroups {
-		result[i] = newQueryResult(group)
+		result[i] = newReportedQueryResult(group, codegenList[i], opts, startTime)
+		errs[i] = group.Err
 	}
 
 	debug.FreeOSMemory()
-	return result, nil
+	return result, commonError(errs)
+}
+
+// commonError returns the first of the errors when every one is reported with the same status
+// and error code, so a request whose fingerprints all failed the same way fails as a whole.
+// Batches where any fingerprint succeeded, or failed differently, report the errors per group
+func commonError(errs []error) error {
+	if len(errs) == 0 || errs[0] == nil {
+		return nil
+	}
+
+	status, code, _ := errorStatus(errs[0])
+	for _, err := range errs[1:] {
+		if err == nil {
+			return nil
+		}
+		if s, c, _ := errorStatus(err); s != status || c != code {
+			return nil
+		}
+	}
+	return errs[0]
+}
+
+// newReportedQueryResult is the queryResult of a group with the stats and evidence requested
+func newReportedQueryResult(group echoprint.MatchGroup, codegenFp *echoprint.CodegenFp, opts echoprint.MatchOptions, startTime time.Time) queryResult {
+	result := newQueryResult(group)
+	if opts.ScoreDetails || opts.Trace {
+		result.Stats = &group.Stats
+	}
+	if signingKey != nil {
+		result.Evidence = echoprint.SignEvidence(signingKey, codegenFp, group.Matches, startTime)
+	}
+	return result
+}
+
+// newAuditRecord starts the audit record of a query. Records are served by /admin/queries, so
+// the API key is recorded by its hash and left out of the options
+func newAuditRecord(r *http.Request, requestID string) *echoprint.AuditRecord {
+	options := r.URL.Query()
+	options.Del("api_key")
+	return &echoprint.AuditRecord{RequestID: requestID, APIKey: hashAPIKey(requestUsageKey(r).APIKey), Options: options}
+}
+
+// matchAudited matches the codegen, writing the query to the audit log when record is provided
+func matchAudited(codegenList []*echoprint.CodegenFp, opts echoprint.MatchOptions, record *echoprint.AuditRecord) []echoprint.MatchGroup {
+	startTime := time.Now()
+	matchGroups := echoprint.MatchAll(codegenList, opts)
+
+	if record != nil {
+		record.Time = startTime
+		record.Query = codegenList
+		record.Groups = matchGroups
+		record.Elapsed = time.Since(startTime)
+		if err := auditSink.Write(record); err != nil {
+			glog.Error(err)
+		}
+	}
+
+	return matchGroups
+}
+
+// streamSpilledQuery matches a large batch with its results spilled to disk, the results are
+// then streamed out one group at a time. Spilled queries are not audited as the audit record
+// would hold every group in memory
+func streamSpilledQuery(w http.ResponseWriter, codegenList []*echoprint.CodegenFp, opts echoprint.MatchOptions) {
+	startTime := time.Now()
+	spilled, err := echoprint.MatchAllSpilled(codegenList, opts, *spillDir)
+	if err != nil {
+		glog.Error(err)
+		apiError(w, err)
+		return
+	}
+	defer spilled.Close()
+	debug.FreeOSMemory()
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	encoder := json.NewEncoder(w)
+	io.WriteString(w, "[")
+	for i := 0; i < spilled.Len(); i++ {
+		group, err := spilled.Get(i)
+		if err != nil {
+			// the response is already under way, the best we can do is truncate it
+			glog.Error(err)
+			return
+		}
+
+		if i > 0 {
+			io.WriteString(w, ",")
+		}
+		result := newQueryResult(group)
+		if signingKey != nil {
+			result.Evidence = echoprint.SignEvidence(signingKey, codegenList[i], group.Matches, startTime)
+		}
+		if err := encoder.Encode(result); err != nil {
+			glog.Error(err)
+			return
+		}
+	}
+	io.WriteString(w, "]\n")
 }
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/AudioAddict/go-echoprint/echoprint"
+	"github.com/golang/glog"
+)
+
+// detectionStore persists stream monitoring detections, nil when disabled
+var detectionStore *echoprint.DetectionStore
+
+var errDetectionsDisabled = errors.New("Detection storage is not enabled")
+
+var errConfidenceStatsDisabled = errors.New("Confidence stats are not enabled")
+
+// parseReportRange reads the from/to (RFC3339 or YYYY-MM-DD) query params, defaulting to the last 24 hours
+func parseReportRange(r *http.Request) (time.Time, time.Time, error) {
+	to := time.Now()
+	from := to.Add(-24 * time.Hour)
+
+	for param, t := range map[string]*time.Time{"from": &from, "to": &to} {
+		parsed, err := parseTimeParam(r, param)
+		if err != nil {
+			return from, to, err
+		} else if !parsed.IsZero() {
+			*t = parsed
+		}
+	}
+
+	return from, to, nil
+}
+
+// parseTimeParam reads an RFC3339 or YYYY-MM-DD query param, the zero time when absent
+func parseTimeParam(r *http.Request, param string) (time.Time, error) {
+	value := r.URL.Query().Get(param)
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		if parsed, err = time.Parse("2006-01-02", value); err != nil {
+			return parsed, badRequest("Invalid %s '%s'", param, value)
+		}
+	}
+	return parsed, nil
+}
+
+func listDetections(w http.ResponseWriter, r *http.Request) ([]*echoprint.Detection, bool) {
+	if detectionStore == nil {
+		apiError(w, errDetectionsDisabled)
+		return nil, false
+	}
+
+	from, to, err := parseReportRange(r)
+	if err != nil {
+		apiError(w, err)
+		return nil, false
+	}
+
+	detections, err := detectionStore.List(from, to, r.URL.Query().Get("stream"))
+	if err != nil {
+		httpError(w, err)
+		return nil, false
+	}
+
+	return detections, true
+}
+
+func detectionsReportHandler(w http.ResponseWriter, r *http.Request) {
+	detections, ok := listDetections(w, r)
+	if !ok {
+		return
+	}
+
+	if r.URL.Query().Get("format") != "csv" {
+		renderResponse(w, detections)
+		return
+	}
+
+	rows := [][]string{{"stream_id", "track_id", "start", "end", "confidence"}}
+	for _, d := range detections {
+		rows = append(rows, []string{
+			d.StreamID,
+			strconv.Itoa(int(d.TrackID)),
+			d.Start.UTC().Format(time.RFC3339),
+			d.End.UTC().Format(time.RFC3339),
+			strconv.FormatFloat(float64(d.Confidence), 'f', 2, 32),
+		})
+	}
+	renderCSV(w, "detections.csv", rows)
+}
+
+func playsReportHandler(w http.ResponseWriter, r *http.Request) {
+	detections, ok := listDetections(w, r)
+	if !ok {
+		return
+	}
+
+	var plays []echoprint.PlayCount
+	switch r.URL.Query().Get("group") {
+	case "stream":
+		plays = echoprint.PlaysPerStream(detections)
+	default:
+		plays = echoprint.PlaysPerTrackPerDay(detections)
+	}
+
+	if r.URL.Query().Get("format") != "csv" {
+		renderResponse(w, plays)
+		return
+	}
+
+	rows := [][]string{{"day", "stream_id", "track_id", "plays"}}
+	for _, p := range plays {
+		rows = append(rows, []string{p.Day, p.StreamID, strconv.Itoa(int(p.TrackID)), strconv.Itoa(p.Plays)})
+	}
+	renderCSV(w, "plays.csv", rows)
+}
+
+func renderCSV(w http.ResponseWriter, filename string, rows [][]string) {
+	w.Header().Set("Content-Type", "text/csv; charset=UTF-8")
+	w.Header().Set("Content-Disposition", "attachment; filename="+filename)
+	if err := csv.NewWriter(w).WriteAll(rows); err != nil {
+		glog.Error(err)
+	}
+}
+
+// confidencesReportHandler reports the daily confidence histograms of the scored candidates,
+// optionally limited to the days from/to
+func confidencesReportHandler(w http.ResponseWriter, r *http.Request) {
+	if *confidenceStatsDays <= 0 {
+		apiError(w, errConfidenceStatsDisabled)
+		return
+	}
+
+	from, err := parseTimeParam(r, "from")
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+	to, err := parseTimeParam(r, "to")
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+
+	histograms := make([]echoprint.ConfidenceHistogram, 0)
+	for _, h := range echoprint.ConfidenceHistograms() {
+		if (from.IsZero() || h.Day >= from.UTC().Format("2006-01-02")) && (to.IsZero() || h.Day <= to.UTC().Format("2006-01-02")) {
+			histograms = append(histograms, h)
+		}
+	}
+
+	if r.URL.Query().Get("format") != "csv" {
+		renderResponse(w, histograms)
+		return
+	}
+
+	rows := [][]string{{"day", "quality", "min_confidence", "max_confidence", "accepted", "rejected"}}
+	for _, h := range histograms {
+		for i := range h.Accepted {
+			rows = append(rows, []string{
+				h.Day,
+				h.Quality,
+				strconv.FormatFloat(float64(float32(i)*h.BinWidth), 'f', 2, 32),
+				strconv.FormatFloat(float64(float32(i+1)*h.BinWidth), 'f', 2, 32),
+				strconv.FormatInt(h.Accepted[i], 10),
+				strconv.FormatInt(h.Rejected[i], 10),
+			})
+		}
+	}
+	renderCSV(w, "confidences.csv", rows)
+}
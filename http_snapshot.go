@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/AudioAddict/go-echoprint/echoprint"
+	"github.com/golang/glog"
+)
+
+// objectStore reaches the S3/GCS buckets holding snapshots, credentials are read from the
+// standard AWS environment variables
+var objectStore *echoprint.ObjectStore
+
+func newObjectStore() *echoprint.ObjectStore {
+	return &echoprint.ObjectStore{
+		Endpoint:     *objectStoreEndpoint,
+		Region:       *objectStoreRegion,
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		PartSize:     *snapshotPartMB * 1024 * 1024,
+	}
+}
+
+type snapshotResult struct {
+	URL string `json:"url"`
+	echoprint.SnapshotInfo
+}
+
+// parseSince reads the sequence a delta starts after, 0 when absent
+func parseSince(r *http.Request) (uint64, error) {
+	since := r.URL.Query().Get("since")
+	if since == "" {
+		return 0, nil
+	}
+
+	value, err := strconv.ParseUint(since, 10, 64)
+	if err != nil {
+		return 0, badRequest("Invalid since '%s'", since)
+	}
+	return value, nil
+}
+
+// createSnapshotHandler uploads a snapshot of the index to the s3:// or gs:// url parameter,
+// a delta of the fingerprints stored after the since sequence when provided
+func createSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	url := r.URL.Query().Get("url")
+	if url == "" {
+		apiError(w, badRequest("Missing snapshot url"))
+		return
+	}
+	since, err := parseSince(r)
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+
+	info, err := echoprint.UploadSnapshot(objectStore, url, since)
+	if err != nil {
+		glog.Error(err)
+		apiError(w, err)
+		return
+	}
+
+	renderResponse(w, snapshotResult{URL: url, SnapshotInfo: info})
+}
+
+// deltaHandler streams the fingerprints stored after the since sequence, standby nodes apply
+// it with restoreSnapshotHandler and ask for the next delta from its X-Echoprint-Sequence
+func deltaHandler(w http.ResponseWriter, r *http.Request) {
+	since, err := parseSince(r)
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+
+	// the sequence is read ahead so its header can be sent before the delta is streamed. The
+	// delta may cover later changes, the next delta repeats them which restores skip
+	sequence, err := echoprint.CurrentSequence()
+	if err != nil {
+		glog.Error(err)
+		apiError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("X-Echoprint-Sequence", strconv.FormatUint(sequence, 10))
+	delta := &countingWriter{ResponseWriter: w}
+	if since == 0 {
+		_, err = echoprint.WriteSnapshot(delta)
+	} else {
+		_, err = echoprint.WriteDelta(delta, since)
+	}
+	if err != nil && delta.count == 0 {
+		glog.Error(err)
+		w.Header().Del("X-Echoprint-Sequence")
+		apiError(w, err)
+	} else if err != nil {
+		// the gzip stream is left unterminated, restoring the truncated delta fails
+		glog.Errorf("Streaming the delta since %d failed: %s", since, err)
+	}
+}
+
+// restoreSnapshotHandler applies a full snapshot or delta posted in the request body
+func restoreSnapshotHandler(w http.ResponseWriter, r *http.Request) {
+	info, err := echoprint.RestoreSnapshot(r.Body)
+	if err != nil {
+		glog.Error(err)
+		apiError(w, err)
+		return
+	}
+
+	renderResponse(w, info)
+}
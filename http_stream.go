@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/AudioAddict/go-echoprint/echoprint"
+	"github.com/golang/glog"
+)
+
+const (
+	// streamNDJSON writes each result on its own line as soon as it completes, in any order
+	streamNDJSON = "ndjson"
+	// streamArray writes the usual json array progressively, in the order of the batch
+	streamArray = "array"
+
+	contentTypeNDJSON = "application/x-ndjson"
+)
+
+// streamedResult is a line of an ndjson response, Index is the position of the fingerprint in
+// the batch as lines are written in the order the matches complete
+type streamedResult struct {
+	Index int `json:"index"`
+	queryResult
+}
+
+type completedGroup struct {
+	index int
+	group echoprint.MatchGroup
+}
+
+// streamMode returns the streaming requested with the stream param or by accepting ndjson, an
+// empty string when the response isn't streamed
+func streamMode(r *http.Request) string {
+	switch mode := r.URL.Query().Get("stream"); mode {
+	case streamNDJSON, streamArray:
+		return mode
+	}
+
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		if mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept)); err == nil && mediaType == contentTypeNDJSON {
+			return streamNDJSON
+		}
+	}
+	return ""
+}
+
+// streamQuery matches a batch writing each result as soon as it can be, flushing it to the
+// client. While no result is ready whitespace is written every -stream-keepalive, which json
+// parsers skip, so proxies don't time out the idle connection. The audit record is written
+// once the batch completes
+func streamQuery(w http.ResponseWriter, mode string, codegenList []*echoprint.CodegenFp, opts echoprint.MatchOptions, record *echoprint.AuditRecord) {
+	startTime := time.Now()
+	completed := make(chan completedGroup)
+	go func() {
+		echoprint.MatchEach(codegenList, opts, func(index int, group echoprint.MatchGroup) {
+			completed <- completedGroup{index, group}
+		})
+		close(completed)
+	}()
+
+	if mode == streamNDJSON {
+		w.Header().Set("Content-Type", contentTypeNDJSON)
+	} else {
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		io.WriteString(w, "[")
+	}
+	flusher := http.NewResponseController(w)
+	flusher.Flush()
+
+	// -write-timeout would cut off long streams, each result gets its own deadline instead
+	extendDeadline := func() {
+		if *writeTimeout > 0 {
+			flusher.SetWriteDeadline(time.Now().Add(*writeTimeout))
+		}
+	}
+
+	var keepalive <-chan time.Time
+	if *streamKeepalive > 0 {
+		ticker := time.NewTicker(*streamKeepalive)
+		defer ticker.Stop()
+		keepalive = ticker.C
+	}
+
+	// the groups are kept for the audit record, the results of an array are written once those
+	// before them are
+	groups := make([]echoprint.MatchGroup, len(codegenList))
+	pending := make([]bool, len(codegenList))
+	var next int
+	var failed bool
+
+loop:
+	for {
+		select {
+		case done, ok := <-completed:
+			if !ok {
+				break loop
+			}
+			groups[done.index] = done.group
+			if failed {
+				// the client is gone, the matches are drained so MatchEach can return
+				continue
+			}
+
+			extendDeadline()
+			if mode == streamNDJSON {
+				failed = writeStreamed(w, streamedResult{done.index, newReportedQueryResult(done.group, codegenList[done.index], opts, startTime)}, "")
+			} else {
+				pending[done.index] = true
+				for ; next < len(pending) && pending[next] && !failed; next++ {
+					separator := ""
+					if next > 0 {
+						separator = ","
+					}
+					failed = writeStreamed(w, newReportedQueryResult(groups[next], codegenList[next], opts, startTime), separator)
+				}
+			}
+			flusher.Flush()
+
+		case <-keepalive:
+			if !failed {
+				extendDeadline()
+				_, err := io.WriteString(w, " ")
+				failed = err != nil
+				flusher.Flush()
+			}
+		}
+	}
+
+	if mode == streamArray && !failed {
+		extendDeadline()
+		io.WriteString(w, "]\n")
+	}
+
+	if record != nil {
+		record.Time = startTime
+		record.Query = codegenList
+		record.Groups = groups
+		record.Elapsed = time.Since(startTime)
+		if err := auditSink.Write(record); err != nil {
+			glog.Error(err)
+		}
+	}
+}
+
+// writeStreamed writes a result of a streamed response, reporting whether writing failed
+func writeStreamed(w io.Writer, result interface{}, separator string) bool {
+	data, err := json.Marshal(result)
+	if err == nil {
+		_, err = io.WriteString(w, separator+string(data)+"\n")
+	}
+	if err != nil {
+		glog.Error(err)
+		return true
+	}
+	return false
+}
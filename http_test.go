@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/AudioAddict/go-echoprint/echoprint"
+)
+
+// TestShedLoad reports shed requests as overloaded, to be retried after Retry-After
+func TestShedLoad(t *testing.T) {
+	rec := httptest.NewRecorder()
+	shedLoad(rec)
+
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("shed request answered %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("shed request answered without Retry-After")
+	}
+	var resp errorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || resp.Code != "overloaded" {
+		t.Errorf("shed request answered code '%s' (%v), want overloaded", resp.Code, err)
+	}
+}
+
+// TestQueryErrorStatus fails requests whose fingerprints all failed the same way with the
+// status of their error, mixed batches are answered per group
+func TestQueryErrorStatus(t *testing.T) {
+	invalid := []*echoprint.CodegenFp{{Code: "not a fingerprint"}, {Code: "nor this"}}
+	results, err := matchCodegen(invalid, echoprint.MatchOptions{}, nil)
+	if status, code, _ := errorStatus(err); status != http.StatusUnprocessableEntity || code != "invalid_fingerprint" {
+		t.Errorf("invalid fingerprints answered %d %s (%v)", status, code, err)
+	}
+	if len(results) != len(invalid) || results[0].Status != statusError {
+		t.Errorf("invalid fingerprints reported as %+v", results)
+	}
+
+	backend := &echoprint.BackendError{Err: errors.New("solr is down")}
+	invalidFp := &echoprint.InvalidFingerprintError{Err: errors.New("bad code")}
+	for _, errs := range [][]error{{invalidFp, nil}, {invalidFp, backend}, {}} {
+		if err := commonError(errs); err != nil {
+			t.Errorf("groups failing with %v answered with %v", errs, err)
+		}
+	}
+	if err := commonError([]error{backend, backend}); err != backend {
+		t.Errorf("groups failing with the backend down answered with %v", err)
+	}
+
+	_, err = performCueSheet([]byte("not json"), echoprint.MatchOptions{})
+	if status, _, _ := errorStatus(err); status != http.StatusBadRequest {
+		t.Errorf("malformed cue sheet codegen answered %d (%v)", status, err)
+	}
+}
+
+// TestAuditRecordAPIKey keeps API keys, credentials, out of the audit records
+func TestAuditRecordAPIKey(t *testing.T) {
+	for _, r := range []*http.Request{
+		httptest.NewRequest("POST", "/query?catalog=partner&api_key=secret", nil),
+		httptest.NewRequest("POST", "/query?catalog=partner", nil),
+	} {
+		if r.URL.Query().Get("api_key") == "" {
+			r.Header.Set("X-API-Key", "secret")
+		}
+
+		record := newAuditRecord(r, "request")
+		if record.APIKey != hashAPIKey("secret") || record.APIKey == "secret" {
+			t.Errorf("%s recorded API key '%s'", r.URL, record.APIKey)
+		}
+		if _, ok := record.Options["api_key"]; ok || record.Options["catalog"][0] != "partner" {
+			t.Errorf("%s recorded options %v", r.URL, record.Options)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/AudioAddict/go-echoprint/echoprint"
+	"github.com/golang/glog"
+)
+
+var errUploadUnfingerprintable = errors.New("The uploaded audio could not be fingerprinted")
+
+// uploadMatch places a match on the timeline of the uploaded audio, times are in seconds
+type uploadMatch struct {
+	*echoprint.MatchResult
+	// UploadStart and UploadEnd delimit the part of the upload lined up with the track,
+	// TrackStart is where UploadStart falls in the track
+	UploadStart float64 `json:"upload_start"`
+	UploadEnd   float64 `json:"upload_end"`
+	TrackStart  float64 `json:"track_start"`
+}
+
+type uploadResult struct {
+	// Duration is the length of the upload in seconds, as reported by codegen
+	Duration float64       `json:"duration"`
+	Status   string        `json:"status"`
+	Matches  []uploadMatch `json:"matches"`
+}
+
+// uploadQueryHandler fingerprints a short audio upload with echoprint-codegen and matches it,
+// placing every match on the upload's timeline. The audio is either the request body or the
+// audio field of a multipart form
+func uploadQueryHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, *uploadMaxBytes)
+
+	path, err := saveUpload(r)
+	if err != nil {
+		glog.Error(err)
+		apiError(w, badRequest("Reading the upload failed: %s", err))
+		return
+	}
+	defer os.Remove(path)
+
+	opts, err := parseMatchOptions(r)
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+	opts.ScoreDetails = true
+
+	codegenList, err := echoprint.RunCodegen(r.Context(), path)
+	if err != nil || len(codegenList) == 0 {
+		apiError(w, errUploadUnfingerprintable)
+		return
+	}
+	// codegen returns a single fingerprint per file
+	codegenList = codegenList[:1]
+
+	queries, err := matchCodegen(codegenList, opts, nil)
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+	result := uploadResult{Duration: codegenList[0].Meta.Duration, Status: queries[0].Status, Matches: []uploadMatch{}}
+	for _, match := range queries[0].Matches {
+		if match.Error != nil {
+			continue
+		}
+
+		// the upload starts at offset in the track, a negative offset starts before the track
+		offset := float64(match.OffsetSeconds)
+		start := math.Max(0, -offset)
+		end := start + float64(match.AlignedSeconds)
+		if result.Duration > 0 {
+			end = math.Min(end, result.Duration)
+		}
+		result.Matches = append(result.Matches, uploadMatch{MatchResult: match, UploadStart: start, UploadEnd: end, TrackStart: start + offset})
+	}
+
+	renderResponse(w, result)
+}
+
+// saveUpload writes the uploaded audio to a temporary file for codegen, keeping the extension
+// of multipart uploads as a hint of their format
+func saveUpload(r *http.Request) (string, error) {
+	var audio io.Reader = r.Body
+	var ext string
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		file, header, err := r.FormFile("audio")
+		if err != nil {
+			return "", err
+		}
+		defer file.Close()
+		audio = file
+		ext = filepath.Ext(header.Filename)
+	}
+
+	f, err := ioutil.TempFile("", "echoprint-upload-*"+ext)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(f, audio); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	return f.Name(), nil
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/AudioAddict/go-echoprint/echoprint"
+	"github.com/golang/glog"
+)
+
+// verifyHandler checks each fingerprint of the codegen json against only the track its metadata
+// claims (track_id or external_id), e.g. to confirm a delivery matches its metadata without
+// the cost of a full search
+func verifyHandler(w http.ResponseWriter, r *http.Request) {
+	jsonData, err := readCodegen(r)
+	if err != nil {
+		glog.Error(err)
+		apiError(w, err)
+		return
+	}
+
+	opts, err := parseMatchOptions(r)
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+
+	codegenList, err := parseCodegen(jsonData)
+	if err != nil {
+		apiError(w, err)
+		return
+	}
+
+	renderResponse(w, echoprint.VerifyAll(codegenList, opts))
+}
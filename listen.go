@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd socket activation
+const listenFDsStart = 3
+
+var errNoActivatedSocket = errors.New("No socket was passed by systemd socket activation")
+
+// listen opens the listener for -listen, a TCP address, unix:<path> for a unix domain socket
+// (e.g. behind an nginx unix socket upstream) or systemd for a socket activated listener
+func listen(addr string) (net.Listener, error) {
+	switch {
+	case addr == "systemd":
+		return activatedListener()
+	case strings.HasPrefix(addr, "unix:"):
+		return unixListener(strings.TrimPrefix(addr, "unix:"))
+	default:
+		return net.Listen("tcp", addr)
+	}
+}
+
+// unixListener listens on the socket path, replacing the socket left behind by a previous run
+func unixListener(path string) (net.Listener, error) {
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	mode, err := strconv.ParseUint(*unixSocketMode, 8, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// activatedListener returns the first socket passed by systemd (sd_listen_fds), the
+// variables are cleared so processes started by the server don't pick them up
+func activatedListener() (net.Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, errNoActivatedSocket
+	}
+	fds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || fds < 1 {
+		return nil, errNoActivatedSocket
+	}
+
+	f := os.NewFile(listenFDsStart, "systemd")
+	defer f.Close()
+	return net.FileListener(f)
+}
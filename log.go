@@ -10,13 +10,14 @@ import (
 )
 
 const (
-	logFmt = "%s \"%s %d %d\" %f"
+	logFmt = "%s \"%s %d %d\" %f request_id=%s"
 )
 
 type logRecord struct {
 	http.ResponseWriter
 
 	ip                    string
+	requestID             string
 	method, uri, protocol string
 	status                int
 	responseBytes         int64
@@ -25,7 +26,7 @@ type logRecord struct {
 
 func (r *logRecord) Log() {
 	requestLine := fmt.Sprintf("%s %s %s", r.method, r.uri, r.protocol)
-	glog.Infof(logFmt, r.ip, requestLine, r.status, r.responseBytes, r.elapsedTime.Seconds())
+	glog.Infof(logFmt, r.ip, requestLine, r.status, r.responseBytes, r.elapsedTime.Seconds(), r.requestID)
 	glog.Flush()
 }
 
@@ -40,6 +41,11 @@ func (r *logRecord) WriteHeader(status int) {
 	r.ResponseWriter.WriteHeader(status)
 }
 
+// Unwrap lets http.ResponseController reach the underlying writer to flush streamed responses
+func (r *logRecord) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
 type loggingHandler struct {
 	handler http.Handler
 }
@@ -57,10 +63,15 @@ func (h *loggingHandler) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
 	if colon := strings.LastIndex(clientIP, ":"); colon != -1 {
 		clientIP = clientIP[:colon]
 	}
+	// clients of a unix socket have no address, the proxy in front passes it on instead
+	if clientIP == "" || clientIP == "@" {
+		clientIP = r.Header.Get("X-Real-IP")
+	}
 
 	record := &logRecord{
 		ResponseWriter: rw,
 		ip:             clientIP,
+		requestID:      assignRequestID(rw, r),
 		method:         r.Method,
 		uri:            r.RequestURI,
 		protocol:       r.Proto,
@@ -1,43 +1,564 @@
 package main
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"expvar"
 	"flag"
-	"fmt"
+	"io/ioutil"
 	"net/http"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/AudioAddict/go-echoprint/echoprint"
 	"github.com/golang/glog"
 	"github.com/gorilla/mux"
 )
 
+var (
+	listenAddr     = flag.String("listen", ":8080", "address to listen on, unix:<path> for a unix domain socket or systemd for socket activation")
+	unixSocketMode = flag.String("unix-socket-mode", "0660", "permissions of the -listen unix domain socket")
+
+	readHeaderTimeout = flag.Duration("read-header-timeout", 10*time.Second, "maximum time to read the headers of a request (0 for no limit)")
+	readTimeout       = flag.Duration("read-timeout", 5*time.Minute, "maximum time to read a whole request, including its body (0 for no limit)")
+	writeTimeout      = flag.Duration("write-timeout", 0, "maximum time to write a response from the end of the request headers, streamed responses get this long for each result instead (0 for no limit)")
+	idleTimeout       = flag.Duration("idle-timeout", 2*time.Minute, "how long idle keep-alive connections are kept open (0 for -read-timeout)")
+	maxHeaderBytes    = flag.Int("max-header-bytes", http.DefaultMaxHeaderBytes, "largest request headers accepted")
+	keepAlives        = flag.Bool("keep-alives", true, "keep client connections open between requests")
+	h2c               = flag.Bool("h2c", false, "also accept unencrypted HTTP/2 (h2c) connections, for load balancers speaking HTTP/2 to their backends")
+	http2MaxStreams   = flag.Int("http2-max-streams", 0, "concurrent requests allowed on each HTTP/2 connection (0 for the default of 250)")
+
+	shadowSampleRate    = flag.Float64("shadow-sample-rate", 0, "fraction of queries to also run through the shadow experiment")
+	shadowSlop          = flag.Uint("shadow-slop", 2, "histogram slop used by the shadow experiment")
+	shadowMinConfidence = flag.Float64("shadow-min-confidence", 0, "minimum match confidence used by the shadow experiment (0 for defaults)")
+	shadowConcurrency   = flag.Int("shadow-concurrency", 2, "shadow or secondary backend matches run at once, samples taken while they all run are dropped")
+
+	minDBScoreHigh   = flag.Float64("min-db-score-high", 0, "minimum db code score for high quality queries (0 for default)")
+	minDBScoreMedium = flag.Float64("min-db-score-medium", 0, "minimum db code score for medium quality queries (0 for default)")
+	minDBScoreLow    = flag.Float64("min-db-score-low", 0, "minimum db code score for low quality queries (0 for default)")
+
+	ingestFullMinutes = flag.Int("ingest-full-minutes", 0, "only store every code for the first N minutes of ingested fingerprints (0 stores everything)")
+	ingestSampleEvery = flag.Int("ingest-sample-every", 0, "store every Nth code beyond -ingest-full-minutes (0 drops them)")
+	sparseMinutes     = flag.Int("sparse-minutes", 0, "store fingerprints longer than N minutes sparsely (0 disables)")
+	sparseEvery       = flag.Int("sparse-every", 4, "store every Nth code of sparse fingerprints")
+	ingestVariants    = flag.Bool("ingest-variants", false, "store additional fingerprints for existing TrackIDs instead of rejecting them")
+	allocateTrackIDs  = flag.Bool("allocate-track-ids", false, "allocate TrackIDs for fingerprints ingested without one")
+	ingestCollisions  = flag.String("ingest-collisions", "ignore", "how to handle reused TrackIDs with different audio (ignore, reject, remap)")
+	postingCap        = flag.Int("posting-cap", 0, "cap the number of fingerprints indexed under each code (0 disables)")
+	postingOverflow   = flag.String("posting-overflow", "truncate", "what happens to codes over -posting-cap: stop indexing them (truncate), index a shrinking sample (sample) or drop them from queries as stop codes (stop)")
+	stopCodes         = flag.Int("stop-codes", 0, "learn the N most frequent codes of the catalog as stop codes excluded from matching (0 disables)")
+	stopCodesInterval = flag.Duration("stop-codes-interval", time.Hour, "how often the stop codes are relearned from the codes ingested since")
+	selfMatch         = flag.String("ingest-self-match", "off", "query ingested fingerprints back before storing them and flag (flag) or reject (reject) those that don't match themselves")
+	selfMatchMin      = flag.Float64("ingest-self-match-confidence", 0, "confidence ingested fingerprints must match themselves with (0 for the high quality threshold)")
+	signingKeyFile    = flag.String("signing-key-file", "", "sign query results with the PEM encoded Ed25519 private key in this file, for evidentiary use")
+	encryptAtRest     = flag.Bool("encrypt-at-rest", false, "encrypt the bolt catalogs with their keys from the ECHOPRINT_KEY_<CATALOG> environment variables")
+	encryptionKeyCmd  = flag.String("encryption-key-command", "", "with -encrypt-at-rest, run this command with the catalog name to print its base64 key (e.g. a KMS hook)")
+	watchLocation     = flag.String("watch", "", "ingest codegen json files dropped into this directory or s3:// or gs:// prefix, moving them to its done/ and error/ folders")
+	watchInterval     = flag.Duration("watch-interval", 10*time.Second, "how often -watch is checked for new files")
+	codeKeyFile       = flag.String("code-key-file", "", "hash codes with the key in this file before storing and matching them, for partner catalogs (requires -tags hashedcodes)")
+
+	codegenBinary  = flag.String("codegen", "echoprint-codegen", "path to the echoprint-codegen binary used by stream monitoring and audio uploads")
+	codegenTimeout = flag.Duration("codegen-timeout", 2*time.Minute, "kill echoprint-codegen runs that take longer than this")
+	uploadMaxBytes = flag.Int64("upload-max-bytes", 20*1024*1024, "largest audio upload accepted by /query/upload")
+	monitorHosts   = flag.String("monitor-hosts", "", "comma separated hosts streams may be monitored from, internal addresses included (empty allows any public host)")
+	monitorCapture = flag.Duration("monitor-capture", 20*time.Second, "length of audio captured from monitored streams for each match")
+	monitorVector  = flag.Bool("monitor-vector-scoring", false, "score the candidates of monitored captures in batches with the vectorized backend (requires -tags vectorscore)")
+	detectionsDB   = flag.String("detections-db", "", "store stream monitoring detections in this bolt database")
+
+	profilesFile        = flag.String("profiles-file", "", "json array of matching profiles to add to or replace the built in ones, as listed by /admin/match-profiles")
+	catalogProfilesFlag = flag.String("catalog-profiles", "", "comma separated catalog=profile pairs selecting the default matching profile of a catalog")
+	virtualCatalogsFlag = flag.String("virtual-catalogs", "", "comma separated name=terms catalogs that are filtered views of the index, terms are ; separated upc:<prefix> or tag:<key>=<value> (e.g. universal=upc:0602;upc:00602)")
+	searchTiersFlag     = flag.String("search-tiers", "", "comma separated virtual catalogs searched in order until one has a best match, * being the whole index (e.g. frontline,*)")
+	catalogQuotas       = flag.String("catalog-quotas", "", "comma separated catalog=tracks:MB quotas (e.g. partner=100000:2048), either limit may be left empty")
+	catalogQuotaMode    = flag.String("catalog-quota-mode", "soft", "log ingests beyond a catalog's quota (soft) or reject them (hard)")
+
+	interactiveMaxBytes   = flag.Int64("interactive-max-bytes", 256*1024, "requests with larger bodies are scheduled as batch")
+	interactiveWorkers    = flag.Int("interactive-workers", 64, "number of interactive requests processed at once")
+	interactiveQueue      = flag.Int("interactive-queue", 256, "number of interactive requests allowed to wait for a worker")
+	batchWorkers          = flag.Int("batch-workers", 2, "number of batch requests processed at once")
+	batchQueue            = flag.Int("batch-queue", 16, "number of batch requests allowed to wait for a worker")
+	queueTimeout          = flag.Duration("queue-timeout", 30*time.Second, "maximum time a request waits for a worker before it is shed (0 waits forever)")
+	priorityRate          = flag.Float64("priority-rate", 0, "high priority (X-Priority: high) requests per second each API key may send, those beyond it run at normal priority (0 for unlimited)")
+	priorityBurst         = flag.Int("priority-burst", 10, "high priority requests an API key may send at once above -priority-rate")
+	priorityKeyRates      = flag.String("priority-key-rates", "", "comma separated key=rate overrides of -priority-rate for specific API keys (0 for unlimited)")
+	usageMaxKeys          = flag.Int("usage-max-keys", 100, "API keys accounted apart by /admin/usage and /metrics, later keys are accounted together as other")
+	usageMaxCatalogs      = flag.Int("usage-max-catalogs", 100, "catalogs without a profile, quota or virtual view accounted apart by /admin/usage and /metrics, later ones are accounted together as other")
+	retryAfter            = flag.Duration("retry-after", 5*time.Second, "Retry-After sent with shed requests")
+	batchMatchConcurrency = flag.Int("batch-match-concurrency", 4, "number of fingerprints of a batch request matched in parallel (0 for unlimited)")
+	groupByISRC           = flag.Bool("group-isrc", false, "group matches sharing an ISRC into a single result by default, queries may override it with group_isrc")
+	latencyBudget         = flag.Duration("latency-budget", 0, "default time budget for matching each fingerprint, returning partial results when exceeded (0 disables)")
+	earlyExitConfidence   = flag.Float64("early-exit-confidence", 0, "stop scoring candidates once a match reaches this confidence and dominates the rest (0 disables)")
+	earlyExitRatio        = flag.Float64("early-exit-ratio", 0.5, "remaining candidates are skipped when their screening scores are below this ratio of the dominant match's")
+	verifyBestSlop        = flag.Uint("verify-best-slop", 0, "re-score best matches against the full query with this tighter slop, demoting those that fall short (0 disables)")
+	verifyBestConfidence  = flag.Float64("verify-best-confidence", 0, "confidence best matches must keep when verified (0 uses the match threshold of the query's quality)")
+	adaptiveDepthPage     = flag.Int("adaptive-depth-page", 0, "fetch candidates in pages of this size until their screening scores fall off (0 uses the fixed search depth)")
+	adaptiveDepthKnee     = flag.Float64("adaptive-depth-knee", 0.5, "stop fetching pages once their best screening score falls below this ratio of the top candidate's")
+	negativeCacheTTL      = flag.Duration("negative-cache-ttl", 0, "cache queries that found no match for this long, ingests clear the cache (0 disables)")
+	negativeCacheSize     = flag.Int("negative-cache-size", 100000, "maximum number of queries held in the negative cache")
+	coalesceQueries       = flag.Bool("coalesce-queries", false, "match identical concurrent queries once, sharing the results between them")
+	maxBatchSize          = flag.Int("max-batch-size", 0, "maximum number of fingerprints in a single request (0 for unlimited)")
+
+	spillThreshold  = flag.Int("spill-threshold", 0, "spill the results of queries with more fingerprints than this to disk (0 disables)")
+	spillDir        = flag.String("spill-dir", "", "directory for spilled query results (defaults to the system temp dir)")
+	streamKeepalive = flag.Duration("stream-keepalive", 15*time.Second, "write whitespace to streamed query responses when no result was written for this long, so proxies don't time them out")
+
+	throttleMaxHeapMB     = flag.Uint64("throttle-max-heap-mb", 0, "throttle match and ingest parallelism when the heap exceeds this size (0 disables)")
+	throttleMaxGoroutines = flag.Int("throttle-max-goroutines", 0, "throttle match and ingest parallelism when the goroutine count exceeds this (0 disables)")
+
+	catalogEvents = flag.Int("catalog-events", 0, "stream catalog changes as server-sent events at /events, retaining the latest N for subscribers catching up after a reconnect (0 disables)")
+
+	corsOrigins = flag.String("cors-origins", "", "comma separated origins allowed to call the API from a browser (* for any)")
+
+	warm              = flag.Bool("warm", false, "load every stored fingerprint at startup before reporting ready")
+	warmWorkers       = flag.Int("warm-workers", 4, "number of shards loaded in parallel while warming")
+	serveWhileWarming = flag.Bool("serve-while-warming", false, "serve (degraded) queries before warming completes instead of 503")
+
+	backfillWorkers = flag.Int("backfill-workers", 4, "number of shards checked in parallel by the quality tier backfill")
+
+	secondaryBolt       = flag.String("secondary-bolt", "", "mirror ingests to a secondary backend with this bolt database, for migrations")
+	secondarySolrHost   = flag.String("secondary-solr-host", "localhost", "solr host of the secondary backend")
+	secondarySolrPort   = flag.Int("secondary-solr-port", 8983, "solr port of the secondary backend")
+	secondarySolrCore   = flag.String("secondary-solr-core", "echoprint", "solr core of the secondary backend")
+	secondarySampleRate = flag.Float64("secondary-sample-rate", 0, "fraction of queries to also run against the secondary backend, logging differences")
+
+	solrMaxIdleConns = flag.Int("solr-max-idle-conns", 64, "idle keep-alive connections kept open to solr, concurrent queries beyond it open new connections")
+
+	objectStoreEndpoint  = flag.String("object-store-endpoint", "", "S3 compatible endpoint for snapshots (defaults to AWS S3 for s3:// and GCS for gs:// URLs)")
+	objectStoreRegion    = flag.String("object-store-region", "", "region used to sign object store requests")
+	snapshotPartMB       = flag.Int("snapshot-part-mb", 16, "size of each part of multipart snapshot uploads")
+	snapshotBootstrapURL = flag.String("snapshot-bootstrap-url", "", "restore an empty index from this s3://, gs:// or https:// snapshot at startup")
+
+	auditFile = flag.String("audit-file", "", "append an audit record of every query to this file")
+	auditDB   = flag.String("audit-db", "", "store an audit record of every query in this bolt database")
+
+	confidenceStatsDays = flag.Int("confidence-stats-days", 0, "keep daily histograms of the confidences of accepted and rejected candidates for this many days, reported by /admin/confidences (0 disables)")
+	feedbackFile        = flag.String("feedback-file", "", "append the results clients label correct or incorrect at /feedback to this file, for tuning thresholds with echoprintctl tune (requires auditing)")
+	auditRetention      = flag.Duration("audit-retention", 0, "purge audit records older than this (0 keeps them forever)")
+	detectionsRetention = flag.Duration("detections-retention", 0, "purge stream monitoring detections older than this (0 keeps them forever)")
+	retentionInterval   = flag.Duration("retention-interval", time.Hour, "how often expired audit records and detections are purged")
+)
+
+// auditSink records every query for dispute resolution, nil when disabled
+var auditSink echoprint.AuditSink
+
+// thresholds are the server wide match thresholds, requests may override them
+var thresholds echoprint.Thresholds
+
+// earlyExit ends the scoring of obvious hits early, nil when disabled
+var earlyExit *echoprint.EarlyExit
+
+// verifyBest re-scores best matches before they are marked best, nil when disabled
+var verifyBest *echoprint.BestMatchVerification
+
+// adaptiveDepth fetches candidates in pages, nil when the fixed search depth is used
+var adaptiveDepth *echoprint.AdaptiveDepth
+
+// searchTiers are searched in order by queries outside of virtual catalogs, nil searches the
+// whole index at once
+var searchTiers []echoprint.Tier
+
+// catalogProfiles maps catalogs to their default matching profile
+var catalogProfiles = make(map[string]string)
+
+// ingestOptions controls how ingested fingerprints are stored
+var ingestOptions echoprint.IngestOptions
+
+// throttle reduces match and ingest parallelism under memory pressure, nil when disabled
+var throttle *echoprint.Throttle
+
+// experiment is the shadow experiment run alongside production queries, nil when disabled
+var experiment *echoprint.Experiment
+
 func main() {
 	flag.Parse()
 	defer glog.Flush()
 
+	thresholds = echoprint.Thresholds{
+		MinDBScoreHighQuality:   float32(*minDBScoreHigh),
+		MinDBScoreMediumQuality: float32(*minDBScoreMedium),
+		MinDBScoreLowQuality:    float32(*minDBScoreLow),
+	}
+
+	if *earlyExitConfidence > 0 {
+		earlyExit = &echoprint.EarlyExit{
+			MinConfidence:     float32(*earlyExitConfidence),
+			MaxScreeningRatio: float32(*earlyExitRatio),
+		}
+	}
+
+	if *verifyBestSlop > 0 {
+		verifyBest = &echoprint.BestMatchVerification{
+			Slop:          uint32(*verifyBestSlop),
+			MinConfidence: float32(*verifyBestConfidence),
+		}
+	}
+
+	if *adaptiveDepthPage > 0 {
+		adaptiveDepth = &echoprint.AdaptiveDepth{
+			PageSize:  *adaptiveDepthPage,
+			KneeRatio: float32(*adaptiveDepthKnee),
+		}
+	}
+
+	if *profilesFile != "" {
+		f, err := os.Open(*profilesFile)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		if err := echoprint.LoadProfiles(f); err != nil {
+			glog.Fatalf("Loading %s failed: %s", *profilesFile, err)
+		}
+		f.Close()
+	}
+
+	for _, pair := range strings.Split(*catalogProfilesFlag, ",") {
+		if kv := strings.SplitN(pair, "=", 2); len(kv) == 2 {
+			if _, ok := echoprint.LookupProfile(kv[1]); !ok {
+				glog.Fatalf("Unknown profile '%s' for catalog '%s'", kv[1], kv[0])
+			}
+			catalogProfiles[kv[0]] = kv[1]
+		}
+	}
+
+	if *virtualCatalogsFlag != "" {
+		var err error
+		if virtualCatalogs, err = parseVirtualCatalogs(*virtualCatalogsFlag); err != nil {
+			glog.Fatal(err)
+		}
+	}
+	if *searchTiersFlag != "" {
+		var err error
+		if searchTiers, err = parseSearchTiers(*searchTiersFlag); err != nil {
+			glog.Fatal(err)
+		}
+	}
+
+	if *catalogQuotas != "" {
+		if *catalogQuotaMode != "soft" && *catalogQuotaMode != "hard" {
+			glog.Fatalf("Unknown -catalog-quota-mode '%s'", *catalogQuotaMode)
+		}
+		var err error
+		if quotas, err = parseQuotas(*catalogQuotas, *catalogQuotaMode == "hard"); err != nil {
+			glog.Fatal(err)
+		}
+	}
+
+	collisions, err := parseCollisionPolicy(*ingestCollisions)
+	if err != nil {
+		glog.Fatal(err)
+	}
+
+	if *throttleMaxHeapMB > 0 || *throttleMaxGoroutines > 0 {
+		throttle = &echoprint.Throttle{
+			MaxHeapBytes:  *throttleMaxHeapMB * 1024 * 1024,
+			MaxGoroutines: *throttleMaxGoroutines,
+		}
+		throttle.Start()
+		expvar.Publish("throttle", expvar.Func(func() interface{} { return throttle.Stats() }))
+	}
+
+	ingestOptions = echoprint.IngestOptions{
+		FullMinutes:      *ingestFullMinutes,
+		SampleEvery:      *ingestSampleEvery,
+		SparseMinutes:    *sparseMinutes,
+		SparseEvery:      *sparseEvery,
+		Variants:         *ingestVariants,
+		AllocateTrackIDs: *allocateTrackIDs,
+		Collisions:       collisions,
+		Throttle:         throttle,
+	}
+	switch *selfMatch {
+	case "off":
+	case "flag", "reject":
+		ingestOptions.SelfMatch = &echoprint.SelfMatch{MinConfidence: float32(*selfMatchMin), Reject: *selfMatch == "reject"}
+	default:
+		glog.Fatalf("Unknown -ingest-self-match mode '%s'", *selfMatch)
+	}
+
+	if *shadowSampleRate > 0 && *secondarySampleRate > 0 {
+		glog.Fatal("The shadow experiment and secondary backend sampling can't run at the same time")
+	}
+
+	if *shadowSampleRate > 0 {
+		minConfidence := float32(*shadowMinConfidence)
+		experiment = &echoprint.Experiment{
+			Name:          "shadow",
+			SampleRate:    *shadowSampleRate,
+			MaxConcurrent: *shadowConcurrency,
+			Options: echoprint.MatchOptions{
+				Scorer: echoprint.HistogramScorer{Slop: uint32(*shadowSlop)},
+				Thresholds: echoprint.Thresholds{
+					MinConfidenceHighQuality:   minConfidence,
+					MinConfidenceMediumQuality: minConfidence,
+					MinConfidenceLowQuality:    minConfidence,
+				},
+			},
+		}
+		glog.Infof("Running shadow experiment on %.1f%% of queries", *shadowSampleRate*100)
+	}
+
+	switch {
+	case *auditDB != "":
+		var err error
+		if auditSink, err = echoprint.NewBoltAuditSink(*auditDB); err != nil {
+			glog.Fatal(err)
+		}
+	case *auditFile != "":
+		auditSink = echoprint.NewFileAuditSink(*auditFile)
+	}
+
+	if *detectionsDB != "" {
+		var err error
+		if detectionStore, err = echoprint.NewDetectionStore(*detectionsDB); err != nil {
+			glog.Fatal(err)
+		}
+		defer detectionStore.Close()
+	}
+
+	if *auditRetention > 0 || *detectionsRetention > 0 {
+		go enforceRetention(*retentionInterval)
+	}
+
+	qosPools = map[string]*qosPool{
+		qosInteractive: newQosPool(*interactiveWorkers, *interactiveQueue, *queueTimeout),
+		qosBatch:       newQosPool(*batchWorkers, *batchQueue, *queueTimeout),
+	}
+	usage = newUsageTracker(*usageMaxKeys, *usageMaxCatalogs)
+	if *priorityRate > 0 || *priorityKeyRates != "" {
+		var err error
+		if priorityLimits, err = newPriorityLimiter(*priorityRate, *priorityBurst, *priorityKeyRates); err != nil {
+			glog.Fatal(err)
+		}
+	}
+
+	echoprint.CodegenBinary = *codegenBinary
+	echoprint.CodegenTimeout = *codegenTimeout
+	monitorOpts := echoprint.MatchOptions{Thresholds: thresholds}
+	if *monitorVector {
+		scorer, err := echoprint.NewVectorScorer(echoprint.HistogramScorer{Slop: 2, Partial: true})
+		if err != nil {
+			glog.Fatal(err)
+		}
+		monitorOpts.Scorer = scorer
+	}
+	monitor = echoprint.NewMonitor(*monitorCapture, monitorOpts, onDetection)
+	if *monitorHosts != "" {
+		monitor.AllowedHosts = strings.Split(*monitorHosts, ",")
+	}
+
 	router := mux.NewRouter()
 	router.HandleFunc("/", indexHandler).Methods("GET")
 	router.HandleFunc("/debug", debugHandler).Methods("GET", "POST")
-	router.HandleFunc("/query", queryHandler).Methods("GET", "POST")
-	router.HandleFunc("/ingest", ingestHandler).Methods("POST")
+	router.Handle("/console", http.RedirectHandler("/console/", http.StatusMovedPermanently)).Methods("GET")
+	router.PathPrefix("/console/").Handler(consoleHandler()).Methods("GET")
+	router.HandleFunc("/query", accountUsage(usageQuery, whenReady(scheduleQoS(queryHandler)))).Methods("GET", "POST")
+	router.HandleFunc("/ingest", accountUsage(usageIngest, whenReady(scheduleQoS(ingestHandler)))).Methods("POST")
+	router.HandleFunc("/query/upload", accountUsage(usageQuery, whenReady(scheduleQoS(uploadQueryHandler)))).Methods("POST")
+	router.HandleFunc("/echoprint/query", accountUsage(usageQuery, whenReady(scheduleQoS(legacyQueryHandler)))).Methods("GET", "POST")
+	router.HandleFunc("/cuesheet", accountUsage(usageQuery, whenReady(scheduleQoS(cueSheetHandler)))).Methods("POST")
+	router.HandleFunc("/verify", accountUsage(usageQuery, whenReady(scheduleQoS(verifyHandler)))).Methods("POST")
+	router.HandleFunc("/diff", accountUsage(usageQuery, scheduleQoS(diffHandler))).Methods("POST")
 
 	router.HandleFunc("/stats", statsHandler).Methods("GET")
 	router.HandleFunc("/purge", purgeHandler).Methods("GET")
 
-	loggingHandler := NewLoggingHandler(router)
-	serverAddr := fmt.Sprintf(":%d", 8080)
+	router.HandleFunc("/metrics", metricsHandler).Methods("GET")
+	router.Handle("/debug/vars", expvar.Handler()).Methods("GET")
+	router.HandleFunc("/readyz", readyzHandler).Methods("GET")
+	router.HandleFunc("/signing-key", signingKeyHandler).Methods("GET")
+
+	router.HandleFunc("/monitor/streams", streamsHandler).Methods("GET")
+	router.HandleFunc("/monitor/streams", addStreamHandler).Methods("POST")
+	router.HandleFunc("/monitor/streams/{id}", removeStreamHandler).Methods("DELETE")
+	router.HandleFunc("/reports/detections", detectionsReportHandler).Methods("GET")
+	router.HandleFunc("/reports/plays", playsReportHandler).Methods("GET")
+
+	router.HandleFunc("/admin/queries/{id}", auditHandler).Methods("GET")
+	router.HandleFunc("/admin/queries/{id}/replay", replayHandler).Methods("POST")
+	router.HandleFunc("/admin/usage", usageHandler).Methods("GET")
+	router.HandleFunc("/events", eventsHandler).Methods("GET")
+	router.HandleFunc("/feedback", feedbackHandler).Methods("POST")
+	router.HandleFunc("/admin/quotas", quotasHandler).Methods("GET")
+	router.HandleFunc("/admin/catalogs", catalogsHandler).Methods("GET")
+	router.HandleFunc("/admin/tracks", tracksHandler).Methods("GET")
+	router.HandleFunc("/admin/tracks/{id}", trackHandler).Methods("GET")
+	router.HandleFunc("/admin/latencies", latenciesHandler).Methods("GET")
+	router.HandleFunc("/admin/confidences", confidencesReportHandler).Methods("GET")
+	router.HandleFunc("/admin/purge", purgeRecordsHandler).Methods("POST")
+	router.HandleFunc("/admin/profile", profileHandler).Methods("GET")
+	router.HandleFunc("/admin/match-profiles", matchProfilesHandler).Methods("GET")
+	router.HandleFunc("/admin/match-profiles", importMatchProfilesHandler).Methods("POST")
+	router.HandleFunc("/admin/match-profiles/{name}", matchProfileHandler).Methods("GET")
+	router.HandleFunc("/admin/match-profiles/{name}", setMatchProfileHandler).Methods("PUT")
+	router.HandleFunc("/admin/backfill/quality", startQualityBackfillHandler).Methods("POST")
+	router.HandleFunc("/admin/backfill/quality", qualityBackfillHandler).Methods("GET")
+	router.HandleFunc("/admin/health", startHealthScanHandler).Methods("POST")
+	router.HandleFunc("/admin/health", healthScanHandler).Methods("GET")
+	router.HandleFunc("/admin/stop-codes", learnStopCodesHandler).Methods("POST")
+	router.HandleFunc("/admin/snapshots", createSnapshotHandler).Methods("POST")
+	router.HandleFunc("/admin/snapshots/delta", deltaHandler).Methods("GET")
+	router.HandleFunc("/admin/snapshots/restore", restoreSnapshotHandler).Methods("POST")
+
+	var handler http.Handler = router
+	if *corsOrigins != "" {
+		handler = NewCORSHandler(router, strings.Split(*corsOrigins, ","))
+	}
+
+	loggingHandler := NewLoggingHandler(handler)
 	server := &http.Server{
-		Addr:    serverAddr,
-		Handler: loggingHandler,
+		Handler:           loggingHandler,
+		ReadHeaderTimeout: *readHeaderTimeout,
+		ReadTimeout:       *readTimeout,
+		WriteTimeout:      *writeTimeout,
+		IdleTimeout:       *idleTimeout,
+		MaxHeaderBytes:    *maxHeaderBytes,
+		HTTP2:             &http.HTTP2Config{MaxConcurrentStreams: *http2MaxStreams},
+	}
+	server.SetKeepAlivesEnabled(*keepAlives)
+	if *h2c {
+		server.Protocols = new(http.Protocols)
+		server.Protocols.SetHTTP1(true)
+		server.Protocols.SetUnencryptedHTTP2(true)
 	}
 
+	echoprint.SetSolrMaxIdleConns(*solrMaxIdleConns)
+
 	if err := echoprint.DBConnect(); err != nil {
 		glog.Fatal(err)
 	}
 	defer echoprint.DBDisconnect()
 
+	var catalogKeys echoprint.KeyProvider
+	if *encryptAtRest {
+		catalogKeys = echoprint.EnvKeyProvider
+		if *encryptionKeyCmd != "" {
+			catalogKeys = echoprint.CommandKeyProvider(*encryptionKeyCmd)
+		}
+		if err := echoprint.EnableEncryption(catalogKeys); err != nil {
+			glog.Fatal(err)
+		}
+	}
+
+	if *signingKeyFile != "" {
+		var err error
+		if signingKey, err = loadSigningKey(*signingKeyFile); err != nil {
+			glog.Fatal(err)
+		}
+		glog.Infof("Signing query results with key %s", echoprint.EvidenceKeyID(signingKey.Public().(ed25519.PublicKey)))
+	}
+
+	var codeHasher echoprint.CodeHasher
+	if *codeKeyFile != "" {
+		key, err := ioutil.ReadFile(*codeKeyFile)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		if codeHasher, err = echoprint.NewCodeHasher(bytes.TrimSpace(key)); err != nil {
+			glog.Fatal(err)
+		}
+		echoprint.EnableCodeHashing(codeHasher)
+		glog.Info("Hashing codes with the catalog key")
+	}
+
+	if *secondaryBolt != "" {
+		secondary, err := echoprint.NewDBStore(*secondaryBolt, *secondarySolrHost, *secondarySolrPort, *secondarySolrCore)
+		if err != nil {
+			glog.Fatal(err)
+		}
+		if catalogKeys != nil {
+			if err := echoprint.EnableStoreEncryption(secondary, catalogKeys); err != nil {
+				glog.Fatal(err)
+			}
+		}
+		echoprint.EnableDualWrite(secondary)
+		glog.Infof("Mirroring ingests to the secondary backend [%s]", *secondaryBolt)
+
+		if *secondarySampleRate > 0 {
+			experiment = &echoprint.Experiment{
+				Name:          "secondary",
+				SampleRate:    *secondarySampleRate,
+				MaxConcurrent: *shadowConcurrency,
+				Options:       echoprint.MatchOptions{Thresholds: thresholds},
+				Matcher:       echoprint.New(echoprint.WithStore(secondary), echoprint.WithCodeHasher(codeHasher)),
+			}
+			glog.Infof("Running %.1f%% of queries against the secondary backend", *secondarySampleRate*100)
+		}
+	}
+
+	if *negativeCacheTTL > 0 {
+		echoprint.EnableNegativeCache(*negativeCacheTTL, *negativeCacheSize)
+	}
+	if *feedbackFile != "" {
+		feedbackLog = echoprint.NewFeedbackLog(*feedbackFile)
+	}
+	if *confidenceStatsDays > 0 {
+		echoprint.EnableConfidenceStats(*confidenceStatsDays)
+	}
+	if *catalogEvents > 0 {
+		echoprint.EnableEvents(*catalogEvents)
+	}
+	if *coalesceQueries {
+		echoprint.EnableCoalescing()
+	}
+
+	objectStore = newObjectStore()
+	if *snapshotBootstrapURL != "" {
+		if _, err := echoprint.BootstrapSnapshot(objectStore, *snapshotBootstrapURL); err != nil {
+			glog.Fatal(err)
+		}
+	}
+
+	if *postingCap > 0 {
+		limit := echoprint.PostingCap{MaxPostings: *postingCap}
+		switch *postingOverflow {
+		case "truncate":
+			limit.Overflow = echoprint.OverflowTruncate
+		case "sample":
+			limit.Overflow = echoprint.OverflowSample
+		case "stop":
+			limit.Overflow = echoprint.OverflowStopCode
+		default:
+			glog.Fatalf("Unknown -posting-overflow '%s'", *postingOverflow)
+		}
+		echoprint.EnablePostingCap(limit)
+	}
+	if *stopCodes > 0 {
+		echoprint.EnableStopCodes(*stopCodes)
+		go learnStopCodes(*stopCodesInterval)
+	}
+	if *postingCap > 0 || *stopCodes > 0 {
+		if err := echoprint.CountPostings(); err != nil {
+			glog.Fatal(err)
+		}
+	}
+
+	if quotas != nil {
+		if err := quotas.count(); err != nil {
+			glog.Fatal(err)
+		}
+	}
+
+	if *watchLocation != "" {
+		go watch(*watchLocation, *watchInterval)
+	}
+
+	if *warm {
+		warmer = &echoprint.Warmer{Workers: *warmWorkers}
+		go func() {
+			if err := warmer.Run(); err != nil {
+				glog.Fatal(err)
+			}
+		}()
+	}
+
 	// TODO: gracefully stop http server (github.com/tylerb/graceful etc)
-	glog.Infof("Starting server [%s]", serverAddr)
-	if err := server.ListenAndServe(); err != nil {
+	listener, err := listen(*listenAddr)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	glog.Infof("Starting server [%s]", listener.Addr())
+	if err := server.Serve(listener); err != nil {
 		glog.Fatal(err)
 	}
 }
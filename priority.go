@@ -0,0 +1,162 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// priorities order the requests waiting for a worker of a QoS pool
+const (
+	priorityLow = iota
+	priorityNormal
+	priorityHigh
+	numPriorities
+)
+
+const (
+	// priorityBucketSweep is how often the buckets of idle API keys are evicted
+	priorityBucketSweep = time.Minute
+	// maxPriorityBuckets bounds the API keys rate limited at once, clients choose their keys
+	// so new keys beyond it run at normal priority until buckets are evicted
+	maxPriorityBuckets = 10000
+)
+
+var errInvalidPriorityRate = errors.New("Invalid priority rate, expected key=requests per second")
+
+// priorityNames are the values of the X-Priority header
+var priorityNames = map[string]int{
+	"low":    priorityLow,
+	"normal": priorityNormal,
+	"high":   priorityHigh,
+}
+
+// priorityDowngrades counts the high priority requests run at normal priority because their
+// API key exceeded its rate
+var priorityDowngrades int64
+
+// priorityLimits holds the high priority rate of each API key, nil when unlimited
+var priorityLimits *priorityLimiter
+
+// requestPriority is the priority asked for with the X-Priority header (or priority param),
+// normal by default. High priority is granted up to the rate allowed to the request's API key,
+// beyond it the request runs at normal priority
+func requestPriority(r *http.Request) int {
+	name := r.Header.Get("X-Priority")
+	if name == "" {
+		name = r.URL.Query().Get("priority")
+	}
+
+	priority, ok := priorityNames[strings.ToLower(name)]
+	if !ok {
+		return priorityNormal
+	}
+	if priority == priorityHigh && !priorityLimits.allow(requestUsageKey(r).APIKey) {
+		atomic.AddInt64(&priorityDowngrades, 1)
+		glog.V(2).Infof("[%s] High priority rate exceeded, running at normal priority", requestID(r))
+		return priorityNormal
+	}
+	return priority
+}
+
+// priorityLimiter is a token bucket per API key refilled at the key's rate
+type priorityLimiter struct {
+	rate  float64
+	rates map[string]float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*priorityBucket
+	swept   time.Time
+}
+
+type priorityBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// newPriorityLimiter allows each API key rate high priority requests per second, with bursts
+// of up to burst requests. keyRates are comma separated key=rate overrides, 0 being unlimited
+func newPriorityLimiter(rate float64, burst int, keyRates string) (*priorityLimiter, error) {
+	l := &priorityLimiter{rate: rate, rates: make(map[string]float64), burst: float64(burst), buckets: make(map[string]*priorityBucket)}
+	if l.burst < 1 {
+		l.burst = 1
+	}
+
+	for _, pair := range strings.Split(keyRates, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(pair, "=")
+		keyRate, err := strconv.ParseFloat(value, 64)
+		if !ok || err != nil || keyRate < 0 {
+			return nil, errInvalidPriorityRate
+		}
+		l.rates[key] = keyRate
+	}
+
+	return l, nil
+}
+
+// allow takes a token from the key's bucket, false when it is empty
+func (l *priorityLimiter) allow(key string) bool {
+	if l == nil {
+		return true
+	}
+
+	rate, ok := l.rates[key]
+	if !ok {
+		rate = l.rate
+	}
+	if rate <= 0 {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.swept) >= priorityBucketSweep {
+		l.sweep(now)
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxPriorityBuckets {
+			return false
+		}
+		b = &priorityBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// sweep evicts the buckets that refilled, a new bucket starts full so they are forgotten
+// without changing what their keys are allowed. l.mu must be held
+func (l *priorityLimiter) sweep(now time.Time) {
+	l.swept = now
+	for key, b := range l.buckets {
+		rate, ok := l.rates[key]
+		if !ok {
+			rate = l.rate
+		}
+		if b.tokens+now.Sub(b.last).Seconds()*rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
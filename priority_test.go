@@ -0,0 +1,48 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestPriorityLimiterBuckets evicts the buckets of idle API keys and bounds those tracked, so
+// clients sending random keys can't grow them without limit
+func TestPriorityLimiterBuckets(t *testing.T) {
+	l, err := newPriorityLimiter(1, 2, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < maxPriorityBuckets; i++ {
+		if !l.allow(strconv.Itoa(i)) {
+			t.Fatalf("first request of key %d downgraded", i)
+		}
+	}
+	if l.allow("new") {
+		t.Error("key beyond the bucket bound allowed high priority")
+	}
+
+	// a second later every bucket refilled
+	l.mu.Lock()
+	l.sweep(time.Now().Add(time.Second))
+	evicted := len(l.buckets) == 0
+	l.mu.Unlock()
+	if !evicted {
+		t.Fatal("refilled buckets not evicted")
+	}
+	if !l.allow("new") {
+		t.Error("new key downgraded once buckets were evicted")
+	}
+
+	// buckets still refilling are kept
+	l.allow("busy")
+	l.allow("busy")
+	l.mu.Lock()
+	l.sweep(time.Now())
+	_, kept := l.buckets["busy"]
+	l.mu.Unlock()
+	if !kept {
+		t.Error("empty bucket evicted")
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AudioAddict/go-echoprint/echoprint"
+)
+
+const (
+	qosInteractive = "interactive"
+	qosBatch       = "batch"
+)
+
+var errServerBusy = errors.New("Server is too busy, try again later")
+
+var errBatchTooLarge = errors.New("Too many fingerprints in a single request")
+
+// qosPool bounds the number of requests of a QoS class being processed at once, and the
+// number allowed to wait for a worker before new ones are rejected. Waiting requests get a
+// worker in order of priority, then arrival
+type qosPool struct {
+	mu      sync.Mutex
+	workers int
+	active  int
+	queues  [numPriorities][]*qosWaiter
+	waiting int
+
+	maxQueue int
+	maxWait  time.Duration
+
+	// shed counts the requests rejected because the pool was saturated
+	shed int64
+}
+
+// qosWaiter is a request waiting for a worker, ready is closed once granted or displaced
+type qosWaiter struct {
+	ready   chan struct{}
+	granted bool
+}
+
+func newQosPool(workers, queue int, maxWait time.Duration) *qosPool {
+	return &qosPool{workers: workers, maxQueue: queue, maxWait: maxWait}
+}
+
+// acquire blocks until a worker is free, false when the queue is full or the request
+// waited longer than maxWait. A full queue makes room for a request by displacing the latest
+// request of a lower priority
+func (p *qosPool) acquire(priority int) bool {
+	p.mu.Lock()
+	if p.active < p.workers {
+		p.active++
+		p.mu.Unlock()
+		return true
+	}
+	if p.waiting >= p.maxQueue && !p.displace(priority) {
+		p.mu.Unlock()
+		atomic.AddInt64(&p.shed, 1)
+		return false
+	}
+	w := &qosWaiter{ready: make(chan struct{})}
+	p.queues[priority] = append(p.queues[priority], w)
+	p.waiting++
+	p.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if p.maxWait > 0 {
+		timer := time.NewTimer(p.maxWait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case <-w.ready:
+	case <-timeout:
+		p.mu.Lock()
+		select {
+		case <-w.ready:
+			// granted or displaced while the timer fired
+		default:
+			p.remove(priority, w)
+		}
+		p.mu.Unlock()
+	}
+
+	if !w.granted {
+		atomic.AddInt64(&p.shed, 1)
+	}
+	return w.granted
+}
+
+// displace sheds the latest waiting request of a lower priority, must be called with the lock
+// held
+func (p *qosPool) displace(priority int) bool {
+	for lower := 0; lower < priority; lower++ {
+		if n := len(p.queues[lower]); n > 0 {
+			w := p.queues[lower][n-1]
+			p.queues[lower] = p.queues[lower][:n-1]
+			p.waiting--
+			close(w.ready)
+			return true
+		}
+	}
+	return false
+}
+
+// remove takes a waiter that gave up out of its queue, must be called with the lock held
+func (p *qosPool) remove(priority int, w *qosWaiter) {
+	queue := p.queues[priority]
+	for i := range queue {
+		if queue[i] == w {
+			p.queues[priority] = append(queue[:i], queue[i+1:]...)
+			p.waiting--
+			return
+		}
+	}
+}
+
+// release hands the worker to the first waiting request of the highest priority
+func (p *qosPool) release() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for priority := numPriorities - 1; priority >= 0; priority-- {
+		if queue := p.queues[priority]; len(queue) > 0 {
+			w := queue[0]
+			p.queues[priority] = queue[1:]
+			p.waiting--
+			w.granted = true
+			close(w.ready)
+			return
+		}
+	}
+	p.active--
+}
+
+// qosPools holds a pool per class so batch jobs can't delay interactive identification
+var qosPools map[string]*qosPool
+
+// qosClass classifies a request as interactive or batch, clients may ask for a class with the
+// X-QoS-Class header (or qos param), otherwise large payloads are treated as batch
+func qosClass(r *http.Request) string {
+	class := r.Header.Get("X-QoS-Class")
+	if class == "" {
+		class = r.URL.Query().Get("qos")
+	}
+
+	switch {
+	case class == qosBatch:
+		return qosBatch
+	case class == qosInteractive && r.ContentLength <= *interactiveMaxBytes:
+		return qosInteractive
+	case r.ContentLength < 0 || r.ContentLength > *interactiveMaxBytes:
+		return qosBatch
+	}
+	return qosInteractive
+}
+
+// scheduleQoS wraps a handler to run it on the worker pool of the request's QoS class
+func scheduleQoS(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pool := qosPools[qosClass(r)]
+		if pool == nil {
+			handler(w, r)
+			return
+		}
+
+		if !pool.acquire(requestPriority(r)) {
+			shedLoad(w)
+			return
+		}
+		defer pool.release()
+
+		handler(w, r)
+	}
+}
+
+// shedLoad rejects a request the server has no capacity for, asking the client to retry later
+func shedLoad(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())))
+	apiError(w, errServerBusy)
+}
+
+// checkBatchSize enforces the maximum number of fingerprints per request
+func checkBatchSize(codegenList []*echoprint.CodegenFp) error {
+	if *maxBatchSize > 0 && len(codegenList) > *maxBatchSize {
+		return errBatchTooLarge
+	}
+	return nil
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/AudioAddict/go-echoprint/echoprint"
+	"github.com/golang/glog"
+)
+
+const (
+	// catalogTag is the tag ingests are labelled with so catalog usage survives restarts,
+	// untagged tracks belong to the default catalog
+	catalogTag = "catalog"
+
+	// bytesPerCode is the storage taken by a code and its time, both stored as uint32
+	bytesPerCode = 8
+)
+
+// catalogQuota limits the size of a catalog, 0 leaves a dimension unlimited
+type catalogQuota struct {
+	MaxTracks int64
+	MaxBytes  int64
+}
+
+type quotaUsage struct {
+	Catalog   string `json:"catalog"`
+	Tracks    int64  `json:"tracks"`
+	Bytes     int64  `json:"bytes"`
+	MaxTracks int64  `json:"max_tracks,omitempty"`
+	MaxBytes  int64  `json:"max_bytes,omitempty"`
+	// Utilization is the highest ratio of a quota used, above 1 once over quota
+	Utilization float64 `json:"utilization"`
+}
+
+// quotaTracker keeps the size of every catalog against its quota, over quota ingests are
+// logged (soft) or rejected (hard)
+type quotaTracker struct {
+	hard   bool
+	quotas map[string]catalogQuota
+
+	mu    sync.Mutex
+	usage map[string]*quotaUsage
+}
+
+// quotas tracks the catalog quotas of -catalog-quotas, nil when disabled
+var quotas *quotaTracker
+
+// parseQuotas parses comma separated catalog=tracks:MB quotas, e.g. partner=100000:2048 or
+// partner=:2048 to only limit the storage
+func parseQuotas(spec string, hard bool) (*quotaTracker, error) {
+	q := &quotaTracker{hard: hard, quotas: make(map[string]catalogQuota), usage: make(map[string]*quotaUsage)}
+	for _, pair := range strings.Split(spec, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		limits := strings.SplitN(kv[1], ":", 2)
+
+		var quota catalogQuota
+		var err error
+		if limits[0] != "" {
+			if quota.MaxTracks, err = strconv.ParseInt(limits[0], 10, 64); err != nil {
+				return nil, fmt.Errorf("Invalid track quota for catalog '%s': %s", kv[0], err)
+			}
+		}
+		if len(limits) == 2 && limits[1] != "" {
+			var mb int64
+			if mb, err = strconv.ParseInt(limits[1], 10, 64); err != nil {
+				return nil, fmt.Errorf("Invalid storage quota for catalog '%s': %s", kv[0], err)
+			}
+			quota.MaxBytes = mb * 1024 * 1024
+		}
+		q.quotas[kv[0]] = quota
+	}
+
+	return q, nil
+}
+
+// count sizes the catalogs from the tracks stored under their tags
+func (q *quotaTracker) count() error {
+	counts, err := echoprint.CountTags(catalogTag)
+	if err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.usage = make(map[string]*quotaUsage)
+	for catalog, count := range counts {
+		if catalog == "" {
+			catalog = defaultCatalog
+		}
+		u := q.usageOf(catalog)
+		u.Tracks += int64(count.Tracks)
+		u.Bytes += int64(count.Codes) * bytesPerCode
+	}
+	for _, u := range q.usage {
+		if q.overQuota(u) {
+			glog.Warningf("Catalog '%s' is over its quota: %d tracks, %d bytes", u.Catalog, u.Tracks, u.Bytes)
+		}
+	}
+
+	return nil
+}
+
+// usageOf returns the usage of a catalog, q.mu must be held
+func (q *quotaTracker) usageOf(catalog string) *quotaUsage {
+	u, ok := q.usage[catalog]
+	if !ok {
+		u = &quotaUsage{Catalog: catalog}
+		q.usage[catalog] = u
+	}
+	return u
+}
+
+// quotaReservation is the usage admit reserves for an ingest until add accounts for it
+type quotaReservation struct {
+	tracks int64
+	bytes  int64
+}
+
+// admit checks an ingest of tracks more tracks and codes more codes into the catalog and
+// reserves them, rejecting it when the quota is hard and the catalog would be over quota.
+// Concurrent ingests can't both fit in the same remaining quota, add releases the reservation
+// once the ingest is done
+func (q *quotaTracker) admit(catalog string, tracks, codes int) (reserved quotaReservation, err error) {
+	if !q.hard {
+		return reserved, nil
+	}
+	quota, ok := q.quotas[catalog]
+	if !ok {
+		return reserved, nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	u := q.usageOf(catalog)
+	reserved = quotaReservation{tracks: int64(tracks), bytes: int64(codes) * bytesPerCode}
+	if quota.MaxTracks > 0 && u.Tracks+reserved.tracks > quota.MaxTracks || quota.MaxBytes > 0 && u.Bytes+reserved.bytes > quota.MaxBytes {
+		return quotaReservation{}, &requestError{
+			status:  http.StatusForbidden,
+			code:    "quota_exceeded",
+			message: fmt.Sprintf("Ingesting %d tracks would exceed the quota of catalog '%s'", tracks, catalog),
+			details: q.withQuota(*u),
+		}
+	}
+	u.Tracks += reserved.tracks
+	u.Bytes += reserved.bytes
+
+	return reserved, nil
+}
+
+// add releases the usage reserved by admit and accounts for the fingerprints stored by an
+// ingest into the catalog
+func (q *quotaTracker) add(catalog string, reserved quotaReservation, results []echoprint.IngestResult) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	u := q.usageOf(catalog)
+	u.Tracks -= reserved.tracks
+	u.Bytes -= reserved.bytes
+	wasOver := q.overQuota(u)
+	for _, result := range results {
+		if result.Error != nil || result.DryRun {
+			continue
+		}
+		// variants add storage to an existing track
+		if result.Variant == 0 {
+			u.Tracks++
+		}
+		u.Bytes += int64(result.Codes) * bytesPerCode
+	}
+
+	if !wasOver && q.overQuota(u) {
+		glog.Warningf("Catalog '%s' went over its quota: %d tracks, %d bytes", catalog, u.Tracks, u.Bytes)
+	}
+}
+
+// overQuota reports whether the catalog uses more than its quota, q.mu must be held
+func (q *quotaTracker) overQuota(u *quotaUsage) bool {
+	return q.withQuota(*u).Utilization > 1
+}
+
+// withQuota fills in the quota and utilization of a catalog's usage
+func (q *quotaTracker) withQuota(u quotaUsage) quotaUsage {
+	quota := q.quotas[u.Catalog]
+	u.MaxTracks = quota.MaxTracks
+	u.MaxBytes = quota.MaxBytes
+	u.Utilization = 0
+	if quota.MaxTracks > 0 {
+		u.Utilization = float64(u.Tracks) / float64(quota.MaxTracks)
+	}
+	if quota.MaxBytes > 0 && float64(u.Bytes)/float64(quota.MaxBytes) > u.Utilization {
+		u.Utilization = float64(u.Bytes) / float64(quota.MaxBytes)
+	}
+	return u
+}
+
+// snapshot returns the usage of every catalog with a quota or tracks, sorted by catalog
+func (q *quotaTracker) snapshot() []quotaUsage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for catalog := range q.quotas {
+		q.usageOf(catalog)
+	}
+	list := make([]quotaUsage, 0, len(q.usage))
+	for _, u := range q.usage {
+		list = append(list, q.withQuota(*u))
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Catalog < list[j].Catalog })
+	return list
+}
+
+// tagCatalog labels the fingerprints ingested into a catalog other than the default
+func tagCatalog(codegenList []*echoprint.CodegenFp, catalog string) {
+	if catalog == defaultCatalog {
+		return
+	}
+	for _, codegenFp := range codegenList {
+		if codegenFp.Meta.Tags == nil {
+			codegenFp.Meta.Tags = make(map[string]string)
+		}
+		if _, ok := codegenFp.Meta.Tags[catalogTag]; !ok {
+			codegenFp.Meta.Tags[catalogTag] = catalog
+		}
+	}
+}
+
+func quotasHandler(w http.ResponseWriter, r *http.Request) {
+	if quotas == nil {
+		renderResponse(w, []quotaUsage{})
+		return
+	}
+
+	renderResponse(w, quotas.snapshot())
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/AudioAddict/go-echoprint/echoprint"
+)
+
+// TestQuotaReservation admits concurrent ingests into the last of a hard quota, only one of
+// them may fit. Its reservation is released once it is done, stored or not
+func TestQuotaReservation(t *testing.T) {
+	q, err := parseQuotas("partner=1:", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	reserved := make([]quotaReservation, 8)
+	errs := make([]error, len(reserved))
+	for i := range reserved {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			reserved[i], errs[i] = q.admit("partner", 1, 0)
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	admitted := -1
+	for i, err := range errs {
+		if err == nil && admitted >= 0 {
+			t.Fatalf("ingests %d and %d both admitted into a quota of 1 track", admitted, i)
+		} else if err == nil {
+			admitted = i
+		}
+	}
+	if admitted < 0 {
+		t.Fatal("no ingest admitted into an empty catalog")
+	}
+
+	// a failed ingest gives its reservation back
+	q.add("partner", reserved[admitted], []echoprint.IngestResult{{Error: "failed"}})
+	n, err := q.admit("partner", 1, 0)
+	if err != nil {
+		t.Fatalf("reservation of a failed ingest not released: %s", err)
+	}
+
+	// a stored track keeps the quota used
+	q.add("partner", n, []echoprint.IngestResult{{Codes: 100}})
+	if _, err := q.admit("partner", 1, 0); err == nil {
+		t.Fatal("ingest admitted into a full catalog")
+	}
+}
+
+// TestQuotaBytesReservation admits ingests into a storage quota, their estimated storage is
+// reserved so a second ingest can't fill the same remaining quota
+func TestQuotaBytesReservation(t *testing.T) {
+	q, err := parseQuotas("partner=:1", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 100000 codes take 800000 of the 1048576 bytes
+	reserved, err := q.admit("partner", 1, 100000)
+	if err != nil {
+		t.Fatalf("ingest not admitted into an empty catalog: %s", err)
+	}
+	if _, err := q.admit("partner", 1, 100000); err == nil {
+		t.Fatal("ingest admitted into the storage reserved by another")
+	}
+
+	q.add("partner", reserved, []echoprint.IngestResult{{Codes: 100000}})
+	if _, err := q.admit("partner", 1, 100000); err == nil {
+		t.Fatal("ingest admitted over the storage quota")
+	}
+	if _, err := q.admit("partner", 1, 1000); err != nil {
+		t.Fatalf("ingest fitting the storage quota not admitted: %s", err)
+	}
+}
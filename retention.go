@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/AudioAddict/go-echoprint/echoprint"
+	"github.com/golang/glog"
+)
+
+type purgeResult struct {
+	Queries    int `json:"queries"`
+	Detections int `json:"detections"`
+}
+
+// enforceRetention purges the audit records and detections older than their retention every
+// interval, until the process exits
+func enforceRetention(interval time.Duration) {
+	for {
+		now := time.Now()
+		if auditSink != nil && *auditRetention > 0 {
+			purged, err := auditSink.Purge(echoprint.PurgeFilter{To: now.Add(-*auditRetention)})
+			if err != nil {
+				glog.Errorf("Purging expired audit records failed: %s", err)
+			} else if purged > 0 {
+				glog.Infof("Purged %d audit records older than %s", purged, *auditRetention)
+			}
+		}
+
+		if detectionStore != nil && *detectionsRetention > 0 {
+			purged, err := detectionStore.Purge(time.Time{}, now.Add(-*detectionsRetention), "")
+			if err != nil {
+				glog.Errorf("Purging expired detections failed: %s", err)
+			} else if purged > 0 {
+				glog.Infof("Purged %d detections older than %s", purged, *detectionsRetention)
+			}
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+// purgeRecordsHandler deletes the audit records of an API key and/or within a from/to time range,
+// e.g. for GDPR erasure requests. Records hold the hash of the API key, api_key is hashed the
+// same way. Detections aren't tied to an API key, they are only purged by time range (and
+// optionally stream) when no api_key is given
+func purgeRecordsHandler(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	filter := echoprint.PurgeFilter{APIKey: hashAPIKey(params.Get("api_key"))}
+
+	var err error
+	if filter.From, err = parseTimeParam(r, "from"); err != nil {
+		apiError(w, err)
+		return
+	}
+	if filter.To, err = parseTimeParam(r, "to"); err != nil {
+		apiError(w, err)
+		return
+	}
+	if filter.APIKey == "" && filter.From.IsZero() && filter.To.IsZero() {
+		apiError(w, badRequest("Missing api_key, from or to, refusing to purge everything"))
+		return
+	}
+
+	var result purgeResult
+	if auditSink != nil {
+		if result.Queries, err = auditSink.Purge(filter); err != nil {
+			httpError(w, err)
+			return
+		}
+	}
+	if detectionStore != nil && filter.APIKey == "" {
+		if result.Detections, err = detectionStore.Purge(filter.From, filter.To, params.Get("stream")); err != nil {
+			httpError(w, err)
+			return
+		}
+	}
+	glog.Infof("Purged %d audit records and %d detections", result.Queries, result.Detections)
+
+	renderResponse(w, result)
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/AudioAddict/go-echoprint/echoprint"
+)
+
+// learnStopCodes relearns the stop codes every interval from the codes ingested since, until
+// the process exits
+func learnStopCodes(interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		echoprint.LearnStopCodes()
+	}
+}
+
+// learnStopCodesHandler relearns the stop codes right away, e.g. after a bulk ingest, and
+// lists them
+func learnStopCodesHandler(w http.ResponseWriter, r *http.Request) {
+	codes := echoprint.LearnStopCodes()
+	if codes == nil {
+		codes = []uint32{}
+	}
+
+	renderResponse(w, map[string][]uint32{"stop_codes": codes})
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AudioAddict/go-echoprint/echoprint"
+)
+
+const (
+	usageQuery  = "query"
+	usageIngest = "ingest"
+
+	defaultCatalog = "default"
+
+	// otherAPIKeys accounts the API keys seen once -usage-max-keys were, otherCatalogs the
+	// catalogs that aren't configured seen once -usage-max-catalogs were
+	otherAPIKeys  = "other"
+	otherCatalogs = "other"
+)
+
+type usageKey struct {
+	APIKey  string `json:"api_key"`
+	Catalog string `json:"catalog"`
+}
+
+type usageCounters struct {
+	usageKey
+	Queries int64 `json:"queries"`
+	Ingests int64 `json:"ingests"`
+	// WallSeconds is the wall clock time the requests took, including the time they waited
+	// on the database and other requests. It is not CPU time
+	WallSeconds float64 `json:"wall_seconds"`
+	BytesIn     int64   `json:"bytes_in"`
+	BytesOut    int64   `json:"bytes_out"`
+}
+
+// usageTracker accounts for the work done on behalf of each API key and catalog so internal
+// teams can be billed and abusive clients spotted. API keys are credentials, they are
+// accounted by a hash and only the first maxKeys of them apart. Catalogs are any value clients
+// send, those that aren't configured are only accounted apart up to maxCatalogs
+type usageTracker struct {
+	mu          sync.Mutex
+	counters    map[usageKey]*usageCounters
+	keys        map[string]struct{}
+	maxKeys     int
+	catalogs    map[string]struct{}
+	maxCatalogs int
+}
+
+var usage *usageTracker
+
+func newUsageTracker(maxKeys, maxCatalogs int) *usageTracker {
+	return &usageTracker{
+		counters:    make(map[usageKey]*usageCounters),
+		keys:        make(map[string]struct{}),
+		maxKeys:     maxKeys,
+		catalogs:    make(map[string]struct{}),
+		maxCatalogs: maxCatalogs,
+	}
+}
+
+// apiKeyLabel returns the hash the API key is accounted by, or otherAPIKeys once maxKeys are
+// accounted. Requests without a key are accounted by the empty label
+func (u *usageTracker) apiKeyLabel(apiKey string) string {
+	label := hashAPIKey(apiKey)
+	if label == "" {
+		return ""
+	}
+	if _, ok := u.keys[label]; !ok {
+		if len(u.keys) >= u.maxKeys {
+			return otherAPIKeys
+		}
+		u.keys[label] = struct{}{}
+	}
+	return label
+}
+
+// catalogLabel returns the catalog, or otherCatalogs when it isn't configured and maxCatalogs
+// other catalogs are accounted
+func (u *usageTracker) catalogLabel(catalog string) string {
+	if configuredCatalog(catalog) {
+		return catalog
+	}
+	if _, ok := u.catalogs[catalog]; !ok {
+		if len(u.catalogs) >= u.maxCatalogs {
+			return otherCatalogs
+		}
+		u.catalogs[catalog] = struct{}{}
+	}
+	return catalog
+}
+
+// configuredCatalog reports whether the catalog is the default, virtual or has a profile or a
+// quota. Other catalogs are only tags of the tracks ingested into them
+func configuredCatalog(catalog string) bool {
+	if catalog == defaultCatalog || catalogProfiles[catalog] != "" {
+		return true
+	}
+	if _, ok := virtualCatalogs[catalog]; ok {
+		return true
+	}
+	if quotas != nil {
+		if _, ok := quotas.quotas[catalog]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// hashAPIKey returns the hash an API key is recorded by rather than the credential itself, the
+// empty key stays empty
+func hashAPIKey(apiKey string) string {
+	if apiKey == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(sum[:6])
+}
+
+func (u *usageTracker) add(key usageKey, op string, elapsed time.Duration, bytesIn, bytesOut int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	key.APIKey = u.apiKeyLabel(key.APIKey)
+	key.Catalog = u.catalogLabel(key.Catalog)
+	c, ok := u.counters[key]
+	if !ok {
+		c = &usageCounters{usageKey: key}
+		u.counters[key] = c
+	}
+
+	switch op {
+	case usageQuery:
+		c.Queries++
+	case usageIngest:
+		c.Ingests++
+	}
+	c.WallSeconds += elapsed.Seconds()
+	c.BytesIn += bytesIn
+	c.BytesOut += bytesOut
+}
+
+// snapshot returns a copy of all the counters sorted by API key and catalog
+func (u *usageTracker) snapshot() []usageCounters {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	list := make([]usageCounters, 0, len(u.counters))
+	for _, c := range u.counters {
+		list = append(list, *c)
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].APIKey != list[j].APIKey {
+			return list[i].APIKey < list[j].APIKey
+		}
+		return list[i].Catalog < list[j].Catalog
+	})
+	return list
+}
+
+// requestUsageKey identifies the client and catalog of a request
+func requestUsageKey(r *http.Request) usageKey {
+	key := usageKey{
+		APIKey:  r.Header.Get("X-API-Key"),
+		Catalog: r.URL.Query().Get("catalog"),
+	}
+	if key.APIKey == "" {
+		key.APIKey = r.URL.Query().Get("api_key")
+	}
+	if key.Catalog == "" {
+		key.Catalog = defaultCatalog
+	}
+
+	return key
+}
+
+type countingReader struct {
+	io.ReadCloser
+	count int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.count += int64(n)
+	return n, err
+}
+
+type countingWriter struct {
+	http.ResponseWriter
+	count int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.count += int64(n)
+	return n, err
+}
+
+func (w *countingWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// accountUsage wraps a handler to record its usage under op
+func accountUsage(op string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		startTime := time.Now()
+
+		body := &countingReader{ReadCloser: r.Body}
+		r.Body = body
+		writer := &countingWriter{ResponseWriter: w}
+
+		handler(writer, r)
+
+		elapsed := time.Since(startTime)
+		key := requestUsageKey(r)
+		usage.add(key, op, elapsed, body.count, writer.count)
+		if op == usageQuery {
+			queryLatencies.add(latencyRecord{Time: startTime, Path: r.URL.Path, Catalog: key.Catalog, Seconds: elapsed.Seconds()})
+		}
+	}
+}
+
+func usageHandler(w http.ResponseWriter, r *http.Request) {
+	renderResponse(w, usage.snapshot())
+}
+
+// metricsHandler exposes the usage counters in the prometheus text format
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	counters := usage.snapshot()
+	metrics := []struct {
+		name, help string
+		value      func(c usageCounters) interface{}
+	}{
+		{"echoprint_queries_total", "Number of query requests", func(c usageCounters) interface{} { return c.Queries }},
+		{"echoprint_ingests_total", "Number of ingest requests", func(c usageCounters) interface{} { return c.Ingests }},
+		{"echoprint_request_wall_seconds_total", "Wall clock time spent handling requests", func(c usageCounters) interface{} { return c.WallSeconds }},
+		{"echoprint_request_bytes_total", "Bytes received in request bodies", func(c usageCounters) interface{} { return c.BytesIn }},
+		{"echoprint_response_bytes_total", "Bytes sent in response bodies", func(c usageCounters) interface{} { return c.BytesOut }},
+	}
+
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", m.name, m.help, m.name)
+		for _, c := range counters {
+			fmt.Fprintf(w, "%s{api_key=%q,catalog=%q} %v\n", m.name, c.APIKey, c.Catalog, m.value(c))
+		}
+	}
+
+	fmt.Fprint(w, "# HELP echoprint_requests_shed_total Number of requests rejected with 503 by a saturated worker pool\n# TYPE echoprint_requests_shed_total counter\n")
+	for _, class := range []string{qosInteractive, qosBatch} {
+		if pool := qosPools[class]; pool != nil {
+			fmt.Fprintf(w, "echoprint_requests_shed_total{class=%q} %d\n", class, atomic.LoadInt64(&pool.shed))
+		}
+	}
+
+	fmt.Fprintf(w, "# HELP echoprint_priority_downgrades_total Number of high priority requests run at normal priority as their API key exceeded its rate\n# TYPE echoprint_priority_downgrades_total counter\nechoprint_priority_downgrades_total %d\n", atomic.LoadInt64(&priorityDowngrades))
+
+	if *negativeCacheTTL > 0 {
+		stats := echoprint.NegativeCacheStats()
+		fmt.Fprintf(w, "# HELP echoprint_negative_cache_entries Number of queries cached as not matching\n# TYPE echoprint_negative_cache_entries gauge\nechoprint_negative_cache_entries %d\n", stats.Entries)
+		fmt.Fprintf(w, "# HELP echoprint_negative_cache_hits_total Number of queries answered from the negative cache\n# TYPE echoprint_negative_cache_hits_total counter\nechoprint_negative_cache_hits_total %d\n", stats.Hits)
+		fmt.Fprintf(w, "# HELP echoprint_negative_cache_misses_total Number of queries not found in the negative cache\n# TYPE echoprint_negative_cache_misses_total counter\nechoprint_negative_cache_misses_total %d\n", stats.Misses)
+	}
+
+	conns := echoprint.SolrConnectionStats()
+	fmt.Fprintf(w, "# HELP echoprint_solr_connections_opened_total Number of connections the candidate queries opened to solr\n# TYPE echoprint_solr_connections_opened_total counter\nechoprint_solr_connections_opened_total %d\n", conns.Opened)
+	fmt.Fprintf(w, "# HELP echoprint_solr_connections_reused_total Number of candidate queries sent on an idle connection to solr\n# TYPE echoprint_solr_connections_reused_total counter\nechoprint_solr_connections_reused_total %d\n", conns.Reused)
+
+	if *coalesceQueries {
+		stats := echoprint.CoalescingStats()
+		fmt.Fprintf(w, "# HELP echoprint_coalesced_queries_total Number of queries that shared the match of an identical concurrent query\n# TYPE echoprint_coalesced_queries_total counter\nechoprint_coalesced_queries_total %d\n", stats.Hits)
+	}
+
+	if quotas != nil {
+		catalogs := quotas.snapshot()
+		fmt.Fprint(w, "# HELP echoprint_catalog_tracks Number of tracks stored in a catalog\n# TYPE echoprint_catalog_tracks gauge\n")
+		for _, u := range catalogs {
+			fmt.Fprintf(w, "echoprint_catalog_tracks{catalog=%q} %d\n", u.Catalog, u.Tracks)
+		}
+		fmt.Fprint(w, "# HELP echoprint_catalog_bytes Storage taken by the codes of a catalog\n# TYPE echoprint_catalog_bytes gauge\n")
+		for _, u := range catalogs {
+			fmt.Fprintf(w, "echoprint_catalog_bytes{catalog=%q} %d\n", u.Catalog, u.Bytes)
+		}
+		fmt.Fprint(w, "# HELP echoprint_catalog_quota_utilization Highest ratio of a catalog's quotas used, above 1 when over quota\n# TYPE echoprint_catalog_quota_utilization gauge\n")
+		for _, u := range catalogs {
+			fmt.Fprintf(w, "echoprint_catalog_quota_utilization{catalog=%q} %g\n", u.Catalog, u.Utilization)
+		}
+	}
+
+	if throttle != nil {
+		stats := throttle.Stats()
+		fmt.Fprintf(w, "# HELP echoprint_throttle_limit Parallelism currently allowed by the memory pressure throttle\n# TYPE echoprint_throttle_limit gauge\nechoprint_throttle_limit %d\n", stats.Limit)
+		fmt.Fprintf(w, "# HELP echoprint_throttled_total Number of times memory pressure reduced parallelism\n# TYPE echoprint_throttled_total counter\nechoprint_throttled_total %d\n", stats.Throttled)
+	}
+}
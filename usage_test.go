@@ -0,0 +1,26 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// TestUsageCatalogLabels accounts a bounded number of unconfigured catalogs apart, the default
+// catalog is always accounted apart
+func TestUsageCatalogLabels(t *testing.T) {
+	u := newUsageTracker(10, 2)
+	for i := 0; i < 5; i++ {
+		u.add(usageKey{Catalog: fmt.Sprintf("random-%d", i)}, usageQuery, time.Millisecond, 0, 0)
+	}
+	u.add(usageKey{Catalog: defaultCatalog}, usageQuery, time.Millisecond, 0, 0)
+
+	queries := make(map[string]int64)
+	for _, c := range u.snapshot() {
+		queries[c.Catalog] = c.Queries
+	}
+	want := map[string]int64{"random-0": 1, "random-1": 1, otherCatalogs: 3, defaultCatalog: 1}
+	if fmt.Sprint(queries) != fmt.Sprint(want) {
+		t.Errorf("accounted %v, want %v", queries, want)
+	}
+}
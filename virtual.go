@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/AudioAddict/go-echoprint/echoprint"
+)
+
+// virtualCatalogs are metadata filtered views of the index addressed like catalogs, so queries
+// can target a subset (a label, a distributor's UPC prefixes) without an index of its own
+var virtualCatalogs = make(map[string]*echoprint.MetadataFilter)
+
+// parseVirtualCatalogs parses comma separated name=terms definitions, the terms being separated
+// by semicolons and either upc:<prefix> (any one of the prefixes) or tag:<key>=<value> (every
+// one of the tags), e.g. universal=upc:0602;upc:00602,indie=tag:label=Indie
+func parseVirtualCatalogs(spec string) (map[string]*echoprint.MetadataFilter, error) {
+	catalogs := make(map[string]*echoprint.MetadataFilter)
+	for _, definition := range strings.Split(spec, ",") {
+		kv := strings.SplitN(definition, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			continue
+		}
+		if kv[0] == defaultCatalog {
+			return nil, fmt.Errorf("The %s catalog can't be virtual", defaultCatalog)
+		}
+
+		filter := &echoprint.MetadataFilter{Tags: make(map[string]string)}
+		for _, term := range strings.Split(kv[1], ";") {
+			switch {
+			case strings.HasPrefix(term, "upc:") && len(term) > len("upc:"):
+				filter.UPCPrefixes = append(filter.UPCPrefixes, strings.TrimPrefix(term, "upc:"))
+			case strings.HasPrefix(term, "tag:"):
+				tag := strings.SplitN(strings.TrimPrefix(term, "tag:"), "=", 2)
+				if len(tag) != 2 || tag[0] == "" {
+					return nil, fmt.Errorf("Invalid tag '%s' of virtual catalog '%s', expected tag:key=value", term, kv[0])
+				}
+				filter.Tags[tag[0]] = tag[1]
+			default:
+				return nil, fmt.Errorf("Invalid term '%s' of virtual catalog '%s', expected upc:<prefix> or tag:<key>=<value>", term, kv[0])
+			}
+		}
+		catalogs[kv[0]] = filter
+	}
+
+	return catalogs, nil
+}
+
+// virtualCatalogFilter narrows the filter of a request to the virtual catalog, the catalog's
+// tags win over any the request asked for. Returns the filter unchanged for other catalogs
+func virtualCatalogFilter(catalog string, filter *echoprint.MetadataFilter) *echoprint.MetadataFilter {
+	virtual, ok := virtualCatalogs[catalog]
+	if !ok {
+		return filter
+	}
+
+	narrowed := &echoprint.MetadataFilter{UPCPrefixes: virtual.UPCPrefixes, Tags: make(map[string]string)}
+	if filter != nil {
+		narrowed.UPCPrefix = filter.UPCPrefix
+		for key, value := range filter.Tags {
+			narrowed.Tags[key] = value
+		}
+	}
+	for key, value := range virtual.Tags {
+		narrowed.Tags[key] = value
+	}
+
+	return narrowed
+}
+
+// checkPhysicalCatalog rejects writes to virtual catalogs, their tracks are ingested into the
+// index they are a view of
+func checkPhysicalCatalog(catalog string) error {
+	if _, ok := virtualCatalogs[catalog]; ok {
+		return &requestError{status: http.StatusBadRequest, code: "virtual_catalog", message: fmt.Sprintf("Catalog '%s' is a virtual view of the index, ingest its tracks without it", catalog)}
+	}
+	return nil
+}
+
+// parseSearchTiers parses the comma separated virtual catalogs searched in order, * being the
+// whole index
+func parseSearchTiers(spec string) ([]echoprint.Tier, error) {
+	var tiers []echoprint.Tier
+	for _, name := range strings.Split(spec, ",") {
+		if name == "*" {
+			tiers = append(tiers, echoprint.Tier{Name: name})
+			continue
+		}
+
+		filter, ok := virtualCatalogs[name]
+		if !ok {
+			return nil, fmt.Errorf("Search tier '%s' is not a virtual catalog", name)
+		}
+		tiers = append(tiers, echoprint.Tier{Name: name, Filter: filter})
+	}
+
+	return tiers, nil
+}
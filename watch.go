@@ -0,0 +1,222 @@
+package main
+
+import (
+	"expvar"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/AudioAddict/go-echoprint/echoprint"
+	"github.com/golang/glog"
+)
+
+const (
+	watchDoneFolder  = "done"
+	watchErrorFolder = "error"
+
+	// files written to a watched directory more recently than this may still be incomplete
+	watchSettleTime = 5 * time.Second
+)
+
+// watchStats counts the files ingested by the watcher, published as an expvar
+var watchStats = expvar.NewMap("watch")
+
+// watchSource is a directory or object store prefix the encoding farm drops codegen json into
+type watchSource interface {
+	// list returns the names of the files ready to be ingested
+	list() ([]string, error)
+	read(name string) ([]byte, error)
+	// move moves a processed file into a folder of the source
+	move(name, folder string) error
+}
+
+// watch ingests the codegen json files dropped into a directory or s3:// / gs:// prefix every
+// interval, until the process exits. Ingested files are moved to its done folder, files that
+// fail to parse or hold fingerprints that fail to ingest to its error folder
+func watch(location string, interval time.Duration) {
+	var source watchSource
+	if strings.HasPrefix(location, "s3://") || strings.HasPrefix(location, "gs://") {
+		source = &objectWatchSource{store: objectStore, prefix: strings.TrimRight(location, "/") + "/"}
+	} else {
+		source = dirWatchSource(location)
+		for _, folder := range []string{watchDoneFolder, watchErrorFolder} {
+			if err := os.MkdirAll(filepath.Join(location, folder), 0755); err != nil {
+				glog.Fatal(err)
+			}
+		}
+	}
+	glog.Infof("Watching %s for codegen json every %s", location, interval)
+
+	w := &watcher{source: source, unmoved: make(map[string]string)}
+	for {
+		if err := w.pass(); err != nil {
+			glog.Errorf("Listing %s failed: %s", location, err)
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+// watcher ingests the files dropped into a source
+type watcher struct {
+	source watchSource
+	// unmoved are the files ingested whose move failed, mapped to the folder they go to. They
+	// are only moved again, ingesting them again would store their fingerprints twice
+	unmoved map[string]string
+}
+
+// pass ingests the files ready in the source and moves them out of the way
+func (w *watcher) pass() error {
+	names, err := w.source.list()
+	if err != nil {
+		return err
+	}
+
+	listed := make(map[string]bool, len(names))
+	for _, name := range names {
+		listed[name] = true
+		folder, ok := w.unmoved[name]
+		if !ok {
+			if folder, ok = ingestWatched(w.source, name); !ok {
+				continue
+			}
+		}
+
+		if err := w.source.move(name, folder); err != nil {
+			glog.Errorf("Moving %s to %s failed, it will be moved again: %s", name, folder, err)
+			w.unmoved[name] = folder
+			continue
+		}
+		delete(w.unmoved, name)
+	}
+
+	// files removed by hand are forgotten
+	for name := range w.unmoved {
+		if !listed[name] {
+			delete(w.unmoved, name)
+		}
+	}
+
+	return nil
+}
+
+// ingestWatched ingests a single file of the source and returns the folder it goes to, or
+// false when it couldn't be read and is left in place to be retried
+func ingestWatched(source watchSource, name string) (string, bool) {
+	folder := watchDoneFolder
+	data, err := source.read(name)
+	if err != nil {
+		glog.Errorf("Reading %s failed: %s", name, err)
+		return "", false
+	}
+
+	results, err := peformIngest(data, defaultCatalog, ingestOptions)
+	if err != nil {
+		glog.Errorf("Ingesting %s failed: %s", name, err)
+		folder = watchErrorFolder
+	}
+	var failed int
+	for _, result := range results {
+		if result.Error != nil {
+			glog.Errorf("Ingesting TrackID=%d of %s failed: %v", result.TrackID, name, result.Error)
+			failed++
+		}
+	}
+	if failed > 0 {
+		folder = watchErrorFolder
+	}
+	glog.Infof("Ingested %s, %d of %d fingerprints failed", name, failed, len(results))
+
+	watchStats.Add("files_"+folder, 1)
+	watchStats.Add("fingerprints", int64(len(results)))
+	watchStats.Add("fingerprints_failed", int64(failed))
+
+	return folder, true
+}
+
+// dirWatchSource is a local directory
+type dirWatchSource string
+
+func (d dirWatchSource) list() ([]string, error) {
+	entries, err := ioutil.ReadDir(string(d))
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() || !isCodegenFile(entry.Name()) || time.Since(entry.ModTime()) < watchSettleTime {
+			continue
+		}
+		names = append(names, entry.Name())
+	}
+	return names, nil
+}
+
+func (d dirWatchSource) read(name string) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(string(d), name))
+}
+
+func (d dirWatchSource) move(name, folder string) error {
+	return os.Rename(filepath.Join(string(d), name), filepath.Join(string(d), folder, name))
+}
+
+// objectWatchSource is an S3 or GCS prefix, objects only become visible once fully uploaded
+type objectWatchSource struct {
+	store  *echoprint.ObjectStore
+	prefix string
+}
+
+func (o *objectWatchSource) list() ([]string, error) {
+	urls, err := o.store.List(o.prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, u := range urls {
+		if name := strings.TrimPrefix(u, o.prefix); isCodegenFile(name) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+func (o *objectWatchSource) read(name string) ([]byte, error) {
+	r, err := o.store.Open(o.prefix + name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
+}
+
+// move copies the object into the folder and deletes the original, object stores can't rename
+func (o *objectWatchSource) move(name, folder string) error {
+	data, err := o.read(name)
+	if err != nil {
+		return err
+	}
+
+	w, err := o.store.Create(o.prefix + path.Join(folder, name))
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return o.store.Delete(o.prefix + name)
+}
+
+// isCodegenFile skips hidden files, which tools often write before renaming them into place
+func isCodegenFile(name string) bool {
+	return strings.HasSuffix(name, ".json") && !strings.HasPrefix(name, ".")
+}
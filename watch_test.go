@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+// fakeWatchSource holds files in memory, its moves fail while failMoves is set
+type fakeWatchSource struct {
+	files     map[string][]byte
+	reads     map[string]int
+	moved     map[string]string
+	failMoves bool
+}
+
+func (s *fakeWatchSource) list() ([]string, error) {
+	var names []string
+	for name := range s.files {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func (s *fakeWatchSource) read(name string) ([]byte, error) {
+	s.reads[name]++
+	return s.files[name], nil
+}
+
+func (s *fakeWatchSource) move(name, folder string) error {
+	if s.failMoves {
+		return errors.New("move failed")
+	}
+	delete(s.files, name)
+	s.moved[name] = folder
+	return nil
+}
+
+// TestWatchUnmoved only moves a file again once its move failed, it is never ingested twice
+func TestWatchUnmoved(t *testing.T) {
+	// the json doesn't parse, so the file is processed without a store
+	source := &fakeWatchSource{
+		files:     map[string][]byte{"batch.json": []byte("not json")},
+		reads:     make(map[string]int),
+		moved:     make(map[string]string),
+		failMoves: true,
+	}
+	w := &watcher{source: source, unmoved: make(map[string]string)}
+
+	for pass := 0; pass < 3; pass++ {
+		if err := w.pass(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if source.reads["batch.json"] != 1 {
+		t.Fatalf("file whose move failed was ingested %d times", source.reads["batch.json"])
+	}
+
+	source.failMoves = false
+	if err := w.pass(); err != nil {
+		t.Fatal(err)
+	}
+	if source.reads["batch.json"] != 1 || source.moved["batch.json"] != watchErrorFolder {
+		t.Fatalf("file read %d times and moved to '%s'", source.reads["batch.json"], source.moved["batch.json"])
+	}
+	if len(w.unmoved) != 0 {
+		t.Fatalf("moved files still recorded: %v", w.unmoved)
+	}
+}